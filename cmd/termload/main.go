@@ -0,0 +1,92 @@
+// Command termload imports code system release files from local disk into
+// the server's concept store. It needs no network access other than to the
+// database, so it can be run in air-gapped deployments.
+//
+//	termload -loinc Loinc.csv -loinc-hierarchy MultiAxialHierarchy.csv
+//	termload -snomed-concepts sct2_Concept_Snapshot_INT.txt \
+//	    -snomed-descriptions sct2_Description_Snapshot-en_INT.txt \
+//	    -snomed-relationships sct2_Relationship_Snapshot_INT.txt \
+//	    -snomed-language der2_cRefset_LanguageSnapshot-en_INT.txt
+//	termload -icd10cm icd10cm_order_2015.txt
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/intervention-engine/fhir/terminology"
+	"gopkg.in/mgo.v2"
+)
+
+func main() {
+	host := flag.String("db", "localhost", "MongoDB host")
+	version := flag.String("version", "", "Code system version to record on each concept")
+	batch := flag.Int("batch", 1000, "Number of concepts to save at a time")
+	loinc := flag.String("loinc", "", "LOINC Loinc.csv file")
+	loincHierarchy := flag.String("loinc-hierarchy", "", "LOINC MultiAxialHierarchy.csv file")
+	snomedConcepts := flag.String("snomed-concepts", "", "SNOMED CT RF2 concept snapshot file")
+	snomedDescriptions := flag.String("snomed-descriptions", "", "SNOMED CT RF2 description snapshot file")
+	snomedRelationships := flag.String("snomed-relationships", "", "SNOMED CT RF2 relationship snapshot file")
+	snomedLanguage := flag.String("snomed-language", "", "SNOMED CT RF2 language refset snapshot file")
+	icd10cm := flag.String("icd10cm", "", "ICD-10-CM order file")
+	flag.Parse()
+
+	session, err := mgo.Dial(*host)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer session.Close()
+	store := terminology.NewConceptStore(session.DB("fhir"))
+
+	save := func(name string, concepts []terminology.Concept, err error) {
+		if err != nil {
+			log.Fatalf("Reading %s: %s", name, err)
+		}
+		for i := range concepts {
+			concepts[i].Version = *version
+		}
+		if err := terminology.Import(store, concepts, *batch); err != nil {
+			log.Fatalf("Saving %s: %s", name, err)
+		}
+		log.Printf("Imported %d %s concepts", len(concepts), name)
+	}
+
+	if *loinc != "" {
+		var hierarchy io.Reader
+		if *loincHierarchy != "" {
+			hierarchy = open(*loincHierarchy)
+		}
+		concepts, err := terminology.LoadLOINC(open(*loinc), hierarchy)
+		save("LOINC", concepts, err)
+	}
+
+	if *snomedConcepts != "" {
+		files := terminology.SNOMEDFiles{
+			Concepts:      open(*snomedConcepts),
+			Descriptions:  open(*snomedDescriptions),
+			Relationships: open(*snomedRelationships),
+		}
+		if *snomedLanguage != "" {
+			files.Language = open(*snomedLanguage)
+		}
+		concepts, err := terminology.LoadSNOMED(files)
+		save("SNOMED CT", concepts, err)
+	}
+
+	if *icd10cm != "" {
+		concepts, err := terminology.LoadICD10CM(open(*icd10cm))
+		save("ICD-10-CM", concepts, err)
+	}
+}
+
+// open opens a release file, exiting if it cannot be read. Files are left
+// open until the command exits.
+func open(name string) *os.File {
+	f, err := os.Open(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
@@ -0,0 +1,293 @@
+// Package matching scores how likely two Patient records are to be the same
+// person, for finding duplicates in a master patient index.
+package matching
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// Match grades, from most to least confident.
+const (
+	Certain  = "certain"
+	Probable = "probable"
+	Possible = "possible"
+)
+
+// Weights gives the relative importance of each element in a comparison.
+type Weights struct {
+	Family     float64 `json:"family"`
+	Given      float64 `json:"given"`
+	BirthDate  float64 `json:"birthDate"`
+	Gender     float64 `json:"gender"`
+	Address    float64 `json:"address"`
+	Telecom    float64 `json:"telecom"`
+	Identifier float64 `json:"identifier"`
+}
+
+// Config holds the weights and the score thresholds for each grade. Scores
+// range from 0 to 1, and a score below Possible is not a match.
+//
+// Only the elements present in both records are compared, and the score is
+// the weighted average of their similarities. When the compared elements'
+// weights add up to less than MinimumWeight the score is reduced in
+// proportion, so that records sharing little information cannot score
+// highly.
+type Config struct {
+	Weights       Weights `json:"weights"`
+	MinimumWeight float64 `json:"minimumWeight"`
+	Certain       float64 `json:"certain"`
+	Probable      float64 `json:"probable"`
+	Possible      float64 `json:"possible"`
+}
+
+// DefaultConfig returns the weights and thresholds used by the server unless
+// it is configured otherwise.
+func DefaultConfig() *Config {
+	return &Config{
+		Weights:       Weights{Family: 3, Given: 2, BirthDate: 3, Gender: 1, Address: 1, Telecom: 1, Identifier: 4},
+		MinimumWeight: 8,
+		Certain:       0.95,
+		Probable:      0.8,
+		Possible:      0.6,
+	}
+}
+
+// Result is the outcome of comparing two patients. Elements holds the
+// similarity of each element compared, by JSON name.
+type Result struct {
+	Score    float64            `json:"score"`
+	Grade    string             `json:"grade,omitempty"`
+	Elements map[string]float64 `json:"elements"`
+}
+
+// Grade returns the grade for a score, or "" if it is not a match.
+func (c *Config) Grade(score float64) string {
+	switch {
+	case score >= c.Certain:
+		return Certain
+	case score >= c.Probable:
+		return Probable
+	case score >= c.Possible:
+		return Possible
+	}
+	return ""
+}
+
+// Compare scores how likely the two patients are to be the same person.
+func (c *Config) Compare(a, b *models.Patient) Result {
+	elements := []struct {
+		name    string
+		weight  float64
+		compare func() (float64, bool)
+	}{
+		{"family", c.Weights.Family, func() (float64, bool) { return bestPair(familyNames(a), familyNames(b), compareNames) }},
+		{"given", c.Weights.Given, func() (float64, bool) { return bestPair(givenNames(a), givenNames(b), compareGivenNames) }},
+		{"birthDate", c.Weights.BirthDate, func() (float64, bool) { return compareBirthDates(a.BirthDate, b.BirthDate) }},
+		{"gender", c.Weights.Gender, func() (float64, bool) { return compareGenders(a.Gender, b.Gender) }},
+		{"address", c.Weights.Address, func() (float64, bool) { return compareAddresses(a.Address, b.Address) }},
+		{"telecom", c.Weights.Telecom, func() (float64, bool) { return compareTelecoms(a.Telecom, b.Telecom) }},
+		{"identifier", c.Weights.Identifier, func() (float64, bool) { return compareIdentifiers(a.Identifier, b.Identifier) }},
+	}
+
+	result := Result{Elements: make(map[string]float64)}
+	var total, weight float64
+	for _, element := range elements {
+		if element.weight <= 0 {
+			continue
+		}
+		if similarity, ok := element.compare(); ok {
+			result.Elements[element.name] = similarity
+			total += element.weight * similarity
+			weight += element.weight
+		}
+	}
+
+	if weight < c.MinimumWeight {
+		weight = c.MinimumWeight
+	}
+	if weight > 0 {
+		result.Score = total / weight
+	}
+	result.Grade = c.Grade(result.Score)
+	return result
+}
+
+// compareNames scores names by spelling, counting names that sound alike as
+// close matches.
+func compareNames(a, b string) float64 {
+	similarity := Similarity(a, b)
+	if similarity < 0.9 && Soundex(a) != "" && Soundex(a) == Soundex(b) {
+		similarity = 0.9
+	}
+	return similarity
+}
+
+// compareGivenNames is compareNames, but also matches an initial to a name.
+func compareGivenNames(a, b string) float64 {
+	a, b = normalize(a), normalize(b)
+	if (len(a) == 1 || len(b) == 1) && a != "" && b != "" && a[0] == b[0] {
+		return 0.7
+	}
+	return compareNames(a, b)
+}
+
+// bestPair returns the highest score of any pair of values, and whether
+// there were values to compare.
+func bestPair(a, b []string, compare func(a, b string) float64) (float64, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, false
+	}
+	best := 0.0
+	for _, x := range a {
+		for _, y := range b {
+			if score := compare(x, y); score > best {
+				best = score
+			}
+		}
+	}
+	return best, true
+}
+
+func familyNames(p *models.Patient) []string {
+	var names []string
+	for _, name := range p.Name {
+		names = append(names, strings.Join(name.Family, " "))
+	}
+	return nonEmpty(names)
+}
+
+func givenNames(p *models.Patient) []string {
+	var names []string
+	for _, name := range p.Name {
+		names = append(names, name.Given...)
+	}
+	return nonEmpty(names)
+}
+
+// compareBirthDates scores matching dates as 1, and dates that differ only in
+// their year, month or day, or that have the month and day swapped, as 0.5.
+func compareBirthDates(a, b models.FHIRDateTime) (float64, bool) {
+	if a.Time.IsZero() || b.Time.IsZero() {
+		return 0, false
+	}
+	ay, am, ad := a.Time.Date()
+	by, bm, bd := b.Time.Date()
+	same := 0
+	for _, equal := range []bool{ay == by, am == bm, ad == bd} {
+		if equal {
+			same++
+		}
+	}
+	switch {
+	case same == 3:
+		return 1, true
+	case same == 2, ay == by && int(am) == bd && ad == int(bm):
+		return 0.5, true
+	}
+	return 0, true
+}
+
+func compareGenders(a, b models.CodeableConcept) (float64, bool) {
+	if len(a.Coding) == 0 || len(b.Coding) == 0 {
+		return 0, false
+	}
+	if strings.EqualFold(a.Coding[0].Code, b.Coding[0].Code) {
+		return 1, true
+	}
+	return 0, true
+}
+
+// compareAddresses scores the closest pair of addresses by the average
+// similarity of their lines, city and zip code, as far as both have them.
+func compareAddresses(a, b []models.Address) (float64, bool) {
+	best, compared := 0.0, false
+	for _, x := range a {
+		for _, y := range b {
+			var total float64
+			parts := 0
+			if len(x.Line) > 0 && len(y.Line) > 0 {
+				total += Similarity(strings.Join(x.Line, " "), strings.Join(y.Line, " "))
+				parts++
+			}
+			for _, pair := range [][2]string{{x.City, y.City}, {x.Zip, y.Zip}} {
+				if pair[0] != "" && pair[1] != "" {
+					if normalize(pair[0]) == normalize(pair[1]) {
+						total++
+					}
+					parts++
+				}
+			}
+			if parts > 0 {
+				compared = true
+				if score := total / float64(parts); score > best {
+					best = score
+				}
+			}
+		}
+	}
+	return best, compared
+}
+
+// compareTelecoms scores 1 if the patients share a phone number or other
+// contact point, comparing phone numbers by their last ten digits.
+func compareTelecoms(a, b []models.ContactPoint) (float64, bool) {
+	if len(a) == 0 || len(b) == 0 {
+		return 0, false
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if telecomKey(x) != "" && telecomKey(x) == telecomKey(y) {
+				return 1, true
+			}
+		}
+	}
+	return 0, true
+}
+
+func telecomKey(c models.ContactPoint) string {
+	if c.System != "phone" && c.System != "fax" {
+		return strings.ToLower(strings.TrimSpace(c.Value))
+	}
+	digits := strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, c.Value)
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return digits
+}
+
+// compareIdentifiers compares the identifiers from systems the patients both
+// have: 1 if any has the same value, otherwise 0. Patients with no systems in
+// common are not compared.
+func compareIdentifiers(a, b []models.Identifier) (float64, bool) {
+	compared := false
+	for _, x := range a {
+		for _, y := range b {
+			if x.System == "" || x.System != y.System || x.Value == "" || y.Value == "" {
+				continue
+			}
+			if x.Value == y.Value {
+				return 1, true
+			}
+			compared = true
+		}
+	}
+	return 0, compared
+}
+
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
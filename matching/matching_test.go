@@ -0,0 +1,86 @@
+package matching
+
+import (
+	"testing"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/check.v1"
+)
+
+type MatchingSuite struct{}
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+var _ = check.Suite(&MatchingSuite{})
+
+func (s *MatchingSuite) TestSoundex(c *check.C) {
+	c.Assert(Soundex("Robert"), check.Equals, "R163")
+	c.Assert(Soundex("Rupert"), check.Equals, "R163")
+	c.Assert(Soundex("Ashcraft"), check.Equals, "A261")
+	c.Assert(Soundex("Tymczak"), check.Equals, "T522")
+	c.Assert(Soundex("Pfister"), check.Equals, "P236")
+	c.Assert(Soundex("Lee"), check.Equals, "L000")
+	c.Assert(Soundex("O'Hara"), check.Equals, "O600")
+	c.Assert(Soundex("123"), check.Equals, "")
+}
+
+func (s *MatchingSuite) TestEditDistance(c *check.C) {
+	c.Assert(EditDistance("kitten", "sitting"), check.Equals, 3)
+	c.Assert(EditDistance("", "abc"), check.Equals, 3)
+	c.Assert(EditDistance("same", "same"), check.Equals, 0)
+	c.Assert(Similarity("Smith", "SMITH"), check.Equals, 1.0)
+	c.Assert(Similarity("Smith", "Smyth"), check.Equals, 0.8)
+	c.Assert(Similarity("", ""), check.Equals, 0.0)
+}
+
+func (s *MatchingSuite) TestCompare(c *check.C) {
+	config := DefaultConfig()
+	record := patient("Smith", "John", "1970-03-04", "M")
+	record.Address = []models.Address{{Line: []string{"12 Main St"}, City: "Bedford", Zip: "01730"}}
+	record.Telecom = []models.ContactPoint{{System: "phone", Value: "(781) 555-1234"}}
+	record.Identifier = []models.Identifier{{System: "urn:mrn", Value: "1234"}}
+
+	same := patient("Smith", "John", "1970-03-04", "M")
+	same.Identifier = []models.Identifier{{System: "urn:mrn", Value: "1234"}}
+	result := config.Compare(same, record)
+	c.Assert(result.Score, check.Equals, 1.0)
+	c.Assert(result.Grade, check.Equals, Certain)
+	c.Assert(result.Elements, check.HasLen, 5)
+
+	// Misspelt names, a swapped birth date and a reformatted phone number
+	typo := patient("Smyth", "Jon", "1970-04-03", "M")
+	typo.Address = []models.Address{{Line: []string{"12 Main St."}, Zip: "01730"}}
+	typo.Telecom = []models.ContactPoint{{System: "phone", Value: "+1 781 555 1234"}}
+	result = config.Compare(typo, record)
+	c.Assert(result.Elements["family"], check.Equals, 0.9)
+	c.Assert(result.Elements["birthDate"], check.Equals, 0.5)
+	c.Assert(result.Elements["address"], check.Equals, 1.0)
+	c.Assert(result.Elements["telecom"], check.Equals, 1.0)
+	c.Assert(result.Grade, check.Equals, Probable)
+
+	// A different identifier from the same system counts against a match
+	other := patient("Smith", "John", "1970-03-04", "M")
+	other.Identifier = []models.Identifier{{System: "urn:mrn", Value: "5678"}}
+	result = config.Compare(other, record)
+	c.Assert(result.Elements["identifier"], check.Equals, 0.0)
+	c.Assert(result.Grade, check.Equals, Possible)
+
+	// Too little in common to be a match, however similar
+	sparse := &models.Patient{Gender: record.Gender}
+	result = config.Compare(sparse, record)
+	c.Assert(result.Score < config.Possible, check.Equals, true)
+	c.Assert(result.Grade, check.Equals, "")
+
+	initial := patient("Smith", "J", "1970-03-04", "M")
+	c.Assert(config.Compare(initial, record).Elements["given"], check.Equals, 0.7)
+}
+
+func patient(family, given, birthDate, gender string) *models.Patient {
+	date, _ := time.Parse("2006-01-02", birthDate)
+	return &models.Patient{
+		Name:      []models.HumanName{{Family: []string{family}, Given: []string{given}}},
+		BirthDate: models.FHIRDateTime{Time: date, Precision: models.Date},
+		Gender:    models.CodeableConcept{Coding: []models.Coding{{Code: gender}}},
+	}
+}
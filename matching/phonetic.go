@@ -0,0 +1,121 @@
+package matching
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Soundex returns the American Soundex code of a name, e.g. "R163" for both
+// "Robert" and "Rupert". Characters other than ASCII letters are ignored. It
+// returns "" for a name with no letters.
+func Soundex(name string) string {
+	var letters []byte
+	for _, r := range strings.ToUpper(name) {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, byte(r))
+		}
+	}
+	if len(letters) == 0 {
+		return ""
+	}
+
+	code := []byte{letters[0]}
+	last := soundexDigit(letters[0])
+	for _, l := range letters[1:] {
+		digit := soundexDigit(l)
+		switch {
+		case l == 'H' || l == 'W':
+			// H and W do not separate letters with the same code
+			continue
+		case digit == 0:
+			last = 0
+			continue
+		case digit != last:
+			code = append(code, '0'+digit)
+			if len(code) == 4 {
+				return string(code)
+			}
+		}
+		last = digit
+	}
+	for len(code) < 4 {
+		code = append(code, '0')
+	}
+	return string(code)
+}
+
+func soundexDigit(l byte) byte {
+	switch l {
+	case 'B', 'F', 'P', 'V':
+		return 1
+	case 'C', 'G', 'J', 'K', 'Q', 'S', 'X', 'Z':
+		return 2
+	case 'D', 'T':
+		return 3
+	case 'L':
+		return 4
+	case 'M', 'N':
+		return 5
+	case 'R':
+		return 6
+	}
+	return 0
+}
+
+// EditDistance returns the Levenshtein distance between two strings: the
+// number of single character insertions, deletions and substitutions needed
+// to turn one into the other.
+func EditDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minimum(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+// Similarity scores how alike two strings are from 0 to 1, by their edit
+// distance relative to the longer of the two, ignoring case and anything but
+// letters and digits.
+func Similarity(a, b string) float64 {
+	a, b = normalize(a), normalize(b)
+	longest := len([]rune(a))
+	if n := len([]rune(b)); n > longest {
+		longest = n
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(EditDistance(a, b))/float64(longest)
+}
+
+func normalize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, s)
+}
+
+func minimum(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Alert struct {
+	DomainResource `bson:",inline"`
+
 	Id         string          `json:"-" bson:"_id"`
 	Identifier []Identifier    `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Category   CodeableConcept `bson:"category,omitempty", json:"category,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type AllergyIntolerance struct {
+	DomainResource `bson:",inline"`
+
 	Id              string       `json:"-" bson:"_id"`
 	Identifier      []Identifier `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Criticality     string       `bson:"criticality,omitempty", json:"criticality,omitempty"`
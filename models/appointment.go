@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Appointment struct {
+	DomainResource `bson:",inline"`
+
 	Id             string                            `json:"-" bson:"_id"`
 	Identifier     []Identifier                      `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Priority       float64                           `bson:"priority,omitempty", json:"priority,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type AppointmentResponse struct {
+	DomainResource `bson:",inline"`
+
 	Id                string            `json:"-" bson:"_id"`
 	Identifier        []Identifier      `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Appointment       Reference         `bson:"appointment,omitempty", json:"appointment,omitempty"`
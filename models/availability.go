@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Availability struct {
+	DomainResource `bson:",inline"`
+
 	Id              string            `json:"-" bson:"_id"`
 	Identifier      []Identifier      `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Type            []CodeableConcept `bson:"type,omitempty", json:"type,omitempty"`
@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Bundle is a bundle whose entries may be resources of any type, such as the
+// result of an operation spanning several resource types. Each entry's Id is
+// its relative URL, e.g. "Observation/1234", which gives the type of its
+// content.
+type Bundle struct {
+	Type         string        `json:"resourceType,omitempty"`
+	Title        string        `json:"title,omitempty"`
+	Id           string        `json:"id,omitempty"`
+	Updated      time.Time     `json:"updated,omitempty"`
+	TotalResults int           `json:"totalResults"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry,omitempty"`
+}
+
+type BundleLink struct {
+	Rel  string `json:"rel,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+type BundleEntry struct {
+	Title   string      `json:"title,omitempty"`
+	Id      string      `json:"id,omitempty"`
+	Content interface{} `json:"content,omitempty"`
+}
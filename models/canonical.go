@@ -0,0 +1,289 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// CanonicalOptions adjusts the canonical form of a resource.
+type CanonicalOptions struct {
+	// OmitNarrative leaves out the text element of the resource and of any
+	// contained resources.
+	OmitNarrative bool
+}
+
+var (
+	fhirDateTimeType = reflect.TypeOf(FHIRDateTime{})
+	narrativeType    = reflect.TypeOf(Narrative{})
+	referenceType    = reflect.TypeOf(Reference{})
+	timeType         = reflect.TypeOf(time.Time{})
+)
+
+// CanonicalJSON returns a deterministic JSON form of a resource, suitable for
+// hashing and signing. Elements have their FHIR names and appear in
+// alphabetical order, with no whitespace. Empty elements are left out, as are
+// meta, the ids of elements other than the resource itself, and the parts of
+// a Reference derived from its reference. Dates keep their precision, and
+// timestamps are given in UTC. Numbers are written in their shortest decimal
+// form without an exponent, so 8.0 is written 8.
+//
+// The resource may be a model struct or a pointer to one, in which case its
+// resourceType is its type's name, or a map such as a resource decoded from
+// JSON.
+func CanonicalJSON(resource interface{}, opts CanonicalOptions) ([]byte, error) {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	var doc map[string]interface{}
+	switch v.Kind() {
+	case reflect.Struct:
+		doc, _ = canonicalValue(v, opts).(map[string]interface{})
+		if doc == nil {
+			doc = make(map[string]interface{})
+		}
+		doc["resourceType"] = v.Type().Name()
+		if id := v.FieldByName("Id"); id.IsValid() && id.Kind() == reflect.String && id.String() != "" {
+			doc["id"] = id.String()
+		}
+	case reflect.Map:
+		doc, _ = canonicalValue(v, opts).(map[string]interface{})
+	default:
+		return nil, fmt.Errorf("Cannot put a %T in canonical form", resource)
+	}
+	if doc == nil {
+		return nil, errors.New("Resource is empty")
+	}
+	buf := &bytes.Buffer{}
+	writeCanonical(buf, doc)
+	return buf.Bytes(), nil
+}
+
+// canonicalNumber is a number already in its canonical form.
+type canonicalNumber string
+
+// canonicalValue converts a value to a tree of maps, slices, strings, bools
+// and canonicalNumbers, or nil if it is empty.
+func canonicalValue(v reflect.Value, opts CanonicalOptions) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		// Scalars behind pointers, or in maps decoded from JSON, are given
+		// even when they are false or zero, since that is how they were
+		// given.
+		if elem := v.Elem(); elem.Kind() == reflect.Bool {
+			return elem.Bool()
+		} else if isNumber(elem.Kind()) {
+			return numberValue(elem, true)
+		}
+		return canonicalValue(v.Elem(), opts)
+
+	case reflect.Struct:
+		switch v.Type() {
+		case fhirDateTimeType:
+			return dateTimeValue(v.Interface().(FHIRDateTime))
+		case timeType:
+			if t := v.Interface().(time.Time); !t.IsZero() {
+				return t.UTC().Format(time.RFC3339Nano)
+			}
+			return nil
+		}
+		doc := make(map[string]interface{})
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.Anonymous {
+				// Embedded types such as DomainResource hold elements of
+				// the struct itself.
+				if embedded, ok := canonicalValue(v.Field(i), opts).(map[string]interface{}); ok {
+					for name, value := range embedded {
+						doc[name] = value
+					}
+				}
+				continue
+			}
+			name := elementName(f)
+			if name == "" || name == "meta" || (opts.OmitNarrative && f.Type == narrativeType) {
+				continue
+			}
+			// A Reference's type, id and externality are derived from the
+			// reference when it is decoded.
+			if v.Type() == referenceType && name != "reference" && name != "display" {
+				continue
+			}
+			if value := canonicalValue(v.Field(i), opts); value != nil {
+				doc[name] = value
+			}
+		}
+		if len(doc) == 0 {
+			return nil
+		}
+		return doc
+
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return nil
+		}
+		isResource := v.MapIndex(reflect.ValueOf("resourceType").Convert(v.Type().Key())).IsValid()
+		doc := make(map[string]interface{})
+		for _, key := range v.MapKeys() {
+			name := key.String()
+			if name == "meta" || name == "_id" || (opts.OmitNarrative && isResource && name == "text") {
+				continue
+			}
+			if value := canonicalValue(v.MapIndex(key), opts); value != nil {
+				doc[name] = value
+			}
+		}
+		if len(doc) == 0 {
+			return nil
+		}
+		return doc
+
+	case reflect.Slice, reflect.Array:
+		var list []interface{}
+		for i := 0; i < v.Len(); i++ {
+			if value := canonicalValue(v.Index(i), opts); value != nil {
+				list = append(list, value)
+			}
+		}
+		if len(list) == 0 {
+			return nil
+		}
+		return list
+
+	case reflect.String:
+		if v.Len() == 0 {
+			return nil
+		}
+		return v.String()
+
+	case reflect.Bool:
+		if !v.Bool() {
+			return nil
+		}
+		return true
+	}
+	if isNumber(v.Kind()) {
+		return numberValue(v, false)
+	}
+	return nil
+}
+
+func isNumber(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// numberValue writes a number in canonical form. Zero is left out unless
+// keepZero is set, as model fields do not distinguish zero from absent.
+func numberValue(v reflect.Value, keepZero bool) interface{} {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Int() == 0 && !keepZero {
+			return nil
+		}
+		return canonicalNumber(strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() == 0 && !keepZero {
+			return nil
+		}
+		return canonicalNumber(strconv.FormatUint(v.Uint(), 10))
+	}
+	f := v.Float()
+	if math.IsNaN(f) || math.IsInf(f, 0) || (f == 0 && !keepZero) {
+		return nil
+	}
+	if f == 0 {
+		// Avoid writing negative zero as -0.
+		f = 0
+	}
+	return canonicalNumber(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// dateTimeValue writes a date to its precision, or a timestamp in UTC.
+func dateTimeValue(d FHIRDateTime) interface{} {
+	if d.Time.IsZero() {
+		return nil
+	}
+	if d.Precision == Date {
+		return d.Time.UTC().Format("2006-01-02")
+	}
+	return d.Time.UTC().Format(time.RFC3339Nano)
+}
+
+// writeCanonical writes a tree made by canonicalValue as JSON with sorted
+// keys.
+func writeCanonical(buf *bytes.Buffer, value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			writeCanonical(buf, value[key])
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range value {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonical(buf, item)
+		}
+		buf.WriteByte(']')
+	case string:
+		writeCanonicalString(buf, value)
+	case bool:
+		buf.WriteString(strconv.FormatBool(value))
+	case canonicalNumber:
+		buf.WriteString(string(value))
+	}
+}
+
+// writeCanonicalString writes a JSON string, escaping only quotes,
+// backslashes and control characters, so that other characters, including
+// HTML's <, > and &, are written as themselves.
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			fmt.Fprintf(buf, `\u%04x`, r)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *ModelsSuite) TestCanonicalJSON(c *check.C) {
+	active := false
+	patient := &Patient{
+		Id:        "123",
+		Active:    &active,
+		BirthDate: FHIRDateTime{Time: time.Date(1970, time.March, 4, 0, 0, 0, 0, time.UTC), Precision: Date},
+		Name:      []HumanName{{Family: []string{"Smith"}, Given: []string{"Jo <J>"}}},
+		Gender:    CodeableConcept{Coding: []Coding{{System: "http://hl7.org/fhir/v3/AdministrativeGender", Code: "F"}}},
+		DeceasedDateTime: FHIRDateTime{Time: time.Date(2014, time.June, 1, 8, 30, 0, 0, time.FixedZone("EDT", -4*60*60)),
+			Precision: Timestamp},
+		ManagingOrganization: Reference{Reference: "Organization/1", Type: "Organization", ReferencedID: "1"},
+	}
+	data, err := CanonicalJSON(patient, CanonicalOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"active":false,"birthDate":"1970-03-04","deceasedDateTime":"2014-06-01T12:30:00Z",`+
+		`"gender":{"coding":[{"code":"F","system":"http://hl7.org/fhir/v3/AdministrativeGender"}]},"id":"123",`+
+		`"managingOrganization":{"reference":"Organization/1"},"name":[{"family":["Smith"],"given":["Jo <J>"]}],"resourceType":"Patient"}`)
+
+	// Numbers are normalized, and maps are treated like structs
+	observation := &Observation{Id: "1", ValueQuantity: Quantity{Value: 8.0, Units: "%"}}
+	data, err = CanonicalJSON(observation, CanonicalOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"id":"1","resourceType":"Observation","valueQuantity":{"units":"%","value":8}}`)
+	var doc map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(`{"valueQuantity": {"value": 8.00, "units": "%"}, "resourceType": "Observation", "id": "1", "meta": {"versionId": "2"}}`), &doc), check.IsNil)
+	fromMap, err := CanonicalJSON(doc, CanonicalOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(fromMap), check.Equals, string(data))
+}
+
+func (s *ModelsSuite) TestCanonicalJSONNarrative(c *check.C) {
+	var doc map[string]interface{}
+	c.Assert(json.Unmarshal([]byte(`{"resourceType": "Patient", "text": {"status": "generated", "div": "<div>Jo</div>"},
+		"contained": [{"resourceType": "Organization", "id": "org", "text": {"div": "<div/>"}, "name": "Acme"}]}`), &doc), check.IsNil)
+	data, err := CanonicalJSON(doc, CanonicalOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"contained":[{"id":"org","name":"Acme","resourceType":"Organization","text":{"div":"<div/>"}}],`+
+		`"resourceType":"Patient","text":{"div":"<div>Jo</div>","status":"generated"}}`)
+	data, err = CanonicalJSON(doc, CanonicalOptions{OmitNarrative: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"contained":[{"id":"org","name":"Acme","resourceType":"Organization"}],"resourceType":"Patient"}`)
+
+	// Contained resources of a model are included too
+	patient := &Patient{}
+	c.Assert(json.Unmarshal([]byte(`{"resourceType": "Patient", "contained": [{"resourceType": "Organization", "id": "org", "name": "Acme"}]}`), patient), check.IsNil)
+	data, err = CanonicalJSON(patient, CanonicalOptions{})
+	c.Assert(err, check.IsNil)
+	c.Assert(string(data), check.Equals, `{"contained":[{"id":"org","name":"Acme","resourceType":"Organization"}],"resourceType":"Patient"}`)
+
+	_, err = CanonicalJSON("Patient", CanonicalOptions{})
+	c.Assert(err, check.NotNil)
+}
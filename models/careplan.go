@@ -29,6 +29,8 @@ package models
 import "time"
 
 type CarePlan struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                         `json:"-" bson:"_id"`
 	Identifier  []Identifier                   `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Patient     Reference                      `bson:"patient,omitempty", json:"patient,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Contraindication struct {
+	DomainResource `bson:",inline"`
+
 	Id         string                                `json:"-" bson:"_id"`
 	Patient    Reference                             `bson:"patient,omitempty", json:"patient,omitempty"`
 	Category   CodeableConcept                       `bson:"category,omitempty", json:"category,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type DataElement struct {
+	DomainResource `bson:",inline"`
+
 	Id                     string                        `json:"-" bson:"_id"`
 	Identifier             Identifier                    `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Version                string                        `bson:"version,omitempty", json:"version,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type DeviceObservationReport struct {
+	DomainResource `bson:",inline"`
+
 	Id            string                                          `json:"-" bson:"_id"`
 	Instant       FHIRDateTime                                    `bson:"instant,omitempty", json:"instant,omitempty"`
 	Identifier    Identifier                                      `bson:"identifier,omitempty", json:"identifier,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type DiagnosticOrder struct {
+	DomainResource `bson:",inline"`
+
 	Id                    string                          `json:"-" bson:"_id"`
 	Subject               Reference                       `bson:"subject,omitempty", json:"subject,omitempty"`
 	Orderer               Reference                       `bson:"orderer,omitempty", json:"orderer,omitempty"`
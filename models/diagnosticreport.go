@@ -29,6 +29,8 @@ package models
 import "time"
 
 type DiagnosticReport struct {
+	DomainResource `bson:",inline"`
+
 	Id                 string                           `json:"-" bson:"_id"`
 	Name               CodeableConcept                  `bson:"name,omitempty", json:"name,omitempty"`
 	Status             string                           `bson:"status,omitempty", json:"status,omitempty"`
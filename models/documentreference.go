@@ -29,6 +29,8 @@ package models
 import "time"
 
 type DocumentReference struct {
+	DomainResource `bson:",inline"`
+
 	Id               string                                `json:"-" bson:"_id"`
 	MasterIdentifier Identifier                            `bson:"masterIdentifier,omitempty", json:"masterIdentifier,omitempty"`
 	Identifier       []Identifier                          `bson:"identifier,omitempty", json:"identifier,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Group struct {
+	DomainResource `bson:",inline"`
+
 	Id             string                         `json:"-" bson:"_id"`
 	Identifier     Identifier                     `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Type           string                         `bson:"type,omitempty", json:"type,omitempty"`
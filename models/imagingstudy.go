@@ -29,6 +29,8 @@ package models
 import "time"
 
 type ImagingStudy struct {
+	DomainResource `bson:",inline"`
+
 	Id                  string                        `json:"-" bson:"_id"`
 	DateTime            FHIRDateTime                  `bson:"dateTime,omitempty", json:"dateTime,omitempty"`
 	Subject             Reference                     `bson:"subject,omitempty", json:"subject,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Location struct {
+	DomainResource `bson:",inline"`
+
 	Id                   string                    `json:"-" bson:"_id"`
 	Identifier           []Identifier              `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Name                 string                    `bson:"name,omitempty", json:"name,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Media struct {
+	DomainResource `bson:",inline"`
+
 	Id         string          `json:"-" bson:"_id"`
 	Type       string          `bson:"type,omitempty", json:"type,omitempty"`
 	Subtype    CodeableConcept `bson:"subtype,omitempty", json:"subtype,omitempty"`
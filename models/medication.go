@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Medication struct {
+	DomainResource `bson:",inline"`
+
 	Id           string                     `json:"-" bson:"_id"`
 	Name         string                     `bson:"name,omitempty", json:"name,omitempty"`
 	Code         CodeableConcept            `bson:"code,omitempty", json:"code,omitempty"`
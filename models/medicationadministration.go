@@ -29,6 +29,8 @@ package models
 import "time"
 
 type MedicationAdministration struct {
+	DomainResource `bson:",inline"`
+
 	Id                    string                                    `json:"-" bson:"_id"`
 	Identifier            []Identifier                              `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Status                string                                    `bson:"status,omitempty", json:"status,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type MedicationPrescription struct {
+	DomainResource `bson:",inline"`
+
 	Id                    string                                             `json:"-" bson:"_id"`
 	Identifier            []Identifier                                       `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	DateWritten           FHIRDateTime                                       `bson:"dateWritten,omitempty", json:"dateWritten,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type MessageHeader struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                         `json:"-" bson:"_id"`
 	Identifier  string                         `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Timestamp   FHIRDateTime                   `bson:"timestamp,omitempty", json:"timestamp,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Namespace struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                       `json:"-" bson:"_id"`
 	Type        string                       `bson:"type,omitempty", json:"type,omitempty"`
 	Name        string                       `bson:"name,omitempty", json:"name,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Observation struct {
+	DomainResource `bson:",inline"`
+
 	Id                   string                               `json:"-" bson:"_id"`
 	Name                 CodeableConcept                      `bson:"name,omitempty", json:"name,omitempty"`
 	ValueQuantity        Quantity                             `bson:"valueQuantity,omitempty", json:"valueQuantity,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type OperationOutcome struct {
+	DomainResource `bson:",inline"`
+
 	Id    string                           `json:"-" bson:"_id"`
 	Issue []OperationOutcomeIssueComponent `bson:"issue,omitempty", json:"issue,omitempty"`
 }
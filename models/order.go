@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Order struct {
+	DomainResource `bson:",inline"`
+
 	Id                    string             `json:"-" bson:"_id"`
 	Identifier            []Identifier       `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Date                  FHIRDateTime       `bson:"date,omitempty", json:"date,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type OrderResponse struct {
+	DomainResource `bson:",inline"`
+
 	Id                       string          `json:"-" bson:"_id"`
 	Identifier               []Identifier    `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Request                  Reference       `bson:"request,omitempty", json:"request,omitempty"`
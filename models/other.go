@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Other struct {
+	DomainResource `bson:",inline"`
+
 	Id         string          `json:"-" bson:"_id"`
 	Identifier []Identifier    `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Code       CodeableConcept `bson:"code,omitempty", json:"code,omitempty"`
@@ -0,0 +1,33 @@
+package models
+
+// Parameters carries the input and output parameters of an operation, such as
+// the matches returned by ConceptMap $translate.
+type Parameters struct {
+	Type      string                         `json:"resourceType,omitempty"`
+	Parameter []ParametersParameterComponent `json:"parameter,omitempty"`
+}
+
+// ParametersParameterComponent is a single named parameter. Compound
+// parameters carry their values as named parts.
+type ParametersParameterComponent struct {
+	Name         string                         `json:"name,omitempty"`
+	ValueString  string                         `json:"valueString,omitempty"`
+	ValueCode    string                         `json:"valueCode,omitempty"`
+	ValueUri     string                         `json:"valueUri,omitempty"`
+	ValueBoolean *bool                          `json:"valueBoolean,omitempty"`
+	ValueInteger *int                           `json:"valueInteger,omitempty"`
+	ValueDecimal *float64                       `json:"valueDecimal,omitempty"`
+	ValueCoding  *Coding                        `json:"valueCoding,omitempty"`
+	Part         []ParametersParameterComponent `json:"part,omitempty"`
+}
+
+// NewParameters returns an empty Parameters resource.
+func NewParameters() *Parameters {
+	return &Parameters{Type: "Parameters"}
+}
+
+// Add appends a parameter and returns the Parameters for chaining.
+func (p *Parameters) Add(param ParametersParameterComponent) *Parameters {
+	p.Parameter = append(p.Parameter, param)
+	return p
+}
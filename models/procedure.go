@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Procedure struct {
+	DomainResource `bson:",inline"`
+
 	Id           string                          `json:"-" bson:"_id"`
 	Identifier   []Identifier                    `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Subject      Reference                       `bson:"subject,omitempty", json:"subject,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Profile struct {
+	DomainResource `bson:",inline"`
+
 	Id            string                          `json:"-" bson:"_id"`
 	Url           string                          `bson:"url,omitempty", json:"url,omitempty"`
 	Identifier    []Identifier                    `bson:"identifier,omitempty", json:"identifier,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Provenance struct {
+	DomainResource `bson:",inline"`
+
 	Id                 string                      `json:"-" bson:"_id"`
 	Target             []Reference                 `bson:"target,omitempty", json:"target,omitempty"`
 	Period             Period                      `bson:"period,omitempty", json:"period,omitempty"`
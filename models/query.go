@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Query struct {
+	DomainResource `bson:",inline"`
+
 	Id         string                 `json:"-" bson:"_id"`
 	Identifier string                 `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Parameter  []Extension            `bson:"parameter,omitempty", json:"parameter,omitempty"`
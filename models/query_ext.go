@@ -1,21 +1,134 @@
 package models
 
-import "gopkg.in/mgo.v2/bson"
+import (
+	"fmt"
+	"time"
 
-func (q *Query) ToPipeline() []bson.M {
-	pipeline := []bson.M{{"$group": bson.M{"_id": "$targetid", "gender": bson.M{"$max": "$gender"}, "birthdate": bson.M{"$max": "$birthdate"}, "entries": bson.M{"$addToSet": bson.M{"startdate": "$startdate", "enddate": "$enddate", "codes": "$codes", "type": "$type"}}}}}
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueryParameterStage builds the pipeline stages that restrict a Query to the
+// patients matching one of its parameters. The stages run on documents with
+// one patient each, as grouped by ToPipeline.
+type QueryParameterStage func(parameter Extension) ([]bson.M, error)
+
+// QueryParameters holds the stage builder for each supported Query parameter
+// URL. Further parameters can be supported by adding to this map.
+var QueryParameters = map[string]QueryParameterStage{
+	"http://interventionengine.org/patientgender":        patientGenderStage,
+	"http://interventionengine.org/conditioncode":        conditionCodeStage,
+	"http://interventionengine.org/agerange":             ageRangeStage,
+	"http://interventionengine.org/observationthreshold": observationThresholdStage,
+	"http://interventionengine.org/encounterwindow":      encounterWindowStage,
+}
+
+// ToPipeline builds a Mongo aggregation over the facts collection, in which
+// each document is a fact about a patient (targetid) with its type, codes,
+// start and end dates and, for observations, numeric value. The pipeline
+// produces one document per matching patient, with the patient's id as its
+// _id, sorted by id. It returns an error if the Query has a parameter that is
+// not in QueryParameters.
+func (q *Query) ToPipeline() ([]bson.M, error) {
+	pipeline := []bson.M{{"$group": bson.M{"_id": "$targetid", "gender": bson.M{"$max": "$gender"}, "birthdate": bson.M{"$max": "$birthdate"}, "entries": bson.M{"$addToSet": bson.M{"startdate": "$startdate", "enddate": "$enddate", "codes": "$codes", "type": "$type", "value": "$value"}}}}}
 	for _, extension := range q.Parameter {
-		switch extension.Url {
-		case "http://interventionengine.org/patientgender":
-			pipeline = append(pipeline, bson.M{"$match": bson.M{"gender": extension.ValueString}})
-		case "http://interventionengine.org/conditioncode":
-			// Hack for now assuming that all codable concepts contain a single code
-			conditionCode := extension.ValueCodeableConcept.Coding[0].Code
-			conditionSystem := extension.ValueCodeableConcept.Coding[0].System
-			pipeline = append(pipeline, bson.M{"$match": bson.M{"entries.type": "Condition", "entries.codes.coding.code": conditionCode, "entries.codes.coding.system": conditionSystem}})
+		stage, ok := QueryParameters[extension.Url]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported query parameter: %s", extension.Url)
 		}
+		stages, err := stage(extension)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid query parameter %s: %s", extension.Url, err)
+		}
+		pipeline = append(pipeline, stages...)
+	}
+
+	pipeline = append(pipeline, bson.M{"$project": bson.M{"_id": 1}}, bson.M{"$sort": bson.M{"_id": 1}})
+	return pipeline, nil
+}
+
+// patientGenderStage matches patients with the gender in valueString.
+func patientGenderStage(extension Extension) ([]bson.M, error) {
+	return []bson.M{{"$match": bson.M{"gender": extension.ValueString}}}, nil
+}
+
+// conditionCodeStage matches patients with a condition coded with any of the
+// codings in valueCodeableConcept.
+func conditionCodeStage(extension Extension) ([]bson.M, error) {
+	codes, err := codingMatch(extension.ValueCodeableConcept)
+	if err != nil {
+		return nil, err
 	}
+	return []bson.M{{"$match": bson.M{"entries": bson.M{"$elemMatch": bson.M{"type": "Condition", "codes.coding": codes}}}}}, nil
+}
 
-	pipeline = append(pipeline, bson.M{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": 1}}})
-	return pipeline
+// ageRangeStage matches patients whose age in whole years is within
+// valueRange. Either end of the range may be left out.
+func ageRangeStage(extension Extension) ([]bson.M, error) {
+	low, high := extension.ValueRange.Low.Value, extension.ValueRange.High.Value
+	if low == 0 && high == 0 {
+		return nil, fmt.Errorf("an age range needs a low or high value")
+	}
+	now := time.Now()
+	birthdate := bson.M{}
+	if low > 0 {
+		birthdate["$lte"] = now.AddDate(-int(low), 0, 0)
+	}
+	if high > 0 {
+		birthdate["$gt"] = now.AddDate(-int(high)-1, 0, 0)
+	}
+	return []bson.M{{"$match": bson.M{"birthdate": birthdate}}}, nil
+}
+
+// observationThresholdStage matches patients with an observation coded with
+// valueCodeableConcept whose value is within valueRange. Either end of the
+// range may be left out; as for age ranges, a bound of zero is treated as
+// absent.
+func observationThresholdStage(extension Extension) ([]bson.M, error) {
+	codes, err := codingMatch(extension.ValueCodeableConcept)
+	if err != nil {
+		return nil, err
+	}
+	value := bson.M{}
+	if low := extension.ValueRange.Low.Value; low != 0 {
+		value["$gte"] = low
+	}
+	if high := extension.ValueRange.High.Value; high != 0 {
+		value["$lte"] = high
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("an observation threshold needs a low or high value")
+	}
+	return []bson.M{{"$match": bson.M{"entries": bson.M{"$elemMatch": bson.M{"type": "Observation", "codes.coding": codes, "value": value}}}}}, nil
+}
+
+// encounterWindowStage matches patients with an encounter that started within
+// the last valueInteger days, optionally of a type in valueCodeableConcept.
+func encounterWindowStage(extension Extension) ([]bson.M, error) {
+	if extension.ValueInteger <= 0 {
+		return nil, fmt.Errorf("an encounter window needs a number of days")
+	}
+	match := bson.M{"type": "Encounter", "startdate": bson.M{"$gte": time.Now().AddDate(0, 0, -extension.ValueInteger)}}
+	if len(extension.ValueCodeableConcept.Coding) > 0 {
+		codes, err := codingMatch(extension.ValueCodeableConcept)
+		if err != nil {
+			return nil, err
+		}
+		match["codes.coding"] = codes
+	}
+	return []bson.M{{"$match": bson.M{"entries": bson.M{"$elemMatch": match}}}}, nil
+}
+
+// codingMatch matches a fact's codings against any of the codings in concept.
+func codingMatch(concept CodeableConcept) (bson.M, error) {
+	if len(concept.Coding) == 0 {
+		return nil, fmt.Errorf("a code is required")
+	}
+	var codings []bson.M
+	for _, coding := range concept.Coding {
+		codings = append(codings, bson.M{"system": coding.System, "code": coding.Code})
+	}
+	if len(codings) == 1 {
+		return bson.M{"$elemMatch": codings[0]}, nil
+	}
+	return bson.M{"$elemMatch": bson.M{"$or": codings}}, nil
 }
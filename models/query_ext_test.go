@@ -0,0 +1,29 @@
+package models
+
+import (
+	"gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func (s *ModelsSuite) TestQueryPipeline(c *check.C) {
+	q := &Query{Parameter: []Extension{
+		{Url: "http://interventionengine.org/patientgender", ValueString: "F"},
+		{Url: "http://interventionengine.org/conditioncode", ValueCodeableConcept: CodeableConcept{Coding: []Coding{{System: "http://snomed.info/sct", Code: "73211009"}}}},
+	}}
+	pipeline, err := q.ToPipeline()
+	c.Assert(err, check.IsNil)
+	c.Assert(pipeline, check.HasLen, 5)
+	c.Assert(pipeline[1], check.DeepEquals, bson.M{"$match": bson.M{"gender": "F"}})
+	c.Assert(pipeline[2], check.DeepEquals, bson.M{"$match": bson.M{"entries": bson.M{"$elemMatch": bson.M{
+		"type":         "Condition",
+		"codes.coding": bson.M{"$elemMatch": bson.M{"system": "http://snomed.info/sct", "code": "73211009"}},
+	}}}})
+
+	q.Parameter = append(q.Parameter, Extension{Url: "http://example.org/unknown"})
+	_, err = q.ToPipeline()
+	c.Assert(err, check.ErrorMatches, "Unsupported query parameter: http://example.org/unknown")
+
+	q.Parameter = []Extension{{Url: "http://interventionengine.org/agerange"}}
+	_, err = q.ToPipeline()
+	c.Assert(err, check.NotNil)
+}
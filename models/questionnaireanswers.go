@@ -29,6 +29,8 @@ package models
 import "time"
 
 type QuestionnaireAnswers struct {
+	DomainResource `bson:",inline"`
+
 	Id            string         `json:"-" bson:"_id"`
 	Identifier    Identifier     `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Questionnaire Reference      `bson:"questionnaire,omitempty", json:"questionnaire,omitempty"`
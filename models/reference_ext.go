@@ -5,17 +5,88 @@ import (
 	"strings"
 )
 
+// BaseURL is the base URL of this server, such as "http://example.org/fhir".
+// Absolute references that start with it are local references. It is set by
+// the server when it starts, if it has not been set already.
+var BaseURL string
+
+// ParsedReference holds the parts of a reference. Type and Id are set for
+// references to a resource of a known type, with Version set if the reference
+// is to a particular version. Base is the base URL of an absolute reference.
+// Contained is the id of a contained resource, as in "#med1". References that
+// are not to this server, such as absolute URLs with another base or URNs,
+// are External.
+type ParsedReference struct {
+	Base      string
+	Type      string
+	Id        string
+	Version   string
+	Contained string
+	External  bool
+}
+
+// ParseReference parses references of these forms:
+//
+//	Patient/123
+//	Patient/123/_history/2
+//	http://example.org/fhir/Patient/123[/_history/2]
+//	#med1
+//	urn:uuid:53fefa32-fcbb-4ff8-8a92-55ee120877b7
+func ParseReference(reference string) ParsedReference {
+	p := ParsedReference{}
+	if strings.HasPrefix(reference, "#") {
+		p.Contained = reference[1:]
+		return p
+	}
+	if strings.HasPrefix(reference, "urn:") {
+		p.External = true
+		return p
+	}
+
+	segments := strings.Split(strings.TrimRight(reference, "/"), "/")
+	end := len(segments)
+	if end >= 4 && segments[end-2] == "_history" {
+		p.Version = segments[end-1]
+		end -= 2
+	}
+	if end >= 2 {
+		if _, ok := resourceTypes[segments[end-2]]; ok && segments[end-1] != "" {
+			p.Type, p.Id = segments[end-2], segments[end-1]
+			p.Base = strings.Join(segments[:end-2], "/")
+		}
+	}
+	if p.Type == "" {
+		p.Version = ""
+		p.Base = reference
+	}
+	if strings.Contains(p.Base, "://") {
+		p.External = !IsLocalBase(p.Base)
+	} else {
+		// A relative reference such as "/Patient/123" has no base
+		p.Base = ""
+	}
+	return p
+}
+
+// IsLocalBase reports whether a base URL is this server's BaseURL, ignoring
+// case and any trailing slash.
+func IsLocalBase(base string) bool {
+	return BaseURL != "" && strings.EqualFold(strings.TrimRight(base, "/"), strings.TrimRight(BaseURL, "/"))
+}
+
 type reference Reference
 
+// UnmarshalJSON sets the Type, ReferencedID and External fields from the
+// reference.
 func (r *Reference) UnmarshalJSON(data []byte) (err error) {
 	ref := reference{}
 	if err = json.Unmarshal(data, &ref); err == nil {
-		splitURL := strings.Split(ref.Reference, "/")
-		if len(splitURL) == 3 {
-			ref.ReferencedID = splitURL[len(splitURL)-1]
-			ref.Type = splitURL[len(splitURL)-2]
+		parsed := ParseReference(ref.Reference)
+		if parsed.Type != "" {
+			ref.ReferencedID = parsed.Id
+			ref.Type = parsed.Type
 		}
-		external := strings.HasPrefix(ref.Reference, "http")
+		external := parsed.External
 		ref.External = &external
 		*r = Reference(ref)
 		return
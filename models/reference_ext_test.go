@@ -0,0 +1,43 @@
+package models
+
+import (
+	"encoding/json"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *ModelsSuite) TestParseReference(c *check.C) {
+	defer func(base string) { BaseURL = base }(BaseURL)
+	BaseURL = "http://example.org/fhir/"
+
+	c.Assert(ParseReference("Patient/123"), check.DeepEquals, ParsedReference{Type: "Patient", Id: "123"})
+	c.Assert(ParseReference("/Patient/123"), check.DeepEquals, ParsedReference{Type: "Patient", Id: "123"})
+	c.Assert(ParseReference("Patient/123/_history/2"), check.DeepEquals, ParsedReference{Type: "Patient", Id: "123", Version: "2"})
+	c.Assert(ParseReference("#med1"), check.DeepEquals, ParsedReference{Contained: "med1"})
+	c.Assert(ParseReference("http://example.org/fhir/Patient/123"), check.DeepEquals,
+		ParsedReference{Base: "http://example.org/fhir", Type: "Patient", Id: "123"})
+	c.Assert(ParseReference("HTTP://EXAMPLE.ORG/fhir/Patient/123/_history/4"), check.DeepEquals,
+		ParsedReference{Base: "HTTP://EXAMPLE.ORG/fhir", Type: "Patient", Id: "123", Version: "4"})
+	c.Assert(ParseReference("http://other.org/fhir/Patient/123"), check.DeepEquals,
+		ParsedReference{Base: "http://other.org/fhir", Type: "Patient", Id: "123", External: true})
+	c.Assert(ParseReference("http://other.org/some/page").External, check.Equals, true)
+	c.Assert(ParseReference("urn:uuid:53fefa32-fcbb-4ff8-8a92-55ee120877b7").External, check.Equals, true)
+	c.Assert(ParseReference("Unknown/123").Type, check.Equals, "")
+}
+
+func (s *ModelsSuite) TestUnmarshalReference(c *check.C) {
+	defer func(base string) { BaseURL = base }(BaseURL)
+	BaseURL = "http://example.org/fhir"
+
+	var refs []Reference
+	err := json.Unmarshal([]byte(`[{"reference": "Patient/123"}, {"reference": "http://example.org/fhir/Practitioner/7"}, {"reference": "http://other.org/fhir/Patient/1"}, {"reference": "#med1"}]`), &refs)
+	c.Assert(err, check.IsNil)
+	c.Assert(refs[0].Type, check.Equals, "Patient")
+	c.Assert(refs[0].ReferencedID, check.Equals, "123")
+	c.Assert(*refs[0].External, check.Equals, false)
+	c.Assert(refs[1].Type, check.Equals, "Practitioner")
+	c.Assert(*refs[1].External, check.Equals, false)
+	c.Assert(*refs[2].External, check.Equals, true)
+	c.Assert(refs[3].ReferencedID, check.Equals, "")
+	c.Assert(*refs[3].External, check.Equals, false)
+}
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type ReferralRequest struct {
+	DomainResource `bson:",inline"`
+
 	Id                    string            `json:"-" bson:"_id"`
 	Status                string            `bson:"status,omitempty", json:"status,omitempty"`
 	Identifier            []Identifier      `bson:"identifier,omitempty", json:"identifier,omitempty"`
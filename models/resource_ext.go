@@ -0,0 +1,15 @@
+package models
+
+// DomainResource holds the elements that every resource has but that the
+// generated models leave out. Each resource model embeds it inline, so that
+// its elements are stored and encoded as elements of the resource.
+//
+// The generator is not part of this repository, and the resource models have
+// been edited by hand since they were generated. A model that is regenerated
+// must embed DomainResource `bson:",inline"` again, and keep the other hand
+// edits, such as the Reference extensions.
+type DomainResource struct {
+	// Contained holds the contained resources, as decoded from JSON or BSON,
+	// which references such as "#med1" refer to.
+	Contained []interface{} `bson:"contained,omitempty" json:"contained,omitempty"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"reflect"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *ModelsSuite) TestResourcesEmbedDomainResource(c *check.C) {
+	// The models are edited by hand, so check that none has lost the embedding
+	for _, name := range ResourceNames() {
+		resource, err := NewStructForResourceName(name)
+		c.Assert(err, check.IsNil)
+		field, ok := reflect.TypeOf(resource).Elem().FieldByName("DomainResource")
+		c.Assert(ok && field.Anonymous, check.Equals, true, check.Commentf("%s does not embed DomainResource", name))
+		c.Assert(field.Tag.Get("bson"), check.Equals, ",inline", check.Commentf("%s does not embed DomainResource inline", name))
+	}
+}
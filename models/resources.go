@@ -0,0 +1,102 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+)
+
+var resourceTypes = map[string]reflect.Type{
+	"AdverseReaction":            reflect.TypeOf(AdverseReaction{}),
+	"Alert":                      reflect.TypeOf(Alert{}),
+	"AllergyIntolerance":         reflect.TypeOf(AllergyIntolerance{}),
+	"Appointment":                reflect.TypeOf(Appointment{}),
+	"AppointmentResponse":        reflect.TypeOf(AppointmentResponse{}),
+	"Availability":               reflect.TypeOf(Availability{}),
+	"CarePlan":                   reflect.TypeOf(CarePlan{}),
+	"Composition":                reflect.TypeOf(Composition{}),
+	"ConceptMap":                 reflect.TypeOf(ConceptMap{}),
+	"Condition":                  reflect.TypeOf(Condition{}),
+	"Conformance":                reflect.TypeOf(Conformance{}),
+	"Contraindication":           reflect.TypeOf(Contraindication{}),
+	"DataElement":                reflect.TypeOf(DataElement{}),
+	"Device":                     reflect.TypeOf(Device{}),
+	"DeviceObservationReport":    reflect.TypeOf(DeviceObservationReport{}),
+	"DiagnosticOrder":            reflect.TypeOf(DiagnosticOrder{}),
+	"DiagnosticReport":           reflect.TypeOf(DiagnosticReport{}),
+	"DocumentManifest":           reflect.TypeOf(DocumentManifest{}),
+	"DocumentReference":          reflect.TypeOf(DocumentReference{}),
+	"Encounter":                  reflect.TypeOf(Encounter{}),
+	"FamilyHistory":              reflect.TypeOf(FamilyHistory{}),
+	"Group":                      reflect.TypeOf(Group{}),
+	"ImagingStudy":               reflect.TypeOf(ImagingStudy{}),
+	"Immunization":               reflect.TypeOf(Immunization{}),
+	"ImmunizationRecommendation": reflect.TypeOf(ImmunizationRecommendation{}),
+	"List":                       reflect.TypeOf(List{}),
+	"Location":                   reflect.TypeOf(Location{}),
+	"Media":                      reflect.TypeOf(Media{}),
+	"Medication":                 reflect.TypeOf(Medication{}),
+	"MedicationAdministration":   reflect.TypeOf(MedicationAdministration{}),
+	"MedicationDispense":         reflect.TypeOf(MedicationDispense{}),
+	"MedicationPrescription":     reflect.TypeOf(MedicationPrescription{}),
+	"MedicationStatement":        reflect.TypeOf(MedicationStatement{}),
+	"MessageHeader":              reflect.TypeOf(MessageHeader{}),
+	"Namespace":                  reflect.TypeOf(Namespace{}),
+	"NutritionOrder":             reflect.TypeOf(NutritionOrder{}),
+	"Observation":                reflect.TypeOf(Observation{}),
+	"OperationDefinition":        reflect.TypeOf(OperationDefinition{}),
+	"OperationOutcome":           reflect.TypeOf(OperationOutcome{}),
+	"Order":                      reflect.TypeOf(Order{}),
+	"OrderResponse":              reflect.TypeOf(OrderResponse{}),
+	"Organization":               reflect.TypeOf(Organization{}),
+	"Other":                      reflect.TypeOf(Other{}),
+	"Patient":                    reflect.TypeOf(Patient{}),
+	"Practitioner":               reflect.TypeOf(Practitioner{}),
+	"Procedure":                  reflect.TypeOf(Procedure{}),
+	"Profile":                    reflect.TypeOf(Profile{}),
+	"Provenance":                 reflect.TypeOf(Provenance{}),
+	"Query":                      reflect.TypeOf(Query{}),
+	"Questionnaire":              reflect.TypeOf(Questionnaire{}),
+	"QuestionnaireAnswers":       reflect.TypeOf(QuestionnaireAnswers{}),
+	"ReferralRequest":            reflect.TypeOf(ReferralRequest{}),
+	"RelatedPerson":              reflect.TypeOf(RelatedPerson{}),
+	"RiskAssessment":             reflect.TypeOf(RiskAssessment{}),
+	"SecurityEvent":              reflect.TypeOf(SecurityEvent{}),
+	"Slot":                       reflect.TypeOf(Slot{}),
+	"Specimen":                   reflect.TypeOf(Specimen{}),
+	"Subscription":               reflect.TypeOf(Subscription{}),
+	"Substance":                  reflect.TypeOf(Substance{}),
+	"Supply":                     reflect.TypeOf(Supply{}),
+	"ValueSet":                   reflect.TypeOf(ValueSet{}),
+}
+
+// ResourceNames returns the names of all of the resource types known to the
+// models package, e.g. "Patient" or "Observation".
+func ResourceNames() []string {
+	names := make([]string, 0, len(resourceTypes))
+	for name := range resourceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStructForResourceName returns a pointer to a new, empty instance of the
+// named resource type, suitable for decoding JSON or BSON into.
+func NewStructForResourceName(name string) (interface{}, error) {
+	t, ok := resourceTypes[name]
+	if !ok {
+		return nil, errors.New("Unknown resource type: " + name)
+	}
+	return reflect.New(t).Interface(), nil
+}
+
+// NewSliceForResourceName returns a pointer to a new, empty slice of the named
+// resource type, suitable for passing to mgo's Iter.All.
+func NewSliceForResourceName(name string) (interface{}, error) {
+	t, ok := resourceTypes[name]
+	if !ok {
+		return nil, errors.New("Unknown resource type: " + name)
+	}
+	return reflect.New(reflect.SliceOf(t)).Interface(), nil
+}
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type RiskAssessment struct {
+	DomainResource `bson:",inline"`
+
 	Id         string                              `json:"-" bson:"_id"`
 	Subject    Reference                           `bson:"subject,omitempty", json:"subject,omitempty"`
 	Date       FHIRDateTime                        `bson:"date,omitempty", json:"date,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type SecurityEvent struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                              `json:"-" bson:"_id"`
 	Event       SecurityEventEventComponent         `bson:"event,omitempty", json:"event,omitempty"`
 	Participant []SecurityEventParticipantComponent `bson:"participant,omitempty", json:"participant,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Subscription struct {
+	DomainResource `bson:",inline"`
+
 	Id       string                       `json:"-" bson:"_id"`
 	Criteria string                       `bson:"criteria,omitempty", json:"criteria,omitempty"`
 	Contact  []ContactPoint               `bson:"contact,omitempty", json:"contact,omitempty"`
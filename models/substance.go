@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Substance struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                         `json:"-" bson:"_id"`
 	Type        CodeableConcept                `bson:"type,omitempty", json:"type,omitempty"`
 	Description string                         `bson:"description,omitempty", json:"description,omitempty"`
@@ -29,6 +29,8 @@ package models
 import "time"
 
 type Supply struct {
+	DomainResource `bson:",inline"`
+
 	Id          string                    `json:"-" bson:"_id"`
 	Kind        CodeableConcept           `bson:"kind,omitempty", json:"kind,omitempty"`
 	Identifier  Identifier                `bson:"identifier,omitempty", json:"identifier,omitempty"`
@@ -0,0 +1,1091 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ResourceRules describes the base invariants for a single resource type.
+// Paths are dotted FHIR element names relative to the resource (e.g.
+// "participant.type"); any slice along the way is checked element by element.
+type ResourceRules struct {
+	// Required lists elements that must be present. A nested element is only
+	// required when its parent element is present.
+	Required []string
+	// Codes fixes the allowed values of code elements.
+	Codes map[string][]string
+	// Concepts binds CodeableConcept elements to fixed code systems.
+	Concepts map[string]ConceptBinding
+	// References restricts the resource types that a Reference may point at.
+	References map[string][]string
+}
+
+// ConceptBinding maps each permitted code system to its permitted codes. Every
+// coding in a bound CodeableConcept must come from one of these systems.
+type ConceptBinding map[string][]string
+
+var administrativeGender = ConceptBinding{
+	"http://hl7.org/fhir/v3/AdministrativeGender": {"F", "M", "UN"},
+	"http://hl7.org/fhir/v3/NullFlavor":           {"UNK"},
+}
+
+var medicationStatus = []string{"in progress", "on hold", "completed", "entered in error", "stopped"}
+
+var participantStatus = []string{"accepted", "declined", "tentative", "in-process", "completed", "needs-action"}
+
+var definitionStatus = []string{"draft", "active", "retired"}
+
+var documentStatus = []string{"current", "superceded", "entered in error"}
+
+var authors = []string{"Practitioner", "Device", "Patient", "RelatedPerson"}
+
+// ValidationRules holds the base FHIR invariants enforced on every resource
+// type. Rules may be added or tightened by adding to this map at startup.
+var ValidationRules = map[string]ResourceRules{
+	"AdverseReaction": {
+		Required: []string{"subject", "didNotOccurFlag"},
+		Codes: map[string][]string{
+			"symptom.severity": {"severe", "serious", "moderate", "minor"},
+			"exposure.type":    {"drugadmin", "immuniz", "coincidental"},
+		},
+		References: map[string][]string{
+			"subject":            {"Patient"},
+			"recorder":           {"Practitioner", "Patient"},
+			"exposure.substance": {"Substance"},
+		},
+	},
+	"Alert": {
+		Required: []string{"status", "subject", "note"},
+		Codes: map[string][]string{
+			"status": {"active", "inactive", "entered in error"},
+		},
+		References: map[string][]string{
+			"subject": {"Patient"},
+			"author":  {"Practitioner", "Patient", "Device"},
+		},
+	},
+	"AllergyIntolerance": {
+		Required: []string{"sensitivityType", "status", "subject", "substance"},
+		Codes: map[string][]string{
+			"criticality":     {"fatal", "high", "medium", "low"},
+			"sensitivityType": {"allergy", "intolerance", "unknown"},
+			"status":          {"suspected", "confirmed", "refuted", "resolved"},
+		},
+		References: map[string][]string{
+			"subject":         {"Patient"},
+			"recorder":        {"Practitioner", "Patient"},
+			"substance":       {"Substance"},
+			"reaction":        {"AdverseReaction"},
+			"sensitivityTest": {"Observation"},
+		},
+	},
+	"Appointment": {
+		Required: []string{"status", "start", "end", "participant", "participant.status"},
+		Codes: map[string][]string{
+			"status":               {"proposed", "pending", "booked", "arrived", "fulfilled", "cancelled", "noshow"},
+			"participant.required": {"required", "optional", "information-only"},
+			"participant.status":   participantStatus,
+		},
+		References: map[string][]string{
+			"slot":           {"Slot"},
+			"location":       {"Location"},
+			"order":          {"Order"},
+			"lastModifiedBy": {"Practitioner", "Patient", "RelatedPerson"},
+		},
+	},
+	"AppointmentResponse": {
+		Required: []string{"appointment", "participantStatus"},
+		Codes: map[string][]string{
+			"participantStatus": participantStatus,
+		},
+		References: map[string][]string{
+			"appointment":    {"Appointment"},
+			"lastModifiedBy": {"Practitioner", "Patient", "RelatedPerson"},
+		},
+	},
+	"Availability": {
+		Required: []string{"actor"},
+	},
+	"CarePlan": {
+		Required: []string{"status", "goal.description", "participant.member"},
+		Codes: map[string][]string{
+			"status":          {"planned", "active", "completed"},
+			"goal.status":     {"in progress", "achieved", "sustaining", "cancelled"},
+			"activity.status": {"not started", "scheduled", "in progress", "on hold", "completed", "cancelled"},
+		},
+		References: map[string][]string{
+			"patient":                  {"Patient"},
+			"concern":                  {"Condition"},
+			"participant.member":       {"Practitioner", "RelatedPerson", "Patient", "Organization"},
+			"goal.concern":             {"Condition"},
+			"activity.simple.location": {"Location"},
+		},
+	},
+	"Composition": {
+		Required: []string{"date", "type", "title", "status", "subject", "author", "attester.mode"},
+		Codes: map[string][]string{
+			"status":        {"preliminary", "final", "appended", "amended", "retracted"},
+			"attester.mode": {"personal", "professional", "legal", "official"},
+		},
+		References: map[string][]string{
+			"subject":        {"Patient", "Practitioner", "Group", "Device", "Location"},
+			"author":         authors,
+			"attester.party": {"Patient", "Practitioner", "Organization"},
+			"custodian":      {"Organization"},
+			"encounter":      {"Encounter"},
+		},
+	},
+	"ConceptMap": {
+		Required: []string{"name", "status", "element.map.equivalence"},
+		Codes: map[string][]string{
+			"status":                  definitionStatus,
+			"element.map.equivalence": {"equal", "equivalent", "wider", "subsumes", "narrower", "specialises", "inexact", "unmatched", "disjoint"},
+		},
+		References: map[string][]string{
+			"sourceReference": {"ValueSet", "Profile"},
+			"targetReference": {"ValueSet", "Profile"},
+		},
+	},
+	"Condition": {
+		Required: []string{"subject", "code", "status"},
+		Codes: map[string][]string{
+			"status": {"provisional", "working", "confirmed", "refuted"},
+		},
+		References: map[string][]string{
+			"subject":   {"Patient"},
+			"encounter": {"Encounter"},
+			"asserter":  {"Practitioner", "Patient"},
+		},
+	},
+	"Conformance": {
+		Required: []string{"publisher", "date", "fhirVersion", "acceptUnknown", "format", "rest.mode"},
+		Codes: map[string][]string{
+			"status":    definitionStatus,
+			"rest.mode": {"client", "server"},
+		},
+		References: map[string][]string{
+			"profile": {"Profile"},
+		},
+	},
+	"Contraindication": {
+		Required: []string{"patient"},
+		Codes: map[string][]string{
+			"severity": {"high", "moderate", "low"},
+		},
+		References: map[string][]string{
+			"patient": {"Patient"},
+			"author":  {"Practitioner", "Device"},
+		},
+	},
+	"DataElement": {
+		Codes: map[string][]string{
+			"status": definitionStatus,
+		},
+	},
+	"Device": {
+		Required: []string{"type"},
+		References: map[string][]string{
+			"owner":    {"Organization"},
+			"location": {"Location"},
+			"patient":  {"Patient"},
+		},
+	},
+	"DeviceObservationReport": {
+		Required: []string{"instant", "source"},
+		References: map[string][]string{
+			"source":  {"Device"},
+			"subject": {"Patient", "Device", "Location"},
+		},
+	},
+	"DiagnosticOrder": {
+		Required: []string{"subject", "event.status", "event.dateTime", "item.code"},
+		Codes: map[string][]string{
+			"status":       {"requested", "received", "accepted", "in progress", "review", "completed", "suspended", "rejected", "failed"},
+			"priority":     {"routine", "urgent", "stat", "asap"},
+			"event.status": {"requested", "received", "accepted", "in progress", "review", "completed", "suspended", "rejected", "failed"},
+			"item.status":  {"requested", "received", "accepted", "in progress", "review", "completed", "suspended", "rejected", "failed"},
+		},
+		References: map[string][]string{
+			"subject":   {"Patient", "Group", "Location", "Device"},
+			"orderer":   {"Practitioner"},
+			"encounter": {"Encounter"},
+			"specimen":  {"Specimen"},
+		},
+	},
+	"DiagnosticReport": {
+		Required: []string{"name", "status", "issued", "subject", "performer"},
+		Codes: map[string][]string{
+			"status": {"registered", "partial", "final", "corrected", "amended", "appended", "cancelled", "entered in error"},
+		},
+		References: map[string][]string{
+			"subject":       {"Patient", "Group", "Device", "Location"},
+			"performer":     {"Practitioner", "Organization"},
+			"requestDetail": {"DiagnosticOrder"},
+			"specimen":      {"Specimen"},
+			"result":        {"Observation"},
+			"imagingStudy":  {"ImagingStudy"},
+		},
+	},
+	"DocumentManifest": {
+		Required: []string{"masterIdentifier", "subject", "author", "status", "content"},
+		Codes: map[string][]string{
+			"status": documentStatus,
+		},
+		References: map[string][]string{
+			"subject":    {"Patient", "Practitioner", "Group", "Device"},
+			"recipient":  {"Patient", "Practitioner", "Organization"},
+			"author":     authors,
+			"supercedes": {"DocumentManifest"},
+			"content":    {"DocumentReference", "Binary", "Media"},
+		},
+	},
+	"DocumentReference": {
+		Required: []string{"masterIdentifier", "subject", "type", "author", "indexed", "status", "mimeType"},
+		Codes: map[string][]string{
+			"status": documentStatus,
+		},
+		References: map[string][]string{
+			"subject":       {"Patient", "Practitioner", "Group", "Device"},
+			"author":        authors,
+			"custodian":     {"Organization"},
+			"authenticator": {"Practitioner", "Organization"},
+		},
+	},
+	"Encounter": {
+		Required: []string{"status", "class", "location.location"},
+		Codes: map[string][]string{
+			"status": {"planned", "in progress", "onleave", "finished", "cancelled"},
+			"class":  {"inpatient", "outpatient", "ambulatory", "emergency", "home", "field", "daytime", "virtual"},
+		},
+		References: map[string][]string{
+			"subject":                {"Patient"},
+			"participant.individual": {"Practitioner", "RelatedPerson"},
+			"fulfills":               {"Appointment"},
+			"location.location":      {"Location"},
+			"serviceProvider":        {"Organization"},
+			"partOf":                 {"Encounter"},
+		},
+	},
+	"FamilyHistory": {
+		Required: []string{"subject"},
+		References: map[string][]string{
+			"subject": {"Patient"},
+		},
+	},
+	"Group": {
+		Required: []string{"type", "actual"},
+		Codes: map[string][]string{
+			"type": {"person", "animal", "practitioner", "device", "medication", "substance"},
+		},
+		References: map[string][]string{
+			"member": {"Patient", "Practitioner", "Device", "Medication", "Substance"},
+		},
+	},
+	"ImagingStudy": {
+		Required: []string{"subject", "uid", "numberOfSeries", "numberOfInstances"},
+		References: map[string][]string{
+			"subject":     {"Patient"},
+			"order":       {"DiagnosticOrder"},
+			"referrer":    {"Practitioner"},
+			"interpreter": {"Practitioner"},
+		},
+	},
+	"Immunization": {
+		Required: []string{"date", "vaccineType", "subject", "refusedIndicator", "reported"},
+		References: map[string][]string{
+			"subject":      {"Patient"},
+			"performer":    {"Practitioner"},
+			"requester":    {"Practitioner"},
+			"manufacturer": {"Organization"},
+			"location":     {"Location"},
+		},
+	},
+	"ImmunizationRecommendation": {
+		Required: []string{"subject", "recommendation", "recommendation.date", "recommendation.vaccineType", "recommendation.forecastStatus"},
+		References: map[string][]string{
+			"subject":                               {"Patient"},
+			"recommendation.supportingImmunization": {"Immunization"},
+		},
+	},
+	"List": {
+		Required: []string{"mode", "entry.item"},
+		Codes: map[string][]string{
+			"mode": {"working", "snapshot", "changes"},
+		},
+		References: map[string][]string{
+			"subject": {"Patient", "Group", "Device", "Location"},
+			"source":  {"Practitioner", "Patient", "Device"},
+		},
+	},
+	"Location": {
+		Codes: map[string][]string{
+			"status": {"active", "suspended", "inactive"},
+			"mode":   {"instance", "kind"},
+		},
+		References: map[string][]string{
+			"managingOrganization": {"Organization"},
+			"partOf":               {"Location"},
+		},
+	},
+	"Media": {
+		Required: []string{"type", "content"},
+		Codes: map[string][]string{
+			"type": {"photo", "video", "audio"},
+		},
+		References: map[string][]string{
+			"subject":  {"Patient", "Practitioner", "Group", "Device", "Specimen"},
+			"operator": {"Practitioner"},
+		},
+	},
+	"Medication": {
+		Codes: map[string][]string{
+			"kind": {"product", "package"},
+		},
+		References: map[string][]string{
+			"manufacturer": {"Organization"},
+		},
+	},
+	"MedicationAdministration": {
+		Required: []string{"status", "patient", "practitioner", "prescription"},
+		Codes: map[string][]string{
+			"status": medicationStatus,
+		},
+		References: map[string][]string{
+			"patient":      {"Patient"},
+			"practitioner": {"Practitioner"},
+			"encounter":    {"Encounter"},
+			"prescription": {"MedicationPrescription"},
+			"medication":   {"Medication"},
+			"device":       {"Device"},
+		},
+	},
+	"MedicationDispense": {
+		Codes: map[string][]string{
+			"status":          medicationStatus,
+			"dispense.status": medicationStatus,
+		},
+		References: map[string][]string{
+			"patient":                 {"Patient"},
+			"dispenser":               {"Practitioner"},
+			"authorizingPrescription": {"MedicationPrescription"},
+			"dispense.medication":     {"Medication"},
+			"dispense.destination":    {"Location"},
+			"dispense.receiver":       {"Patient", "Practitioner"},
+		},
+	},
+	"MedicationPrescription": {
+		Codes: map[string][]string{
+			"status": {"active", "paused", "completed", "entered in error", "stopped", "superceded"},
+		},
+		References: map[string][]string{
+			"patient":         {"Patient"},
+			"prescriber":      {"Practitioner"},
+			"encounter":       {"Encounter"},
+			"reasonReference": {"Condition"},
+			"medication":      {"Medication"},
+		},
+	},
+	"MedicationStatement": {
+		References: map[string][]string{
+			"patient":    {"Patient"},
+			"medication": {"Medication"},
+			"device":     {"Device"},
+		},
+	},
+	"MessageHeader": {
+		Required: []string{"identifier", "timestamp", "event", "source", "source.endpoint"},
+		References: map[string][]string{
+			"enterer":     {"Practitioner"},
+			"author":      {"Practitioner"},
+			"receiver":    {"Practitioner", "Organization"},
+			"responsible": {"Practitioner", "Organization"},
+		},
+	},
+	"Namespace": {
+		Required: []string{"type", "name", "status", "uniqueId", "uniqueId.type", "uniqueId.value"},
+		Codes: map[string][]string{
+			"type":          {"codesystem", "identifier", "root"},
+			"status":        {"proposed", "active", "retired"},
+			"uniqueId.type": {"oid", "uuid", "uri", "other"},
+		},
+		References: map[string][]string{
+			"replacedBy": {"Namespace"},
+		},
+	},
+	"NutritionOrder": {
+		Required: []string{"subject", "orderer", "dateTime"},
+		Codes: map[string][]string{
+			"status": {"requested", "active", "inactive", "held", "cancelled"},
+		},
+		References: map[string][]string{
+			"subject":            {"Patient"},
+			"orderer":            {"Practitioner"},
+			"encounter":          {"Encounter"},
+			"allergyIntolerance": {"AllergyIntolerance"},
+		},
+	},
+	"Observation": {
+		Required: []string{"name", "status", "reliability", "related.target"},
+		Codes: map[string][]string{
+			"status":       {"registered", "preliminary", "final", "amended", "cancelled", "entered in error"},
+			"reliability":  {"ok", "ongoing", "early", "questionable", "calibrating", "error", "unknown"},
+			"related.type": {"has-component", "has-member", "derived-from", "sequel-to", "replaces", "qualified-by", "interfered-by"},
+		},
+		References: map[string][]string{
+			"subject":        {"Patient", "Group", "Device", "Location"},
+			"specimen":       {"Specimen"},
+			"performer":      {"Practitioner", "Device", "Organization", "Patient", "RelatedPerson"},
+			"encounter":      {"Encounter"},
+			"related.target": {"Observation"},
+		},
+	},
+	"OperationDefinition": {
+		Required: []string{"title", "status", "kind", "name", "system", "instance"},
+		Codes: map[string][]string{
+			"status": definitionStatus,
+			"kind":   {"operation", "query"},
+		},
+		References: map[string][]string{
+			"base": {"OperationDefinition"},
+		},
+	},
+	"OperationOutcome": {
+		Required: []string{"issue", "issue.severity"},
+		Codes: map[string][]string{
+			"issue.severity": {"fatal", "error", "warning", "information"},
+		},
+	},
+	"Order": {
+		Required: []string{"detail"},
+		References: map[string][]string{
+			"subject": {"Patient"},
+			"source":  {"Practitioner"},
+			"target":  {"Organization", "Device", "Practitioner"},
+		},
+	},
+	"OrderResponse": {
+		Required: []string{"request", "code"},
+		Codes: map[string][]string{
+			"code": {"pending", "review", "rejected", "error", "accepted", "cancelled", "replaced", "aborted", "complete"},
+		},
+		References: map[string][]string{
+			"request": {"Order"},
+			"who":     {"Practitioner", "Organization", "Device"},
+		},
+	},
+	"Organization": {
+		References: map[string][]string{
+			"partOf":   {"Organization"},
+			"location": {"Location"},
+		},
+	},
+	"Other": {
+		Required: []string{"code", "subject"},
+		References: map[string][]string{
+			"author": {"Practitioner", "Patient", "RelatedPerson"},
+		},
+	},
+	"Patient": {
+		Codes: map[string][]string{
+			"link.type": {"replace", "refer", "seealso"},
+		},
+		Concepts: map[string]ConceptBinding{
+			"gender":         administrativeGender,
+			"contact.gender": administrativeGender,
+		},
+		References: map[string][]string{
+			"careProvider":         {"Organization", "Practitioner"},
+			"managingOrganization": {"Organization"},
+			"contact.organization": {"Organization"},
+			"link.other":           {"Patient"},
+		},
+	},
+	"Practitioner": {
+		Concepts: map[string]ConceptBinding{
+			"gender": administrativeGender,
+		},
+		References: map[string][]string{
+			"organization": {"Organization"},
+			"location":     {"Location"},
+		},
+	},
+	"Procedure": {
+		Required: []string{"subject", "type"},
+		References: map[string][]string{
+			"subject":          {"Patient"},
+			"performer.person": {"Practitioner"},
+			"encounter":        {"Encounter"},
+			"report":           {"DiagnosticReport"},
+		},
+	},
+	"Profile": {
+		Required: []string{"name", "status"},
+		Codes: map[string][]string{
+			"status": definitionStatus,
+		},
+	},
+	"Provenance": {
+		Required: []string{"target", "recorded", "agent.role", "agent.type", "agent.reference", "entity.role", "entity.type", "entity.reference"},
+		Codes: map[string][]string{
+			"entity.role": {"derivation", "revision", "quotation", "source"},
+		},
+		References: map[string][]string{
+			"location": {"Location"},
+		},
+	},
+	"Query": {
+		Required: []string{"identifier", "parameter"},
+		Codes: map[string][]string{
+			"response.outcome": {"ok", "limited", "refused", "error"},
+		},
+	},
+	"Questionnaire": {
+		Required: []string{"status", "group"},
+		Codes: map[string][]string{
+			"status": {"draft", "published", "retired"},
+		},
+	},
+	"QuestionnaireAnswers": {
+		Required: []string{"status"},
+		Codes: map[string][]string{
+			"status": {"in progress", "completed", "amended"},
+		},
+		References: map[string][]string{
+			"questionnaire": {"Questionnaire"},
+			"author":        {"Practitioner", "Patient", "RelatedPerson"},
+			"source":        {"Patient", "Practitioner", "RelatedPerson"},
+			"encounter":     {"Encounter"},
+		},
+	},
+	"ReferralRequest": {
+		Required: []string{"status"},
+		Codes: map[string][]string{
+			"status": {"draft", "sent", "active", "cancelled", "refused", "completed"},
+		},
+		References: map[string][]string{
+			"subject":   {"Patient"},
+			"requester": {"Practitioner", "Organization", "Patient"},
+			"recipient": {"Practitioner", "Organization"},
+			"encounter": {"Encounter"},
+		},
+	},
+	"RelatedPerson": {
+		Required: []string{"patient"},
+		Concepts: map[string]ConceptBinding{
+			"gender": administrativeGender,
+		},
+		References: map[string][]string{
+			"patient": {"Patient"},
+		},
+	},
+	"RiskAssessment": {
+		References: map[string][]string{
+			"subject":   {"Patient", "Group"},
+			"condition": {"Condition"},
+			"performer": {"Practitioner", "Device"},
+		},
+	},
+	"SecurityEvent": {
+		Required: []string{"event", "event.type", "event.dateTime", "participant", "source", "source.identifier"},
+		Codes: map[string][]string{
+			"event.action":             {"C", "R", "U", "D", "E"},
+			"event.outcome":            {"0", "4", "8", "12"},
+			"participant.network.type": {"1", "2", "3", "4", "5"},
+			"object.type":              {"1", "2", "3", "4"},
+		},
+	},
+	"Slot": {
+		Required: []string{"availability", "freeBusyType", "start", "end"},
+		Codes: map[string][]string{
+			"freeBusyType": {"BUSY", "FREE", "BUSY-UNAVAILABLE", "BUSY-TENTATIVE"},
+		},
+		References: map[string][]string{
+			"availability": {"Availability"},
+		},
+	},
+	"Specimen": {
+		Required: []string{"subject"},
+		References: map[string][]string{
+			"subject": {"Patient", "Group", "Device", "Substance"},
+		},
+	},
+	"Subscription": {
+		Required: []string{"criteria", "reason", "status", "channel", "channel.type"},
+		Codes: map[string][]string{
+			"status":       {"requested", "active", "error", "off"},
+			"channel.type": {"rest-hook", "websocket", "email", "sms", "message"},
+		},
+	},
+	"Substance": {
+		Required: []string{"type"},
+	},
+	"Supply": {
+		Codes: map[string][]string{
+			"status":          {"requested", "dispensed", "received", "failed", "cancelled"},
+			"dispense.status": {"in progress", "dispensed", "abandoned"},
+		},
+		References: map[string][]string{
+			"orderedItem":           {"Medication", "Substance", "Device"},
+			"patient":               {"Patient"},
+			"dispense.suppliedItem": {"Medication", "Substance", "Device"},
+			"dispense.supplier":     {"Practitioner"},
+			"dispense.destination":  {"Location"},
+			"dispense.receiver":     {"Practitioner"},
+		},
+	},
+	"ValueSet": {
+		Required: []string{"name", "description", "status"},
+		Codes: map[string][]string{
+			"status": definitionStatus,
+		},
+	},
+}
+
+// datatypeCodes fixes the allowed values of code elements on data types,
+// wherever those data types appear in a resource.
+var datatypeCodes = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(Address{}): {
+		"use": {"home", "work", "temp", "old"},
+	},
+	reflect.TypeOf(ContactPoint{}): {
+		"system": {"phone", "fax", "email", "url"},
+		"use":    {"home", "work", "temp", "old", "mobile"},
+	},
+	reflect.TypeOf(HumanName{}): {
+		"use": {"usual", "official", "temp", "nickname", "anonymous", "old", "maiden"},
+	},
+	reflect.TypeOf(Identifier{}): {
+		"use": {"usual", "official", "temp", "secondary"},
+	},
+	reflect.TypeOf(Narrative{}): {
+		"status": {"generated", "extensions", "additional", "empty"},
+	},
+	reflect.TypeOf(Quantity{}): {
+		"comparator": {"<", "<=", ">=", ">"},
+	},
+}
+
+// ValidateResource checks a resource against the base rules for its type and
+// returns an issue for every violation. A valid resource yields no issues.
+func ValidateResource(resource interface{}) []OperationOutcomeIssueComponent {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	name := v.Type().Name()
+	rules := ValidationRules[name]
+
+	var issues []OperationOutcomeIssueComponent
+	for _, path := range rules.Required {
+		for _, e := range missingElements(v, name, strings.Split(path, ".")) {
+			issues = append(issues, validationIssue("required", e, "Missing required element "+e))
+		}
+	}
+	for _, path := range sortedKeys(rules.Codes) {
+		for _, e := range findElements(v, name, strings.Split(path, ".")) {
+			issues = append(issues, checkCodes(e, rules.Codes[path])...)
+		}
+	}
+	conceptPaths := make([]string, 0, len(rules.Concepts))
+	for path := range rules.Concepts {
+		conceptPaths = append(conceptPaths, path)
+	}
+	sort.Strings(conceptPaths)
+	for _, path := range conceptPaths {
+		for _, e := range findElements(v, name, strings.Split(path, ".")) {
+			issues = append(issues, checkConcept(e, rules.Concepts[path])...)
+		}
+	}
+	for _, path := range sortedKeys(rules.References) {
+		for _, e := range findElements(v, name, strings.Split(path, ".")) {
+			issues = append(issues, checkReferences(e, rules.References[path])...)
+		}
+	}
+	walkStructs(v, name, func(e element) {
+		for field, codes := range datatypeCodes[e.value.Type()] {
+			for _, c := range findElements(e.value, e.location, []string{field}) {
+				issues = append(issues, checkCodes(c, codes)...)
+			}
+		}
+	})
+	if contained, ok := v.FieldByName("Contained").Interface().([]interface{}); ok {
+		issues = append(issues, validateContained(contained, name)...)
+	}
+	return issues
+}
+
+// validateContained checks each contained resource against the rules for its
+// own type. Issues are located within the container, e.g.
+// "MedicationStatement.contained[0].name".
+func validateContained(contained []interface{}, name string) []OperationOutcomeIssueComponent {
+	var issues []OperationOutcomeIssueComponent
+	for i, c := range contained {
+		location := fmt.Sprintf("%s.contained[%d]", name, i)
+		resource, err := decodeContained(c)
+		if err != nil {
+			issues = append(issues, validationIssue("invalid", location, "Invalid contained resource: "+err.Error()))
+			continue
+		}
+		prefix := reflect.Indirect(reflect.ValueOf(resource)).Type().Name()
+		for _, issue := range ValidateResource(resource) {
+			for j, l := range issue.Location {
+				issue.Location[j] = location + strings.TrimPrefix(l, prefix)
+			}
+			issue.Details = strings.Replace(issue.Details, prefix+".", location+".", -1)
+			issues = append(issues, issue)
+		}
+	}
+	return issues
+}
+
+// decodeContained decodes a contained resource, as held in
+// DomainResource.Contained, into the model for its resourceType.
+func decodeContained(contained interface{}) (interface{}, error) {
+	data, err := json.Marshal(contained)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+	resource, err := NewStructForResourceName(header.ResourceType)
+	if err != nil {
+		return nil, err
+	}
+	return resource, json.Unmarshal(data, resource)
+}
+
+// element is a value found in a resource along with its FHIR location.
+type element struct {
+	value    reflect.Value
+	location string
+}
+
+// findElements returns every non-empty value at path, descending through
+// slices so that each member is returned separately.
+func findElements(v reflect.Value, location string, path []string) []element {
+	v = reflect.Indirect(v)
+	if !v.IsValid() || isEmpty(v) {
+		return nil
+	}
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct {
+		var found []element
+		for i := 0; i < v.Len(); i++ {
+			found = append(found, findElements(v.Index(i), fmt.Sprintf("%s[%d]", location, i), path)...)
+		}
+		return found
+	}
+	if len(path) == 0 {
+		return []element{{v, location}}
+	}
+	child, ok := fieldByElementName(v, path[0])
+	if !ok {
+		return nil
+	}
+	return findElements(child, location+"."+path[0], path[1:])
+}
+
+// missingElements returns the location of every required element that is
+// absent from a present parent.
+func missingElements(v reflect.Value, location string, path []string) []string {
+	parents := []element{{v, location}}
+	if len(path) > 1 {
+		parents = findElements(v, location, path[:len(path)-1])
+	}
+	last := path[len(path)-1]
+	var missing []string
+	for _, p := range parents {
+		for _, e := range expandSlice(p) {
+			child, ok := fieldByElementName(e.value, last)
+			if !ok || isEmpty(child) {
+				missing = append(missing, e.location+"."+last)
+			}
+		}
+	}
+	return missing
+}
+
+func expandSlice(e element) []element {
+	if e.value.Kind() != reflect.Slice {
+		return []element{e}
+	}
+	var found []element
+	for i := 0; i < e.value.Len(); i++ {
+		found = append(found, element{e.value.Index(i), fmt.Sprintf("%s[%d]", e.location, i)})
+	}
+	return found
+}
+
+// WalkElements calls fn with the location and value of every non-empty
+// complex element in a resource, including data types such as Coding, e.g.
+// ("Observation.name.coding[0]", Coding{...}).
+func WalkElements(resource interface{}, fn func(location string, element interface{})) {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	walkStructs(v, v.Type().Name(), func(e element) {
+		fn(e.location, e.value.Interface())
+	})
+}
+
+// ElementsAtPath calls fn with the location and value of every non-empty
+// element at a dotted FHIR path relative to the resource, e.g. "name" or
+// "participant.type".
+func ElementsAtPath(resource interface{}, path string, fn func(location string, element interface{})) {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	for _, e := range findElements(v, v.Type().Name(), strings.Split(path, ".")) {
+		fn(e.location, e.value.Interface())
+	}
+}
+
+// WalkCodings calls fn with the location of, and a pointer to, every non-empty
+// Coding in the resource so that fn can modify it. The resource must be
+// passed as a pointer.
+func WalkCodings(resource interface{}, fn func(location string, coding *Coding)) {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	walkStructs(v, v.Type().Name(), func(e element) {
+		if !e.value.CanAddr() {
+			return
+		}
+		if coding, ok := e.value.Addr().Interface().(*Coding); ok {
+			fn(e.location, coding)
+		}
+	})
+}
+
+// ElementType returns the declared type of the element at a dotted path
+// relative to the struct type t, e.g. "name.coding". Slices and pointers are
+// unwrapped along the path, but not in the returned type.
+func ElementType(t reflect.Type, path string) (reflect.Type, bool) {
+	for _, name := range strings.Split(path, ".") {
+		t = elementBaseType(t)
+		if t.Kind() != reflect.Struct {
+			return nil, false
+		}
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			if elementName(t.Field(i)) == name {
+				t, found = t.Field(i).Type, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return t, true
+}
+
+// Elements returns the FHIR element names of a struct type in field order.
+func Elements(t reflect.Type) []string {
+	t = elementBaseType(t)
+	var names []string
+	for i := 0; t.Kind() == reflect.Struct && i < t.NumField(); i++ {
+		if name := elementName(t.Field(i)); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ReferencePaths returns the dotted path of every Reference element in a
+// struct type, including those nested in backbone elements, e.g.
+// "participant.individual".
+func ReferencePaths(t reflect.Type) []string {
+	return referencePaths(elementBaseType(t), "", make(map[reflect.Type]bool))
+}
+
+func referencePaths(t reflect.Type, prefix string, seen map[reflect.Type]bool) []string {
+	// Stop at types that contain themselves, such as Questionnaire groups
+	if seen[t] {
+		return nil
+	}
+	seen[t] = true
+	defer delete(seen, t)
+
+	var paths []string
+	for _, name := range Elements(t) {
+		elementType, _ := ElementType(t, name)
+		base := elementBaseType(elementType)
+		if base == reflect.TypeOf(Reference{}) {
+			paths = append(paths, prefix+name)
+		} else if base.Kind() == reflect.Struct {
+			paths = append(paths, referencePaths(base, prefix+name+".", seen)...)
+		}
+	}
+	return paths
+}
+
+func elementBaseType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// walkStructs calls fn for every non-empty struct value in the resource.
+func walkStructs(v reflect.Value, location string, fn func(element)) {
+	v = reflect.Indirect(v)
+	switch v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkStructs(v.Index(i), fmt.Sprintf("%s[%d]", location, i), fn)
+		}
+	case reflect.Struct:
+		if isEmpty(v) {
+			return
+		}
+		fn(element{v, location})
+		for i := 0; i < v.NumField(); i++ {
+			if name := elementName(v.Type().Field(i)); name != "" {
+				walkStructs(v.Field(i), location+"."+name, fn)
+			}
+		}
+	}
+}
+
+func checkCodes(e element, codes []string) []OperationOutcomeIssueComponent {
+	var values []string
+	switch e.value.Kind() {
+	case reflect.String:
+		values = []string{e.value.String()}
+	case reflect.Slice:
+		values, _ = e.value.Interface().([]string)
+	}
+	var issues []OperationOutcomeIssueComponent
+	for _, value := range values {
+		if !containsString(codes, value) {
+			details := fmt.Sprintf("Invalid code %q for %s; expected one of: %s", value, e.location, strings.Join(codes, ", "))
+			issues = append(issues, validationIssue("code-unknown", e.location, details))
+		}
+	}
+	return issues
+}
+
+func checkConcept(e element, binding ConceptBinding) []OperationOutcomeIssueComponent {
+	concept, ok := e.value.Interface().(CodeableConcept)
+	if !ok {
+		return nil
+	}
+	var issues []OperationOutcomeIssueComponent
+	for i, coding := range concept.Coding {
+		location := fmt.Sprintf("%s.coding[%d]", e.location, i)
+		codes, ok := binding[coding.System]
+		if !ok {
+			issues = append(issues, validationIssue("code-unknown", location, fmt.Sprintf("Code system %q is not permitted for %s", coding.System, e.location)))
+		} else if !containsString(codes, coding.Code) {
+			details := fmt.Sprintf("Invalid code %q in system %s for %s", coding.Code, coding.System, e.location)
+			issues = append(issues, validationIssue("code-unknown", location, details))
+		}
+	}
+	return issues
+}
+
+func checkReferences(e element, types []string) []OperationOutcomeIssueComponent {
+	var issues []OperationOutcomeIssueComponent
+	for _, r := range expandSlice(e) {
+		ref, ok := r.value.Interface().(Reference)
+		if !ok || ref.Reference == "" || strings.HasPrefix(ref.Reference, "#") {
+			continue
+		}
+		if t := referencedType(ref); !containsString(types, t) {
+			details := fmt.Sprintf("%s must reference one of: %s", r.location, strings.Join(types, ", "))
+			issues = append(issues, validationIssue("invalid", r.location, details))
+		}
+	}
+	return issues
+}
+
+// referencedType determines the resource type that a reference points at.
+func referencedType(ref Reference) string {
+	if t := ParseReference(ref.Reference).Type; t != "" {
+		return t
+	}
+	return ref.Type
+}
+
+func validationIssue(code, location, details string) OperationOutcomeIssueComponent {
+	return OperationOutcomeIssueComponent{
+		Severity: "error",
+		Type:     Coding{System: "http://hl7.org/fhir/issue-type", Code: code},
+		Details:  details,
+		Location: []string{location},
+	}
+}
+
+// fieldByElementName finds the struct field whose BSON name is the given FHIR
+// element name.
+func fieldByElementName(v reflect.Value, name string) (reflect.Value, bool) {
+	v = reflect.Indirect(v)
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, false
+	}
+	for i := 0; i < v.NumField(); i++ {
+		if elementName(v.Type().Field(i)) == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// elementName returns the FHIR element name of a model field, or "" for
+// fields that are not FHIR elements (such as the Mongo id).
+func elementName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("bson"), ",")[0]
+	if name == "_id" || name == "-" || f.PkgPath != "" {
+		return ""
+	}
+	return name
+}
+
+// isEmpty reports whether v holds no data, treating structs as empty when all
+// of their FHIR elements are empty.
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	case reflect.Struct:
+		if t, ok := v.Interface().(time.Time); ok {
+			return t.IsZero()
+		}
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" || strings.HasPrefix(f.Tag.Get("bson"), "_id") {
+				continue
+			}
+			if !isEmpty(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	}
+	return false
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+type ModelsSuite struct{}
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+var _ = check.Suite(&ModelsSuite{})
+
+func (s *ModelsSuite) TestValidationRulePathsExist(c *check.C) {
+	for name, rules := range ValidationRules {
+		resource, err := NewStructForResourceName(name)
+		c.Assert(err, check.IsNil)
+		t := reflect.TypeOf(resource).Elem()
+		paths := append([]string{}, rules.Required...)
+		paths = append(paths, sortedKeys(rules.Codes)...)
+		paths = append(paths, sortedKeys(rules.References)...)
+		for path := range rules.Concepts {
+			paths = append(paths, path)
+		}
+		for _, path := range paths {
+			_, ok := ElementType(t, path)
+			c.Check(ok, check.Equals, true, check.Commentf("%s.%s", name, path))
+		}
+	}
+}
+
+func (s *ModelsSuite) TestValidateObservation(c *check.C) {
+	issues := ValidateResource(&Observation{Subject: Reference{Reference: "Practitioner/1"}})
+	c.Assert(issues, check.HasLen, 4)
+	c.Assert(issues[0].Location, check.DeepEquals, []string{"Observation.name"})
+	c.Assert(issues[0].Type.Code, check.Equals, "required")
+	c.Assert(issues[3].Location, check.DeepEquals, []string{"Observation.subject"})
+	c.Assert(issues[3].Type.Code, check.Equals, "invalid")
+
+	valid := &Observation{
+		Name:        CodeableConcept{Coding: []Coding{{System: "http://loinc.org", Code: "2951-2"}}},
+		Status:      "final",
+		Reliability: "ok",
+		Subject:     Reference{Reference: "Patient/1"},
+	}
+	c.Assert(ValidateResource(valid), check.HasLen, 0)
+}
+
+func (s *ModelsSuite) TestValidatePatientGender(c *check.C) {
+	patient := &Patient{Gender: CodeableConcept{Coding: []Coding{{System: "http://hl7.org/fhir/v3/AdministrativeGender", Code: "X"}}}}
+	issues := ValidateResource(patient)
+	c.Assert(issues, check.HasLen, 1)
+	c.Assert(issues[0].Location, check.DeepEquals, []string{"Patient.gender.coding[0]"})
+
+	patient.Gender.Coding[0].Code = "F"
+	patient.Identifier = []Identifier{{Use: "bogus"}}
+	issues = ValidateResource(patient)
+	c.Assert(issues, check.HasLen, 1)
+	c.Assert(issues[0].Location, check.DeepEquals, []string{"Patient.identifier[0].use"})
+}
+
+func (s *ModelsSuite) TestValidateContained(c *check.C) {
+	observation := &Observation{
+		Name:        CodeableConcept{Coding: []Coding{{System: "http://loinc.org", Code: "2951-2"}}},
+		Status:      "final",
+		Reliability: "ok",
+		Subject:     Reference{Reference: "#p1"},
+	}
+	observation.Contained = []interface{}{
+		map[string]interface{}{"resourceType": "Patient", "id": "p1", "gender": map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": "http://hl7.org/fhir/v3/AdministrativeGender", "code": "X"}}}},
+		map[string]interface{}{"resourceType": "Bogus", "id": "b1"},
+	}
+	issues := ValidateResource(observation)
+	c.Assert(issues, check.HasLen, 2)
+	c.Assert(issues[0].Location, check.DeepEquals, []string{"Observation.contained[0].gender.coding[0]"})
+	c.Assert(issues[0].Details, check.Matches, ".*Observation.contained\\[0\\].gender.*")
+	c.Assert(issues[1].Location, check.DeepEquals, []string{"Observation.contained[1]"})
+}
+
+func (s *ModelsSuite) TestReferencePaths(c *check.C) {
+	paths := ReferencePaths(reflect.TypeOf(Encounter{}))
+	c.Assert(paths, check.Not(check.HasLen), 0)
+	c.Assert(containsString(paths, "subject"), check.Equals, true)
+	c.Assert(containsString(paths, "participant.individual"), check.Equals, true)
+	c.Assert(containsString(paths, "hospitalization.origin"), check.Equals, true)
+
+	// Recursive types such as nested answer groups terminate
+	paths = ReferencePaths(reflect.TypeOf(QuestionnaireAnswers{}))
+	c.Assert(containsString(paths, "subject"), check.Equals, true)
+}
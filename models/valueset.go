@@ -29,6 +29,8 @@ package models
 import "time"
 
 type ValueSet struct {
+	DomainResource `bson:",inline"`
+
 	Id           string                     `json:"-" bson:"_id"`
 	Identifier   string                     `bson:"identifier,omitempty", json:"identifier,omitempty"`
 	Version      string                     `bson:"version,omitempty", json:"version,omitempty"`
@@ -1,14 +1,67 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 
 	"github.com/intervention-engine/fhir/server"
 )
 
 func main() {
+	signingKey := flag.String("signing-key", "", "PEM private key to sign Provenance with")
+	signingCert := flag.String("signing-cert", "", "PEM certificate for the signing key")
+	trustedCerts := flag.String("trusted-certs", "", "Comma separated PEM certificate files to also trust when verifying signatures")
+	authIssuer := flag.String("auth-issuer", "", "Issuer of the bearer tokens to accept")
+	authAudience := flag.String("auth-audience", "", "Audience the bearer tokens must be for")
+	authJWKS := flag.String("auth-jwks", "", "JWKS file of the keys that sign bearer tokens")
+	authKeys := flag.String("auth-keys", "", "Comma separated PEM public key or certificate files of the keys that sign bearer tokens")
+	authAdminScope := flag.String("auth-admin-scope", "admin", "Scope bearer tokens need for the admin routes")
+	allowedOrigins := flag.String("allowed-origins", "", "Comma separated origins whose browser scripts may call the server, or * for any")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated addresses or CIDR ranges of proxies whose X-Forwarded-For headers are believed")
+	mrnSystems := flag.String("mrn-system", "", "Comma separated identifier systems of the medical record numbers that must be unique among patients")
+	flag.Parse()
+
+	if *signingKey != "" {
+		signer, err := server.LoadSigner(*signingKey, *signingCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.ProvenanceSigner = signer
+	}
+	if *trustedCerts != "" {
+		if err := server.LoadCertificates(strings.Split(*trustedCerts, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *allowedOrigins != "" {
+		server.AllowedOrigins = strings.Split(*allowedOrigins, ",")
+	}
+	if *trustedProxies != "" {
+		server.TrustedProxies = strings.Split(*trustedProxies, ",")
+	}
+	if *mrnSystems != "" {
+		server.UniqueIdentifiers["Patient"] = strings.Split(*mrnSystems, ",")
+	}
+
 	s := server.NewServer("localhost")
+	if *authJWKS != "" || *authKeys != "" {
+		s.Authenticator = server.NewAuthenticator(*authIssuer, *authAudience)
+		s.Authenticator.AdminScope = *authAdminScope
+		if *authJWKS != "" {
+			if err := s.Authenticator.LoadJWKS(*authJWKS); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *authKeys != "" {
+			if err := s.Authenticator.LoadPEM(strings.Split(*authKeys, ",")...); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 
 	s.Run()
 }
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"gopkg.in/mgo.v2"
+)
+
+// RegisterAdminRoutes registers the administrative routes for inspecting the
+// delivery queue, replaying dead letters, rebuilding the facts collection and
+// identifier claims, and refreshing Group members.
+func RegisterAdminRoutes(router *mux.Router, config map[string][]negroni.Handler) {
+	router.Path("/admin/deliveries").Methods("GET").Handler(negroni.New(append(config["AdminDeliveries"], negroni.HandlerFunc(DeliveriesIndexHandler))...))
+	router.Path("/admin/deadletters").Methods("GET").Handler(negroni.New(append(config["AdminDeadLetters"], negroni.HandlerFunc(DeadLettersIndexHandler))...))
+	router.Path("/admin/deadletters/replay").Methods("POST").Handler(negroni.New(append(config["AdminReplay"], negroni.HandlerFunc(ReplayDeadLettersHandler))...))
+	router.Path("/admin/deadletters/{id}/replay").Methods("POST").Handler(negroni.New(append(config["AdminReplay"], negroni.HandlerFunc(ReplayDeadLettersHandler))...))
+	router.Path("/admin/facts/rebuild").Methods("POST").Handler(negroni.New(append(config["AdminRebuildFacts"], negroni.HandlerFunc(RebuildFactsHandler))...))
+	router.Path("/admin/identifiers/rebuild").Methods("POST").Handler(negroni.New(append(config["AdminRebuildIdentifiers"], negroni.HandlerFunc(RebuildIdentifiersHandler))...))
+	router.Path("/admin/groups/refresh").Methods("POST").Handler(negroni.New(append(config["AdminRefreshGroups"], negroni.HandlerFunc(RefreshGroupsHandler))...))
+}
+
+// DeliveriesIndexHandler lists the queued deliveries, optionally for the
+// destination given as a parameter.
+func DeliveriesIndexHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	deliveries, err := DefaultDeliveryQueue.Pending(r.URL.Query().Get("destination"))
+	writeDeliveries(rw, deliveries, err)
+}
+
+// DeadLettersIndexHandler lists the deliveries that ran out of attempts,
+// optionally for the destination given as a parameter.
+func DeadLettersIndexHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	deliveries, err := DefaultDeliveryQueue.DeadLetters(r.URL.Query().Get("destination"))
+	writeDeliveries(rw, deliveries, err)
+}
+
+// ReplayDeadLettersHandler puts dead letters back on the queue: the one named
+// in the path, or else every dead letter, or those for the destination given
+// as a parameter. It responds with the replayed deliveries. If a replay fails
+// the ones already replayed stay on the queue, and the error response lists
+// them, so that retrying the request replays only the rest.
+func ReplayDeadLettersHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var deliveries []Delivery
+	if id, ok := mux.Vars(r)["id"]; ok {
+		d := Delivery{}
+		if err := Database.C(DefaultDeliveryQueue.DeadLetterCollection).FindId(id).One(&d); err == mgo.ErrNotFound {
+			WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", "No dead letter with id "+id))
+			return
+		} else if err != nil {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+			return
+		}
+		deliveries = append(deliveries, d)
+	} else {
+		var err error
+		if deliveries, err = DefaultDeliveryQueue.DeadLetters(r.URL.Query().Get("destination")); err != nil {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+			return
+		}
+	}
+
+	var replayed []Delivery
+	for _, d := range deliveries {
+		err := DefaultDeliveryQueue.Replay(d.Id)
+		if err == mgo.ErrNotFound {
+			// Replayed by another request since it was listed
+			continue
+		} else if err != nil {
+			ids := make([]string, len(replayed))
+			for i, r := range replayed {
+				ids[i] = r.Id
+			}
+			details := fmt.Sprintf("Replaying dead letter %s: %s. %d of %d dead letters were replayed before it: %s", d.Id, err, len(replayed), len(deliveries), strings.Join(ids, ", "))
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", details))
+			return
+		}
+		replayed = append(replayed, d)
+	}
+	writeDeliveries(rw, replayed, nil)
+}
+
+func writeDeliveries(rw http.ResponseWriter, deliveries []Delivery, err error) {
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	if deliveries == nil {
+		deliveries = []Delivery{}
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(deliveries)
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// AuditLog writes the SecurityEvents recorded for requests behind the
+// requests, so that they do not wait for the database. Events are buffered
+// and inserted in batches by a single worker, started with Run. When the
+// buffer is full events are written as they are recorded, so none are lost.
+type AuditLog struct {
+	Collection    string
+	BatchSize     int
+	FlushInterval time.Duration
+	events        chan *models.SecurityEvent
+}
+
+// DefaultAuditLog holds the events recorded by AuditHandler. Its events are
+// stored with the other SecurityEvent resources.
+var DefaultAuditLog = NewAuditLog(1000)
+
+// NewAuditLog returns a log stored in the securityevents collection that
+// buffers up to the given number of events, writing up to 100 at a time at
+// least every second.
+func NewAuditLog(buffer int) *AuditLog {
+	return &AuditLog{
+		Collection:    CollectionName("SecurityEvent"),
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		events:        make(chan *models.SecurityEvent, buffer),
+	}
+}
+
+// Record queues an event to be written.
+func (a *AuditLog) Record(event *models.SecurityEvent) {
+	select {
+	case a.events <- event:
+	default:
+		if err := Database.C(a.Collection).Insert(event); err != nil {
+			log.Println("Recording security event:", err)
+		}
+	}
+}
+
+// Run writes the queued events until stop is closed, and then writes those
+// still queued.
+func (a *AuditLog) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(a.FlushInterval)
+	defer ticker.Stop()
+	var batch []interface{}
+	write := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := Database.C(a.Collection).Insert(batch...); err != nil {
+			log.Println("Writing security events:", err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case event := <-a.events:
+			if batch = append(batch, event); len(batch) >= a.BatchSize {
+				write()
+			}
+		case <-ticker.C:
+			write()
+		case <-stop:
+			write()
+			a.Flush()
+			return
+		}
+	}
+}
+
+// Flush writes the queued events and returns once they are written.
+func (a *AuditLog) Flush() {
+	for {
+		select {
+		case event := <-a.events:
+			if err := Database.C(a.Collection).Insert(event); err != nil {
+				log.Println("Writing security events:", err)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// ReadOnlyHandler rejects the request with a 405 response. NewServer puts it
+// in front of the SecurityEvent update and delete routes, so that the audit
+// trail cannot be changed or removed.
+func ReadOnlyHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	rw.Header().Set("Allow", "GET, POST")
+	WriteOperationOutcome(rw, http.StatusMethodNotAllowed, NewOperationOutcomeIssue("not-supported", ResourceTypeFromPath(r.URL.Path)+" resources cannot be updated or deleted"))
+}
+
+var auditActions = map[string]string{
+	"create": "C",
+	"read":   "R",
+	"search": "R",
+	"update": "U",
+	"delete": "D",
+}
+
+var auditLifecycles = map[string]string{
+	"create": "1",
+	"update": "3",
+	"delete": "14",
+}
+
+// AuditHandler records a SecurityEvent in DefaultAuditLog for every request,
+// once it has been handled. The event's subtype is the Action the route set,
+// and its objects are the resources it touched, with the patients whose
+// compartments they are in. It should be the first middleware, and the router
+// must use RouteContextMiddleware so that the route's context is seen here.
+func AuditHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	r, _ = withRequestState(r)
+	next(rw, r)
+	defer context.Clear(r)
+
+	status := http.StatusOK
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() != 0 {
+		status = w.Status()
+	}
+	DefaultAuditLog.Record(NewSecurityEvent(r, status, time.Now()))
+}
+
+// NewSecurityEvent describes a handled request as a SecurityEvent.
+func NewSecurityEvent(r *http.Request, status int, when time.Time) *models.SecurityEvent {
+	action, _ := requestValue(r, "Action").(string)
+	action = strings.ToLower(action)
+	event := &models.SecurityEvent{Id: bson.NewObjectId().Hex(), Event: models.SecurityEventEventComponent{
+		Type:        models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/security-event-type", Code: "rest", Display: "RESTful Operation"}}},
+		Action:      "E",
+		DateTime:    models.FHIRDateTime{Time: when, Precision: models.Timestamp},
+		Outcome:     "0",
+		OutcomeDesc: r.Method + " " + r.URL.RequestURI() + ": " + http.StatusText(status),
+	}}
+	if code, ok := auditActions[action]; ok {
+		event.Event.Action = code
+	}
+	if action != "" {
+		event.Event.Subtype = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://hl7.org/fhir/restful-interaction", Code: action}}}}
+	}
+	switch {
+	case status >= http.StatusInternalServerError:
+		event.Event.Outcome = "8"
+	case status >= http.StatusBadRequest:
+		event.Event.Outcome = "4"
+	}
+
+	requestor := true
+	participant := models.SecurityEventParticipantComponent{Requestor: &requestor}
+	if principal := RequestPrincipal(r); principal != nil {
+		participant.UserId = principal.Subject
+	} else {
+		participant.UserId, _, _ = r.BasicAuth()
+	}
+	participant.Network = models.SecurityEventParticipantNetworkComponent{Identifier: clientAddress(r), Type: "2"}
+	event.Participant = []models.SecurityEventParticipantComponent{participant}
+
+	host, _ := os.Hostname()
+	event.Source = models.SecurityEventSourceComponent{
+		Site:       host,
+		Identifier: models.BaseURL,
+		Type:       []models.Coding{{System: "http://hl7.org/fhir/security-source-type", Code: "4", Display: "Application Server"}},
+	}
+
+	event.Object = auditObjects(r, action)
+	return event
+}
+
+// TrustedProxies lists the proxies, by address or CIDR range, whose
+// X-Forwarded-For headers are believed. The header is ignored on requests
+// from anywhere else, since any client can send one.
+var TrustedProxies []string
+
+// clientAddress returns the address of the client that made a request. If the
+// request came through trusted proxies, it is the last address in the
+// X-Forwarded-For header that is not a trusted proxy.
+func clientAddress(r *http.Request) string {
+	address := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		address = host
+	}
+	if !trustedProxy(address) {
+		return address
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		if address = hop; !trustedProxy(hop) {
+			break
+		}
+	}
+	return address
+}
+
+// trustedProxy reports whether an address is one of the TrustedProxies.
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// auditObjects describes the resources a request touched, from the resource
+// or resources the route put in the context, or else the id in its URL.
+// Patients whose compartments the resources are in are added, and a search's
+// query is recorded too.
+func auditObjects(r *http.Request, action string) []models.SecurityEventObjectComponent {
+	resourceType, _ := requestValue(r, "Resource").(string)
+	lifecycle := auditLifecycles[action]
+	if lifecycle == "" {
+		lifecycle = "6"
+	}
+
+	var objects []models.SecurityEventObjectComponent
+	seen := make(map[string]bool)
+	add := func(object models.SecurityEventObjectComponent) {
+		if !seen[object.Reference.Reference] {
+			seen[object.Reference.Reference] = true
+			objects = append(objects, object)
+		}
+	}
+	addResource := func(id string, resource interface{}) {
+		if id == "" {
+			return
+		}
+		for _, object := range resourceAuditObjects(resourceType, id, resource, lifecycle) {
+			add(object)
+		}
+	}
+
+	if resourceType != "" {
+		switch value := reflect.ValueOf(requestValue(r, resourceType)); value.Kind() {
+		case reflect.String:
+			addResource(value.String(), nil)
+		case reflect.Slice:
+			for i := 0; i < value.Len(); i++ {
+				resource := value.Index(i).Interface()
+				addResource(resourceId(resource), resource)
+			}
+		case reflect.Ptr, reflect.Struct:
+			resource := value.Interface()
+			addResource(resourceId(resource), resource)
+		}
+		if len(objects) == 0 {
+			addResource(requestVars(r)["id"], nil)
+		}
+	}
+	if compartment, ok := requestValue(r, "Compartment").(string); ok && strings.HasPrefix(compartment, "Patient/") {
+		add(patientAuditObject(compartment, lifecycle))
+	}
+	if action == "search" && r.URL.RawQuery != "" {
+		objects = append(objects, models.SecurityEventObjectComponent{
+			Type:      "2",
+			Role:      "24",
+			Lifecycle: lifecycle,
+			Query:     base64.StdEncoding.EncodeToString([]byte(r.URL.RawQuery)),
+		})
+	}
+	return objects
+}
+
+// resourceAuditObjects describes a resource, and the patients whose
+// compartments it is in if it is given, as SecurityEvent objects.
+func resourceAuditObjects(resourceType, id string, resource interface{}, lifecycle string) []models.SecurityEventObjectComponent {
+	if resourceType == "Patient" {
+		return []models.SecurityEventObjectComponent{patientAuditObject("Patient/"+id, lifecycle)}
+	}
+	objects := []models.SecurityEventObjectComponent{{
+		Reference: models.Reference{Reference: resourceType + "/" + id},
+		Type:      "2",
+		Role:      "4",
+		Lifecycle: lifecycle,
+	}}
+	if resource != nil {
+		for _, patient := range PatientCompartment.Ids(resourceType, resource) {
+			objects = append(objects, patientAuditObject("Patient/"+patient, lifecycle))
+		}
+	}
+	return objects
+}
+
+func patientAuditObject(reference, lifecycle string) models.SecurityEventObjectComponent {
+	return models.SecurityEventObjectComponent{Reference: models.Reference{Reference: reference}, Type: "1", Role: "1", Lifecycle: lifecycle}
+}
+
+// serverSecurityEvent describes a change the server made to a resource while
+// handling a request, such as a cascaded delete, as a SecurityEvent.
+func serverSecurityEvent(r *http.Request, action, resourceType, id string, resource interface{}) *models.SecurityEvent {
+	event := NewSecurityEvent(r, http.StatusOK, time.Now())
+	event.Event.Action = auditActions[action]
+	event.Event.Subtype = []models.CodeableConcept{{Coding: []models.Coding{{System: "http://hl7.org/fhir/restful-interaction", Code: action}}}}
+	event.Object = resourceAuditObjects(resourceType, id, resource, auditLifecycles[action])
+	return event
+}
@@ -0,0 +1,414 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// Authenticator validates the bearer tokens sent with requests: JSON Web
+// Tokens signed with RS256 or ES256 by one of its keys, issued by Issuer for
+// Audience, and current to within Leeway. Keys are loaded from a JWKS file
+// with LoadJWKS or from PEM files with LoadPEM. The token's scopes must allow
+// the request, and the /admin routes need AdminScope.
+type Authenticator struct {
+	Issuer     string
+	Audience   string
+	Realm      string
+	Leeway     time.Duration
+	AdminScope string
+	keys       []authenticationKey
+}
+
+// authenticationKey is a key that tokens may be signed with. Keys from a JWKS
+// have the id tokens name them by; keys from PEM files have none.
+type authenticationKey struct {
+	Id  string
+	Key crypto.PublicKey
+}
+
+// Principal is who a request was made by, from its token.
+type Principal struct {
+	Subject string
+	Issuer  string
+	Scopes  []string
+	Expires time.Time
+}
+
+// NewAuthenticator returns an authenticator, without keys, that accepts tokens
+// from the issuer for the audience, allowing a minute of clock skew. The
+// admin routes need the "admin" scope.
+func NewAuthenticator(issuer, audience string) *Authenticator {
+	return &Authenticator{Issuer: issuer, Audience: audience, Realm: "fhir", Leeway: time.Minute, AdminScope: "admin"}
+}
+
+// LoadJWKS adds the signing keys in a JSON Web Key Set file: RSA keys and
+// P-256 EC keys whose use, if given, is "sig".
+func (a *Authenticator) LoadJWKS(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("%s is not a JWKS: %s", file, err)
+	}
+	loaded := 0
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		var key crypto.PublicKey
+		switch {
+		case jwk.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 {
+				return fmt.Errorf("%s has an invalid RSA key %q", file, jwk.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if errX != nil || errY != nil {
+				return fmt.Errorf("%s has an invalid EC key %q", file, jwk.Kid)
+			}
+			key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		default:
+			continue
+		}
+		a.keys = append(a.keys, authenticationKey{Id: jwk.Kid, Key: key})
+		loaded++
+	}
+	if loaded == 0 {
+		return fmt.Errorf("%s holds no usable signing keys", file)
+	}
+	return nil
+}
+
+// LoadPEM adds the public keys, or the keys of the certificates, in PEM
+// files.
+func (a *Authenticator) LoadPEM(files ...string) error {
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		loaded := 0
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			var key crypto.PublicKey
+			switch block.Type {
+			case "PUBLIC KEY":
+				key, err = x509.ParsePKIXPublicKey(block.Bytes)
+			case "CERTIFICATE":
+				var cert *x509.Certificate
+				if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+					key = cert.PublicKey
+				}
+			default:
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if signatureAlgorithm(key) == "" {
+				return fmt.Errorf("%s holds an unsupported kind of key", file)
+			}
+			a.keys = append(a.keys, authenticationKey{Key: key})
+			loaded++
+		}
+		if loaded == 0 {
+			return fmt.Errorf("%s holds no public keys", file)
+		}
+	}
+	return nil
+}
+
+// Errors returned by Authenticate.
+var (
+	ErrTokenMissing = errors.New("Bearer token required")
+	ErrTokenExpired = errors.New("Token has expired")
+)
+
+// Authenticate validates a token, returning who it was issued to.
+func (a *Authenticator) Authenticate(token string, now time.Time) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Token is not a JWT")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyId     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Token signature is malformed")
+	}
+	verified := false
+	for _, key := range a.keys {
+		if header.KeyId != "" && key.Id != "" && key.Id != header.KeyId {
+			continue
+		}
+		if verifyJWS(key.Key, header.Algorithm, parts[0]+"."+parts[1], sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("Token signature is not valid")
+	}
+
+	var claims struct {
+		Issuer    string          `json:"iss"`
+		Subject   string          `json:"sub"`
+		Audience  json.RawMessage `json:"aud"`
+		Expires   float64         `json:"exp"`
+		NotBefore float64         `json:"nbf"`
+		Scope     string          `json:"scope"`
+		ClientId  string          `json:"client_id"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != a.Issuer {
+		return nil, fmt.Errorf("Token was not issued by %s", a.Issuer)
+	}
+	if !hasAudience(claims.Audience, a.Audience) {
+		return nil, fmt.Errorf("Token is not for %s", a.Audience)
+	}
+	if claims.Expires == 0 {
+		return nil, errors.New("Token has no expiry")
+	}
+	expires := time.Unix(int64(claims.Expires), 0)
+	if now.After(expires.Add(a.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(a.Leeway).Before(time.Unix(int64(claims.NotBefore), 0)) {
+		return nil, errors.New("Token is not valid yet")
+	}
+
+	principal := &Principal{Subject: claims.Subject, Issuer: claims.Issuer, Scopes: strings.Fields(claims.Scope), Expires: expires}
+	if principal.Subject == "" {
+		principal.Subject = claims.ClientId
+	}
+	return principal, nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("Token is malformed")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("Token is malformed")
+	}
+	return nil
+}
+
+// hasAudience reports whether an aud claim, a string or an array of strings,
+// includes the audience.
+func hasAudience(claim json.RawMessage, audience string) bool {
+	var one string
+	if json.Unmarshal(claim, &one) == nil {
+		return one == audience
+	}
+	var many []string
+	if json.Unmarshal(claim, &many) == nil {
+		for _, aud := range many {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handler authenticates each request by its bearer token, and checks that the
+// token's scopes allow it. Requests without a valid token are rejected with a
+// 401, and those it does not allow with a 403, each with a WWW-Authenticate
+// challenge. The Principal is put in the request's context, where
+// RequestPrincipal finds it.
+func (a *Authenticator) Handler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var principal *Principal
+	err := ErrTokenMissing
+	if token := requestToken(r); token != "" {
+		principal, err = a.Authenticate(token, time.Now())
+	}
+	if err != nil {
+		challenge := fmt.Sprintf("Bearer realm=%q", a.Realm)
+		issue := NewOperationOutcomeIssue("login", err.Error())
+		if err != ErrTokenMissing {
+			challenge += fmt.Sprintf(", error=\"invalid_token\", error_description=%q", err.Error())
+			issue.Type.Code = "security"
+			if err == ErrTokenExpired {
+				issue.Type.Code = "expired"
+			}
+		}
+		rw.Header().Set("WWW-Authenticate", challenge)
+		WriteOperationOutcome(rw, http.StatusUnauthorized, issue)
+		return
+	}
+	if !a.Allows(principal, r.Method, r.URL.Path) {
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\"", a.Realm))
+		WriteOperationOutcome(rw, http.StatusForbidden, NewOperationOutcomeIssue("forbidden", "The token's scopes do not allow "+r.Method+" "+r.URL.Path))
+		return
+	}
+
+	r, state := withRequestState(r)
+	state.Principal = principal
+	next(rw, r)
+}
+
+// requestToken returns the bearer token sent in a request's Authorization
+// header. Browsers cannot set headers on websocket connections, so a
+// websocket upgrade may instead send the token as the subprotocol following
+// "bearer", as in new WebSocket(url, ["bearer", token]).
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		protocols := websocket.Subprotocols(r)
+		for i := 0; i+1 < len(protocols); i++ {
+			if protocols[i] == "bearer" {
+				return protocols[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// RequestPrincipal returns who made a request, as authenticated by
+// Authenticator.Handler, or nil.
+func RequestPrincipal(r *http.Request) *Principal {
+	if state := getRequestState(r); state != nil {
+		return state.Principal
+	}
+	return nil
+}
+
+// writeOperations are the operations that change resources, and so need
+// write access even though they could be made by a read.
+var writeOperations = map[string]bool{
+	"$merge":   true,
+	"$unmerge": true,
+	"$refresh": true,
+	"$execute": true,
+}
+
+// Allows reports whether a principal's scopes allow a request. Requests for
+// resources need a SMART user or system scope for the resource type, such as
+// "user/Observation.read" or "system/*.*": GET requests and operations that
+// only read need read access, and others write access. Compartment searches,
+// such as /Patient/{id}/Observation, need read access to both types, and
+// /Patient/{id}/* and $everything to every type. $disclosures reads the
+// SecurityEvents about a patient, and so also needs read access to them. The
+// /admin routes need AdminScope, and the
+// websocket needs read access to Subscriptions; other routes are open to
+// anyone authenticated. Patient scopes are not honored, since requests are
+// not limited to the patient's compartment.
+func (a *Authenticator) Allows(principal *Principal, method, path string) bool {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	switch segments[0] {
+	case "admin":
+		return a.AdminScope != "" && principal.HasScope(a.AdminScope)
+	case "websocket":
+		return principal.Allows("Subscription", "read")
+	}
+
+	access := "write"
+	if method == "GET" || method == "HEAD" {
+		access = "read"
+	}
+	var types []string
+	if isResourceName(segments[0]) {
+		types = append(types, segments[0])
+	}
+	for _, segment := range segments[1:] {
+		switch {
+		case segment == "$everything" || segment == "*":
+			types = []string{"*"}
+			access = "read"
+		case segment == "$disclosures":
+			types = append(types, "SecurityEvent")
+			access = "read"
+		case strings.HasPrefix(segment, "$"):
+			if !writeOperations[segment] {
+				access = "read"
+			}
+		case isResourceName(segment):
+			types = append(types, segment)
+			access = "read"
+		}
+	}
+	for _, resourceType := range types {
+		if !principal.Allows(resourceType, access) {
+			return false
+		}
+	}
+	return true
+}
+
+func isResourceName(name string) bool {
+	_, err := models.NewStructForResourceName(name)
+	return err == nil
+}
+
+// HasScope reports whether the principal was granted a scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the principal's user or system scopes give read or
+// write access to a resource type. The type "*" needs a scope for every type.
+func (p *Principal) Allows(resourceType, access string) bool {
+	for _, scope := range p.Scopes {
+		slash, dot := strings.Index(scope, "/"), strings.LastIndex(scope, ".")
+		if slash < 0 || dot < slash {
+			continue
+		}
+		if context := scope[:slash]; context != "user" && context != "system" {
+			continue
+		}
+		scopeType, scopeAccess := scope[slash+1:dot], scope[dot+1:]
+		if (scopeType == "*" || scopeType == resourceType) && (scopeAccess == "*" || scopeAccess == access) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+)
+
+// CanonicalReadHandler serves GET /{type}/{id}?_format=canonical, which reads
+// a resource in the canonical JSON form made by models.CanonicalJSON. With
+// _summary=data the narrative is left out.
+func CanonicalReadHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resourceType := ResourceTypeFromPath(r.URL.Path)
+	context.Set(r, "Action", "read")
+	context.Set(r, "Resource", resourceType)
+
+	resource, err := models.NewStructForResourceName(resourceType)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	err = Database.C(CollectionName(resourceType)).FindId(mux.Vars(r)["id"]).One(resource)
+	if err == mgo.ErrNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", resourceType+" not found"))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	context.Set(r, resourceType, resource)
+
+	data, err := models.CanonicalJSON(resource, models.CanonicalOptions{OmitNarrative: r.URL.Query().Get("_summary") == "data"})
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if _, err := rw.Write(data); err != nil {
+		log.Println("Writing canonical resource:", err)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// PatientCohortHandler implements the $cohort operation, which counts the
+// patients matching the PatientFilter posted as the request body. The result
+// is a Parameters resource with the total and, if a count parameter is given,
+// a page of patient references starting at offset.
+func PatientCohortHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "cohort")
+	context.Set(r, "Resource", "Patient")
+
+	filter := &PatientFilter{}
+	if err := json.NewDecoder(r.Body).Decode(filter); err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	query := r.URL.Query()
+	offset, err := optionalInt(query.Get("offset"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid offset: "+err.Error()))
+		return
+	}
+	count, err := optionalInt(query.Get("count"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count: "+err.Error()))
+		return
+	}
+
+	patients, err := FindPatients(filter)
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+
+	total := len(patients)
+	params := models.NewParameters().Add(models.ParametersParameterComponent{Name: "total", ValueInteger: &total})
+	ids := patients.Ids()
+	for i := offset; i < len(ids) && i < offset+count; i++ {
+		params.Add(models.ParametersParameterComponent{Name: "patient", ValueUri: "Patient/" + ids[i]})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(params)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"sort"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Compartment defines which resources belong to the compartment of a
+// resource, such as a patient. A resource of one of the listed types is in
+// the compartment of each resource of the compartment's type that any of the
+// listed Reference elements refers to. The compartment's own resource is also
+// in its compartment.
+type Compartment struct {
+	Type string
+	// Resources gives the paths of the Reference elements that place a
+	// resource of each type in the compartment.
+	Resources map[string][]string
+}
+
+// PatientCompartment holds the resources that make up a patient's record.
+var PatientCompartment = &Compartment{
+	Type: "Patient",
+	Resources: map[string][]string{
+		"AdverseReaction":            {"subject"},
+		"Alert":                      {"subject"},
+		"AllergyIntolerance":         {"subject"},
+		"Appointment":                {"participant.actor"},
+		"AppointmentResponse":        {"individual"},
+		"CarePlan":                   {"patient", "participant.member"},
+		"Composition":                {"subject", "author", "attester.party"},
+		"Condition":                  {"subject"},
+		"Contraindication":           {"patient"},
+		"Device":                     {"patient"},
+		"DeviceObservationReport":    {"subject"},
+		"DiagnosticOrder":            {"subject"},
+		"DiagnosticReport":           {"subject"},
+		"DocumentManifest":           {"subject", "author", "recipient"},
+		"DocumentReference":          {"subject", "author"},
+		"Encounter":                  {"subject"},
+		"FamilyHistory":              {"subject"},
+		"ImagingStudy":               {"subject"},
+		"Immunization":               {"subject"},
+		"ImmunizationRecommendation": {"subject"},
+		"List":                       {"subject", "source"},
+		"Media":                      {"subject"},
+		"MedicationAdministration":   {"patient"},
+		"MedicationDispense":         {"patient"},
+		"MedicationPrescription":     {"patient"},
+		"MedicationStatement":        {"patient"},
+		"NutritionOrder":             {"subject"},
+		"Observation":                {"subject", "performer"},
+		"Order":                      {"subject"},
+		"Other":                      {"subject"},
+		"Procedure":                  {"subject"},
+		"Provenance":                 {"target"},
+		"QuestionnaireAnswers":       {"subject", "author", "source"},
+		"ReferralRequest":            {"subject"},
+		"RelatedPerson":              {"patient"},
+		"RiskAssessment":             {"subject"},
+		"Specimen":                   {"subject"},
+		"Supply":                     {"patient"},
+	},
+}
+
+// Compartments holds the compartments that can be searched with URLs such as
+// /Patient/1234/Observation, by compartment type.
+var Compartments = map[string]*Compartment{
+	"Patient": PatientCompartment,
+}
+
+type resourceKey struct {
+	Type, Id string
+}
+
+// Types returns the compartment's type followed by the types of the
+// resources that can be in the compartment, in alphabetical order.
+func (c *Compartment) Types() []string {
+	types := make([]string, 0, len(c.Resources))
+	for resourceType := range c.Resources {
+		types = append(types, resourceType)
+	}
+	sort.Strings(types)
+	return append([]string{c.Type}, types...)
+}
+
+// Includes reports whether resources of a type can be in the compartment.
+func (c *Compartment) Includes(resourceType string) bool {
+	_, ok := c.Resources[resourceType]
+	return ok || resourceType == c.Type
+}
+
+// Query returns a query for the resources of a type in the compartment of the
+// resource with the given id. It returns nil if the type cannot be in the
+// compartment. Only local references place a resource in the compartment, so
+// a reference to a patient on another server with the same id does not.
+func (c *Compartment) Query(resourceType, id string) bson.M {
+	if resourceType == c.Type {
+		return bson.M{"_id": id}
+	}
+	var clauses []bson.M
+	for _, path := range c.Resources[resourceType] {
+		clauses = append(clauses, localReferenceClause(path, c.Type+"/"+id))
+	}
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		return clauses[0]
+	}
+	return bson.M{"$or": clauses}
+}
+
+// Ids returns the ids of the compartments that a resource is in, in the
+// order they are found. The resource must be of the given type.
+func (c *Compartment) Ids(resourceType string, resource interface{}) []string {
+	if resourceType == c.Type {
+		return []string{resourceId(resource)}
+	}
+	var ids []string
+	seen := make(map[string]bool)
+	for _, path := range c.Resources[resourceType] {
+		models.ElementsAtPath(resource, path, func(location string, element interface{}) {
+			ref, ok := element.(models.Reference)
+			if !ok {
+				return
+			}
+			if key := referenceKey(ref); key.Type == c.Type && !seen[key.Id] {
+				seen[key.Id] = true
+				ids = append(ids, key.Id)
+			}
+		})
+	}
+	return ids
+}
+
+// Contains reports whether a resource of the given type is in the
+// compartment of the resource with the given id.
+func (c *Compartment) Contains(resourceType string, resource interface{}, id string) bool {
+	for _, found := range c.Ids(resourceType, resource) {
+		if found == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Search finds the resources of the given types in the compartment of the
+// resource with the given id, ordered by type and id. If restrict is not nil
+// it is called for each type, and the query it returns, if any, must also be
+// matched.
+func (c *Compartment) Search(id string, resourceTypes []string, restrict func(resourceType string) (bson.M, error)) ([]resourceKey, error) {
+	var keys []resourceKey
+	for _, resourceType := range resourceTypes {
+		query := c.Query(resourceType, id)
+		if query == nil {
+			continue
+		}
+		if restrict != nil {
+			extra, err := restrict(resourceType)
+			if err != nil {
+				return nil, err
+			}
+			if len(extra) > 0 {
+				query = bson.M{"$and": []bson.M{query, extra}}
+			}
+		}
+		var ids []struct {
+			Id string `bson:"_id"`
+		}
+		if err := Database.C(CollectionName(resourceType)).Find(query).Select(bson.M{"_id": 1}).Sort("_id").All(&ids); err != nil {
+			return nil, err
+		}
+		for _, doc := range ids {
+			keys = append(keys, resourceKey{resourceType, doc.Id})
+		}
+	}
+	return keys, nil
+}
+
+// pageKeys returns the keys on a page. A count of zero means all of them.
+func pageKeys(keys []resourceKey, offset, count int) []resourceKey {
+	if offset >= len(keys) {
+		return nil
+	}
+	keys = keys[offset:]
+	if count > 0 && len(keys) > count {
+		keys = keys[:count]
+	}
+	return keys
+}
+
+// bundleEntries returns an entry for each of the keys whose resource was
+// loaded.
+func bundleEntries(keys []resourceKey, resources map[resourceKey]interface{}) []models.BundleEntry {
+	var entries []models.BundleEntry
+	for _, key := range keys {
+		if resource, ok := resources[key]; ok {
+			entries = append(entries, models.BundleEntry{Title: key.Type + " " + key.Id, Id: key.Type + "/" + key.Id, Content: resource})
+		}
+	}
+	return entries
+}
+
+// loadResources fetches resources by type and id. Resources that no longer
+// exist are left out.
+func loadResources(keys []resourceKey) (map[resourceKey]interface{}, error) {
+	byType := make(map[string][]string)
+	for _, key := range keys {
+		byType[key.Type] = append(byType[key.Type], key.Id)
+	}
+	types := make([]string, 0, len(byType))
+	for resourceType := range byType {
+		types = append(types, resourceType)
+	}
+	sort.Strings(types)
+
+	resources := make(map[resourceKey]interface{})
+	for _, resourceType := range types {
+		resource, err := models.NewStructForResourceName(resourceType)
+		if err != nil {
+			continue
+		}
+		iter := Database.C(CollectionName(resourceType)).Find(bson.M{"_id": bson.M{"$in": byType[resourceType]}}).Iter()
+		for iter.Next(resource) {
+			resources[resourceKey{resourceType, resourceId(resource)}] = resource
+			resource, _ = models.NewStructForResourceName(resourceType)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return resources, nil
+}
+
+// referenceKey returns the type and id of the stored resource a reference
+// such as "Practitioner/1234" points at. It returns an empty key for external
+// and contained references, which do not point at stored resources.
+func referenceKey(ref models.Reference) resourceKey {
+	parsed := models.ParseReference(ref.Reference)
+	switch {
+	case parsed.External || parsed.Contained != "" || (ref.External != nil && *ref.External):
+		return resourceKey{}
+	case parsed.Type != "":
+		return resourceKey{parsed.Type, parsed.Id}
+	}
+	return resourceKey{ref.Type, referenceId(ref)}
+}
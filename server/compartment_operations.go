@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CompartmentSearchHandler searches a compartment, as in
+// /Patient/1234/Observation?name=http://loinc.org|2951-2. The search
+// parameters are those of BuildSearchQuery. A type of * searches every type
+// in the compartment, and then only _since may restrict the search. The
+// _offset and _count parameters select the page of the resulting bundle,
+// which holds resources in order of type and id.
+func CompartmentSearchHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	vars := mux.Vars(r)
+	compartment, ok := Compartments[vars["compartment"]]
+	if !ok {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", "Unknown compartment "+vars["compartment"]))
+		return
+	}
+	resourceType, id := vars["type"], vars["id"]
+	context.Set(r, "Action", "search")
+	context.Set(r, "Resource", resourceType)
+	context.Set(r, "Compartment", compartment.Type+"/"+id)
+
+	types := []string{resourceType}
+	if resourceType == "*" {
+		types = compartment.Types()
+	} else if !compartment.Includes(resourceType) {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", resourceType+" resources are not in the "+compartment.Type+" compartment"))
+		return
+	}
+	if n, err := Database.C(CollectionName(compartment.Type)).FindId(id).Count(); err != nil || n == 0 {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", compartment.Type+" "+id+" not found"))
+		return
+	}
+
+	params := r.URL.Query()
+	offset, err := optionalInt(params.Get("_offset"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid _offset: "+err.Error()))
+		return
+	}
+	count, err := optionalInt(params.Get("_count"), EverythingPageSize)
+	if err != nil || count == 0 {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid _count"))
+		return
+	}
+	var since bson.M
+	if value := params.Get("_since"); value != "" {
+		t, _, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid _since: "+err.Error()))
+			return
+		}
+		since = sinceClause(t)
+	}
+	if resourceType == "*" {
+		for name := range params {
+			if !strings.HasPrefix(name, "_") {
+				WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("not-supported", "Search parameters cannot be used when searching every type"))
+				return
+			}
+		}
+	}
+
+	keys, err := compartment.Search(id, types, func(resourceType string) (bson.M, error) {
+		query, err := BuildSearchQuery(resourceType, params)
+		if err != nil || since == nil {
+			return query, err
+		}
+		return bson.M{"$and": []bson.M{query, since}}, nil
+	})
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+
+	bundle := &models.Bundle{Type: "Bundle", Title: "Search of " + compartment.Type + " " + id, Id: bson.NewObjectId().Hex(), Updated: time.Now(), TotalResults: len(keys)}
+	keys = pageKeys(keys, offset, count)
+	resources, err := loadResources(keys)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	bundle.Entry = bundleEntries(keys, resources)
+	bundle.Link = pageLinks(r.URL, "_offset", "_count", offset, count, bundle.TotalResults)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(bundle)
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TranslateRequest describes a code to translate through ConceptMaps.
+type TranslateRequest struct {
+	// System and Code identify the code to translate.
+	System string
+	Code   string
+	// Source and Target optionally restrict the maps used to those whose
+	// source or target is the given ValueSet identifier, URI or reference.
+	Source string
+	Target string
+	// Reverse translates from a map's targets back to its sources.
+	Reverse bool
+	// DependsOn supplies the values of other elements that mappings may
+	// depend on. A mapping with dependencies only applies if every one of
+	// them is satisfied by a supplied value.
+	DependsOn []models.OtherElementComponent
+}
+
+// Translation is a single match found by translating a code.
+type Translation struct {
+	System      string
+	Code        string
+	Equivalence string
+	Comments    string
+	// Product lists other elements that the mapping also produces.
+	Product []models.OtherElementComponent
+	// ConceptMap is the id of the map the match came from.
+	ConceptMap string
+}
+
+// reverseEquivalence gives the equivalence of a mapping when it is followed
+// from target to source.
+var reverseEquivalence = map[string]string{
+	"wider":       "narrower",
+	"narrower":    "wider",
+	"subsumes":    "specialises",
+	"specialises": "subsumes",
+}
+
+// Translate translates a code using every stored ConceptMap that applies to
+// it. It is the in-process equivalent of the $translate operation.
+func Translate(req TranslateRequest) ([]Translation, error) {
+	var maps []models.ConceptMap
+	if err := Database.C("conceptmaps").Find(conceptMapQuery(req)).All(&maps); err != nil {
+		return nil, err
+	}
+
+	var translations []Translation
+	for i := range maps {
+		if conceptMapApplies(&maps[i], req) {
+			translations = append(translations, TranslateWithConceptMap(&maps[i], req)...)
+		}
+	}
+	return translations, nil
+}
+
+// TranslateWithConceptMap translates a code using a single ConceptMap,
+// ignoring the request's Source and Target.
+func TranslateWithConceptMap(cm *models.ConceptMap, req TranslateRequest) []Translation {
+	var translations []Translation
+	for _, element := range cm.Element {
+		for _, m := range element.Map {
+			if !req.Reverse && codeMatches(req, element.CodeSystem, element.Code) && dependenciesSatisfied(element.DependsOn, req.DependsOn) {
+				translations = append(translations, Translation{
+					System:      m.CodeSystem,
+					Code:        m.Code,
+					Equivalence: m.Equivalence,
+					Comments:    m.Comments,
+					Product:     m.Product,
+					ConceptMap:  cm.Id,
+				})
+			}
+			// In reverse the map's products become dependencies and the
+			// element's dependencies become products.
+			if req.Reverse && codeMatches(req, m.CodeSystem, m.Code) && dependenciesSatisfied(m.Product, req.DependsOn) {
+				equivalence := m.Equivalence
+				if reversed, ok := reverseEquivalence[equivalence]; ok {
+					equivalence = reversed
+				}
+				translations = append(translations, Translation{
+					System:      element.CodeSystem,
+					Code:        element.Code,
+					Equivalence: equivalence,
+					Comments:    m.Comments,
+					Product:     element.DependsOn,
+					ConceptMap:  cm.Id,
+				})
+			}
+		}
+	}
+	return translations
+}
+
+// conceptMapQuery finds the maps that mention the code being translated, on
+// the source side or, in reverse, on the target side.
+func conceptMapQuery(req TranslateRequest) bson.M {
+	field := "element"
+	if req.Reverse {
+		field = "element.map"
+	}
+	match := bson.M{"code": req.Code}
+	if req.System != "" {
+		match["codeSystem"] = req.System
+	}
+	return bson.M{field: bson.M{"$elemMatch": match}}
+}
+
+// conceptMapApplies checks the request's source and target restrictions, which
+// swap sides when translating in reverse.
+func conceptMapApplies(cm *models.ConceptMap, req TranslateRequest) bool {
+	source, target := req.Source, req.Target
+	if req.Reverse {
+		source, target = target, source
+	}
+	return conceptMapSideMatches(cm.SourceUri, cm.SourceReference, source) && conceptMapSideMatches(cm.TargetUri, cm.TargetReference, target)
+}
+
+func conceptMapSideMatches(uri string, ref models.Reference, want string) bool {
+	if want == "" {
+		return true
+	}
+	return uri == want || ref.Reference == want || (ref.Reference != "" && strings.HasSuffix(want, "/"+ref.Reference))
+}
+
+func codeMatches(req TranslateRequest, system, code string) bool {
+	return code == req.Code && (req.System == "" || system == req.System)
+}
+
+func dependenciesSatisfied(required, supplied []models.OtherElementComponent) bool {
+	for _, dependency := range required {
+		satisfied := false
+		for _, s := range supplied {
+			if s.Element == dependency.Element && s.Code == dependency.Code && (s.CodeSystem == "" || s.CodeSystem == dependency.CodeSystem) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			return false
+		}
+	}
+	return true
+}
+
+// ConceptMapTranslateHandler implements the $translate operation, on a single
+// ConceptMap instance or on every stored ConceptMap. It takes system and code
+// parameters, optional source and target ValueSets, reverse=true to translate
+// from target to source, and any number of dependsOn parameters in the form
+// element|system|code. The matches are returned in a Parameters resource.
+func ConceptMapTranslateHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "translate")
+	context.Set(r, "Resource", "ConceptMap")
+
+	query := r.URL.Query()
+	req := TranslateRequest{
+		System:  query.Get("system"),
+		Code:    query.Get("code"),
+		Source:  query.Get("source"),
+		Target:  query.Get("target"),
+		Reverse: query.Get("reverse") == "true",
+	}
+	if req.Code == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The code parameter is required"))
+		return
+	}
+	for _, dependsOn := range query["dependsOn"] {
+		parts := strings.SplitN(dependsOn, "|", 3)
+		if len(parts) != 3 {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "dependsOn must be in the form element|system|code"))
+			return
+		}
+		req.DependsOn = append(req.DependsOn, models.OtherElementComponent{Element: parts[0], CodeSystem: parts[1], Code: parts[2]})
+	}
+
+	var translations []Translation
+	var err error
+	if _, ok := mux.Vars(r)["id"]; ok {
+		var cm *models.ConceptMap
+		if cm, err = LoadConceptMap(r); err != nil {
+			WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+			return
+		}
+		translations = TranslateWithConceptMap(cm, req)
+	} else if translations, err = Translate(req); err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(TranslationParameters(translations))
+}
+
+// TranslationParameters builds the $translate response: a result flag, a
+// message when nothing matched, and a match parameter for each translation.
+func TranslationParameters(translations []Translation) *models.Parameters {
+	result := len(translations) > 0
+	params := models.NewParameters().Add(models.ParametersParameterComponent{Name: "result", ValueBoolean: &result})
+	if !result {
+		params.Add(models.ParametersParameterComponent{Name: "message", ValueString: "No mapping was found for the code"})
+	}
+	for _, t := range translations {
+		match := models.ParametersParameterComponent{Name: "match", Part: []models.ParametersParameterComponent{
+			{Name: "equivalence", ValueCode: t.Equivalence},
+			{Name: "concept", ValueCoding: &models.Coding{System: t.System, Code: t.Code}},
+			{Name: "source", ValueUri: "ConceptMap/" + t.ConceptMap},
+		}}
+		if t.Comments != "" {
+			match.Part = append(match.Part, models.ParametersParameterComponent{Name: "comments", ValueString: t.Comments})
+		}
+		for _, product := range t.Product {
+			match.Part = append(match.Part, models.ParametersParameterComponent{Name: "product", Part: []models.ParametersParameterComponent{
+				{Name: "element", ValueUri: product.Element},
+				{Name: "concept", ValueCoding: &models.Coding{System: product.CodeSystem, Code: product.Code}},
+			}})
+		}
+		params.Add(match)
+	}
+	return params
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/codegangsta/negroni"
+)
+
+// AllowedOrigins lists the origins, such as "https://app.example.org", whose
+// browser scripts may call the server. "*" allows every origin. By default
+// no cross-origin requests are allowed.
+var AllowedOrigins []string
+
+// CORSHandler applies AllowedOrigins to every response. The routes allow any
+// origin, so their Access-Control-Allow-Origin header is replaced with the
+// request's origin if it is allowed, and removed otherwise. Preflight
+// requests from allowed origins are answered here, allowing the Authorization
+// header, and those from other origins are answered without allowing them.
+// It should come before the Authenticator, since browsers send preflight
+// requests without credentials.
+func CORSHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	origin := r.Header.Get("Origin")
+	allowed := origin != "" && allowedOrigin(origin)
+	setHeaders := func(header http.Header) {
+		header.Del("Access-Control-Allow-Origin")
+		if allowed {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Expose-Headers", "Location, WWW-Authenticate")
+			header.Add("Vary", "Origin")
+		}
+	}
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		setHeaders(rw.Header())
+		if allowed {
+			rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+			rw.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Provenance")
+		}
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	w, ok := rw.(negroni.ResponseWriter)
+	if !ok {
+		next(rw, r)
+		return
+	}
+	w.Before(func(w negroni.ResponseWriter) { setHeaders(w.Header()) })
+	next(rw, r)
+	if !w.Written() {
+		setHeaders(w.Header())
+	}
+}
+
+func allowedOrigin(origin string) bool {
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Delivery is an outbound HTTP request waiting in the delivery queue.
+type Delivery struct {
+	Id string `bson:"_id" json:"id"`
+	// Destination groups deliveries that must be made in order. It defaults
+	// to the request URL.
+	Destination string      `bson:"destination" json:"destination"`
+	Method      string      `bson:"method" json:"method"`
+	Url         string      `bson:"url" json:"url"`
+	Header      http.Header `bson:"header,omitempty" json:"header,omitempty"`
+	Body        []byte      `bson:"body,omitempty" json:"body,omitempty"`
+	// Subscription is the id of the subscription the delivery notifies, if
+	// any.
+	Subscription string    `bson:"subscription,omitempty" json:"subscription,omitempty"`
+	Created      time.Time `bson:"created" json:"created"`
+	Attempts     int       `bson:"attempts" json:"attempts"`
+	NextAttempt  time.Time `bson:"nextAttempt" json:"nextAttempt"`
+	LastError    string    `bson:"lastError,omitempty" json:"lastError,omitempty"`
+}
+
+// DeliveryQueue is a persistent queue of outbound requests. Deliveries to the
+// same destination are made one at a time in the order they were queued; a
+// failed delivery is retried with exponential backoff, holding up the
+// deliveries behind it, until MaxAttempts is reached and it is moved to the
+// dead letter collection.
+//
+// A queue is processed by a single worker, started with Run.
+type DeliveryQueue struct {
+	Collection           string
+	DeadLetterCollection string
+	Client               *http.Client
+	MaxAttempts          int
+	InitialBackoff       time.Duration
+	MaxBackoff           time.Duration
+	PollInterval         time.Duration
+	// Result, if set, is called after each attempt with the error, if any,
+	// and whether the delivery has been dead-lettered.
+	Result func(d *Delivery, err error, dead bool)
+}
+
+// DefaultDeliveryQueue holds the notifications for rest-hook subscriptions.
+var DefaultDeliveryQueue = NewDeliveryQueue()
+
+// NewDeliveryQueue returns a queue stored in the deliveries collection, with
+// dead letters in the deadletters collection. It makes up to 10 attempts,
+// starting 30 seconds apart and doubling up to an hour.
+func NewDeliveryQueue() *DeliveryQueue {
+	return &DeliveryQueue{
+		Collection:           "deliveries",
+		DeadLetterCollection: "deadletters",
+		Client:               &http.Client{Timeout: 30 * time.Second},
+		MaxAttempts:          10,
+		InitialBackoff:       30 * time.Second,
+		MaxBackoff:           time.Hour,
+		PollInterval:         5 * time.Second,
+		Result:               subscriptionDeliveryResult,
+	}
+}
+
+// Enqueue adds a delivery to the queue, to be attempted as soon as the
+// deliveries ahead of it for the same destination have been made.
+func (q *DeliveryQueue) Enqueue(d *Delivery) error {
+	d.Id = bson.NewObjectId().Hex()
+	if d.Destination == "" {
+		d.Destination = d.Url
+	}
+	d.Created = time.Now()
+	d.NextAttempt = d.Created
+	return Database.C(q.Collection).Insert(d)
+}
+
+// Run processes the queue every PollInterval until stop is closed.
+func (q *DeliveryQueue) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := q.ProcessDue(); err != nil {
+			log.Println("Processing delivery queue:", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessDue attempts every delivery that is due, returning the number
+// delivered. For each destination, deliveries are attempted in order until
+// one fails or is not yet due.
+func (q *DeliveryQueue) ProcessDue() (int, error) {
+	var destinations []string
+	if err := Database.C(q.Collection).Find(nil).Distinct("destination", &destinations); err != nil {
+		return 0, err
+	}
+	delivered := 0
+	for _, destination := range destinations {
+		n, err := q.processDestination(destination)
+		delivered += n
+		if err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+func (q *DeliveryQueue) processDestination(destination string) (int, error) {
+	delivered := 0
+	for {
+		d := &Delivery{}
+		err := Database.C(q.Collection).Find(bson.M{"destination": destination}).Sort("created", "_id").One(d)
+		if err == mgo.ErrNotFound {
+			return delivered, nil
+		} else if err != nil {
+			return delivered, err
+		}
+		if d.NextAttempt.After(time.Now()) {
+			return delivered, nil
+		}
+
+		attemptErr := q.attempt(d)
+		d.Attempts++
+		dead := attemptErr != nil && d.Attempts >= q.MaxAttempts
+		switch {
+		case attemptErr == nil:
+			err = Database.C(q.Collection).RemoveId(d.Id)
+			delivered++
+		case dead:
+			d.LastError = attemptErr.Error()
+			if err = Database.C(q.DeadLetterCollection).Insert(d); err == nil {
+				err = Database.C(q.Collection).RemoveId(d.Id)
+			}
+		default:
+			d.LastError = attemptErr.Error()
+			d.NextAttempt = time.Now().Add(q.backoff(d.Attempts))
+			err = Database.C(q.Collection).UpdateId(d.Id, bson.M{"$set": bson.M{"attempts": d.Attempts, "nextAttempt": d.NextAttempt, "lastError": d.LastError}})
+		}
+		if q.Result != nil {
+			q.Result(d, attemptErr, dead)
+		}
+		if err != nil || (attemptErr != nil && !dead) {
+			return delivered, err
+		}
+	}
+}
+
+func (q *DeliveryQueue) attempt(d *Delivery) error {
+	req, err := http.NewRequest(d.Method, d.Url, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+	for name, values := range d.Header {
+		req.Header[name] = values
+	}
+	res, err := q.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Delivery to %s failed with status %s", d.Url, res.Status)
+	}
+	return nil
+}
+
+// backoff returns the delay before the attempt after the given number of
+// failed attempts.
+func (q *DeliveryQueue) backoff(attempts int) time.Duration {
+	delay := q.InitialBackoff
+	for i := 1; i < attempts && delay < q.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.MaxBackoff {
+		delay = q.MaxBackoff
+	}
+	return delay
+}
+
+// Pending returns the queued deliveries, optionally for one destination, in
+// the order they will be attempted.
+func (q *DeliveryQueue) Pending(destination string) ([]Delivery, error) {
+	return q.list(q.Collection, destination)
+}
+
+// DeadLetters returns the deliveries that ran out of attempts, optionally for
+// one destination.
+func (q *DeliveryQueue) DeadLetters(destination string) ([]Delivery, error) {
+	return q.list(q.DeadLetterCollection, destination)
+}
+
+func (q *DeliveryQueue) list(collection, destination string) ([]Delivery, error) {
+	query := bson.M{}
+	if destination != "" {
+		query["destination"] = destination
+	}
+	deliveries := []Delivery{}
+	err := Database.C(collection).Find(query).Sort("created", "_id").All(&deliveries)
+	return deliveries, err
+}
+
+// Replay moves a dead letter back onto the queue with its attempts reset. It
+// keeps its original place in the order for its destination. The dead letter
+// is removed before it is queued, so that replaying it again, such as when a
+// replay of many is retried, cannot queue it twice; replaying one that is no
+// longer a dead letter returns mgo.ErrNotFound. If it cannot be queued it is
+// put back as a dead letter.
+func (q *DeliveryQueue) Replay(id string) error {
+	d := &Delivery{}
+	if _, err := Database.C(q.DeadLetterCollection).FindId(id).Apply(mgo.Change{Remove: true}, d); err != nil {
+		return err
+	}
+	dead := *d
+	d.Attempts = 0
+	d.NextAttempt = time.Now()
+	d.LastError = ""
+	if _, err := Database.C(q.Collection).UpsertId(id, d); err != nil {
+		if _, restoreErr := Database.C(q.DeadLetterCollection).UpsertId(id, &dead); restoreErr != nil {
+			log.Println("Restoring dead letter", id, restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// subscriptionDeliveryResult records the outcome of a subscription's
+// notification on the subscription. Failures that will be retried are noted
+// in its error; once a notification is dead-lettered the subscription is put
+// into the error state.
+func subscriptionDeliveryResult(d *Delivery, err error, dead bool) {
+	if d.Subscription == "" {
+		return
+	}
+	var update bson.M
+	switch {
+	case err == nil:
+		update = bson.M{"$unset": bson.M{"error": ""}}
+	case dead:
+		update = bson.M{"$set": bson.M{"status": "error", "error": err.Error()}}
+	default:
+		update = bson.M{"$set": bson.M{"error": fmt.Sprintf("%s (attempt %d, retrying)", err, d.Attempts)}}
+	}
+	if err := Database.C("subscriptions").UpdateId(d.Subscription, update); err != nil && err != mgo.ErrNotFound {
+		log.Println("Updating subscription", d.Subscription, err)
+	}
+}
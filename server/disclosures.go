@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// DisclosureReport accounts for the accesses to a patient's record in a
+// period, from the SecurityEvents recorded by AuditHandler.
+type DisclosureReport struct {
+	Patient     string       `json:"patient"`
+	Start       *time.Time   `json:"start,omitempty"`
+	End         *time.Time   `json:"end,omitempty"`
+	Disclosures []Disclosure `json:"disclosures"`
+}
+
+// Disclosure groups the successful requests of one participant, identified by
+// user id and network address, that took one action on the patient's record.
+// Resources lists the patient's resources that the requests touched, as
+// "Type/id".
+type Disclosure struct {
+	User      string    `json:"user,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Action    string    `json:"action"`
+	Count     int       `json:"count"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	Resources []string  `json:"resources"`
+}
+
+// PatientDisclosures reports the accesses to the patient's record between
+// start and end, either of which may be nil. An access is a SecurityEvent
+// whose objects include the patient, or a patient merged into it, in the
+// patient role, as AuditHandler records the patients whose compartments the
+// resources a request touched were in at the time. The resources of an event
+// with a single patient are all the patient's; for an event with several
+// patients, only those now in the patient's PatientCompartment are listed.
+// Disclosures are ordered by user, address and action.
+func PatientDisclosures(id string, start, end *time.Time) (*DisclosureReport, error) {
+	if n, err := Database.C("patients").FindId(id).Count(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrPatientNotFound
+	}
+
+	merged, err := MergedPatients(id)
+	if err != nil {
+		return nil, err
+	}
+	patients := []string{"Patient/" + id}
+	for _, patient := range merged {
+		patients = append(patients, "Patient/"+patient)
+	}
+	record := make(map[string]bool)
+	for _, patient := range patients {
+		record[patient] = true
+	}
+
+	patientObject := bson.M{"reference.reference": bson.M{"$in": patients}, "role": "1"}
+	query := bson.M{"object": bson.M{"$elemMatch": patientObject}, "event.outcome": "0"}
+	if start != nil || end != nil {
+		when := bson.M{}
+		if start != nil {
+			when["$gte"] = *start
+		}
+		if end != nil {
+			when["$lt"] = *end
+		}
+		query["event.dateTime.time"] = when
+	}
+
+	type groupKey struct{ user, address, action string }
+	groups := make(map[groupKey]*Disclosure)
+	seen := make(map[groupKey]map[string]bool)
+	// The resources of events with several patients are checked against the
+	// patient's compartment once the events have been read, so that only
+	// those resources are loaded.
+	unchecked := make(map[groupKey][]string)
+	var uncheckedKeys []resourceKey
+	event := &models.SecurityEvent{}
+	iter := Database.C(CollectionName("SecurityEvent")).Find(query).Sort("event.dateTime.time").Iter()
+	for iter.Next(event) {
+		key := groupKey{action: disclosureAction(event)}
+		if len(event.Participant) > 0 {
+			key.user, key.address = event.Participant[0].UserId, event.Participant[0].Network.Identifier
+		}
+		when := event.Event.DateTime.Time
+		d, ok := groups[key]
+		if !ok {
+			d = &Disclosure{User: key.user, Address: key.address, Action: key.action, First: when}
+			groups[key] = d
+			seen[key] = make(map[string]bool)
+		}
+		d.Count++
+		d.Last = when
+		eventPatients := 0
+		for _, object := range event.Object {
+			if object.Role == "1" {
+				eventPatients++
+			}
+		}
+		for _, object := range event.Object {
+			reference := object.Reference.Reference
+			if reference == "" || seen[key][reference] {
+				continue
+			}
+			if object.Role == "1" && !record[reference] {
+				continue
+			}
+			if eventPatients > 1 && !record[reference] {
+				if parsed := models.ParseReference(reference); parsed.Type != "" && !parsed.External {
+					unchecked[key] = append(unchecked[key], reference)
+					uncheckedKeys = append(uncheckedKeys, resourceKey{parsed.Type, parsed.Id})
+				}
+				continue
+			}
+			seen[key][reference] = true
+			d.Resources = append(d.Resources, reference)
+		}
+		event = &models.SecurityEvent{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	resources, err := loadResources(uncheckedKeys)
+	if err != nil {
+		return nil, err
+	}
+	for key, references := range unchecked {
+		for _, reference := range references {
+			parsed := models.ParseReference(reference)
+			resource, ok := resources[resourceKey{parsed.Type, parsed.Id}]
+			if !seen[key][reference] && ok && PatientCompartment.Contains(parsed.Type, resource, id) {
+				seen[key][reference] = true
+				groups[key].Resources = append(groups[key].Resources, reference)
+			}
+		}
+	}
+
+	report := &DisclosureReport{Patient: "Patient/" + id, Start: start, End: end, Disclosures: []Disclosure{}}
+	for _, d := range groups {
+		sort.Strings(d.Resources)
+		report.Disclosures = append(report.Disclosures, *d)
+	}
+	sort.Sort(byParticipant(report.Disclosures))
+	return report, nil
+}
+
+// EnsureDisclosureIndexes creates the indexes used to find the SecurityEvents
+// that name a patient, in time order.
+func EnsureDisclosureIndexes() error {
+	for _, key := range [][]string{{"object.reference.reference", "event.dateTime.time"}, {"event.dateTime.time"}} {
+		if err := Database.C(CollectionName("SecurityEvent")).EnsureIndexKey(key...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disclosureAction returns the interaction an event records, such as "read",
+// or else its action code.
+func disclosureAction(event *models.SecurityEvent) string {
+	for _, subtype := range event.Event.Subtype {
+		for _, coding := range subtype.Coding {
+			if coding.Code != "" {
+				return coding.Code
+			}
+		}
+	}
+	return event.Event.Action
+}
+
+type byParticipant []Disclosure
+
+func (d byParticipant) Len() int      { return len(d) }
+func (d byParticipant) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+func (d byParticipant) Less(i, j int) bool {
+	if d[i].User != d[j].User {
+		return d[i].User < d[j].User
+	}
+	if d[i].Address != d[j].Address {
+		return d[i].Address < d[j].Address
+	}
+	return d[i].Action < d[j].Action
+}
+
+// WriteJSON writes the report as a JSON object.
+func (r *DisclosureReport) WriteJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(r)
+}
+
+// WriteCSV writes a row for each disclosure, with the resources separated by
+// spaces.
+func (r *DisclosureReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"user", "address", "action", "count", "first", "last", "resources"})
+	for _, d := range r.Disclosures {
+		out.Write([]string{d.User, d.Address, d.Action, strconv.Itoa(d.Count), d.First.Format(time.RFC3339), d.Last.Format(time.RFC3339), strings.Join(d.Resources, " ")})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// WriteText writes the report as plain text for printing, grouped by
+// participant.
+func (r *DisclosureReport) WriteText(w io.Writer) error {
+	period := "all dates"
+	switch {
+	case r.Start != nil && r.End != nil:
+		period = r.Start.Format(time.RFC3339) + " to " + r.End.Format(time.RFC3339)
+	case r.Start != nil:
+		period = "since " + r.Start.Format(time.RFC3339)
+	case r.End != nil:
+		period = "before " + r.End.Format(time.RFC3339)
+	}
+	text := fmt.Sprintf("Accounting of disclosures for %s\nPeriod: %s\n", r.Patient, period)
+	if len(r.Disclosures) == 0 {
+		text += "\nNo disclosures.\n"
+	}
+	for i, d := range r.Disclosures {
+		if i == 0 || d.User != r.Disclosures[i-1].User || d.Address != r.Disclosures[i-1].Address {
+			user := d.User
+			if user == "" {
+				user = "Unidentified user"
+			}
+			text += fmt.Sprintf("\n%s (%s)\n", user, d.Address)
+		}
+		text += fmt.Sprintf("  %s: %d times, %s to %s\n", d.Action, d.Count, d.First.Format(time.RFC3339), d.Last.Format(time.RFC3339))
+		for _, resource := range d.Resources {
+			text += "    " + resource + "\n"
+		}
+	}
+	_, err := io.WriteString(w, text)
+	return err
+}
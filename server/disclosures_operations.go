@@ -0,0 +1,67 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// PatientDisclosuresHandler implements the $disclosures operation, which
+// reports who accessed the patient's record, and what they saw, from the
+// server's audit trail. The start and end parameters are optional dates of
+// any precision bounding the report, with end inclusive. The report is JSON,
+// or CSV if _format=csv is given or text/csv is accepted, or plain text if
+// _format=text is given or text/plain is accepted.
+func PatientDisclosuresHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "disclosures")
+	context.Set(r, "Resource", "Patient")
+
+	query := r.URL.Query()
+	var start, end *time.Time
+	if value := query.Get("start"); value != "" {
+		t, _, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid start: "+err.Error()))
+			return
+		}
+		start = &t
+	}
+	if value := query.Get("end"); value != "" {
+		_, t, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid end: "+err.Error()))
+			return
+		}
+		end = &t
+	}
+
+	report, err := PatientDisclosures(mux.Vars(r)["id"], start, end)
+	if err == ErrPatientNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	accept := r.Header.Get("Accept")
+	switch format := query.Get("_format"); {
+	case format == "csv" || (format == "" && strings.Contains(accept, "text/csv")):
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = report.WriteCSV(rw)
+	case format == "text" || (format == "" && strings.Contains(accept, "text/plain")):
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		err = report.WriteText(rw)
+	default:
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err = report.WriteJSON(rw)
+	}
+	if err != nil {
+		log.Println("Writing disclosure report:", err)
+	}
+}
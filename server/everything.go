@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// EverythingPageSize is the number of compartment resources in each page of
+// the $everything operation when no count is given.
+var EverythingPageSize = 100
+
+// EverythingIncludes lists the types of the resources that are added to each
+// page of $everything when a resource on the page refers to them.
+var EverythingIncludes = []string{"Location", "Medication", "Organization", "Practitioner"}
+
+// EverythingDates gives the elements holding the clinical date of each
+// resource type, which $everything's start and end parameters are applied to.
+// Resources of other types are included whatever the window.
+var EverythingDates = map[string][]string{
+	"AllergyIntolerance":       {"recordedDate"},
+	"CarePlan":                 {"period"},
+	"Condition":                {"onsetDate", "dateAsserted"},
+	"DiagnosticReport":         {"diagnosticDateTime", "diagnosticPeriod"},
+	"DocumentReference":        {"created"},
+	"Encounter":                {"period"},
+	"FamilyHistory":            {"date"},
+	"ImagingStudy":             {"dateTime"},
+	"Immunization":             {"date"},
+	"MedicationAdministration": {"effectiveTimeDateTime", "effectiveTimePeriod"},
+	"MedicationDispense":       {"dispense.whenHandedOver"},
+	"MedicationPrescription":   {"dateWritten"},
+	"MedicationStatement":      {"whenGiven"},
+	"Observation":              {"appliesDateTime", "appliesPeriod"},
+	"Procedure":                {"date"},
+}
+
+// EverythingOptions restricts and pages the $everything operation. Start and
+// End form a window that resources with a clinical date must fall in; Since
+// selects resources updated at or after a time. A Count of zero returns the
+// whole record.
+type EverythingOptions struct {
+	Start, End *time.Time
+	Since      *time.Time
+	Offset     int
+	Count      int
+}
+
+// ErrPatientNotFound is returned by PatientEverything and PatientDisclosures
+// for an unknown patient.
+var ErrPatientNotFound = errors.New("Patient not found")
+
+// PatientEverything returns a page of the patient's record: the Patient and
+// the other resources in its PatientCompartment, ordered by type and id,
+// followed by the resources in EverythingIncludes that those on the page
+// refer to. The bundle's total counts the record but not the included
+// resources.
+func PatientEverything(id string, opts EverythingOptions) (*models.Bundle, error) {
+	if n, err := Database.C("patients").FindId(id).Count(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrPatientNotFound
+	}
+
+	keys, err := PatientCompartment.Search(id, PatientCompartment.Types(), func(resourceType string) (bson.M, error) {
+		return everythingQuery(resourceType, opts), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	bundle := &models.Bundle{Type: "Bundle", Title: "Everything for Patient " + id, Id: bson.NewObjectId().Hex(), Updated: time.Now(), TotalResults: len(keys)}
+	keys = pageKeys(keys, opts.Offset, opts.Count)
+
+	resources, err := loadResources(keys)
+	if err != nil {
+		return nil, err
+	}
+	onPage := make(map[resourceKey]bool)
+	var included []resourceKey
+	for _, key := range keys {
+		onPage[key] = true
+	}
+	for _, key := range keys {
+		resource, ok := resources[key]
+		if !ok {
+			continue
+		}
+		models.WalkElements(resource, func(location string, element interface{}) {
+			ref, ok := element.(models.Reference)
+			if !ok {
+				return
+			}
+			target := referenceKey(ref)
+			if containsType(EverythingIncludes, target.Type) && !onPage[target] {
+				onPage[target] = true
+				included = append(included, target)
+			}
+		})
+	}
+	includedResources, err := loadResources(included)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range includedResources {
+		resources[k] = v
+	}
+
+	bundle.Entry = bundleEntries(append(keys, included...), resources)
+	return bundle, nil
+}
+
+// everythingQuery restricts a resource type to the options' date window and
+// _since, returning nil if there is nothing to restrict.
+func everythingQuery(resourceType string, opts EverythingOptions) bson.M {
+	var clauses []bson.M
+	if paths, ok := EverythingDates[resourceType]; ok && (opts.Start != nil || opts.End != nil) {
+		resource, _ := models.NewStructForResourceName(resourceType)
+		t := reflect.TypeOf(resource).Elem()
+		var window []bson.M
+		for _, path := range paths {
+			elementType, _ := models.ElementType(t, path)
+			window = append(window, windowClause(path, elementType == reflect.TypeOf(models.Period{}), opts.Start, opts.End))
+		}
+		clauses = append(clauses, bson.M{"$or": window})
+	}
+	if opts.Since != nil {
+		clauses = append(clauses, sinceClause(*opts.Since))
+	}
+	switch len(clauses) {
+	case 0:
+		return nil
+	case 1:
+		return clauses[0]
+	}
+	return bson.M{"$and": clauses}
+}
+
+// windowClause matches a date or period that overlaps the window from start
+// up to end. A period with no end is taken to be ongoing.
+func windowClause(path string, period bool, start, end *time.Time) bson.M {
+	clause := bson.M{}
+	if !period {
+		date := bson.M{}
+		if start != nil {
+			date["$gte"] = *start
+		}
+		if end != nil {
+			date["$lt"] = *end
+		}
+		clause[path+".time"] = date
+		return clause
+	}
+	if end != nil {
+		clause[path+".start.time"] = bson.M{"$lt": *end}
+	}
+	if start != nil {
+		clause["$or"] = []bson.M{
+			{path + ".end.time": bson.M{"$gte": *start}},
+			{path + ".end.time": bson.M{"$exists": false}, path + ".start.time": bson.M{"$exists": true}},
+		}
+	}
+	return clause
+}
+
+func containsType(types []string, resourceType string) bool {
+	for _, t := range types {
+		if t == resourceType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// PatientEverythingHandler implements the $everything operation, which
+// returns a bundle with a page of the patient's record. The start and end
+// parameters are dates of any precision that restrict resources with a
+// clinical date to those in the window, with end inclusive; _since selects
+// resources updated at or after an instant. The offset and count parameters
+// select the page, and the bundle links to the next and previous pages.
+func PatientEverythingHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "everything")
+	context.Set(r, "Resource", "Patient")
+
+	query := r.URL.Query()
+	opts := EverythingOptions{}
+	var err error
+	if value := query.Get("start"); value != "" {
+		start, _, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid start: "+err.Error()))
+			return
+		}
+		opts.Start = &start
+	}
+	if value := query.Get("end"); value != "" {
+		_, end, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid end: "+err.Error()))
+			return
+		}
+		opts.End = &end
+	}
+	if value := query.Get("_since"); value != "" {
+		since, _, err := parseSearchDate(value)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid _since: "+err.Error()))
+			return
+		}
+		opts.Since = &since
+	}
+	if opts.Offset, err = optionalInt(query.Get("offset"), 0); err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid offset: "+err.Error()))
+		return
+	}
+	if opts.Count, err = optionalInt(query.Get("count"), EverythingPageSize); err != nil || opts.Count == 0 {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count"))
+		return
+	}
+
+	bundle, err := PatientEverything(mux.Vars(r)["id"], opts)
+	if err == ErrPatientNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	bundle.Link = pageLinks(r.URL, "offset", "count", opts.Offset, opts.Count, bundle.TotalResults)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(bundle)
+}
+
+// pageLinks returns the self, previous and next links for a page of results,
+// relative to the server. The page is given by the named offset and count
+// parameters.
+func pageLinks(u *url.URL, offsetParam, countParam string, offset, count, total int) []models.BundleLink {
+	link := func(rel string, offset int) models.BundleLink {
+		query := u.Query()
+		query.Set(offsetParam, strconv.Itoa(offset))
+		query.Set(countParam, strconv.Itoa(count))
+		return models.BundleLink{Rel: rel, Href: u.Path + "?" + query.Encode()}
+	}
+	links := []models.BundleLink{link("self", offset)}
+	if offset > 0 {
+		previous := offset - count
+		if previous < 0 {
+			previous = 0
+		}
+		links = append(links, link("previous", previous))
+	}
+	if offset+count < total {
+		links = append(links, link("next", offset+count))
+	}
+	return links
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Fact is a document in the facts collection: one fact about a patient,
+// derived from a single resource. Facts are the input to Query pipelines and
+// patient filters.
+type Fact struct {
+	Id string `bson:"_id"`
+	// TargetId is the id of the patient the fact is about.
+	TargetId string `bson:"targetid"`
+	// SourceId is the id of the resource the fact was derived from.
+	SourceId  string                   `bson:"sourceid"`
+	Type      string                   `bson:"type"`
+	Gender    string                   `bson:"gender,omitempty"`
+	BirthDate *time.Time               `bson:"birthdate,omitempty"`
+	StartDate *time.Time               `bson:"startdate,omitempty"`
+	EndDate   *time.Time               `bson:"enddate,omitempty"`
+	Codes     []models.CodeableConcept `bson:"codes,omitempty"`
+	// CodeKeys holds each of the fact's codings as "system|code", so that
+	// they can be matched against a code set with one indexed lookup.
+	CodeKeys []string `bson:"codekeys,omitempty"`
+	// NameKeys holds the Soundex codes of a patient's names, which
+	// MatchPatients selects candidates by.
+	NameKeys []string `bson:"namekeys,omitempty"`
+	Value    *float64 `bson:"value,omitempty"`
+	Status   string   `bson:"status,omitempty"`
+}
+
+// FactExtractors derives the facts for each resource type that is projected
+// into the facts collection. The resource is always a pointer to the model
+// struct. Further types can be projected by adding to this map.
+var FactExtractors = map[string]func(resource interface{}) []Fact{
+	"Patient":             patientFacts,
+	"Condition":           conditionFacts,
+	"Observation":         observationFacts,
+	"Encounter":           encounterFacts,
+	"MedicationStatement": medicationStatementFacts,
+}
+
+// FactsHandler keeps the facts collection up to date with the resource
+// written or deleted by a route once the route has succeeded.
+func FactsHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(rw, r)
+
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	resourceType, _ := context.Get(r, "Resource").(string)
+	if _, ok := FactExtractors[resourceType]; !ok {
+		return
+	}
+	var err error
+	switch context.Get(r, "Action") {
+	case "create", "update":
+		err = UpdateFacts(resourceType, context.Get(r, resourceType))
+	case "delete":
+		id, _ := context.Get(r, resourceType).(string)
+		err = RemoveFacts(resourceType, id)
+	}
+	if err != nil {
+		log.Println("Updating facts:", err)
+	}
+}
+
+// UpdateFacts replaces the facts derived from a resource. Facts about a
+// patient that is not stored here, such as one on another server, are left
+// out.
+func UpdateFacts(resourceType string, resource interface{}) error {
+	id := resourceId(resource)
+	if _, err := Database.C("facts").RemoveAll(bson.M{"sourceid": id}); err != nil {
+		return err
+	}
+	for _, fact := range FactExtractors[resourceType](resource) {
+		if fact.TargetId == "" {
+			continue
+		}
+		fact.Id = bson.NewObjectId().Hex()
+		fact.SourceId = id
+		fact.Type = resourceType
+		for _, concept := range fact.Codes {
+			for _, coding := range concept.Coding {
+				fact.CodeKeys = append(fact.CodeKeys, coding.System+"|"+coding.Code)
+			}
+		}
+		if err := Database.C("facts").Insert(fact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveFacts removes the facts derived from a deleted resource. Deleting a
+// patient removes every fact about the patient.
+func RemoveFacts(resourceType, id string) error {
+	query := bson.M{"sourceid": id}
+	if resourceType == "Patient" {
+		query = bson.M{"$or": []bson.M{{"sourceid": id}, {"targetid": id}}}
+	}
+	_, err := Database.C("facts").RemoveAll(query)
+	return err
+}
+
+// RebuildFacts recreates the facts collection from the stored resources.
+func RebuildFacts() error {
+	if _, err := Database.C("facts").RemoveAll(nil); err != nil {
+		return err
+	}
+	if err := EnsureFactIndexes(); err != nil {
+		return err
+	}
+	for resourceType := range FactExtractors {
+		resource, _ := models.NewStructForResourceName(resourceType)
+		iter := Database.C(CollectionName(resourceType)).Find(nil).Iter()
+		for iter.Next(resource) {
+			if err := UpdateFacts(resourceType, resource); err != nil {
+				iter.Close()
+				return err
+			}
+			resource, _ = models.NewStructForResourceName(resourceType)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnsureFactIndexes creates the indexes used by patient filters and patient
+// matching.
+func EnsureFactIndexes() error {
+	for _, key := range [][]string{{"sourceid"}, {"targetid"}, {"type", "codekeys", "startdate"}, {"type", "gender"}, {"type", "birthdate"}, {"type", "namekeys"}} {
+		if err := Database.C("facts").EnsureIndexKey(key...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RebuildFactsHandler rebuilds the facts collection, for use after loading
+// resources directly into the database.
+func RebuildFactsHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if err := RebuildFacts(); err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	info := NewOperationOutcomeIssue("informational", "The facts collection has been rebuilt")
+	info.Severity = "information"
+	WriteOperationOutcome(rw, http.StatusOK, info)
+}
+
+func patientFacts(resource interface{}) []Fact {
+	patient := resource.(*models.Patient)
+	fact := Fact{TargetId: patient.Id, BirthDate: factTime(patient.BirthDate), NameKeys: nameKeys(patient)}
+	if len(patient.Gender.Coding) > 0 {
+		fact.Gender = patient.Gender.Coding[0].Code
+	}
+	return []Fact{fact}
+}
+
+func conditionFacts(resource interface{}) []Fact {
+	condition := resource.(*models.Condition)
+	return []Fact{{
+		TargetId:  referenceId(condition.Subject),
+		Codes:     []models.CodeableConcept{condition.Code},
+		StartDate: factTime(condition.OnsetDate),
+		EndDate:   factTime(condition.AbatementDate),
+		Status:    condition.Status,
+	}}
+}
+
+func observationFacts(resource interface{}) []Fact {
+	observation := resource.(*models.Observation)
+	fact := Fact{
+		TargetId:  referenceId(observation.Subject),
+		Codes:     []models.CodeableConcept{observation.Name},
+		StartDate: factTime(observation.AppliesDateTime),
+		Status:    observation.Status,
+	}
+	if fact.StartDate == nil {
+		fact.StartDate = factTime(observation.AppliesPeriod.Start)
+		fact.EndDate = factTime(observation.AppliesPeriod.End)
+	}
+	if fact.StartDate == nil {
+		fact.StartDate = factTime(observation.Issued)
+	}
+	if q := observation.ValueQuantity; q.Value != 0 || q.Units != "" || q.Code != "" {
+		value := q.Value
+		fact.Value = &value
+	}
+	return []Fact{fact}
+}
+
+func encounterFacts(resource interface{}) []Fact {
+	encounter := resource.(*models.Encounter)
+	return []Fact{{
+		TargetId:  referenceId(encounter.Subject),
+		Codes:     encounter.Type,
+		StartDate: factTime(encounter.Period.Start),
+		EndDate:   factTime(encounter.Period.End),
+		Status:    encounter.Status,
+	}}
+}
+
+// medicationStatementFacts codes the fact with the code of the referenced
+// Medication.
+func medicationStatementFacts(resource interface{}) []Fact {
+	statement := resource.(*models.MedicationStatement)
+	fact := Fact{
+		TargetId:  referenceId(statement.Patient),
+		StartDate: factTime(statement.WhenGiven.Start),
+		EndDate:   factTime(statement.WhenGiven.End),
+	}
+	medication := &models.Medication{}
+	if id := referenceId(statement.Medication); id != "" && Database.C("medications").FindId(id).One(medication) == nil {
+		fact.Codes = []models.CodeableConcept{medication.Code}
+	}
+	return []Fact{fact}
+}
+
+func factTime(dt models.FHIRDateTime) *time.Time {
+	if dt.Time.IsZero() {
+		return nil
+	}
+	t := dt.Time
+	return &t
+}
+
+// referenceId returns the id of the stored resource a local reference such
+// as "Patient/1234" points at, or "" for external and contained references
+// and those that cannot be parsed.
+func referenceId(ref models.Reference) string {
+	parsed := models.ParseReference(ref.Reference)
+	if parsed.External || parsed.Contained != "" || (ref.External != nil && *ref.External) {
+		return ""
+	}
+	if parsed.Id != "" {
+		return parsed.Id
+	}
+	return ref.ReferencedID
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PatientFilter selects patients using the facts collection. A filter is
+// either a combination of other filters (And, Or or Not) or a criterion that
+// matches the patients with at least one fact satisfying every one of its
+// fields. Filters are written in JSON, e.g.
+//
+//	{"and": [
+//	  {"type": "Patient", "gender": "F", "age": {"low": 18}},
+//	  {"type": "Condition", "valueSet": "http://example.org/fhir/vs/diabetes"},
+//	  {"not": {"type": "Encounter", "withinDays": 365}}
+//	]}
+type PatientFilter struct {
+	And []PatientFilter `json:"and,omitempty"`
+	Or  []PatientFilter `json:"or,omitempty"`
+	Not *PatientFilter  `json:"not,omitempty"`
+
+	// Type is the type of resource the fact came from.
+	Type string `json:"type,omitempty"`
+	// Codes and ValueSet restrict the fact to a set of codes. ValueSet is a
+	// ValueSet identifier or local reference ("ValueSet/1234"), and is
+	// expanded when the filter is run.
+	Codes    []models.Coding `json:"codes,omitempty"`
+	ValueSet string          `json:"valueSet,omitempty"`
+	// Status restricts the fact to resources with one of the given statuses.
+	Status []string `json:"status,omitempty"`
+	// Gender and Age apply to Patient facts. Age is in whole years.
+	Gender string       `json:"gender,omitempty"`
+	Age    *FilterRange `json:"age,omitempty"`
+	// Value restricts Observation facts to a numeric value.
+	Value *FilterRange `json:"value,omitempty"`
+	// Start, End and WithinDays form a temporal window that the fact must
+	// overlap. A fact with no end date is treated as happening at its start
+	// date.
+	Start      *time.Time `json:"start,omitempty"`
+	End        *time.Time `json:"end,omitempty"`
+	WithinDays int        `json:"withinDays,omitempty"`
+	// AnyTime lets the fact fall outside the context's period, e.g. for a
+	// history of a condition.
+	AnyTime bool `json:"anyTime,omitempty"`
+}
+
+// isCriterion reports whether any of the filter's criterion fields are set.
+func (f *PatientFilter) isCriterion() bool {
+	return f.Type != "" || len(f.Codes) > 0 || f.ValueSet != "" || len(f.Status) > 0 || f.Gender != "" || f.Age != nil ||
+		f.Value != nil || f.Start != nil || f.End != nil || f.WithinDays != 0 || f.AnyTime
+}
+
+// FilterRange is an inclusive numeric range in which either end may be left
+// out.
+type FilterRange struct {
+	Low  *float64 `json:"low,omitempty"`
+	High *float64 `json:"high,omitempty"`
+}
+
+// PatientSet is a set of patient ids.
+type PatientSet map[string]bool
+
+// Intersect returns the patients in both s and other.
+func (s PatientSet) Intersect(other PatientSet) PatientSet {
+	result := PatientSet{}
+	for id := range s {
+		if other[id] {
+			result[id] = true
+		}
+	}
+	return result
+}
+
+// Subtract returns the patients in s but not in other.
+func (s PatientSet) Subtract(other PatientSet) PatientSet {
+	result := PatientSet{}
+	for id := range s {
+		if !other[id] {
+			result[id] = true
+		}
+	}
+	return result
+}
+
+// Ids returns the patient ids in the set in sorted order.
+func (s PatientSet) Ids() []string {
+	ids := make([]string, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// FilterContext caches what is needed to evaluate filters: the set of all
+// patients and the expansions of ValueSets. A context should be used for a
+// single evaluation or batch of evaluations.
+type FilterContext struct {
+	// Now is the time that ages and relative windows are measured from.
+	Now time.Time
+	// PeriodStart and PeriodEnd, if set, are the window for criteria on
+	// facts other than Patient facts that do not give their own Start, End
+	// or AnyTime.
+	PeriodStart *time.Time
+	PeriodEnd   *time.Time
+	Expander    *ValueSetExpander
+	all         PatientSet
+	valueSets   map[string][]string
+}
+
+// NewFilterContext returns a context that measures time from now.
+func NewFilterContext() *FilterContext {
+	return &FilterContext{Now: time.Now(), Expander: NewValueSetExpander(), valueSets: make(map[string][]string)}
+}
+
+// FindPatients returns the patients matching a filter.
+func FindPatients(f *PatientFilter) (PatientSet, error) {
+	return f.Evaluate(NewFilterContext())
+}
+
+// Evaluate returns the patients matching the filter. Combinations are
+// evaluated by set operations on the patients matching their parts, and each
+// criterion by a single indexed query on the facts collection. A filter that
+// is both a combination and a criterion, or more than one kind of
+// combination, is rejected rather than having parts of it ignored.
+func (f *PatientFilter) Evaluate(ctx *FilterContext) (PatientSet, error) {
+	combinations := 0
+	for _, set := range []bool{f.Not != nil, len(f.And) > 0, len(f.Or) > 0} {
+		if set {
+			combinations++
+		}
+	}
+	if combinations > 1 {
+		return nil, errors.New("A filter can only have one of and, or and not")
+	} else if combinations == 1 && f.isCriterion() {
+		return nil, errors.New("A filter cannot combine and, or or not with criterion fields")
+	}
+
+	switch {
+	case f.Not != nil:
+		all, err := ctx.allPatients()
+		if err != nil {
+			return nil, err
+		}
+		excluded, err := f.Not.Evaluate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return all.Subtract(excluded), nil
+	case len(f.And) > 0:
+		var result PatientSet
+		for i := range f.And {
+			matched, err := f.And[i].Evaluate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if result == nil {
+				result = matched
+			} else {
+				result = result.Intersect(matched)
+			}
+		}
+		return result, nil
+	case len(f.Or) > 0:
+		result := PatientSet{}
+		for i := range f.Or {
+			matched, err := f.Or[i].Evaluate(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for id := range matched {
+				result[id] = true
+			}
+		}
+		return result, nil
+	}
+
+	query, err := f.factQuery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return distinctPatients(query)
+}
+
+// factQuery builds the facts query for a criterion.
+func (f *PatientFilter) factQuery(ctx *FilterContext) (bson.M, error) {
+	if f.Type == "" {
+		return nil, errors.New("A filter criterion must have a type")
+	}
+	query := bson.M{"type": f.Type}
+
+	var keys []string
+	for _, coding := range f.Codes {
+		keys = append(keys, coding.System+"|"+coding.Code)
+	}
+	if f.ValueSet != "" {
+		expanded, err := ctx.valueSetKeys(f.ValueSet)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, expanded...)
+	}
+	if len(f.Codes) > 0 || f.ValueSet != "" {
+		query["codekeys"] = bson.M{"$in": keys}
+	}
+
+	if len(f.Status) > 0 {
+		query["status"] = bson.M{"$in": f.Status}
+	}
+	if f.Gender != "" {
+		query["gender"] = f.Gender
+	}
+	if f.Age != nil {
+		birthdate := bson.M{}
+		if f.Age.Low != nil {
+			birthdate["$lte"] = ctx.Now.AddDate(-int(*f.Age.Low), 0, 0)
+		}
+		if f.Age.High != nil {
+			birthdate["$gt"] = ctx.Now.AddDate(-int(*f.Age.High)-1, 0, 0)
+		}
+		query["birthdate"] = birthdate
+	}
+	if f.Value != nil {
+		value := bson.M{}
+		if f.Value.Low != nil {
+			value["$gte"] = *f.Value.Low
+		}
+		if f.Value.High != nil {
+			value["$lte"] = *f.Value.High
+		}
+		query["value"] = value
+	}
+
+	start, end := f.Start, f.End
+	if !f.AnyTime && f.Type != "Patient" {
+		if start == nil {
+			start = ctx.PeriodStart
+		}
+		if end == nil {
+			end = ctx.PeriodEnd
+		}
+	}
+	if f.WithinDays > 0 {
+		windowStart := ctx.Now.AddDate(0, 0, -f.WithinDays)
+		if start == nil || windowStart.After(*start) {
+			start = &windowStart
+		}
+	}
+	if end != nil {
+		query["startdate"] = bson.M{"$lt": *end}
+	}
+	if start != nil {
+		query["$or"] = []bson.M{
+			{"enddate": bson.M{"$gte": *start}},
+			{"enddate": nil, "startdate": bson.M{"$gte": *start}},
+		}
+	}
+	return query, nil
+}
+
+func distinctPatients(query bson.M) (PatientSet, error) {
+	var ids []string
+	if err := Database.C("facts").Find(query).Distinct("targetid", &ids); err != nil {
+		return nil, err
+	}
+	result := make(PatientSet, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			result[id] = true
+		}
+	}
+	return result, nil
+}
+
+func (ctx *FilterContext) allPatients() (PatientSet, error) {
+	if ctx.all == nil {
+		all, err := distinctPatients(bson.M{"type": "Patient"})
+		if err != nil {
+			return nil, err
+		}
+		ctx.all = all
+	}
+	return ctx.all, nil
+}
+
+// valueSetKeys expands a ValueSet into "system|code" keys.
+func (ctx *FilterContext) valueSetKeys(name string) ([]string, error) {
+	if keys, ok := ctx.valueSets[name]; ok {
+		return keys, nil
+	}
+	vs, err := FindValueSetByReference(models.Reference{Reference: name})
+	if err != nil {
+		return nil, errors.New("Unable to find ValueSet " + name)
+	}
+	contains, err := ctx.Expander.Expand(vs)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(contains))
+	for i, c := range contains {
+		keys[i] = c.System + "|" + c.Code
+	}
+	ctx.valueSets[name] = keys
+	return keys, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GroupCharacteristicSystem is the code system for Group characteristics that
+// are not clinical codes:
+//
+//	gender       the patient's gender, in valueCodeableConcept
+//	age          the patient's age in years, in valueRange
+//	condition    a Condition coded with valueCodeableConcept
+//	observation  an Observation coded with valueCodeableConcept
+//	encounter    an Encounter of a type in valueCodeableConcept
+//	medication   a MedicationStatement for a medication coded with
+//	             valueCodeableConcept
+//
+// A characteristic with any other code matches patients with something coded
+// with that code: with valueBoolean true, a fact of any type; with valueRange
+// or valueQuantity, an Observation whose value is in range. Quantity
+// comparators are treated as inclusive, and as for age ranges a range bound of
+// zero is treated as absent.
+const GroupCharacteristicSystem = "http://interventionengine.org/groupcharacteristic"
+
+var groupCharacteristicFactTypes = map[string]string{
+	"condition":   "Condition",
+	"observation": "Observation",
+	"encounter":   "Encounter",
+	"medication":  "MedicationStatement",
+}
+
+// GroupFilter compiles the characteristics of a person Group into a
+// PatientFilter matching the patients with all of them. Characteristics with
+// exclude set match the patients without them.
+func GroupFilter(g *models.Group) (*PatientFilter, error) {
+	if g.Type != "" && g.Type != "person" {
+		return nil, fmt.Errorf("Only person groups can be defined by characteristics, not %s groups", g.Type)
+	}
+	if len(g.Characteristic) == 0 {
+		return nil, errors.New("The group has no characteristics")
+	}
+	filter := &PatientFilter{}
+	for i, characteristic := range g.Characteristic {
+		f, err := characteristicFilter(characteristic)
+		if err != nil {
+			return nil, fmt.Errorf("Characteristic %d: %s", i+1, err)
+		}
+		if characteristic.Exclude != nil && *characteristic.Exclude {
+			f = PatientFilter{Not: &f}
+		}
+		filter.And = append(filter.And, f)
+	}
+	return filter, nil
+}
+
+func characteristicFilter(c models.GroupCharacteristicComponent) (PatientFilter, error) {
+	if len(c.Code.Coding) == 0 {
+		return PatientFilter{}, errors.New("a code is required")
+	}
+	coding := c.Code.Coding[0]
+	if coding.System != GroupCharacteristicSystem {
+		return clinicalCharacteristicFilter(c)
+	}
+
+	values := c.ValueCodeableConcept.Coding
+	switch coding.Code {
+	case "gender":
+		if len(values) == 0 {
+			return PatientFilter{}, errors.New("a gender requires a valueCodeableConcept")
+		}
+		return PatientFilter{Type: "Patient", Gender: values[0].Code}, nil
+	case "age":
+		age := rangeFilter(c.ValueRange)
+		if age == nil {
+			return PatientFilter{}, errors.New("an age requires a valueRange")
+		}
+		return PatientFilter{Type: "Patient", Age: age}, nil
+	}
+	factType, ok := groupCharacteristicFactTypes[coding.Code]
+	if !ok {
+		return PatientFilter{}, errors.New("unknown characteristic " + coding.Code)
+	}
+	if len(values) == 0 {
+		return PatientFilter{}, fmt.Errorf("a %s requires a valueCodeableConcept", coding.Code)
+	}
+	return PatientFilter{Type: factType, Codes: values, AnyTime: true}, nil
+}
+
+// clinicalCharacteristicFilter handles characteristics coded with a clinical
+// code rather than one from GroupCharacteristicSystem.
+func clinicalCharacteristicFilter(c models.GroupCharacteristicComponent) (PatientFilter, error) {
+	if value := rangeFilter(c.ValueRange); value != nil {
+		return PatientFilter{Type: "Observation", Codes: c.Code.Coding, Value: value, AnyTime: true}, nil
+	}
+	if q := c.ValueQuantity; q.Value != 0 || q.Comparator != "" {
+		v := q.Value
+		value := &FilterRange{}
+		if !strings.HasPrefix(q.Comparator, ">") {
+			value.High = &v
+		}
+		if !strings.HasPrefix(q.Comparator, "<") {
+			value.Low = &v
+		}
+		return PatientFilter{Type: "Observation", Codes: c.Code.Coding, Value: value, AnyTime: true}, nil
+	}
+	if c.ValueBoolean == nil {
+		return PatientFilter{}, errors.New("a valueBoolean, valueRange or valueQuantity is required")
+	}
+
+	var types []string
+	for factType := range FactExtractors {
+		if factType != "Patient" {
+			types = append(types, factType)
+		}
+	}
+	sort.Strings(types)
+	f := PatientFilter{}
+	for _, factType := range types {
+		f.Or = append(f.Or, PatientFilter{Type: factType, Codes: c.Code.Coding, AnyTime: true})
+	}
+	if !*c.ValueBoolean {
+		f = PatientFilter{Not: &f}
+	}
+	return f, nil
+}
+
+func rangeFilter(r models.Range) *FilterRange {
+	low, high := r.Low.Value, r.High.Value
+	if low == 0 && high == 0 {
+		return nil
+	}
+	f := &FilterRange{}
+	if low != 0 {
+		f.Low = &low
+	}
+	if high != 0 {
+		f.High = &high
+	}
+	return f
+}
+
+// IsDefinitional reports whether a Group's members are computed from its
+// characteristics rather than listed explicitly.
+func IsDefinitional(g *models.Group) bool {
+	return (g.Actual == nil || !*g.Actual) && len(g.Characteristic) > 0
+}
+
+// RefreshGroup sets the Member list and Quantity of a definitional Group to
+// the patients currently matching its characteristics, in order of id. It
+// does not save the group.
+func RefreshGroup(g *models.Group) error {
+	if !IsDefinitional(g) {
+		return errors.New("Only groups that are not actual and have characteristics can be refreshed")
+	}
+	filter, err := GroupFilter(g)
+	if err != nil {
+		return err
+	}
+	patients, err := FindPatients(filter)
+	if err != nil {
+		return err
+	}
+	g.Member = make([]models.Reference, 0, len(patients))
+	for _, id := range patients.Ids() {
+		g.Member = append(g.Member, models.Reference{Reference: "Patient/" + id})
+	}
+	g.Quantity = float64(len(patients))
+	return nil
+}
+
+// RefreshGroups refreshes and saves every definitional Group for the request
+// r, returning the number refreshed. Groups whose characteristics cannot be evaluated are
+// skipped, and the first such error is returned after the others have been
+// refreshed.
+func RefreshGroups(r *http.Request) (int, error) {
+	var firstErr error
+	refreshed := 0
+	g := &models.Group{}
+	iter := Database.C("groups").Find(bson.M{"characteristic.0": bson.M{"$exists": true}, "actual": bson.M{"$ne": true}}).Iter()
+	for iter.Next(g) {
+		err := RefreshGroup(g)
+		if err == nil {
+			err = saveGroupMembers(r, g)
+		}
+		if err == nil {
+			refreshed++
+		} else if firstErr == nil {
+			firstErr = fmt.Errorf("Group %s: %s", g.Id, err)
+		}
+		g = &models.Group{}
+	}
+	if err := iter.Close(); err != nil {
+		return refreshed, err
+	}
+	return refreshed, firstErr
+}
+
+// saveGroupMembers stores a refreshed Group's members, recording the change
+// with RecordServerWrite.
+func saveGroupMembers(r *http.Request, g *models.Group) error {
+	if err := Database.C("groups").UpdateId(g.Id, bson.M{"$set": bson.M{"member": g.Member, "quantity": g.Quantity}}); err != nil {
+		return err
+	}
+	return RecordServerWrite(r, "$refresh", "Group", g.Id)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// GroupMembershipHandler computes the members of a definitional Group being
+// created or updated, so that it is stored with them. Groups whose
+// characteristics cannot be evaluated are rejected with a 422 response.
+func GroupMembershipHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	g := resource.(*models.Group)
+	if !IsDefinitional(g) {
+		next(rw, r)
+		return
+	}
+	if err := RefreshGroup(g); err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	body, err := json.Marshal(g)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	next(rw, r)
+}
+
+// GroupMembersHandler implements the $members operation, which returns the
+// stored members of a Group as a Parameters resource with the total and a
+// page of member references, selected by the offset and count parameters.
+// Refresh a definitional Group first to bring its members up to date.
+func GroupMembersHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "members")
+	g, err := LoadGroup(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	}
+	query := r.URL.Query()
+	offset, err := optionalInt(query.Get("offset"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid offset: "+err.Error()))
+		return
+	}
+	count, err := optionalInt(query.Get("count"), len(g.Member))
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count: "+err.Error()))
+		return
+	}
+
+	total := len(g.Member)
+	params := models.NewParameters().Add(models.ParametersParameterComponent{Name: "total", ValueInteger: &total})
+	for i := offset; i < len(g.Member) && i < offset+count; i++ {
+		params.Add(models.ParametersParameterComponent{Name: "member", ValueUri: g.Member[i].Reference})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(params)
+}
+
+// GroupRefreshHandler implements the $refresh operation, which recomputes and
+// saves the members of a definitional Group and returns the Group.
+func GroupRefreshHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "refresh")
+	g, err := LoadGroup(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	}
+	if err := RefreshGroup(g); err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	if err := saveGroupMembers(r, g); err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	context.Set(r, "Group", g)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(g)
+}
+
+// RefreshGroupsHandler refreshes every definitional Group, for example from a
+// scheduled job after a bulk load.
+func RefreshGroupsHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	refreshed, err := RefreshGroups(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	info := NewOperationOutcomeIssue("informational", strconv.Itoa(refreshed)+" groups have been refreshed")
+	info.Severity = "information"
+	WriteOperationOutcome(rw, http.StatusOK, info)
+}
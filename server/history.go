@@ -0,0 +1,138 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ResourceVersion is a version of a resource, kept in the history collection.
+// Versions are numbered from 1, and the resource's meta.versionId holds the
+// number of its current version. Resources stored before their first version
+// was kept start their history at their next update. The last number given
+// to each resource is kept in the historycounters collection.
+type ResourceVersion struct {
+	Id         string    `bson:"_id"`
+	Type       string    `bson:"type"`
+	ResourceId string    `bson:"resourceid"`
+	Version    string    `bson:"version"`
+	Saved      time.Time `bson:"saved"`
+	Resource   bson.M    `bson:"resource"`
+}
+
+// HistoryHandler keeps a version of each resource created or updated by a
+// route once the route has succeeded, responding with a 500 if it cannot. It
+// should come before LastUpdatedHandler, so that versions record when they
+// were made.
+func HistoryHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(rw, r)
+
+	w, ok := rw.(negroni.ResponseWriter)
+	if ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	if action := context.Get(r, "Action"); action != "create" && action != "update" {
+		return
+	}
+	resourceType, _ := context.Get(r, "Resource").(string)
+	id := resourceId(context.Get(r, resourceType))
+	if id == "" {
+		return
+	}
+	if _, err := SaveVersion(resourceType, id); err != nil {
+		log.Println("Saving version:", err)
+		if ok && !w.Written() {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", "The resource was stored, but its version was not kept: "+err.Error()))
+		}
+	}
+}
+
+// SaveVersion records the stored resource as its next version, returning the
+// version's number. Numbers are taken from a counter, so concurrent writes
+// get different numbers.
+func SaveVersion(resourceType, id string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		version, err := nextVersion(resourceType, id)
+		if err != nil {
+			return "", err
+		}
+		collection := Database.C(CollectionName(resourceType))
+		if err := collection.UpdateId(id, bson.M{"$set": bson.M{"meta.versionId": version}}); err != nil {
+			return "", err
+		}
+		doc := bson.M{}
+		if err := collection.FindId(id).One(&doc); err != nil {
+			return "", err
+		}
+		entry := ResourceVersion{Id: bson.NewObjectId().Hex(), Type: resourceType, ResourceId: id, Version: version, Saved: time.Now(), Resource: doc}
+		err = Database.C("history").Insert(entry)
+		if !mgo.IsDup(err) || attempt == 2 {
+			return version, err
+		}
+		// The counter is behind the versions kept before it was, so move it
+		// past them.
+		n, err := Database.C("history").Find(bson.M{"type": resourceType, "resourceid": id}).Count()
+		if err != nil {
+			return "", err
+		}
+		if _, err := Database.C("historycounters").UpsertId(resourceType+"/"+id, bson.M{"$max": bson.M{"version": n}}); err != nil {
+			return "", err
+		}
+	}
+}
+
+// nextVersion takes the next version number for a resource from its counter.
+func nextVersion(resourceType, id string) (string, error) {
+	var counter struct {
+		Version int `bson:"version"`
+	}
+	change := mgo.Change{Update: bson.M{"$inc": bson.M{"version": 1}}, Upsert: true, ReturnNew: true}
+	_, err := Database.C("historycounters").FindId(resourceType+"/"+id).Apply(change, &counter)
+	if mgo.IsDup(err) {
+		// Another write created the counter at the same time
+		_, err = Database.C("historycounters").FindId(resourceType+"/"+id).Apply(change, &counter)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(counter.Version), nil
+}
+
+// LoadVersion fetches a version of a resource from its history.
+func LoadVersion(resourceType, id, version string) (interface{}, error) {
+	entry := ResourceVersion{}
+	err := Database.C("history").Find(bson.M{"type": resourceType, "resourceid": id, "version": version}).One(&entry)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("%s/%s has no version %s", resourceType, id, version)
+	} else if err != nil {
+		return nil, err
+	}
+	return entry.Load()
+}
+
+// Load returns the version of the resource.
+func (v *ResourceVersion) Load() (interface{}, error) {
+	resource, err := models.NewStructForResourceName(v.Type)
+	if err != nil {
+		return nil, err
+	}
+	data, err := bson.Marshal(v.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return resource, bson.Unmarshal(data, resource)
+}
+
+// EnsureHistoryIndexes creates the index used to find versions, which also
+// stops two versions of a resource from having the same number.
+func EnsureHistoryIndexes() error {
+	return Database.C("history").EnsureIndex(mgo.Index{Key: []string{"type", "resourceid", "version"}, Unique: true})
+}
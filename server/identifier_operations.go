@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UniqueIdentifierHandler enforces UniqueIdentifiers when resources are
+// created, updated and deleted. A resource with an identifier that another
+// resource of its type holds is rejected with a 409 response before it is
+// stored. Claims are moved to the new resource's id, or released, once the
+// route has finished.
+func UniqueIdentifierHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resourceType := ResourceTypeFromPath(r.URL.Path)
+	if len(UniqueIdentifiers[resourceType]) == 0 {
+		next(rw, r)
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if r.Method == "DELETE" {
+		next(rw, r)
+		if w, ok := rw.(negroni.ResponseWriter); !ok || w.Status() < http.StatusBadRequest {
+			if err := ReleaseIdentifiers(resourceType, id, nil); err != nil {
+				log.Println("Releasing identifiers:", err)
+			}
+		}
+		return
+	}
+
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	holder := id
+	if holder == "" {
+		holder = "pending/" + bson.NewObjectId().Hex()
+	}
+	claims := UniqueIdentifierClaims(resourceType, holder, resource)
+	added, err := ClaimIdentifiers(claims)
+	if _, ok := err.(*DuplicateIdentifierError); ok {
+		WriteOperationOutcome(rw, http.StatusConflict, NewOperationOutcomeIssue("duplicate", err.Error()))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	next(rw, r)
+
+	stored := resourceId(context.Get(r, resourceType))
+	if w, ok := rw.(negroni.ResponseWriter); (ok && w.Status() >= http.StatusBadRequest) || stored == "" {
+		if err := WithdrawIdentifierClaims(added); err != nil {
+			log.Println("Withdrawing identifier claims:", err)
+		}
+		return
+	}
+	if stored != holder {
+		if _, err := Database.C("identifiers").UpdateAll(bson.M{"type": resourceType, "resourceid": holder}, bson.M{"$set": bson.M{"resourceid": stored}}); err != nil {
+			log.Println("Claiming identifiers:", err)
+		}
+	}
+	if err := ReleaseIdentifiers(resourceType, stored, claims); err != nil {
+		log.Println("Releasing identifiers:", err)
+	}
+}
+
+// IdentifierLookupHandler searches a resource type by identifier, as in
+// /Patient?identifier=urn:mrn|1234. An identifier from a system in
+// UniqueIdentifiers is resolved directly from its claim; others are searched
+// for as by BuildSearchQuery. The response is a bundle of the resources
+// found.
+func IdentifierLookupHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resourceType := ResourceTypeFromPath(r.URL.Path)
+	context.Set(r, "Action", "search")
+	context.Set(r, "Resource", resourceType)
+
+	params := r.URL.Query()
+	value := params.Get("identifier")
+	var keys []resourceKey
+	if parts := strings.SplitN(value, "|", 2); len(params) == 1 && len(params["identifier"]) == 1 && len(parts) == 2 &&
+		!strings.Contains(value, ",") && IsUniqueIdentifier(resourceType, parts[0]) {
+		id, err := FindByIdentifier(resourceType, parts[0], parts[1])
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+			return
+		}
+		if id != "" {
+			keys = append(keys, resourceKey{resourceType, id})
+		}
+	} else {
+		query, err := BuildSearchQuery(resourceType, params)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", err.Error()))
+			return
+		}
+		var ids []struct {
+			Id string `bson:"_id"`
+		}
+		if err := Database.C(CollectionName(resourceType)).Find(query).Select(bson.M{"_id": 1}).Sort("_id").Limit(100).All(&ids); err != nil {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+			return
+		}
+		for _, doc := range ids {
+			keys = append(keys, resourceKey{resourceType, doc.Id})
+		}
+	}
+
+	resources, err := loadResources(keys)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	bundle := &models.Bundle{Type: "Bundle", Title: resourceType + " Search", Id: bson.NewObjectId().Hex(), Updated: time.Now()}
+	bundle.Entry = bundleEntries(keys, resources)
+	bundle.TotalResults = len(bundle.Entry)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(bundle)
+}
+
+// RebuildIdentifiersHandler rebuilds the identifier claims, for use after
+// changing UniqueIdentifiers or loading resources directly into the database.
+// Duplicates already stored are reported with a 409 response.
+func RebuildIdentifiersHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	err := RebuildIdentifierClaims()
+	if _, ok := err.(*DuplicateIdentifierError); ok {
+		WriteOperationOutcome(rw, http.StatusConflict, NewOperationOutcomeIssue("duplicate", err.Error()))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	info := NewOperationOutcomeIssue("informational", "The identifier claims have been rebuilt")
+	info.Severity = "information"
+	WriteOperationOutcome(rw, http.StatusOK, info)
+}
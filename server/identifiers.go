@@ -0,0 +1,173 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// UniqueIdentifiers lists, by resource type, the identifier systems whose
+// values must be unique among resources of that type, e.g.
+//
+//	server.UniqueIdentifiers["Patient"] = []string{"urn:oid:1.2.36.146.595.217.0.1"}
+//
+// The system "*" makes every identifier of the type unique. Rules added after
+// resources have been stored take effect for them once RebuildIdentifierClaims
+// has run. The server warns when it starts if there is no rule for patients,
+// whose medical record numbers are given with the -mrn-system flag.
+var UniqueIdentifiers = map[string][]string{}
+
+// IdentifierClaim records that a resource holds a unique identifier. Claims
+// are kept in the identifiers collection, whose unique index on type, system
+// and value stops two resources of a type from holding the same identifier.
+// A resource being created holds its claims under a pending id until it has
+// been stored.
+type IdentifierClaim struct {
+	Type       string `bson:"type"`
+	System     string `bson:"system"`
+	Value      string `bson:"value"`
+	ResourceId string `bson:"resourceid"`
+}
+
+// DuplicateIdentifierError is returned when a resource is given a unique
+// identifier that another resource of its type already holds.
+type DuplicateIdentifierError struct {
+	IdentifierClaim
+}
+
+func (e *DuplicateIdentifierError) Error() string {
+	return fmt.Sprintf("%s/%s already has the identifier %s|%s", e.Type, e.ResourceId, e.System, e.Value)
+}
+
+// IsUniqueIdentifier reports whether identifiers from the system must be
+// unique among resources of the type.
+func IsUniqueIdentifier(resourceType, system string) bool {
+	for _, s := range UniqueIdentifiers[resourceType] {
+		if s == system || s == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// UniqueIdentifierClaims returns the claims a resource of the given type and
+// id needs for its unique identifiers.
+func UniqueIdentifierClaims(resourceType, id string, resource interface{}) []IdentifierClaim {
+	var claims []IdentifierClaim
+	models.ElementsAtPath(resource, "identifier", func(location string, element interface{}) {
+		identifier, ok := element.(models.Identifier)
+		if ok && identifier.Value != "" && IsUniqueIdentifier(resourceType, identifier.System) {
+			claims = append(claims, IdentifierClaim{resourceType, identifier.System, identifier.Value, id})
+		}
+	})
+	return claims
+}
+
+// ClaimIdentifiers records the claims, which must all be for the same
+// resource. If another resource holds one of the identifiers, the claims
+// added so far are withdrawn and a DuplicateIdentifierError is returned. It
+// returns the claims that were added, leaving out those the resource already
+// held.
+func ClaimIdentifiers(claims []IdentifierClaim) ([]IdentifierClaim, error) {
+	var added []IdentifierClaim
+	for _, claim := range claims {
+		err := Database.C("identifiers").Insert(claim)
+		if err == nil {
+			added = append(added, claim)
+			continue
+		}
+		if mgo.IsDup(err) {
+			holder := IdentifierClaim{}
+			if Database.C("identifiers").Find(bson.M{"type": claim.Type, "system": claim.System, "value": claim.Value}).One(&holder) == nil {
+				if holder.ResourceId == claim.ResourceId {
+					continue
+				}
+				err = &DuplicateIdentifierError{holder}
+			}
+		}
+		WithdrawIdentifierClaims(added)
+		return nil, err
+	}
+	return added, nil
+}
+
+// WithdrawIdentifierClaims removes the claims.
+func WithdrawIdentifierClaims(claims []IdentifierClaim) error {
+	for _, claim := range claims {
+		if err := Database.C("identifiers").Remove(claim); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReleaseIdentifiers removes the claims of a resource, except for those it
+// still needs.
+func ReleaseIdentifiers(resourceType, id string, keep []IdentifierClaim) error {
+	query := bson.M{"type": resourceType, "resourceid": id}
+	if len(keep) > 0 {
+		kept := make([]bson.M, len(keep))
+		for i, claim := range keep {
+			kept[i] = bson.M{"system": claim.System, "value": claim.Value}
+		}
+		query["$nor"] = kept
+	}
+	_, err := Database.C("identifiers").RemoveAll(query)
+	return err
+}
+
+// FindByIdentifier returns the id of the resource of the given type holding a
+// unique identifier, or "" if no resource holds it.
+func FindByIdentifier(resourceType, system, value string) (string, error) {
+	claim := IdentifierClaim{}
+	err := Database.C("identifiers").Find(bson.M{"type": resourceType, "system": system, "value": value}).One(&claim)
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+	return claim.ResourceId, err
+}
+
+// RebuildIdentifierClaims recreates the identifiers collection from the stored
+// resources. Every resource is claimed for, and the first duplicate found is
+// returned as a DuplicateIdentifierError once the others have been claimed.
+func RebuildIdentifierClaims() error {
+	if _, err := Database.C("identifiers").RemoveAll(nil); err != nil {
+		return err
+	}
+	if err := EnsureIdentifierIndexes(); err != nil {
+		return err
+	}
+	var duplicate error
+	for resourceType := range UniqueIdentifiers {
+		resource, err := models.NewStructForResourceName(resourceType)
+		if err != nil {
+			return err
+		}
+		iter := Database.C(CollectionName(resourceType)).Find(nil).Iter()
+		for iter.Next(resource) {
+			_, err := ClaimIdentifiers(UniqueIdentifierClaims(resourceType, resourceId(resource), resource))
+			if _, ok := err.(*DuplicateIdentifierError); ok && duplicate == nil {
+				duplicate = err
+			} else if !ok && err != nil {
+				iter.Close()
+				return err
+			}
+			resource, _ = models.NewStructForResourceName(resourceType)
+		}
+		if err := iter.Close(); err != nil {
+			return err
+		}
+	}
+	return duplicate
+}
+
+// EnsureIdentifierIndexes creates the unique index that enforces identifier
+// claims, and the index used to release a resource's claims.
+func EnsureIdentifierIndexes() error {
+	if err := Database.C("identifiers").EnsureIndex(mgo.Index{Key: []string{"type", "system", "value"}, Unique: true}); err != nil {
+		return err
+	}
+	return Database.C("identifiers").EnsureIndexKey("type", "resourceid")
+}
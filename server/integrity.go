@@ -0,0 +1,280 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// VerifyReferences lists the resource types that local references are
+// checked against when a resource is created or updated: a reference to a
+// resource of a listed type must point at one that exists. The type "*"
+// covers every type. External references, such as absolute URLs, and
+// references to contained resources are not checked. By default references to
+// patients, encounters and practitioners are checked.
+var VerifyReferences = map[string]bool{"Patient": true, "Encounter": true, "Practitioner": true}
+
+// DeletePolicy says what happens to the resources that refer to a resource
+// when it is deleted.
+type DeletePolicy string
+
+const (
+	// AllowDelete leaves the references dangling.
+	AllowDelete DeletePolicy = "allow"
+	// RestrictDelete rejects the delete, listing the referring resources.
+	RestrictDelete DeletePolicy = "restrict"
+	// CascadeDelete deletes the referring resources too, applying their own
+	// types' policies in turn.
+	CascadeDelete DeletePolicy = "cascade"
+)
+
+// DeletePolicies gives the DeletePolicy for each resource type that is
+// referred to. Types that are not listed use AllowDelete. By default patients,
+// encounters and practitioners cannot be deleted while other resources refer
+// to them.
+var DeletePolicies = map[string]DeletePolicy{
+	"Patient":      RestrictDelete,
+	"Encounter":    RestrictDelete,
+	"Practitioner": RestrictDelete,
+}
+
+// recordTypes are the types the server keeps as a record of what happened to
+// other resources. Their references are history: they do not stop a resource
+// from being deleted, are not deleted with it, and are not rewritten when
+// patients are merged.
+var recordTypes = map[string]bool{"Provenance": true, "SecurityEvent": true}
+
+// ReferenceError lists the resources that stop a resource from being deleted.
+type ReferenceError struct {
+	Type, Id string
+	// Referrers holds the referring resources as "Type/id".
+	Referrers []string
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("%s/%s cannot be deleted because %d other resources refer to it", e.Type, e.Id, len(e.Referrers))
+}
+
+// ReferentialIntegrityHandler applies VerifyReferences to resources being
+// created or updated, rejecting those with missing references with a 422
+// response, and DeletePolicies to resources being deleted, rejecting restricted
+// deletes with a 409 response that lists the referring resources. Cascaded
+// deletes are made with DeleteResource once the route has succeeded.
+func ReferentialIntegrityHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resourceType := ResourceTypeFromPath(r.URL.Path)
+	if r.Method == "DELETE" {
+		cascaded, err := PlanDelete(resourceType, mux.Vars(r)["id"])
+		if refErr, ok := err.(*ReferenceError); ok {
+			issues := []models.OperationOutcomeIssueComponent{NewOperationOutcomeIssue("conflict", err.Error())}
+			for _, referrer := range refErr.Referrers {
+				issues = append(issues, NewOperationOutcomeIssue("conflict", referrer+" refers to "+refErr.Type+"/"+refErr.Id))
+			}
+			WriteOperationOutcome(rw, http.StatusConflict, issues...)
+			return
+		} else if err != nil {
+			WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+			return
+		}
+		next(rw, r)
+		if w, ok := rw.(negroni.ResponseWriter); !ok || w.Status() < http.StatusBadRequest {
+			if err := CascadeDeletes(r, cascaded); err != nil {
+				log.Println("Cascading delete:", err)
+			}
+		}
+		return
+	}
+
+	if len(VerifyReferences) == 0 {
+		next(rw, r)
+		return
+	}
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	missing, err := MissingReferences(resource)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	if len(missing) > 0 {
+		var issues []models.OperationOutcomeIssueComponent
+		for _, reference := range missing {
+			issues = append(issues, NewOperationOutcomeIssue("not-found", "The referenced resource "+reference+" does not exist"))
+		}
+		WriteOperationOutcome(rw, 422, issues...)
+		return
+	}
+	next(rw, r)
+}
+
+func verifiesReferences(resourceType string) bool {
+	return VerifyReferences[resourceType] || VerifyReferences["*"]
+}
+
+// MissingReferences returns the local references in a resource to the types
+// in VerifyReferences, as "Type/id", whose targets do not exist.
+func MissingReferences(resource interface{}) ([]string, error) {
+	var missing []string
+	checked := make(map[resourceKey]bool)
+	var err error
+	models.WalkElements(resource, func(location string, element interface{}) {
+		ref, ok := element.(models.Reference)
+		if !ok || err != nil || !isLocalReference(ref) {
+			return
+		}
+		key := referenceKey(ref)
+		if checked[key] || !verifiesReferences(key.Type) {
+			return
+		}
+		checked[key] = true
+		if _, e := models.NewStructForResourceName(key.Type); e != nil {
+			missing = append(missing, key.Type+"/"+key.Id)
+			return
+		}
+		var n int
+		if n, err = Database.C(CollectionName(key.Type)).FindId(key.Id).Count(); err == nil && n == 0 {
+			missing = append(missing, key.Type+"/"+key.Id)
+		}
+	})
+	return missing, err
+}
+
+// isLocalReference reports whether a reference is to a resource on this
+// server, rather than an external or contained one.
+func isLocalReference(ref models.Reference) bool {
+	parsed := models.ParseReference(ref.Reference)
+	return parsed.Type != "" && !parsed.External
+}
+
+// referringQuery returns a query for the resources of a type with a local
+// reference to the given "Type/id", or nil if the type has no references.
+// Each of the type's reference paths is matched against the relative and
+// absolute forms of the reference, with or without a version; references to
+// other servers are not matched.
+func referringQuery(resourceType, reference string) bson.M {
+	resource, err := models.NewStructForResourceName(resourceType)
+	if err != nil {
+		return nil
+	}
+	var refs []bson.M
+	for _, path := range models.ReferencePaths(reflect.TypeOf(resource)) {
+		refs = append(refs, localReferenceClause(path, reference))
+	}
+	if len(refs) == 0 {
+		return nil
+	}
+	return bson.M{"$or": refs}
+}
+
+// localReferenceClause matches the Reference elements at a path that are
+// local references to the given "Type/id": its relative and absolute forms,
+// with or without a version.
+func localReferenceClause(path, reference string) bson.M {
+	forms := []string{reference, "/" + reference}
+	if models.BaseURL != "" {
+		forms = append(forms, strings.TrimRight(models.BaseURL, "/")+"/"+reference)
+	}
+	var values []interface{}
+	for _, form := range forms {
+		values = append(values, form, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(form+"/_history/") + "[^/]+$"})
+	}
+	return bson.M{path + ".reference": bson.M{"$in": values}}
+}
+
+// ReferringResources returns the resources of any type that refer to the
+// given resource, ordered by type and id. Provenance and SecurityEvents are
+// not included, since they only record what happened to the resource.
+func ReferringResources(resourceType, id string) ([]resourceKey, error) {
+	var keys []resourceKey
+	for _, referrer := range models.ResourceNames() {
+		if recordTypes[referrer] {
+			continue
+		}
+		query := referringQuery(referrer, resourceType+"/"+id)
+		if query == nil {
+			continue
+		}
+		var ids []struct {
+			Id string `bson:"_id"`
+		}
+		if err := Database.C(CollectionName(referrer)).Find(query).Select(bson.M{"_id": 1}).Sort("_id").All(&ids); err != nil {
+			return nil, err
+		}
+		for _, doc := range ids {
+			if referrer != resourceType || doc.Id != id {
+				keys = append(keys, resourceKey{referrer, doc.Id})
+			}
+		}
+	}
+	return keys, nil
+}
+
+// PlanDelete works out what deleting a resource involves under the
+// DeletePolicies. It returns the other resources that must be deleted with
+// it, or a ReferenceError if a resource that would be deleted is referred to
+// by one that would not and its type's policy is RestrictDelete.
+func PlanDelete(resourceType, id string) ([]resourceKey, error) {
+	root := resourceKey{resourceType, id}
+	planned := map[resourceKey]bool{root: true}
+	queue := []resourceKey{root}
+	var cascaded []resourceKey
+	restricted := make(map[resourceKey][]resourceKey)
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		policy := DeletePolicies[key.Type]
+		if policy == "" || policy == AllowDelete {
+			continue
+		}
+		referrers, err := ReferringResources(key.Type, key.Id)
+		if err != nil {
+			return nil, err
+		}
+		if policy == RestrictDelete {
+			restricted[key] = referrers
+			continue
+		}
+		for _, referrer := range referrers {
+			if !planned[referrer] {
+				planned[referrer] = true
+				queue = append(queue, referrer)
+				cascaded = append(cascaded, referrer)
+			}
+		}
+	}
+
+	for _, key := range append([]resourceKey{root}, cascaded...) {
+		var blocking []string
+		for _, referrer := range restricted[key] {
+			if !planned[referrer] {
+				blocking = append(blocking, referrer.Type+"/"+referrer.Id)
+			}
+		}
+		if len(blocking) > 0 {
+			return nil, &ReferenceError{key.Type, key.Id, blocking}
+		}
+	}
+	return cascaded, nil
+}
+
+// CascadeDeletes deletes the resources planned by PlanDelete with
+// DeleteResource, for the request r that deleted the first resource.
+func CascadeDeletes(r *http.Request, keys []resourceKey) error {
+	for _, key := range keys {
+		if err := DeleteResource(r, "cascade", key.Type, key.Id); err != nil && err != mgo.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// LastUpdatedHandler records the time a resource was created or updated in
+// its meta.lastUpdated field once the route has succeeded. An update replaces
+// the stored document, so the field is set again on every write.
+func LastUpdatedHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(rw, r)
+
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	resourceType, _ := context.Get(r, "Resource").(string)
+	id := resourceId(context.Get(r, resourceType))
+	if id == "" {
+		return
+	}
+	if err := Database.C(CollectionName(resourceType)).UpdateId(id, bson.M{"$set": bson.M{"meta.lastUpdated": time.Now()}}); err != nil {
+		log.Println("Recording last updated time:", err)
+	}
+}
+
+// sinceClause matches resources updated at or after a time. Resources without
+// meta.lastUpdated, such as those loaded directly into the database, are
+// matched by the creation time in their object id.
+func sinceClause(since time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"meta.lastUpdated": bson.M{"$gte": since}},
+		{"meta.lastUpdated": bson.M{"$exists": false}, "_id": bson.M{"$gte": bson.NewObjectIdWithTime(since).Hex()}},
+	}}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/terminology"
+)
+
+// CodeLookup is the result of looking up a code.
+type CodeLookup struct {
+	terminology.Concept
+	// Children lists the codes immediately below the concept.
+	Children []string
+}
+
+// LookupCode looks a code up in the concept store, falling back to the code
+// systems defined by value sets for systems that were not loaded from release
+// files.
+func LookupCode(system, code string) (*CodeLookup, error) {
+	if store := NewConceptStore(); store != nil {
+		concept, err := store.Lookup(system, code)
+		if err == nil {
+			lookup := &CodeLookup{Concept: *concept}
+			children, err := store.Children(system, code)
+			for _, child := range children {
+				lookup.Children = append(lookup.Children, child.Code)
+			}
+			return lookup, err
+		} else if err != terminology.ErrConceptNotFound {
+			return nil, err
+		}
+	}
+
+	define, err := FindCodeSystemDefinition(system)
+	if err != nil {
+		return nil, terminology.ErrConceptNotFound
+	}
+	found := findConcept(define.Concept, code)
+	if found == nil {
+		return nil, terminology.ErrConceptNotFound
+	}
+	lookup := &CodeLookup{Concept: terminology.Concept{System: system, Version: define.Version, Code: found.Code, Display: found.Display, Active: true, Designation: found.Designation}}
+	if parent := findParentConcept(define.Concept, code); parent != nil {
+		lookup.Parents = []string{parent.Code}
+	}
+	for _, child := range found.Concept {
+		lookup.Children = append(lookup.Children, child.Code)
+	}
+	return lookup, nil
+}
+
+// findParentConcept returns the concept immediately above code in a concept
+// hierarchy, or nil if code is at the top level or not found.
+func findParentConcept(concepts []models.ConceptDefinitionComponent, code string) *models.ConceptDefinitionComponent {
+	for i := range concepts {
+		for _, child := range concepts[i].Concept {
+			if child.Code == code {
+				return &concepts[i]
+			}
+		}
+		if found := findParentConcept(concepts[i].Concept, code); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// ValueSetLookupHandler implements the $lookup operation, which returns the
+// display, designations, properties and immediate parents and children of the
+// code given by the system and code parameters.
+func ValueSetLookupHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "lookup")
+	context.Set(r, "Resource", "ValueSet")
+
+	query := r.URL.Query()
+	system, code := query.Get("system"), query.Get("code")
+	if system == "" || code == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The system and code parameters are required"))
+		return
+	}
+	lookup, err := LookupCode(system, code)
+	if err == terminology.ErrConceptNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("code-unknown", "Unknown code "+code+" in "+system))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(LookupParameters(lookup))
+}
+
+// LookupParameters builds the $lookup response. Parents and children are
+// returned as parent and child properties.
+func LookupParameters(concept *CodeLookup) *models.Parameters {
+	params := models.NewParameters().Add(models.ParametersParameterComponent{Name: "name", ValueString: concept.System})
+	if concept.Version != "" {
+		params.Add(models.ParametersParameterComponent{Name: "version", ValueString: concept.Version})
+	}
+	params.Add(models.ParametersParameterComponent{Name: "display", ValueString: concept.Display})
+	inactive := !concept.Active
+	params.Add(models.ParametersParameterComponent{Name: "inactive", ValueBoolean: &inactive})
+	for _, d := range concept.Designation {
+		designation := models.ParametersParameterComponent{Name: "designation"}
+		if d.Language != "" {
+			designation.Part = append(designation.Part, models.ParametersParameterComponent{Name: "language", ValueCode: d.Language})
+		}
+		if d.Use.Code != "" {
+			use := d.Use
+			designation.Part = append(designation.Part, models.ParametersParameterComponent{Name: "use", ValueCoding: &use})
+		}
+		designation.Part = append(designation.Part, models.ParametersParameterComponent{Name: "value", ValueString: d.Value})
+		params.Add(designation)
+	}
+	names := make([]string, 0, len(concept.Properties))
+	for name := range concept.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		params.Add(models.ParametersParameterComponent{Name: "property", Part: []models.ParametersParameterComponent{
+			{Name: "code", ValueCode: name},
+			{Name: "value", ValueString: concept.Properties[name]},
+		}})
+	}
+	for _, parent := range concept.Parents {
+		params.Add(models.ParametersParameterComponent{Name: "property", Part: []models.ParametersParameterComponent{
+			{Name: "code", ValueCode: "parent"},
+			{Name: "value", ValueCode: parent},
+		}})
+	}
+	for _, child := range concept.Children {
+		params.Add(models.ParametersParameterComponent{Name: "property", Part: []models.ParametersParameterComponent{
+			{Name: "code", ValueCode: "child"},
+			{Name: "value", ValueCode: child},
+		}})
+	}
+	return params
+}
+
+// Subsumes tests whether codeA subsumes codeB in a code system, returning one
+// of the terminology package's subsumption outcomes. As with LookupCode, code
+// systems defined by value sets are used when the system was not loaded from
+// release files.
+func Subsumes(system, codeA, codeB string) (string, error) {
+	if store := NewConceptStore(); store != nil {
+		if found, err := store.HasSystem(system); err != nil {
+			return "", err
+		} else if found {
+			return store.Subsumes(system, codeA, codeB)
+		}
+	}
+
+	define, err := FindCodeSystemDefinition(system)
+	if err != nil {
+		return "", terminology.ErrConceptNotFound
+	}
+	a, b := findConcept(define.Concept, codeA), findConcept(define.Concept, codeB)
+	switch {
+	case a == nil || b == nil:
+		return "", terminology.ErrConceptNotFound
+	case codeA == codeB:
+		return terminology.Equivalent, nil
+	case findConcept(a.Concept, codeB) != nil:
+		return terminology.Subsumes, nil
+	case findConcept(b.Concept, codeA) != nil:
+		return terminology.SubsumedBy, nil
+	}
+	return terminology.NotSubsumed, nil
+}
+
+// ValueSetSubsumesHandler implements the $subsumes operation, which tests
+// whether the codeA parameter subsumes codeB in the given system. The outcome
+// is returned as the outcome parameter of a Parameters resource.
+func ValueSetSubsumesHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "subsumes")
+	context.Set(r, "Resource", "ValueSet")
+
+	query := r.URL.Query()
+	system, codeA, codeB := query.Get("system"), query.Get("codeA"), query.Get("codeB")
+	if system == "" || codeA == "" || codeB == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The system, codeA and codeB parameters are required"))
+		return
+	}
+	outcome, err := Subsumes(system, codeA, codeB)
+	if err == terminology.ErrConceptNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("code-unknown", "Unknown code in "+system))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(models.NewParameters().Add(models.ParametersParameterComponent{Name: "outcome", ValueCode: outcome}))
+}
+
+// DisplayEnrichmentHandler fills in the display of any coding in a created or
+// updated resource that has a system and code but no display, using the
+// concepts loaded from release files.
+func DisplayEnrichmentHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	store := NewConceptStore()
+	if store == nil {
+		next(rw, r)
+		return
+	}
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		next(rw, r)
+		return
+	}
+	if EnrichDisplays(store, resource) > 0 {
+		if body, err := json.Marshal(resource); err == nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+	}
+	next(rw, r)
+}
+
+// EnrichDisplays fills in missing coding displays in a resource from the
+// concept store, returning the number of displays added. Each code system is
+// checked once, and codes are only looked up in systems the store holds, so
+// resources coded from other systems cost a query per system, not per code.
+func EnrichDisplays(store *terminology.ConceptStore, resource interface{}) int {
+	added := 0
+	stored := make(map[string]bool)
+	models.WalkCodings(resource, func(location string, coding *models.Coding) {
+		if coding.Display != "" || coding.System == "" || coding.Code == "" {
+			return
+		}
+		has, checked := stored[coding.System]
+		if !checked {
+			has, _ = store.HasSystem(coding.System)
+			stored[coding.System] = has
+		}
+		if !has {
+			return
+		}
+		if coding.Display = store.Display(coding.System, coding.Code); coding.Display != "" {
+			added++
+		}
+	})
+	return added
+}
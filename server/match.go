@@ -0,0 +1,134 @@
+package server
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/intervention-engine/fhir/matching"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MatchConfig holds the weights and thresholds used to match patients.
+var MatchConfig = matching.DefaultConfig()
+
+// PatientMatch is a patient that may be the same person as a candidate, with
+// the result of comparing them.
+type PatientMatch struct {
+	Patient *models.Patient
+	matching.Result
+}
+
+// MatchPatients finds the stored patients that may be the same person as the
+// candidate, best match first. Only patients sharing an identifier, birth
+// date, phone number, the start of a family name, or the Soundex code of a
+// family or given name with the candidate are compared, and those that have
+// been merged into another patient are left out. A limit of zero returns
+// every match.
+func MatchPatients(candidate *models.Patient, limit int) ([]PatientMatch, error) {
+	query, err := matchQuery(candidate)
+	if query == nil || err != nil {
+		return nil, err
+	}
+	var matches []PatientMatch
+	patient := &models.Patient{}
+	iter := Database.C("patients").Find(query).Iter()
+	for iter.Next(patient) {
+		if result := MatchConfig.Compare(candidate, patient); result.Grade != "" && patient.Id != candidate.Id && !isReplaced(patient) {
+			matches = append(matches, PatientMatch{patient, result})
+		}
+		patient = &models.Patient{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(byScore(matches))
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches, nil
+}
+
+// byScore sorts matches from best to worst, and then by patient id.
+type byScore []PatientMatch
+
+func (m byScore) Len() int      { return len(m) }
+func (m byScore) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+func (m byScore) Less(i, j int) bool {
+	if m[i].Score != m[j].Score {
+		return m[i].Score > m[j].Score
+	}
+	return m[i].Patient.Id < m[j].Patient.Id
+}
+
+// matchQuery selects the patients worth comparing with a candidate, or
+// returns nil if the candidate has nothing to select them by. Patients with a
+// name that sounds like one of the candidate's are found by the NameKeys of
+// their facts.
+func matchQuery(candidate *models.Patient) (bson.M, error) {
+	var clauses []bson.M
+	for _, identifier := range candidate.Identifier {
+		if identifier.Value != "" {
+			clauses = append(clauses, bson.M{"identifier": bson.M{"$elemMatch": bson.M{"system": identifier.System, "value": identifier.Value}}})
+		}
+	}
+	if !candidate.BirthDate.Time.IsZero() {
+		clauses = append(clauses, bson.M{"birthDate.time": candidate.BirthDate.Time})
+	}
+	for _, name := range candidate.Name {
+		for _, family := range name.Family {
+			if letters := []rune(strings.TrimSpace(family)); len(letters) >= 2 {
+				clauses = append(clauses, bson.M{"name.family": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(string(letters[:2])), Options: "i"}})
+			}
+		}
+	}
+	for _, telecom := range candidate.Telecom {
+		if telecom.Value != "" {
+			clauses = append(clauses, bson.M{"telecom.value": telecom.Value})
+		}
+	}
+	if keys := nameKeys(candidate); len(keys) > 0 {
+		var ids []string
+		if err := Database.C("facts").Find(bson.M{"type": "Patient", "namekeys": bson.M{"$in": keys}}).Distinct("targetid", &ids); err != nil {
+			return nil, err
+		}
+		if len(ids) > 0 {
+			clauses = append(clauses, bson.M{"_id": bson.M{"$in": ids}})
+		}
+	}
+	if len(clauses) == 0 {
+		return nil, nil
+	}
+	return bson.M{"$or": clauses}, nil
+}
+
+// nameKeys returns the Soundex codes of a patient's family and given names,
+// as "family|S530" and "given|J500".
+func nameKeys(patient *models.Patient) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	add := func(kind string, names []string) {
+		for _, name := range names {
+			if code := matching.Soundex(name); code != "" && !seen[kind+"|"+code] {
+				seen[kind+"|"+code] = true
+				keys = append(keys, kind+"|"+code)
+			}
+		}
+	}
+	for _, name := range patient.Name {
+		add("family", name.Family)
+		add("given", name.Given)
+	}
+	return keys
+}
+
+func isReplaced(patient *models.Patient) bool {
+	for _, link := range patient.Link {
+		if link.Type == "replace" {
+			return true
+		}
+	}
+	return false
+}
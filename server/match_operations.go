@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// MatchPageSize is the number of matches $match returns when no count is
+// given.
+var MatchPageSize = 10
+
+// PatientMatchHandler implements the $match operation. The request body is a
+// Patient, which need not be stored, and the response is a Parameters
+// resource with the total number of matches and a match parameter for each of
+// the best count of them, with parts giving the patient, the score from 0 to 1
+// and the grade: certain, probable or possible.
+func PatientMatchHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "match")
+	context.Set(r, "Resource", "Patient")
+
+	count, err := optionalInt(r.URL.Query().Get("count"), MatchPageSize)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count: "+err.Error()))
+		return
+	}
+	candidate := &models.Patient{}
+	if err := json.NewDecoder(r.Body).Decode(candidate); err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	matches, err := MatchPatients(candidate, 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	total := len(matches)
+	result := models.NewParameters().Add(models.ParametersParameterComponent{Name: "total", ValueInteger: &total})
+	for i, match := range matches {
+		if count > 0 && i == count {
+			break
+		}
+		score := match.Score
+		result.Add(models.ParametersParameterComponent{Name: "match", Part: []models.ParametersParameterComponent{
+			{Name: "patient", ValueUri: "Patient/" + match.Patient.Id},
+			{Name: "score", ValueDecimal: &score},
+			{Name: "grade", ValueCode: match.Grade},
+		}})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(result)
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Measure is a proportion measure. Each population is a PatientFilter, which
+// is evaluated for a measurement period: criteria on facts other than Patient
+// facts must fall within the period unless they give their own window or set
+// AnyTime, and ages are measured at the end of the period.
+//
+// The populations nest in the usual way. The denominator is taken from the
+// initial population (and is the whole initial population if no criteria are
+// given), exclusions from the denominator, the numerator from the
+// denominator less exclusions, and exceptions from the denominator patients
+// that are neither excluded nor in the numerator.
+type Measure struct {
+	Name                  string         `json:"name,omitempty"`
+	InitialPopulation     *PatientFilter `json:"initialPopulation"`
+	Denominator           *PatientFilter `json:"denominator,omitempty"`
+	DenominatorExclusions *PatientFilter `json:"denominatorExclusions,omitempty"`
+	Numerator             *PatientFilter `json:"numerator"`
+	DenominatorExceptions *PatientFilter `json:"denominatorExceptions,omitempty"`
+}
+
+// MeasureReport is the result of evaluating a Measure for a period.
+type MeasureReport struct {
+	Measure     string             `json:"measure,omitempty"`
+	PeriodStart time.Time          `json:"periodStart"`
+	PeriodEnd   time.Time          `json:"periodEnd"`
+	Populations MeasurePopulations `json:"populations"`
+	// PerformanceRate is the numerator over the denominator less exclusions
+	// and exceptions. It is nil if that is empty.
+	PerformanceRate *float64 `json:"performanceRate,omitempty"`
+
+	initialPopulation, denominator, exclusions, numerator, exceptions PatientSet
+}
+
+// MeasurePopulations holds the number of patients in each population.
+type MeasurePopulations struct {
+	InitialPopulation     int `json:"initialPopulation"`
+	Denominator           int `json:"denominator"`
+	DenominatorExclusions int `json:"denominatorExclusions"`
+	Numerator             int `json:"numerator"`
+	DenominatorExceptions int `json:"denominatorExceptions"`
+}
+
+// MeasureMembership records the populations a patient is in.
+type MeasureMembership struct {
+	Patient              string `json:"patient"`
+	InitialPopulation    bool   `json:"initialPopulation"`
+	Denominator          bool   `json:"denominator"`
+	DenominatorExclusion bool   `json:"denominatorExclusion"`
+	Numerator            bool   `json:"numerator"`
+	DenominatorException bool   `json:"denominatorException"`
+}
+
+// EvaluateMeasure calculates a measure for the period from start up to end.
+func EvaluateMeasure(m *Measure, start, end time.Time) (*MeasureReport, error) {
+	if m.InitialPopulation == nil || m.Numerator == nil {
+		return nil, errors.New("A measure must have an initial population and a numerator")
+	}
+	ctx := NewFilterContext()
+	ctx.Now, ctx.PeriodStart, ctx.PeriodEnd = end, &start, &end
+
+	report := &MeasureReport{Measure: m.Name, PeriodStart: start, PeriodEnd: end}
+	var err error
+	if report.initialPopulation, err = m.InitialPopulation.Evaluate(ctx); err != nil {
+		return nil, err
+	}
+	if report.denominator, err = evaluatePopulation(ctx, m.Denominator, report.initialPopulation, report.initialPopulation); err != nil {
+		return nil, err
+	}
+	if report.exclusions, err = evaluatePopulation(ctx, m.DenominatorExclusions, report.denominator, PatientSet{}); err != nil {
+		return nil, err
+	}
+	remaining := report.denominator.Subtract(report.exclusions)
+	if report.numerator, err = evaluatePopulation(ctx, m.Numerator, remaining, PatientSet{}); err != nil {
+		return nil, err
+	}
+	if report.exceptions, err = evaluatePopulation(ctx, m.DenominatorExceptions, remaining.Subtract(report.numerator), PatientSet{}); err != nil {
+		return nil, err
+	}
+
+	report.Populations = MeasurePopulations{
+		InitialPopulation:     len(report.initialPopulation),
+		Denominator:           len(report.denominator),
+		DenominatorExclusions: len(report.exclusions),
+		Numerator:             len(report.numerator),
+		DenominatorExceptions: len(report.exceptions),
+	}
+	if eligible := len(remaining) - len(report.exceptions); eligible > 0 {
+		rate := float64(len(report.numerator)) / float64(eligible)
+		report.PerformanceRate = &rate
+	}
+	return report, nil
+}
+
+// evaluatePopulation returns the patients in within that match the filter, or
+// empty if there is no filter.
+func evaluatePopulation(ctx *FilterContext, f *PatientFilter, within, empty PatientSet) (PatientSet, error) {
+	if f == nil {
+		return empty, nil
+	}
+	matched, err := f.Evaluate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return within.Intersect(matched), nil
+}
+
+// Members returns the membership of each patient in the initial population,
+// in order of patient id.
+func (r *MeasureReport) Members() []MeasureMembership {
+	ids := r.initialPopulation.Ids()
+	members := make([]MeasureMembership, len(ids))
+	for i, id := range ids {
+		members[i] = MeasureMembership{
+			Patient:              id,
+			InitialPopulation:    true,
+			Denominator:          r.denominator[id],
+			DenominatorExclusion: r.exclusions[id],
+			Numerator:            r.numerator[id],
+			DenominatorException: r.exceptions[id],
+		}
+	}
+	return members
+}
+
+// WriteJSON writes the report with the membership of every patient in the
+// initial population, flushing as it goes so that large reports are
+// streamed.
+func (r *MeasureReport) WriteJSON(w io.Writer) error {
+	summary, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	// Open up the summary object to append the patients to it.
+	if _, err := w.Write(append(summary[:len(summary)-1], []byte(`,"patients":[`)...)); err != nil {
+		return err
+	}
+	for i, member := range r.Members() {
+		body, err := json.Marshal(member)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			body = append([]byte(",\n"), body...)
+		}
+		if _, err := w.Write(body); err != nil {
+			return err
+		}
+		flushEvery(w, i)
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// WriteCSV writes the membership of every patient in the initial population
+// as CSV, with a 1 or 0 for each population.
+func (r *MeasureReport) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"patient", "initial-population", "denominator", "denominator-exclusion", "numerator", "denominator-exception"})
+	flag := func(b bool) string {
+		if b {
+			return "1"
+		}
+		return "0"
+	}
+	for i, m := range r.Members() {
+		out.Write([]string{m.Patient, flag(m.InitialPopulation), flag(m.Denominator), flag(m.DenominatorExclusion), flag(m.Numerator), flag(m.DenominatorException)})
+		if i%100 == 99 {
+			out.Flush()
+			flushEvery(w, i)
+		}
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// flushEvery flushes w to the client after every hundred rows.
+func flushEvery(w io.Writer, row int) {
+	if f, ok := w.(http.Flusher); ok && row%100 == 99 {
+		f.Flush()
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+)
+
+// MeasureEvaluateHandler implements the $evaluate operation, which calculates
+// the Measure posted as the request body for the period given by the
+// periodStart and periodEnd parameters. Each is a date of any precision, and
+// the period runs to the end of periodEnd, so periodStart=2014&periodEnd=2014
+// is the whole of 2014. The report is streamed as JSON, or as CSV with one
+// row per patient if _format=csv is given or text/csv is accepted.
+func MeasureEvaluateHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "evaluate")
+	context.Set(r, "Resource", "Measure")
+
+	query := r.URL.Query()
+	if query.Get("periodStart") == "" || query.Get("periodEnd") == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The periodStart and periodEnd parameters are required"))
+		return
+	}
+	start, _, err := parseSearchDate(query.Get("periodStart"))
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid periodStart: "+err.Error()))
+		return
+	}
+	_, end, err := parseSearchDate(query.Get("periodEnd"))
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid periodEnd: "+err.Error()))
+		return
+	}
+
+	measure := &Measure{}
+	if err := json.NewDecoder(r.Body).Decode(measure); err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	report, err := EvaluateMeasure(measure, start, end)
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	if query.Get("_format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		rw.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		err = report.WriteCSV(rw)
+	} else {
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		err = report.WriteJSON(rw)
+	}
+	if err != nil {
+		log.Println("Writing measure report:", err)
+	}
+}
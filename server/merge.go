@@ -0,0 +1,361 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// PatientMerge records the merge of a duplicate patient into another, with
+// every reference it rewrote, so that the merge can be undone. Merges are
+// kept in the merges collection after they are undone.
+type PatientMerge struct {
+	Id     string    `bson:"_id" json:"id"`
+	Source string    `bson:"source" json:"source"`
+	Target string    `bson:"target" json:"target"`
+	Merged time.Time `bson:"merged" json:"merged"`
+	// Unmerged is set once the merge has been undone.
+	Unmerged *time.Time `bson:"unmerged,omitempty" json:"unmerged,omitempty"`
+	// SourceActive is the source patient's active flag before the merge.
+	SourceActive *bool              `bson:"sourceActive,omitempty" json:"sourceActive,omitempty"`
+	Rewrites     []ReferenceRewrite `bson:"rewrites" json:"rewrites"`
+}
+
+// ReferenceRewrite records a reference that a merge pointed at the target
+// patient: the resource, the Mongo path of the Reference within it (e.g.
+// "performer.1") and the original reference. ReferencedID is set if the
+// Reference's referenceid was rewritten too. Version is the version of the
+// resource that the merge kept.
+type ReferenceRewrite struct {
+	Type         string `bson:"type" json:"type"`
+	Id           string `bson:"id" json:"id"`
+	Path         string `bson:"path" json:"path"`
+	Reference    string `bson:"reference" json:"reference"`
+	ReferencedID bool   `bson:"referencedId,omitempty" json:"referencedId,omitempty"`
+	Version      string `bson:"version,omitempty" json:"version,omitempty"`
+}
+
+// MergePatients merges the source patient into the target. The source is
+// marked inactive with a replace link to the target, the target gets a
+// seealso link back to the source, and every reference to the source in
+// other resources is pointed at the target. Each changed resource is recorded
+// with RecordServerWrite as written for the request r.
+func MergePatients(r *http.Request, sourceId, targetId string) (*PatientMerge, error) {
+	if sourceId == targetId {
+		return nil, errors.New("A patient cannot be merged into itself")
+	}
+	source, target := &models.Patient{}, &models.Patient{}
+	if err := Database.C("patients").FindId(sourceId).One(source); err != nil {
+		return nil, errors.New("Source patient " + sourceId + " not found")
+	}
+	if err := Database.C("patients").FindId(targetId).One(target); err != nil {
+		return nil, errors.New("Target patient " + targetId + " not found")
+	}
+	for _, link := range source.Link {
+		if link.Type == "replace" {
+			return nil, errors.New("Patient " + sourceId + " has already been replaced by " + link.Other.Reference)
+		}
+	}
+
+	merge := &PatientMerge{Id: bson.NewObjectId().Hex(), Source: sourceId, Target: targetId, Merged: time.Now(), SourceActive: source.Active}
+	rewrites, err := rewritePatientReferences(r, sourceId, targetId)
+	merge.Rewrites = rewrites
+	if err != nil {
+		// Record what was rewritten so that it can be undone
+		Database.C("merges").Insert(merge)
+		return nil, err
+	}
+
+	if err := Database.C("patients").UpdateId(sourceId, bson.M{
+		"$set":  bson.M{"active": false},
+		"$push": bson.M{"link": models.PatientLinkComponent{Other: models.Reference{Reference: "Patient/" + targetId}, Type: "replace"}},
+	}); err != nil {
+		return nil, err
+	}
+	if err := RecordServerWrite(r, "$merge", "Patient", sourceId); err != nil {
+		return nil, err
+	}
+	if err := Database.C("patients").UpdateId(targetId, bson.M{
+		"$push": bson.M{"link": models.PatientLinkComponent{Other: models.Reference{Reference: "Patient/" + sourceId}, Type: "seealso"}},
+	}); err != nil {
+		return nil, err
+	}
+	if err := RecordServerWrite(r, "$merge", "Patient", targetId); err != nil {
+		return nil, err
+	}
+	if err := Database.C("merges").Insert(merge); err != nil {
+		return nil, err
+	}
+
+	refreshMergedFacts(merge.Rewrites)
+	if err := RemoveFacts("Patient", sourceId); err != nil {
+		log.Println("Removing facts for merged patient:", err)
+	}
+	return merge, nil
+}
+
+// UnmergePatient undoes the most recent merge of the source patient. Each
+// resource the merge rewrote is restored to the version before the merge if
+// it has not changed since; otherwise the references the merge rewrote are
+// pointed back at the source unless they have since been changed. The links
+// the merge added are removed. Each changed resource is recorded with
+// RecordServerWrite as written for the request r.
+func UnmergePatient(r *http.Request, sourceId string) (*PatientMerge, error) {
+	merge := &PatientMerge{}
+	err := Database.C("merges").Find(bson.M{"source": sourceId, "unmerged": nil}).Sort("-merged").One(merge)
+	if err == mgo.ErrNotFound {
+		return nil, errors.New("Patient " + sourceId + " has not been merged")
+	} else if err != nil {
+		return nil, err
+	}
+
+	target := "Patient/" + merge.Target
+	var restored []resourceKey
+	reverted := make(map[resourceKey]bool)
+	for _, rewrite := range merge.Rewrites {
+		key := resourceKey{rewrite.Type, rewrite.Id}
+		if rewrite.Version != "" {
+			ok, err := restorePreviousVersion(rewrite.Type, rewrite.Id, rewrite.Version)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				reverted[key] = true
+				restored = append(restored, key)
+			}
+		}
+		if reverted[key] {
+			continue
+		}
+		current, _ := replacePatientReference(rewrite.Reference, merge.Source, merge.Target)
+		set := bson.M{rewrite.Path + ".reference": rewrite.Reference}
+		if rewrite.ReferencedID {
+			set[rewrite.Path+".referenceid"] = merge.Source
+		}
+		err := Database.C(CollectionName(rewrite.Type)).Update(bson.M{"_id": rewrite.Id, rewrite.Path + ".reference": current}, bson.M{"$set": set})
+		if err == nil {
+			restored = append(restored, key)
+		} else if err != mgo.ErrNotFound {
+			return nil, err
+		}
+	}
+	done := make(map[resourceKey]bool)
+	for _, key := range restored {
+		if !done[key] {
+			done[key] = true
+			if err := RecordServerWrite(r, "$unmerge", key.Type, key.Id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	active := bson.M{"$unset": bson.M{"active": ""}}
+	if merge.SourceActive != nil {
+		active = bson.M{"$set": bson.M{"active": *merge.SourceActive}}
+	}
+	if err := Database.C("patients").UpdateId(merge.Source, active); err != nil {
+		return nil, err
+	}
+	if err := Database.C("patients").UpdateId(merge.Source, bson.M{"$pull": bson.M{"link": bson.M{"other.reference": target, "type": "replace"}}}); err != nil {
+		return nil, err
+	}
+	if err := RecordServerWrite(r, "$unmerge", "Patient", merge.Source); err != nil {
+		return nil, err
+	}
+	err = Database.C("patients").UpdateId(merge.Target, bson.M{"$pull": bson.M{"link": bson.M{"other.reference": "Patient/" + merge.Source, "type": "seealso"}}})
+	if err == nil {
+		err = RecordServerWrite(r, "$unmerge", "Patient", merge.Target)
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, err
+	}
+	now := time.Now()
+	merge.Unmerged = &now
+	if err := Database.C("merges").UpdateId(merge.Id, bson.M{"$set": bson.M{"unmerged": now}}); err != nil {
+		return nil, err
+	}
+
+	refreshMergedFacts(merge.Rewrites)
+	source := &models.Patient{}
+	if err := Database.C("patients").FindId(merge.Source).One(source); err == nil {
+		if err := UpdateFacts("Patient", source); err != nil {
+			log.Println("Restoring facts for unmerged patient:", err)
+		}
+	}
+	return merge, nil
+}
+
+// MergedPatients returns the ids of the patients merged into a patient, and
+// of those merged into them in turn, whose merges have not been undone.
+func MergedPatients(id string) ([]string, error) {
+	var merged []string
+	seen := map[string]bool{id: true}
+	for queue := []string{id}; len(queue) > 0; queue = queue[1:] {
+		var merges []PatientMerge
+		if err := Database.C("merges").Find(bson.M{"target": queue[0], "unmerged": nil}).All(&merges); err != nil {
+			return nil, err
+		}
+		for _, merge := range merges {
+			if !seen[merge.Source] {
+				seen[merge.Source] = true
+				merged = append(merged, merge.Source)
+				queue = append(queue, merge.Source)
+			}
+		}
+	}
+	return merged, nil
+}
+
+// rewritePatientReferences points every reference to the source patient, in
+// resources of any type but Provenance and SecurityEvents, at the target.
+// Those record what happened to the source, so they keep referring to it.
+func rewritePatientReferences(r *http.Request, sourceId, targetId string) ([]ReferenceRewrite, error) {
+	rewrites := []ReferenceRewrite{}
+	for _, resourceType := range models.ResourceNames() {
+		if recordTypes[resourceType] {
+			continue
+		}
+		query := referringQuery(resourceType, "Patient/"+sourceId)
+		if query == nil {
+			continue
+		}
+		if resourceType == "Patient" {
+			query["_id"] = bson.M{"$nin": []string{sourceId, targetId}}
+		}
+
+		collection := Database.C(CollectionName(resourceType))
+		var doc bson.M
+		iter := collection.Find(query).Iter()
+		for iter.Next(&doc) {
+			id, _ := doc["_id"].(string)
+			first := len(rewrites)
+			set := bson.M{}
+			findReferences(doc, "", func(path string, ref bson.M) {
+				reference, _ := ref["reference"].(string)
+				replaced, ok := replacePatientReference(reference, sourceId, targetId)
+				if !ok {
+					return
+				}
+				rewrite := ReferenceRewrite{Type: resourceType, Id: id, Path: path, Reference: reference}
+				set[path+".reference"] = replaced
+				if ref["referenceid"] == sourceId {
+					set[path+".referenceid"] = targetId
+					rewrite.ReferencedID = true
+				}
+				rewrites = append(rewrites, rewrite)
+			})
+			if len(set) > 0 {
+				err := collection.UpdateId(id, bson.M{"$set": set})
+				if err == nil {
+					err = RecordServerWrite(r, "$merge", resourceType, id)
+				}
+				if err == nil {
+					var version string
+					version, err = currentVersion(resourceType, id)
+					for i := first; i < len(rewrites); i++ {
+						rewrites[i].Version = version
+					}
+				}
+				if err != nil {
+					iter.Close()
+					return rewrites, err
+				}
+			}
+			doc = nil
+		}
+		if err := iter.Close(); err != nil {
+			return rewrites, err
+		}
+	}
+	return rewrites, nil
+}
+
+// findReferences calls fn with the Mongo path and value of every Reference in
+// a document.
+func findReferences(value interface{}, path string, fn func(path string, ref bson.M)) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+	switch v := value.(type) {
+	case bson.M:
+		if _, ok := v["reference"].(string); ok && path != "" {
+			fn(path, v)
+		}
+		for key, child := range v {
+			findReferences(child, join(key), fn)
+		}
+	case []interface{}:
+		for i, child := range v {
+			findReferences(child, join(strconv.Itoa(i)), fn)
+		}
+	}
+}
+
+// replacePatientReference points a local reference to Patient/from, or a
+// version of it, at Patient/to, keeping the base URL of an absolute
+// reference and the /_history/{version} suffix of a versioned one. It
+// reports false if the reference is not a local reference to Patient/from.
+func replacePatientReference(reference, from, to string) (string, bool) {
+	parsed := models.ParseReference(reference)
+	if parsed.Type != "Patient" || parsed.Id != from || parsed.External {
+		return "", false
+	}
+	replaced := "Patient/" + to
+	if parsed.Base != "" {
+		replaced = strings.TrimRight(parsed.Base, "/") + "/" + replaced
+	}
+	if parsed.Version != "" {
+		replaced += "/_history/" + parsed.Version
+	}
+	return replaced, true
+}
+
+// restorePreviousVersion replaces a resource with the version kept before the
+// given one, unless the resource has changed since that version. It reports
+// whether the resource was restored.
+func restorePreviousVersion(resourceType, id, version string) (bool, error) {
+	var versions []ResourceVersion
+	if err := Database.C("history").Find(bson.M{"type": resourceType, "resourceid": id}).Sort("-saved").All(&versions); err != nil {
+		return false, err
+	}
+	for i, v := range versions {
+		if v.Version != version || i+1 == len(versions) {
+			continue
+		}
+		err := Database.C(CollectionName(resourceType)).Update(bson.M{"_id": id, "meta.versionId": version}, versions[i+1].Resource)
+		if err == mgo.ErrNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// refreshMergedFacts recomputes the facts for the resources a merge touched.
+func refreshMergedFacts(rewrites []ReferenceRewrite) {
+	done := make(map[resourceKey]bool)
+	for _, rewrite := range rewrites {
+		key := resourceKey{rewrite.Type, rewrite.Id}
+		if _, ok := FactExtractors[rewrite.Type]; !ok || done[key] {
+			continue
+		}
+		done[key] = true
+		resource, _ := models.NewStructForResourceName(rewrite.Type)
+		if err := Database.C(CollectionName(rewrite.Type)).FindId(rewrite.Id).One(resource); err != nil {
+			continue
+		}
+		if err := UpdateFacts(rewrite.Type, resource); err != nil {
+			log.Println("Updating facts after merge:", err)
+		}
+	}
+}
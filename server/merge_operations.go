@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// PatientMergeHandler implements the $merge operation. The request body is a
+// Parameters resource with source and target parameters, each a valueUri
+// reference such as "Patient/1234". The response is a Parameters resource
+// with the id of the merge and the number of references rewritten.
+func PatientMergeHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "merge")
+	context.Set(r, "Resource", "Patient")
+
+	params, err := decodeParameters(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	source, target := patientParameter(params, "source"), patientParameter(params, "target")
+	if source == "" || target == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The source and target parameters are required"))
+		return
+	}
+	merge, err := MergePatients(r, source, target)
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("processing", err.Error()))
+		return
+	}
+	writeMerge(rw, merge)
+}
+
+// PatientUnmergeHandler implements the $unmerge operation, which undoes the
+// most recent merge of the patient given by the source parameter.
+func PatientUnmergeHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "unmerge")
+	context.Set(r, "Resource", "Patient")
+
+	params, err := decodeParameters(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	source := patientParameter(params, "source")
+	if source == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The source parameter is required"))
+		return
+	}
+	merge, err := UnmergePatient(r, source)
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("processing", err.Error()))
+		return
+	}
+	writeMerge(rw, merge)
+}
+
+func decodeParameters(r *http.Request) (*models.Parameters, error) {
+	params := &models.Parameters{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	return params, err
+}
+
+// patientParameter returns the patient id from the named parameter.
+func patientParameter(params *models.Parameters, name string) string {
+	for _, p := range params.Parameter {
+		if p.Name == name {
+			return strings.TrimPrefix(p.ValueUri, "Patient/")
+		}
+	}
+	return ""
+}
+
+func writeMerge(rw http.ResponseWriter, merge *PatientMerge) {
+	rewritten := len(merge.Rewrites)
+	result := models.NewParameters().
+		Add(models.ParametersParameterComponent{Name: "merge", ValueString: merge.Id}).
+		Add(models.ParametersParameterComponent{Name: "rewritten", ValueInteger: &rewritten})
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(result)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"reflect"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// RegisterOperationRoutes registers the routes for FHIR operations such as
+// $expand and $verify, for the /websocket subscription channel, for
+// compartment searches, for searches by identifier and Provenance target, and
+// for canonical reads. It must be called before RegisterRoutes, so that
+// type-level operations like /ValueSet/$expand are not mistaken for resource
+// ids.
+func RegisterOperationRoutes(router *mux.Router, config map[string][]negroni.Handler) {
+
+	router.Path("/websocket").Methods("GET").Handler(negroni.New(append(config["WebSocket"], negroni.HandlerFunc(DefaultWebSocketHub.WebSocketHandler))...))
+
+	router.Path("/ConceptMap/$translate").Methods("GET").Handler(negroni.New(append(config["ConceptMapTranslate"], negroni.HandlerFunc(ConceptMapTranslateHandler))...))
+	router.Path("/ConceptMap/{id}/$translate").Methods("GET").Handler(negroni.New(append(config["ConceptMapTranslate"], negroni.HandlerFunc(ConceptMapTranslateHandler))...))
+
+	router.Path("/Group/{id}/$members").Methods("GET").Handler(negroni.New(append(config["GroupMembers"], negroni.HandlerFunc(GroupMembersHandler))...))
+	router.Path("/Group/{id}/$refresh").Methods("POST").Handler(negroni.New(append(config["GroupRefresh"], negroni.HandlerFunc(GroupRefreshHandler))...))
+
+	router.Path("/Measure/$evaluate").Methods("POST").Handler(negroni.New(append(config["MeasureEvaluate"], negroni.HandlerFunc(MeasureEvaluateHandler))...))
+
+	router.Path("/Patient/$cohort").Methods("POST").Handler(negroni.New(append(config["PatientCohort"], negroni.HandlerFunc(PatientCohortHandler))...))
+	router.Path("/Patient/$match").Methods("POST").Handler(negroni.New(append(config["PatientMatch"], negroni.HandlerFunc(PatientMatchHandler))...))
+	router.Path("/Patient/$merge").Methods("POST").Handler(negroni.New(append(config["PatientMerge"], negroni.HandlerFunc(PatientMergeHandler))...))
+	router.Path("/Patient/$unmerge").Methods("POST").Handler(negroni.New(append(config["PatientUnmerge"], negroni.HandlerFunc(PatientUnmergeHandler))...))
+	router.Path("/Patient/{id}/$disclosures").Methods("GET").Handler(negroni.New(append(config["PatientDisclosures"], negroni.HandlerFunc(PatientDisclosuresHandler))...))
+	router.Path("/Patient/{id}/$everything").Methods("GET").Handler(negroni.New(append(config["PatientEverything"], negroni.HandlerFunc(PatientEverythingHandler))...))
+
+	router.Path("/Provenance").Methods("GET").Queries("target", "{target}").Handler(negroni.New(append(config["ProvenanceTarget"], negroni.HandlerFunc(ProvenanceTargetHandler))...))
+
+	router.Path("/Query/{id}/$execute").Methods("POST").Handler(negroni.New(append(config["QueryExecute"], negroni.HandlerFunc(QueryExecuteHandler))...))
+
+	router.Path("/ValueSet/$expand").Methods("GET").Handler(negroni.New(append(config["ValueSetExpand"], negroni.HandlerFunc(ValueSetExpandHandler))...))
+	router.Path("/ValueSet/{id}/$expand").Methods("GET").Handler(negroni.New(append(config["ValueSetExpand"], negroni.HandlerFunc(ValueSetExpandHandler))...))
+	router.Path("/ValueSet/$lookup").Methods("GET").Handler(negroni.New(append(config["ValueSetLookup"], negroni.HandlerFunc(ValueSetLookupHandler))...))
+	router.Path("/ValueSet/$subsumes").Methods("GET").Handler(negroni.New(append(config["ValueSetSubsumes"], negroni.HandlerFunc(ValueSetSubsumesHandler))...))
+	router.Path("/ValueSet/$validate-code").Methods("GET").Handler(negroni.New(append(config["ValueSetValidateCode"], negroni.HandlerFunc(ValueSetValidateCodeHandler))...))
+	router.Path("/ValueSet/{id}/$validate-code").Methods("GET").Handler(negroni.New(append(config["ValueSetValidateCode"], negroni.HandlerFunc(ValueSetValidateCodeHandler))...))
+
+	for _, name := range models.ResourceNames() {
+		router.Path("/"+name+"/{id}").Methods("GET").Queries("_format", "canonical").Handler(negroni.New(append(config["CanonicalRead"], negroni.HandlerFunc(CanonicalReadHandler))...))
+		router.Path("/" + name + "/{id}/$verify").Methods("GET").Handler(negroni.New(append(config["ResourceVerify"], negroni.HandlerFunc(ResourceVerifyHandler))...))
+		resource, _ := models.NewStructForResourceName(name)
+		if _, ok := models.ElementType(reflect.TypeOf(resource).Elem(), "identifier"); ok {
+			router.Path("/"+name).Methods("GET").Queries("identifier", "{identifier}").Handler(negroni.New(append(config["IdentifierLookup"], negroni.HandlerFunc(IdentifierLookupHandler))...))
+		}
+	}
+	for name := range Compartments {
+		router.Path("/{compartment:" + name + "}/{id}/{type}").Methods("GET").Handler(negroni.New(append(config["CompartmentSearch"], negroni.HandlerFunc(CompartmentSearchHandler))...))
+	}
+}
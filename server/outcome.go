@@ -0,0 +1,26 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// WriteOperationOutcome responds with the given status code and an
+// OperationOutcome made up of the given issues.
+func WriteOperationOutcome(rw http.ResponseWriter, status int, issues ...models.OperationOutcomeIssueComponent) {
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(models.OperationOutcome{Issue: issues})
+}
+
+// NewOperationOutcomeIssue builds an error issue of the given issue-type code.
+func NewOperationOutcomeIssue(code, details string) models.OperationOutcomeIssueComponent {
+	return models.OperationOutcomeIssueComponent{
+		Severity: "error",
+		Type:     models.Coding{System: "http://hl7.org/fhir/issue-type", Code: code},
+		Details:  details,
+	}
+}
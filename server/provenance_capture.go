@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ProvenancePolicy is the policy recorded on captured Provenance that does not
+// name its own, such as the URL of the server's data governance policy.
+var ProvenancePolicy string
+
+// ProvenanceHandler records a Provenance for each resource created or updated
+// by a route, targeting the exact version stored. A client may describe the
+// write by sending a Provenance resource in the X-Provenance header, as JSON
+// or base64 encoded JSON; the server fills in what it leaves out. It should
+// come before HistoryHandler, so that the version has been kept when the
+// Provenance is recorded.
+func ProvenanceHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	provenance, err := requestProvenance(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", "Invalid X-Provenance header: "+err.Error()))
+		return
+	}
+
+	next(rw, r)
+
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	action, _ := context.Get(r, "Action").(string)
+	resourceType, _ := context.Get(r, "Resource").(string)
+	if (action != "create" && action != "update") || resourceType == "Provenance" {
+		return
+	}
+	id := resourceId(context.Get(r, resourceType))
+	if id == "" {
+		return
+	}
+	if err := RecordProvenance(r, provenance, resourceType, id); err != nil {
+		log.Println("Recording provenance:", err)
+	}
+}
+
+// requestProvenance decodes the Provenance a request sent in its
+// X-Provenance header, or returns an empty one.
+func requestProvenance(r *http.Request) (*models.Provenance, error) {
+	provenance := &models.Provenance{}
+	header := strings.TrimSpace(r.Header.Get("X-Provenance"))
+	if header == "" {
+		return provenance, nil
+	}
+	data := []byte(header)
+	if !strings.HasPrefix(header, "{") {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(header); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(data, provenance); err != nil {
+		return nil, err
+	}
+	return provenance, nil
+}
+
+// RecordProvenance stores a Provenance for the current version of a resource
+// written by a request. Its target is replaced with the version, and it is
+// recorded now. Unless the client gave them, the agents are the requesting
+// user and the client software, the period is the moment of the write, the
+// reason is the interaction, and the policy is ProvenancePolicy. If
+// ProvenanceSigner is set the version is signed; a signature sent by the
+// client is discarded.
+func RecordProvenance(r *http.Request, provenance *models.Provenance, resourceType, id string) error {
+	version, err := currentVersion(resourceType, id)
+	if err != nil {
+		return err
+	}
+	target := resourceType + "/" + id
+	if version != "" {
+		target += "/_history/" + version
+	}
+
+	now := models.FHIRDateTime{Time: time.Now(), Precision: models.Timestamp}
+	provenance.Id = bson.NewObjectId().Hex()
+	provenance.Target = []models.Reference{{Reference: target, Type: resourceType, ReferencedID: id}}
+	provenance.Recorded = now
+	if provenance.Period.Start.Time.IsZero() && provenance.Period.End.Time.IsZero() {
+		provenance.Period = models.Period{Start: now, End: now}
+	}
+	if len(provenance.Reason.Coding) == 0 && provenance.Reason.Text == "" {
+		action, _ := context.Get(r, "Action").(string)
+		provenance.Reason = models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/restful-interaction", Code: action}}}
+	}
+	if len(provenance.Policy) == 0 && ProvenancePolicy != "" {
+		provenance.Policy = []string{ProvenancePolicy}
+	}
+	if len(provenance.Agent) == 0 {
+		provenance.Agent = requestAgents(r)
+	}
+	provenance.IntegritySignature = ""
+	if ProvenanceSigner != nil {
+		if provenance.IntegritySignature, err = signResource(resourceType, id, version); err != nil {
+			return err
+		}
+	}
+	return Database.C(CollectionName("Provenance")).Insert(provenance)
+}
+
+// requestAgents describes who made a request: the authenticated user, if
+// any, as the enterer, and the client software with its network address.
+func requestAgents(r *http.Request) []models.ProvenanceAgentComponent {
+	role := models.Coding{System: "http://hl7.org/fhir/provenance-participant-role", Code: "enterer"}
+	var agents []models.ProvenanceAgentComponent
+	if principal := RequestPrincipal(r); principal != nil && principal.Subject != "" {
+		agents = append(agents, models.ProvenanceAgentComponent{
+			Role:      role,
+			Type:      models.Coding{System: "http://hl7.org/fhir/provenance-participant-type", Code: "person"},
+			Reference: principal.Subject,
+			Display:   principal.Subject,
+		})
+	}
+	software := r.UserAgent()
+	if software == "" {
+		software = "Unknown client"
+	}
+	return append(agents, models.ProvenanceAgentComponent{
+		Role:      role,
+		Type:      models.Coding{System: "http://hl7.org/fhir/provenance-participant-type", Code: "software"},
+		Reference: clientAddress(r),
+		Display:   software,
+	})
+}
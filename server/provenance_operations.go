@@ -0,0 +1,41 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ProvenanceTargetHandler serves GET /Provenance?target=..., which finds the
+// Provenance of a resource, oldest first. A target of Type/id matches the
+// Provenance of every version of the resource, and Type/id/_history/n that of
+// one version. Other search parameters may be given to narrow the search.
+func ProvenanceTargetHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "search")
+	context.Set(r, "Resource", "Provenance")
+
+	query, err := BuildSearchQuery("Provenance", r.URL.Query())
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+	var result []models.Provenance
+	if err := Database.C(CollectionName("Provenance")).Find(query).Sort("recorded.time", "_id").Limit(100).All(&result); err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	context.Set(r, "Provenance", result)
+
+	bundle := &models.Bundle{Type: "Bundle", Title: "Provenance Search", Id: bson.NewObjectId().Hex(), Updated: time.Now(), TotalResults: len(result)}
+	for _, provenance := range result {
+		bundle.Entry = append(bundle.Entry, models.BundleEntry{Title: "Provenance " + provenance.Id, Id: "Provenance/" + provenance.Id, Content: provenance})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(bundle)
+}
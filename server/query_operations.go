@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// QueryPageSize is the number of patient references returned in a page of a
+// Query response when no count is given.
+var QueryPageSize = 50
+
+// Extension URLs for the paging parameters in a Query response's first,
+// previous, next and last links.
+const (
+	QueryOffsetUrl = "http://interventionengine.org/query/offset"
+	QueryCountUrl  = "http://interventionengine.org/query/count"
+)
+
+// ExecuteQuery runs a Query's pipeline over the facts collection and fills in
+// its Response with the total number of matching patients, a page of
+// references to them starting at offset, and the paging parameters for the
+// first, previous, next and last pages.
+func ExecuteQuery(q *models.Query, offset, count int) error {
+	pipeline, err := q.ToPipeline()
+	if err != nil {
+		return err
+	}
+	// Count the patients and fetch the page in the database, rather than
+	// loading every matching id
+	var counted struct {
+		Total int `bson:"total"`
+	}
+	countPipeline := append(append([]bson.M{}, pipeline...), bson.M{"$group": bson.M{"_id": nil, "total": bson.M{"$sum": 1}}})
+	if err := Database.C("facts").Pipe(countPipeline).One(&counted); err != nil && err != mgo.ErrNotFound {
+		return err
+	}
+	var patients []struct {
+		Id string `bson:"_id"`
+	}
+	pagePipeline := append(append([]bson.M{}, pipeline...), bson.M{"$skip": offset}, bson.M{"$limit": count})
+	if err := Database.C("facts").Pipe(pagePipeline).All(&patients); err != nil {
+		return err
+	}
+
+	total := counted.Total
+	response := models.QueryResponseComponent{
+		Identifier: bson.NewObjectId().Hex(),
+		Outcome:    "ok",
+		Total:      float64(total),
+		Parameter:  q.Parameter,
+		First:      queryPage(0, count),
+	}
+	for _, patient := range patients {
+		response.Reference = append(response.Reference, models.Reference{Reference: "Patient/" + patient.Id, Type: "Patient", ReferencedID: patient.Id})
+	}
+	if offset > 0 {
+		previous := offset - count
+		if previous < 0 {
+			previous = 0
+		}
+		response.Previous = queryPage(previous, count)
+	}
+	if offset+count < total {
+		response.Next = queryPage(offset+count, count)
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / count * count
+	}
+	response.Last = queryPage(last, count)
+	q.Response = response
+	return nil
+}
+
+func queryPage(offset, count int) []models.Extension {
+	return []models.Extension{{Url: QueryOffsetUrl, ValueInteger: offset}, {Url: QueryCountUrl, ValueInteger: count}}
+}
+
+// QueryExecutionHandler runs a Query being created, so that it is stored with
+// the first page of its response. Queries with unsupported or invalid
+// parameters are rejected with a 422 response.
+func QueryExecutionHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+		return
+	}
+	q := resource.(*models.Query)
+	if err := ExecuteQuery(q, 0, QueryPageSize); err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	body, err := json.Marshal(q)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	next(rw, r)
+}
+
+// QueryExecuteHandler implements the $execute operation, which runs a stored
+// Query again, saves and returns it with a fresh response. The offset and
+// count parameters select the page of patients returned. Since it saves the
+// Query, it is only served for POST.
+func QueryExecuteHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "execute")
+	q, err := LoadQuery(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	}
+
+	params := r.URL.Query()
+	offset, err := optionalInt(params.Get("offset"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid offset: "+err.Error()))
+		return
+	}
+	count, err := optionalInt(params.Get("count"), QueryPageSize)
+	if err != nil || count == 0 {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count"))
+		return
+	}
+
+	if err := ExecuteQuery(q, offset, count); err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	if err := Database.C("querys").UpdateId(q.Id, bson.M{"$set": bson.M{"response": q.Response}}); err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+	context.Set(r, "Query", q)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(q)
+}
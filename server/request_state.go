@@ -0,0 +1,76 @@
+package server
+
+import (
+	stdcontext "context"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// requestState is what is learned about a request while it is handled. It is
+// kept in the request's context, so that it is shared by the middleware in
+// front of the router and the route that handles the request. The router
+// hands each route a copy of the request, so what a route puts in the gorilla
+// context, which is keyed by request, is not visible to the middleware in
+// front of it; RouteContextMiddleware copies it here once the route is done.
+type requestState struct {
+	Principal *Principal
+	Vars      map[string]string
+	Values    map[interface{}]interface{}
+}
+
+type requestStateKey struct{}
+
+// withRequestState returns the request with a requestState in its context,
+// adding one unless it already has one.
+func withRequestState(r *http.Request) (*http.Request, *requestState) {
+	if state := getRequestState(r); state != nil {
+		return r, state
+	}
+	state := &requestState{}
+	return r.WithContext(stdcontext.WithValue(r.Context(), requestStateKey{}, state)), state
+}
+
+func getRequestState(r *http.Request) *requestState {
+	state, _ := r.Context().Value(requestStateKey{}).(*requestState)
+	return state
+}
+
+// RouteContextMiddleware is router middleware that copies the gorilla context
+// and URL variables of each route's request to its requestState once the
+// route is done, and then clears the route's gorilla context.
+func RouteContextMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		defer context.Clear(r)
+		next.ServeHTTP(rw, r)
+		if state := getRequestState(r); state != nil {
+			state.Vars = mux.Vars(r)
+			state.Values = context.GetAll(r)
+		}
+	})
+}
+
+// requestValue returns a value a route put in the gorilla context, given the
+// route's request or the request as seen in front of the router.
+func requestValue(r *http.Request, key interface{}) interface{} {
+	if value, ok := context.GetOk(r, key); ok {
+		return value
+	}
+	if state := getRequestState(r); state != nil {
+		return state.Values[key]
+	}
+	return nil
+}
+
+// requestVars returns the URL variables of the route that handled a request,
+// given the route's request or the request as seen in front of the router.
+func requestVars(r *http.Request) map[string]string {
+	if vars := mux.Vars(r); vars != nil {
+		return vars
+	}
+	if state := getRequestState(r); state != nil && state.Vars != nil {
+		return state.Vars
+	}
+	return map[string]string{}
+}
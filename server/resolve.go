@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Resolve loads the resource a reference points at. References to resources
+// on this server, whether relative or absolute, are resolved to the stored
+// resource, or to a version from its history if the reference names one.
+// Contained references, such as "#med1", are resolved against the contained
+// resources of container, which may be nil for other references. External
+// references cannot be resolved.
+func Resolve(ref models.Reference, container interface{}) (interface{}, error) {
+	parsed := models.ParseReference(ref.Reference)
+	if parsed.Type == "" && parsed.Contained == "" && !parsed.External && ref.Type != "" && ref.ReferencedID != "" {
+		parsed.Type, parsed.Id = ref.Type, ref.ReferencedID
+	}
+	switch {
+	case parsed.Contained != "":
+		return containedResource(container, parsed.Contained)
+	case parsed.External:
+		return nil, fmt.Errorf("%s is not a reference to this server", ref.Reference)
+	case parsed.Type == "":
+		return nil, fmt.Errorf("%q is not a reference to a resource", ref.Reference)
+	case parsed.Version != "":
+		return LoadVersion(parsed.Type, parsed.Id, parsed.Version)
+	}
+
+	resource, err := models.NewStructForResourceName(parsed.Type)
+	if err != nil {
+		return nil, err
+	}
+	err = Database.C(CollectionName(parsed.Type)).FindId(parsed.Id).One(resource)
+	if err == mgo.ErrNotFound {
+		return nil, fmt.Errorf("%s/%s not found", parsed.Type, parsed.Id)
+	}
+	return resource, err
+}
+
+// containedResource finds the resource with the given id among the contained
+// resources of a container.
+func containedResource(container interface{}, id string) (interface{}, error) {
+	v := reflect.Indirect(reflect.ValueOf(container))
+	var contained reflect.Value
+	if v.Kind() == reflect.Struct {
+		contained = v.FieldByName("Contained")
+	}
+	if !contained.IsValid() || contained.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("No resource to find contained resource #%s in", id)
+	}
+	for i := 0; i < contained.Len(); i++ {
+		var doc map[string]interface{}
+		switch c := contained.Index(i).Interface().(type) {
+		case map[string]interface{}:
+			doc = c
+		case bson.M:
+			doc = c
+		default:
+			continue
+		}
+		if doc["id"] != id && doc["_id"] != id {
+			continue
+		}
+		resourceType, _ := doc["resourceType"].(string)
+		resource, err := models.NewStructForResourceName(resourceType)
+		if err != nil {
+			return nil, fmt.Errorf("Contained resource #%s has unknown type %q", id, resourceType)
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		return resource, json.Unmarshal(data, resource)
+	}
+	return nil, fmt.Errorf("No contained resource #%s", id)
+}
@@ -0,0 +1,313 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SearchParameterAliases maps FHIR search parameter names to element paths
+// where the two differ, by resource type. Other parameters are taken to be
+// element paths, with hyphenated names such as value-quantity converted to
+// their camel case element names.
+var SearchParameterAliases = map[string]map[string]string{
+	"Condition":        {"patient": "subject", "onset": "onsetDate", "date-asserted": "dateAsserted"},
+	"DiagnosticReport": {"patient": "subject", "date": "diagnosticDateTime"},
+	"Encounter":        {"patient": "subject", "date": "period.start"},
+	"Observation":      {"patient": "subject", "date": "appliesDateTime"},
+	"Procedure":        {"patient": "subject"},
+}
+
+// CollectionName returns the name of the collection a resource type is stored
+// in.
+func CollectionName(resourceType string) string {
+	return strings.ToLower(resourceType) + "s"
+}
+
+// ParseSearchCriteria splits search criteria in the form used by
+// Subscription.criteria, e.g. "Observation?name=http://loinc.org|2951-2",
+// into the resource type and a query for its collection.
+func ParseSearchCriteria(criteria string) (string, bson.M, error) {
+	parts := strings.SplitN(strings.TrimPrefix(criteria, "/"), "?", 2)
+	resourceType := parts[0]
+	params := url.Values{}
+	if len(parts) == 2 {
+		var err error
+		if params, err = url.ParseQuery(parts[1]); err != nil {
+			return "", nil, err
+		}
+	}
+	query, err := BuildSearchQuery(resourceType, params)
+	return resourceType, query, err
+}
+
+// BuildSearchQuery translates search parameters into a query on the
+// resource type's collection. The kind of match depends on the type of the
+// element searched:
+//
+//	CodeableConcept, Coding     [system]|code or code
+//	Identifier                  [system]|value or value
+//	Reference                   Type/id or id
+//	FHIRDateTime, Period        date, optionally prefixed with >, >=, <, <=
+//	Quantity and numbers        number, optionally prefixed as for dates
+//	string                      case-insensitive prefix, or exact with :exact
+//	HumanName, Address, ...     as for string, against any of their parts
+//
+// Comma separated values match any of the values, and a parameter may be
+// given more than once to require all of its values. The :missing modifier
+// matches resources that do or do not have the element.
+func BuildSearchQuery(resourceType string, params url.Values) (bson.M, error) {
+	resource, err := models.NewStructForResourceName(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(resource).Elem()
+
+	var clauses []bson.M
+	for _, key := range sortedParams(params) {
+		name, modifier := key, ""
+		if i := strings.Index(key, ":"); i >= 0 {
+			name, modifier = key[:i], key[i+1:]
+		}
+		if name == "_id" {
+			for _, value := range params[key] {
+				clauses = append(clauses, bson.M{"_id": bson.M{"$in": strings.Split(value, ",")}})
+			}
+			continue
+		}
+		if strings.HasPrefix(name, "_") {
+			// Result parameters such as _count do not restrict the search
+			continue
+		}
+
+		path := searchPath(resourceType, name)
+		elementType, ok := models.ElementType(t, path)
+		if !ok {
+			return nil, fmt.Errorf("Unknown search parameter %s for %s", name, resourceType)
+		}
+		for _, value := range params[key] {
+			clause, err := searchClause(path, elementType, modifier, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid value for search parameter %s: %s", key, err)
+			}
+			clauses = append(clauses, clause)
+		}
+	}
+
+	switch len(clauses) {
+	case 0:
+		return bson.M{}, nil
+	case 1:
+		return clauses[0], nil
+	}
+	return bson.M{"$and": clauses}, nil
+}
+
+// searchPath returns the element path searched by a parameter.
+func searchPath(resourceType, name string) string {
+	if path, ok := SearchParameterAliases[resourceType][name]; ok {
+		return path
+	}
+	parts := strings.Split(name, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+func searchClause(path string, t reflect.Type, modifier, value string) (bson.M, error) {
+	if modifier == "missing" {
+		missing, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{path: bson.M{"$exists": !missing}}, nil
+	} else if modifier != "" && modifier != "exact" {
+		return nil, fmt.Errorf("unsupported modifier %s", modifier)
+	}
+
+	var alternatives []bson.M
+	for _, v := range strings.Split(value, ",") {
+		clause, err := searchValueClause(path, t, modifier, v)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, clause)
+	}
+	if len(alternatives) == 1 {
+		return alternatives[0], nil
+	}
+	return bson.M{"$or": alternatives}, nil
+}
+
+func searchValueClause(path string, t reflect.Type, modifier, value string) (bson.M, error) {
+	list := t.Kind() == reflect.Slice
+	for t.Kind() == reflect.Slice || t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case reflect.TypeOf(models.CodeableConcept{}):
+		return tokenClause(path+".coding", true, "system", "code", value), nil
+	case reflect.TypeOf(models.Coding{}):
+		return tokenClause(path, list, "system", "code", value), nil
+	case reflect.TypeOf(models.Identifier{}):
+		return tokenClause(path, list, "system", "value", value), nil
+	case reflect.TypeOf(models.Reference{}):
+		return bson.M{path + ".reference": bson.M{"$regex": "(^|/)" + regexp.QuoteMeta(value) + "(/_history/[^/]+)?$"}}, nil
+	case reflect.TypeOf(models.FHIRDateTime{}):
+		return dateClause(path+".time", path+".time", value)
+	case reflect.TypeOf(models.Period{}):
+		return dateClause(path+".start.time", path+".end.time", value)
+	case reflect.TypeOf(models.Quantity{}):
+		return numberClause(path+".value", value)
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		if modifier == "exact" {
+			return bson.M{path: value}, nil
+		}
+		return bson.M{path: bson.M{"$regex": "^" + regexp.QuoteMeta(value), "$options": "i"}}, nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{path: b}, nil
+	case reflect.Int, reflect.Int32, reflect.Int64, reflect.Float32, reflect.Float64:
+		return numberClause(path, value)
+	case reflect.Struct:
+		// Search every string part of a compound element such as HumanName
+		var parts []bson.M
+		for _, name := range models.Elements(t) {
+			partType, _ := models.ElementType(t, name)
+			if partType.Kind() == reflect.String {
+				clause, _ := searchValueClause(path+"."+name, partType, modifier, value)
+				parts = append(parts, clause)
+			}
+		}
+		if len(parts) > 0 {
+			return bson.M{"$or": parts}, nil
+		}
+	}
+	return nil, fmt.Errorf("elements of type %s cannot be searched", t.Name())
+}
+
+// tokenClause matches "system|code", "|code" (no system) or "code" (any
+// system). In a list both parts must match the same element.
+func tokenClause(path string, list bool, systemField, codeField, value string) bson.M {
+	parts := strings.SplitN(value, "|", 2)
+	match := bson.M{codeField: parts[0]}
+	if len(parts) == 2 {
+		match[codeField] = parts[1]
+		if parts[0] == "" {
+			match[systemField] = bson.M{"$exists": false}
+		} else {
+			match[systemField] = parts[0]
+		}
+	}
+	if list {
+		return bson.M{path: bson.M{"$elemMatch": match}}
+	}
+	clause := bson.M{}
+	for field, v := range match {
+		clause[path+"."+field] = v
+	}
+	return clause
+}
+
+var comparisonPrefixes = []struct{ prefix, op string }{
+	{">=", "$gte"}, {"<=", "$lte"}, {">", "$gt"}, {"<", "$lt"},
+	{"ge", "$gte"}, {"le", "$lte"}, {"gt", "$gt"}, {"lt", "$lt"}, {"eq", ""},
+}
+
+func splitComparison(value string) (string, string) {
+	for _, p := range comparisonPrefixes {
+		if strings.HasPrefix(value, p.prefix) {
+			return p.op, strings.TrimPrefix(value, p.prefix)
+		}
+	}
+	return "", value
+}
+
+func numberClause(path, value string) (bson.M, error) {
+	op, value := splitComparison(value)
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, err
+	}
+	if op == "" {
+		return bson.M{path: n}, nil
+	}
+	return bson.M{path: bson.M{op: n}}, nil
+}
+
+var searchDateLayouts = []struct {
+	layout string
+	next   func(time.Time) time.Time
+}{
+	{"2006-01-02T15:04:05Z07:00", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02T15:04Z07:00", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+// parseSearchDate returns the range of instants covered by a date at the
+// precision it was given in, e.g. the whole of a day for "2014-05-01".
+func parseSearchDate(value string) (time.Time, time.Time, error) {
+	for _, l := range searchDateLayouts {
+		if t, err := time.Parse(l.layout, value); err == nil {
+			return t, l.next(t), nil
+		}
+	}
+	return time.Time{}, time.Time{}, errors.New("unrecognized date " + value)
+}
+
+// dateClause matches dates, or periods whose start and end are stored at
+// different paths, against a date that may be prefixed with a comparison.
+// Without a prefix the element must fall within the range covered by the
+// date.
+func dateClause(startPath, endPath, value string) (bson.M, error) {
+	op, value := splitComparison(value)
+	start, end, err := parseSearchDate(value)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "$gt":
+		return bson.M{endPath: bson.M{"$gte": end}}, nil
+	case "$gte":
+		return bson.M{endPath: bson.M{"$gte": start}}, nil
+	case "$lt":
+		return bson.M{startPath: bson.M{"$lt": start}}, nil
+	case "$lte":
+		return bson.M{startPath: bson.M{"$lt": end}}, nil
+	}
+	if startPath == endPath {
+		return bson.M{startPath: bson.M{"$gte": start, "$lt": end}}, nil
+	}
+	return bson.M{startPath: bson.M{"$gte": start}, endPath: bson.M{"$lt": end}}, nil
+}
+
+func sortedParams(params url.Values) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -2,9 +2,15 @@ package server
 
 import (
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"github.com/codegangsta/negroni"
 	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
 	"gopkg.in/mgo.v2"
 )
 
@@ -12,6 +18,9 @@ type FHIRServer struct {
 	DatabaseHost     string
 	Router           *mux.Router
 	MiddlewareConfig map[string][]negroni.Handler
+	// Authenticator, if set, requires every request to carry a valid bearer
+	// token.
+	Authenticator *Authenticator
 }
 
 func (f *FHIRServer) AddMiddleware(key string, middleware negroni.Handler) {
@@ -23,6 +32,41 @@ func NewServer(databaseHost string) *FHIRServer {
 	server.Router = mux.NewRouter()
 	server.Router.StrictSlash(true)
 	server.Router.KeepContext = true
+	server.Router.Use(RouteContextMiddleware)
+
+	for _, action := range []string{"Create", "Update", "Delete"} {
+		server.AddMiddleware("Subscription"+action, negroni.HandlerFunc(SubscriptionAccessHandler))
+	}
+	server.AddMiddleware("SecurityEventUpdate", negroni.HandlerFunc(ReadOnlyHandler))
+	server.AddMiddleware("SecurityEventDelete", negroni.HandlerFunc(ReadOnlyHandler))
+	for _, name := range models.ResourceNames() {
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(ValidationHandler))
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(BindingValidationHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(ValidationHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(BindingValidationHandler))
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(DisplayEnrichmentHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(DisplayEnrichmentHandler))
+		for _, action := range []string{"Create", "Update", "Delete"} {
+			server.AddMiddleware(name+action, negroni.HandlerFunc(ReferentialIntegrityHandler))
+			server.AddMiddleware(name+action, negroni.HandlerFunc(UniqueIdentifierHandler))
+		}
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(ProvenanceHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(ProvenanceHandler))
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(HistoryHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(HistoryHandler))
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(LastUpdatedHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(LastUpdatedHandler))
+		server.AddMiddleware(name+"Create", negroni.HandlerFunc(SubscriptionHandler))
+		server.AddMiddleware(name+"Update", negroni.HandlerFunc(SubscriptionHandler))
+	}
+	for name := range FactExtractors {
+		for _, action := range []string{"Create", "Update", "Delete"} {
+			server.AddMiddleware(name+action, negroni.HandlerFunc(FactsHandler))
+		}
+	}
+	server.AddMiddleware("GroupCreate", negroni.HandlerFunc(GroupMembershipHandler))
+	server.AddMiddleware("GroupUpdate", negroni.HandlerFunc(GroupMembershipHandler))
+	server.AddMiddleware("QueryCreate", negroni.HandlerFunc(QueryExecutionHandler))
 	return server
 }
 
@@ -37,13 +81,77 @@ func (f *FHIRServer) Run() {
 	defer MongoSession.Close()
 
 	Database = MongoSession.DB("fhir")
+	if err = EnsureFactIndexes(); err != nil {
+		panic(err)
+	}
+	if err = EnsureIdentifierIndexes(); err != nil {
+		panic(err)
+	}
+	if len(UniqueIdentifiers["Patient"]) == 0 {
+		log.Println("WARNING: No medical record number system is configured with -mrn-system, so patients with the same MRN can be stored")
+	}
+	if err = EnsureHistoryIndexes(); err != nil {
+		panic(err)
+	}
+	if err = EnsureDisclosureIndexes(); err != nil {
+		panic(err)
+	}
+	if models.BaseURL == "" {
+		host, _ := os.Hostname()
+		models.BaseURL = "http://" + host + ":3001"
+	}
 
+	RegisterOperationRoutes(f.Router, f.MiddlewareConfig)
+	if f.Authenticator != nil && f.Authenticator.AdminScope != "" {
+		RegisterAdminRoutes(f.Router, f.MiddlewareConfig)
+	} else {
+		log.Println("The /admin routes are disabled, since they need an Authenticator with an admin scope")
+	}
 	RegisterRoutes(f.Router, f.MiddlewareConfig)
 
+	// The workers stop when the server does, writing the audit events that
+	// are still queued.
+	stop := make(chan struct{})
+	auditDone := make(chan struct{})
+	go DefaultDeliveryQueue.Run(stop)
+	go func() {
+		DefaultAuditLog.Run(stop)
+		close(auditDone)
+	}()
+	var stopOnce sync.Once
+	shutdown := func() {
+		stopOnce.Do(func() {
+			close(stop)
+			<-auditDone
+			DefaultAuditLog.Flush()
+		})
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Println("Shutting down")
+		shutdown()
+		MongoSession.Close()
+		os.Exit(0)
+	}()
+
 	n := negroni.Classic()
+	n.Use(negroni.HandlerFunc(AuditHandler))
+	n.Use(negroni.HandlerFunc(CORSHandler))
+	if f.Authenticator != nil {
+		n.Use(negroni.HandlerFunc(f.Authenticator.Handler))
+	} else {
+		log.Println("WARNING: No Authenticator is configured, so every request is allowed without authentication")
+	}
 	// for _, m := range f.Middleware {
 	// 	n.Use(m)
 	// }
 	n.UseHandler(f.Router)
-	n.Run(":3001")
+	log.Println("Listening on :3001")
+	err = http.ListenAndServe(":3001", n)
+	shutdown()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
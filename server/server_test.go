@@ -1,16 +1,33 @@
 package server
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/terminology"
 	"github.com/pebbe/util"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
@@ -18,10 +35,11 @@ import (
 )
 
 type ServerSuite struct {
-	Session   *mgo.Session
-	Router    *mux.Router
-	Server    *httptest.Server
-	FixtureId string
+	Session           *mgo.Session
+	Router            *mux.Router
+	Server            *httptest.Server
+	FixtureId         string
+	ValueSetFixtureId string
 }
 
 func Test(t *testing.T) { TestingT(t) }
@@ -40,6 +58,9 @@ func (s *ServerSuite) SetUpSuite(c *C) {
 	s.Router = mux.NewRouter()
 	s.Router.StrictSlash(true)
 	s.Router.KeepContext = true
+	s.Router.Use(RouteContextMiddleware)
+	RegisterOperationRoutes(s.Router, make(map[string][]negroni.Handler))
+	RegisterAdminRoutes(s.Router, make(map[string][]negroni.Handler))
 	RegisterRoutes(s.Router, make(map[string][]negroni.Handler))
 
 	// Create httptest server
@@ -53,6 +74,16 @@ func (s *ServerSuite) SetUpSuite(c *C) {
 	patient.Id = s.FixtureId
 	err = patientCollection.Insert(patient)
 	util.CheckErr(err)
+
+	// Add value set fixtures
+	valueSetCollection := Database.C("valuesets")
+	for _, fixture := range []string{"valueset-example-codesystem.json", "valueset-example-diabetes.json"} {
+		vs := LoadValueSetFromFixture("../fixtures/" + fixture)
+		vs.Id = bson.NewObjectId().Hex()
+		s.ValueSetFixtureId = vs.Id
+		err = valueSetCollection.Insert(vs)
+		util.CheckErr(err)
+	}
 }
 
 func (s *ServerSuite) TearDownSuite(c *C) {
@@ -72,6 +103,21 @@ func (s *ServerSuite) TestGetPatient(c *C) {
 	c.Assert(patient.Name[0].Family[0], Equals, "Donald")
 }
 
+func (s *ServerSuite) TestGetPatientCanonical(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient/" + s.FixtureId + "?_format=canonical")
+	util.CheckErr(err)
+	body, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+
+	patient := &models.Patient{}
+	util.CheckErr(Database.C("patients").FindId(s.FixtureId).One(patient))
+	canonical, err := models.CanonicalJSON(patient, models.CanonicalOptions{})
+	util.CheckErr(err)
+	c.Assert(string(body), Equals, string(canonical))
+	c.Assert(strings.HasPrefix(string(body), `{"`), Equals, true)
+	c.Assert(strings.Contains(string(body), `"id":"`+s.FixtureId+`"`), Equals, true)
+}
+
 func (s *ServerSuite) TestShowPatient(c *C) {
 	res, err := http.Get(s.Server.URL + "/Patient")
 	util.CheckErr(err)
@@ -147,6 +193,1649 @@ func (s *ServerSuite) TestDeletePatient(c *C) {
 	c.Assert(count, Equals, 0)
 }
 
+func (s *ServerSuite) TestExpandValueSet(c *C) {
+	res, err := http.Get(s.Server.URL + "/ValueSet/" + s.ValueSetFixtureId + "/$expand")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	vs := &models.ValueSet{}
+	err = json.NewDecoder(res.Body).Decode(vs)
+	util.CheckErr(err)
+	c.Assert(vs.Expansion.Contains, HasLen, 2)
+	c.Assert(vs.Expansion.Contains[0].Code, Equals, "diabetes")
+	c.Assert(vs.Expansion.Contains[1].Code, Equals, "t2dm")
+
+	res, err = http.Get(s.Server.URL + "/ValueSet/$expand?identifier=http://example.org/fhir/vs/conditions&filter=diabetes&offset=1&count=1")
+	util.CheckErr(err)
+	vs = &models.ValueSet{}
+	err = json.NewDecoder(res.Body).Decode(vs)
+	util.CheckErr(err)
+	c.Assert(vs.Expansion.Contains, HasLen, 1)
+	c.Assert(vs.Expansion.Contains[0].Code, Equals, "t1dm")
+
+	// Listed codes get the display $lookup gives, whether the code is in the
+	// code system's definition or only in the concept store
+	store := NewConceptStore()
+	util.CheckErr(store.Save(terminology.Concept{System: "http://example.org/fhir/conditions", Code: "e11", Display: "Type 2 diabetes mellitus without complications", Active: true}))
+	defer store.Collection.RemoveId(terminology.ConceptId("http://example.org/fhir/conditions", "e11"))
+	listed := &models.ValueSet{Compose: models.ValueSetComposeComponent{Include: []models.ConceptSetComponent{{
+		System:  "http://example.org/fhir/conditions",
+		Concept: []models.ConceptReferenceComponent{{Code: "t2dm"}, {Code: "e11"}},
+	}}}}
+	contains, err := NewValueSetExpander().Expand(listed)
+	util.CheckErr(err)
+	c.Assert(contains, HasLen, 2)
+	for _, code := range contains {
+		lookup, err := LookupCode(code.System, code.Code)
+		util.CheckErr(err)
+		c.Assert(code.Display, Equals, lookup.Display)
+	}
+	c.Assert(contains[1].Display, Equals, "Type 2 diabetes mellitus without complications")
+}
+
+func (s *ServerSuite) TestValidateCode(c *C) {
+	outcome := s.validateCode(c, "?system=http://example.org/fhir/conditions&code=t2dm&display=Type%202%20diabetes%20mellitus")
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+
+	outcome = s.validateCode(c, "?system=http://example.org/fhir/conditions&code=t1dm")
+	c.Assert(outcome.Issue[0].Severity, Equals, "error")
+	c.Assert(outcome.Issue[0].Type.Code, Equals, "code-unknown")
+
+	outcome = s.validateCode(c, "?system=http://example.org/fhir/conditions&code=t2dm&display=Hypertension")
+	c.Assert(outcome.Issue[0].Severity, Equals, "error")
+	c.Assert(outcome.Issue[0].Type.Code, Equals, "value")
+
+	// Codes are looked up, so value sets too large to expand can be checked
+	defer func(max int) { MaxStoredExpansion = max }(MaxStoredExpansion)
+	MaxStoredExpansion = 1
+	store := NewConceptStore()
+	system := "http://example.org/fhir/stored-" + bson.NewObjectId().Hex()
+	for _, concept := range []terminology.Concept{
+		{System: system, Code: "root", Active: true},
+		{System: system, Code: "a", Display: "A", Parents: []string{"root"}, Ancestors: []string{"root"}, Active: true},
+		{System: system, Code: "b", Parents: []string{"root"}, Ancestors: []string{"root"}, Active: true},
+		{System: system, Code: "other", Active: true},
+	} {
+		util.CheckErr(store.Save(concept))
+	}
+	defer store.Collection.RemoveAll(bson.M{"system": system})
+	large := &models.ValueSet{Identifier: "http://example.org/fhir/vs/large", Compose: models.ValueSetComposeComponent{
+		Include: []models.ConceptSetComponent{{System: system, Filter: []models.ConceptSetFilterComponent{{Property: "concept", Op: "is-a", Value: "root"}}}},
+		Exclude: []models.ConceptSetComponent{{System: system, Concept: []models.ConceptReferenceComponent{{Code: "b"}}}},
+	}}
+	_, err := NewValueSetExpander().Expand(large)
+	c.Assert(err, NotNil)
+	service := NewTerminologyService()
+	for code, member := range map[string]bool{"a": true, "b": false, "other": false} {
+		result, err := service.ValidateCode(large, system, code, "")
+		util.CheckErr(err)
+		c.Assert(result.Member, Equals, member, Commentf(code))
+	}
+	result, err := service.ValidateCode(large, "", "a", "")
+	util.CheckErr(err)
+	c.Assert(result.Display, Equals, "A")
+}
+
+func (s *ServerSuite) TestLookupAndSubsumes(c *C) {
+	res, err := http.Get(s.Server.URL + "/ValueSet/$lookup?system=http://example.org/fhir/conditions&code=diabetes")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	params := &models.Parameters{}
+	err = json.NewDecoder(res.Body).Decode(params)
+	util.CheckErr(err)
+	c.Assert(params.Parameter[1].Name, Equals, "display")
+	c.Assert(params.Parameter[1].ValueString, Equals, "Diabetes mellitus")
+
+	res, err = http.Get(s.Server.URL + "/ValueSet/$lookup?system=http://example.org/fhir/conditions&code=bogus")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+
+	res, err = http.Get(s.Server.URL + "/ValueSet/$subsumes?system=http://example.org/fhir/conditions&codeA=metabolic&codeB=t1dm")
+	util.CheckErr(err)
+	params = &models.Parameters{}
+	err = json.NewDecoder(res.Body).Decode(params)
+	util.CheckErr(err)
+	c.Assert(params.Parameter[0].ValueCode, Equals, "subsumes")
+}
+
+func (s *ServerSuite) validateCode(c *C, query string) *models.OperationOutcome {
+	res, err := http.Get(s.Server.URL + "/ValueSet/" + s.ValueSetFixtureId + "/$validate-code" + query)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	outcome := &models.OperationOutcome{}
+	err = json.NewDecoder(res.Body).Decode(outcome)
+	util.CheckErr(err)
+	return outcome
+}
+
+func (s *ServerSuite) TestTranslateWithConceptMap(c *C) {
+	cm := &models.ConceptMap{Id: "labs", Element: []models.ConceptMapElementComponent{
+		{
+			CodeSystem: "http://example.org/local-labs",
+			Code:       "GLU",
+			DependsOn:  []models.OtherElementComponent{{Element: "specimen", CodeSystem: "http://example.org/specimens", Code: "serum"}},
+			Map:        []models.ConceptMapElementMapComponent{{CodeSystem: "http://loinc.org", Code: "2345-7", Equivalence: "equivalent"}},
+		},
+		{
+			CodeSystem: "http://example.org/local-labs",
+			Code:       "GLU",
+			Map:        []models.ConceptMapElementMapComponent{{CodeSystem: "http://loinc.org", Code: "2339-0", Equivalence: "wider"}},
+		},
+	}}
+
+	translations := TranslateWithConceptMap(cm, TranslateRequest{System: "http://example.org/local-labs", Code: "GLU"})
+	c.Assert(translations, HasLen, 1)
+	c.Assert(translations[0].Code, Equals, "2339-0")
+
+	req := TranslateRequest{System: "http://example.org/local-labs", Code: "GLU", DependsOn: cm.Element[0].DependsOn}
+	c.Assert(TranslateWithConceptMap(cm, req), HasLen, 2)
+
+	translations = TranslateWithConceptMap(cm, TranslateRequest{System: "http://loinc.org", Code: "2339-0", Reverse: true})
+	c.Assert(translations, HasLen, 1)
+	c.Assert(translations[0].Code, Equals, "GLU")
+	c.Assert(translations[0].Equivalence, Equals, "narrower")
+}
+
+func (s *ServerSuite) TestBuildSearchQuery(c *C) {
+	_, query, err := ParseSearchCriteria("Observation?name=http://loinc.org|2951-2&subject=Patient/1")
+	util.CheckErr(err)
+	c.Assert(query, DeepEquals, bson.M{"$and": []bson.M{
+		{"name.coding": bson.M{"$elemMatch": bson.M{"system": "http://loinc.org", "code": "2951-2"}}},
+		{"subject.reference": bson.M{"$regex": "(^|/)Patient/1$"}},
+	}})
+
+	_, _, err = ParseSearchCriteria("Observation?bogus=1")
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestRestHookSubscription(c *C) {
+	notified := make(chan *http.Request, 1)
+	hook := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		notified <- r
+	}))
+	defer hook.Close()
+
+	subscriptions := Database.C("subscriptions")
+	abnormal := &models.Subscription{
+		Id:       bson.NewObjectId().Hex(),
+		Criteria: "Observation?interpretation=A",
+		Status:   "requested",
+		Channel:  models.SubscriptionChannelComponent{Type: "rest-hook", Url: hook.URL, Payload: "application/json", Header: "Authorization: Bearer abc"},
+	}
+	expired := &models.Subscription{
+		Id:       bson.NewObjectId().Hex(),
+		Criteria: "Observation",
+		Status:   "active",
+		Channel:  models.SubscriptionChannelComponent{Type: "rest-hook", Url: hook.URL},
+		End:      models.FHIRDateTime{Time: time.Now().Add(-time.Hour), Precision: models.Timestamp},
+	}
+	util.CheckErr(subscriptions.Insert(abnormal, expired))
+
+	obs := &models.Observation{Id: bson.NewObjectId().Hex(), Interpretation: models.CodeableConcept{Coding: []models.Coding{{System: "http://hl7.org/fhir/v2/0078", Code: "A"}}}}
+	util.CheckErr(Database.C("observations").Insert(obs))
+	NotifySubscriptions("Observation", obs)
+	_, err := DefaultDeliveryQueue.ProcessDue()
+	util.CheckErr(err)
+
+	select {
+	case r := <-notified:
+		c.Assert(r.Header.Get("Authorization"), Equals, "Bearer abc")
+		c.Assert(r.Header.Get("Content-Type"), Equals, "application/json")
+	default:
+		c.Fatal("Subscription was not notified")
+	}
+	c.Assert(notified, HasLen, 0)
+
+	sub := &models.Subscription{}
+	util.CheckErr(subscriptions.FindId(abnormal.Id).One(sub))
+	c.Assert(sub.Status, Equals, "active")
+	util.CheckErr(subscriptions.FindId(expired.Id).One(sub))
+	c.Assert(sub.Status, Equals, "off")
+}
+
+func (s *ServerSuite) TestWebSocketSubscription(c *C) {
+	sub := &models.Subscription{
+		Id:       bson.NewObjectId().Hex(),
+		Criteria: "Observation?status=final",
+		Status:   "requested",
+		Channel:  models.SubscriptionChannelComponent{Type: "websocket"},
+	}
+	util.CheckErr(Database.C("subscriptions").Insert(sub))
+
+	// A notification made before the client binds is kept for it
+	obs := &models.Observation{Id: bson.NewObjectId().Hex(), Status: "final"}
+	util.CheckErr(Database.C("observations").Insert(obs))
+	NotifySubscriptions("Observation", obs)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(s.Server.URL, "http")+"/websocket", nil)
+	util.CheckErr(err)
+	defer conn.Close()
+
+	util.CheckErr(conn.WriteMessage(websocket.TextMessage, []byte("bind bogus")))
+	c.Assert(readWebSocketMessage(conn), Equals, "error Unknown subscription bogus")
+
+	util.CheckErr(conn.WriteMessage(websocket.TextMessage, []byte("bind "+sub.Id)))
+	c.Assert(readWebSocketMessage(conn), Equals, "bound "+sub.Id)
+	c.Assert(readWebSocketMessage(conn), Equals, "ping "+sub.Id)
+
+	NotifySubscriptions("Observation", obs)
+	c.Assert(readWebSocketMessage(conn), Equals, "ping "+sub.Id)
+}
+
+func readWebSocketMessage(conn *websocket.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	util.CheckErr(err)
+	return string(message)
+}
+
+func (s *ServerSuite) TestDeliveryQueue(c *C) {
+	var received []string
+	failures := 1
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if failures > 0 {
+			failures--
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, string(body))
+	}))
+	defer receiver.Close()
+
+	q := NewDeliveryQueue()
+	q.Collection, q.DeadLetterCollection = "testdeliveries", "testdeadletters"
+	q.InitialBackoff = 0
+	q.MaxAttempts = 2
+	for _, body := range []string{"first", "second"} {
+		util.CheckErr(q.Enqueue(&Delivery{Method: "POST", Url: receiver.URL, Body: []byte(body)}))
+	}
+
+	// The first delivery fails, holding up the second
+	delivered, err := q.ProcessDue()
+	util.CheckErr(err)
+	c.Assert(delivered, Equals, 0)
+	pending, err := q.Pending("")
+	util.CheckErr(err)
+	c.Assert(pending, HasLen, 2)
+	c.Assert(pending[0].Attempts, Equals, 1)
+	c.Assert(pending[0].LastError, Matches, ".*503.*")
+
+	delivered, err = q.ProcessDue()
+	util.CheckErr(err)
+	c.Assert(delivered, Equals, 2)
+	c.Assert(received, DeepEquals, []string{"first", "second"})
+
+	// Deliveries that run out of attempts are dead-lettered and can be replayed
+	failures = 2
+	util.CheckErr(q.Enqueue(&Delivery{Method: "POST", Url: receiver.URL, Body: []byte("third")}))
+	q.ProcessDue()
+	q.ProcessDue()
+	dead, err := q.DeadLetters(receiver.URL)
+	util.CheckErr(err)
+	c.Assert(dead, HasLen, 1)
+
+	util.CheckErr(q.Replay(dead[0].Id))
+	// Replaying it again, as a retried request would, does not queue it twice
+	c.Assert(q.Replay(dead[0].Id), Equals, mgo.ErrNotFound)
+	pending, err = q.Pending(receiver.URL)
+	util.CheckErr(err)
+	c.Assert(pending, HasLen, 1)
+	delivered, err = q.ProcessDue()
+	util.CheckErr(err)
+	c.Assert(delivered, Equals, 1)
+	c.Assert(received[2], Equals, "third")
+}
+
+func (s *ServerSuite) TestReplayDeadLetters(c *C) {
+	d := &Delivery{Id: bson.NewObjectId().Hex(), Destination: "http://example.org/hook", Method: "POST", Url: "http://example.org/hook", Attempts: 10}
+	util.CheckErr(Database.C("deadletters").Insert(d))
+
+	res, err := http.Get(s.Server.URL + "/admin/deadletters?destination=http://example.org/hook")
+	util.CheckErr(err)
+	var deliveries []Delivery
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&deliveries))
+	c.Assert(deliveries, HasLen, 1)
+
+	res, err = http.Post(s.Server.URL+"/admin/deadletters/"+d.Id+"/replay", "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	res, err = http.Get(s.Server.URL + "/admin/deliveries?destination=http://example.org/hook")
+	util.CheckErr(err)
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&deliveries))
+	c.Assert(deliveries, HasLen, 1)
+	c.Assert(deliveries[0].Attempts, Equals, 0)
+	util.CheckErr(Database.C("deliveries").RemoveId(d.Id))
+}
+
+func (s *ServerSuite) TestExecuteQuery(c *C) {
+	diabetes := bson.M{"coding": []bson.M{{"system": "http://snomed.info/sct", "code": "73211009"}}}
+	facts := Database.C("facts")
+	util.CheckErr(facts.Insert(
+		bson.M{"targetid": "a", "type": "Patient", "gender": "F"},
+		bson.M{"targetid": "a", "type": "Condition", "codes": []bson.M{diabetes}},
+		bson.M{"targetid": "b", "type": "Patient", "gender": "F"},
+		bson.M{"targetid": "b", "type": "Condition", "codes": []bson.M{diabetes}},
+		bson.M{"targetid": "c", "type": "Patient", "gender": "M"},
+		bson.M{"targetid": "c", "type": "Condition", "codes": []bson.M{diabetes}},
+	))
+
+	q := &models.Query{Id: bson.NewObjectId().Hex(), Parameter: []models.Extension{
+		{Url: "http://interventionengine.org/patientgender", ValueString: "F"},
+		{Url: "http://interventionengine.org/conditioncode", ValueCodeableConcept: models.CodeableConcept{Coding: []models.Coding{{System: "http://snomed.info/sct", Code: "73211009"}}}},
+	}}
+	util.CheckErr(Database.C("querys").Insert(q))
+
+	// $execute stores the Query, so it cannot be made with GET
+	res, err := http.Get(s.Server.URL + "/Query/" + q.Id + "/$execute?count=1")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusMethodNotAllowed)
+
+	res, err = http.Post(s.Server.URL+"/Query/"+q.Id+"/$execute?count=1", "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	result := &models.Query{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(result))
+	c.Assert(result.Response.Total, Equals, float64(2))
+	c.Assert(result.Response.Reference, HasLen, 1)
+	c.Assert(result.Response.Reference[0].Reference, Equals, "Patient/a")
+	c.Assert(result.Response.Next[0].ValueInteger, Equals, 1)
+	c.Assert(result.Response.Last[0].ValueInteger, Equals, 1)
+
+	res, err = http.Post(s.Server.URL+"/Query/"+q.Id+"/$execute?offset=1&count=1", "application/json", nil)
+	util.CheckErr(err)
+	result = &models.Query{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(result))
+	c.Assert(result.Response.Total, Equals, float64(2))
+	c.Assert(result.Response.Reference, HasLen, 1)
+	c.Assert(result.Response.Reference[0].Reference, Equals, "Patient/b")
+
+	stored := &models.Query{}
+	util.CheckErr(Database.C("querys").FindId(q.Id).One(stored))
+	c.Assert(stored.Response.Total, Equals, float64(2))
+}
+
+func (s *ServerSuite) TestPatientFilters(c *C) {
+	woman := &models.Patient{Id: bson.NewObjectId().Hex(), Gender: models.CodeableConcept{Coding: []models.Coding{{Code: "F"}}}, BirthDate: models.FHIRDateTime{Time: time.Date(1950, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	man := &models.Patient{Id: bson.NewObjectId().Hex(), Gender: models.CodeableConcept{Coding: []models.Coding{{Code: "M"}}}, BirthDate: models.FHIRDateTime{Time: time.Date(1990, 1, 1, 0, 0, 0, 0, time.UTC)}}
+	util.CheckErr(UpdateFacts("Patient", woman))
+	util.CheckErr(UpdateFacts("Patient", man))
+
+	hypertension := models.Coding{System: "http://example.org/fhir/conditions", Code: "htn"}
+	util.CheckErr(UpdateFacts("Condition", &models.Condition{
+		Id:        bson.NewObjectId().Hex(),
+		Subject:   models.Reference{Reference: "Patient/" + woman.Id},
+		Code:      models.CodeableConcept{Coding: []models.Coding{hypertension}},
+		OnsetDate: models.FHIRDateTime{Time: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}))
+	// A condition of a patient on another server with the same id is no fact about the man
+	util.CheckErr(UpdateFacts("Condition", &models.Condition{
+		Id:      bson.NewObjectId().Hex(),
+		Subject: models.Reference{Reference: "http://other.example.org/fhir/Patient/" + man.Id},
+		Code:    models.CodeableConcept{Coding: []models.Coding{hypertension}},
+	}))
+	util.CheckErr(UpdateFacts("Observation", &models.Observation{
+		Id:              bson.NewObjectId().Hex(),
+		Subject:         models.Reference{Reference: "Patient/" + man.Id},
+		Name:            models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "4548-4"}}},
+		ValueQuantity:   models.Quantity{Value: 9.5, Units: "%"},
+		AppliesDateTime: models.FHIRDateTime{Time: time.Now()},
+	}))
+
+	nine := 9.0
+	patients, err := FindPatients(&PatientFilter{And: []PatientFilter{
+		{Type: "Patient", Gender: "F"},
+		{Type: "Condition", ValueSet: "http://example.org/fhir/vs/conditions"},
+	}})
+	util.CheckErr(err)
+	c.Assert(patients[woman.Id], Equals, true)
+	c.Assert(patients[man.Id], Equals, false)
+
+	patients, err = FindPatients(&PatientFilter{Not: &PatientFilter{Type: "Condition", Codes: []models.Coding{hypertension}}})
+	util.CheckErr(err)
+	c.Assert(patients[woman.Id], Equals, false)
+	c.Assert(patients[man.Id], Equals, true)
+
+	patients, err = FindPatients(&PatientFilter{Type: "Observation", Codes: []models.Coding{{System: "http://loinc.org", Code: "4548-4"}}, Value: &FilterRange{Low: &nine}, WithinDays: 30})
+	util.CheckErr(err)
+	c.Assert(patients.Ids(), DeepEquals, []string{man.Id})
+
+	// Combinations cannot also be criteria, or parts of them would be ignored
+	_, err = FindPatients(&PatientFilter{Type: "Patient", Gender: "F", Not: &PatientFilter{Type: "Condition"}})
+	c.Assert(err, NotNil)
+	_, err = FindPatients(&PatientFilter{And: []PatientFilter{{Type: "Patient"}}, Or: []PatientFilter{{Type: "Condition"}}})
+	c.Assert(err, NotNil)
+
+	res, err := http.Post(s.Server.URL+"/Patient/$cohort?count=10", "application/json", strings.NewReader(`{"or": [{"type": "Patient", "gender": "F", "age": {"low": 60}}, {"type": "Patient", "gender": "M", "age": {"high": 40}}]}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	params := &models.Parameters{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(params))
+	c.Assert(params.Parameter[0].Name, Equals, "total")
+	c.Assert(*params.Parameter[0].ValueInteger >= 2, Equals, true)
+}
+
+func (s *ServerSuite) TestEvaluateMeasure(c *C) {
+	diabetes := models.Coding{System: "http://example.org/fhir/measure-conditions", Code: "diabetes"}
+	hospice := models.Coding{System: "http://example.org/fhir/measure-conditions", Code: "hospice"}
+	hba1c := models.Coding{System: "http://example.org/fhir/measure-tests", Code: "hba1c"}
+	date := func(year int, month time.Month) models.FHIRDateTime {
+		return models.FHIRDateTime{Time: time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	condition := func(patient string, code models.Coding, onset models.FHIRDateTime) {
+		util.CheckErr(UpdateFacts("Condition", &models.Condition{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + patient}, Code: models.CodeableConcept{Coding: []models.Coding{code}}, OnsetDate: onset}))
+	}
+
+	ids := make([]string, 4)
+	for i := range ids {
+		ids[i] = bson.NewObjectId().Hex()
+		util.CheckErr(UpdateFacts("Patient", &models.Patient{Id: ids[i], BirthDate: date(1960, 1)}))
+	}
+	condition(ids[0], diabetes, date(2014, 3))
+	condition(ids[1], diabetes, date(2014, 5))
+	condition(ids[2], diabetes, date(2014, 2))
+	condition(ids[2], hospice, date(2010, 1))
+	condition(ids[3], diabetes, date(2012, 1))
+	util.CheckErr(UpdateFacts("Observation", &models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + ids[0]}, Name: models.CodeableConcept{Coding: []models.Coding{hba1c}}, ValueQuantity: models.Quantity{Value: 8}, AppliesDateTime: date(2014, 6)}))
+
+	eighteen, nine := 18.0, 9.0
+	measure := &Measure{
+		Name: "Diabetes: HbA1c control",
+		InitialPopulation: &PatientFilter{And: []PatientFilter{
+			{Type: "Patient", Age: &FilterRange{Low: &eighteen}},
+			{Type: "Condition", Codes: []models.Coding{diabetes}},
+		}},
+		DenominatorExclusions: &PatientFilter{Type: "Condition", Codes: []models.Coding{hospice}, AnyTime: true},
+		Numerator:             &PatientFilter{Type: "Observation", Codes: []models.Coding{hba1c}, Value: &FilterRange{High: &nine}},
+	}
+	start, end := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	report, err := EvaluateMeasure(measure, start, end)
+	util.CheckErr(err)
+	c.Assert(report.Populations, Equals, MeasurePopulations{InitialPopulation: 3, Denominator: 3, DenominatorExclusions: 1, Numerator: 1})
+	c.Assert(*report.PerformanceRate, Equals, 0.5)
+	c.Assert(report.Members(), HasLen, 3)
+
+	body, err := json.Marshal(measure)
+	util.CheckErr(err)
+	res, err := http.Post(s.Server.URL+"/Measure/$evaluate?periodStart=2014&periodEnd=2014&_format=csv", "application/json", strings.NewReader(string(body)))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	csv, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	c.Assert(strings.Contains(string(csv), ids[0]+",1,1,0,1,0\n"), Equals, true)
+	c.Assert(strings.Contains(string(csv), ids[2]+",1,1,1,0,0\n"), Equals, true)
+	c.Assert(strings.Contains(string(csv), ids[3]), Equals, false)
+
+	res, err = http.Post(s.Server.URL+"/Measure/$evaluate?periodStart=2014&periodEnd=2014", "application/json", strings.NewReader(string(body)))
+	util.CheckErr(err)
+	var streamed struct {
+		MeasurePopulations `json:"populations"`
+		Patients           []MeasureMembership `json:"patients"`
+	}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&streamed))
+	c.Assert(streamed.Numerator, Equals, 1)
+	c.Assert(streamed.Patients, DeepEquals, report.Members())
+}
+
+func (s *ServerSuite) TestGroupMembership(c *C) {
+	asthma := models.Coding{System: "http://example.org/fhir/group-conditions", Code: "asthma"}
+	smoker := models.Coding{System: "http://example.org/fhir/group-findings", Code: "smoker"}
+	ids := make([]string, 3)
+	for i := range ids {
+		ids[i] = bson.NewObjectId().Hex()
+		util.CheckErr(UpdateFacts("Patient", &models.Patient{Id: ids[i], Gender: models.CodeableConcept{Coding: []models.Coding{{Code: "F"}}}}))
+		util.CheckErr(UpdateFacts("Condition", &models.Condition{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + ids[i]}, Code: models.CodeableConcept{Coding: []models.Coding{asthma}}}))
+	}
+	util.CheckErr(UpdateFacts("Observation", &models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + ids[1]}, Name: models.CodeableConcept{Coding: []models.Coding{smoker}}}))
+
+	exclude := true
+	group := &models.Group{
+		Id:   bson.NewObjectId().Hex(),
+		Type: "person",
+		Characteristic: []models.GroupCharacteristicComponent{
+			{Code: models.CodeableConcept{Coding: []models.Coding{{System: GroupCharacteristicSystem, Code: "gender"}}}, ValueCodeableConcept: models.CodeableConcept{Coding: []models.Coding{{Code: "F"}}}},
+			{Code: models.CodeableConcept{Coding: []models.Coding{{System: GroupCharacteristicSystem, Code: "condition"}}}, ValueCodeableConcept: models.CodeableConcept{Coding: []models.Coding{asthma}}},
+			{Code: models.CodeableConcept{Coding: []models.Coding{smoker}}, ValueBoolean: &exclude, Exclude: &exclude},
+		},
+	}
+	util.CheckErr(Database.C("groups").Insert(group))
+
+	res, err := http.Post(s.Server.URL+"/Group/"+group.Id+"/$refresh", "application/json", nil)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	refreshed := &models.Group{}
+	util.CheckErr(Database.C("groups").FindId(group.Id).One(refreshed))
+	c.Assert(refreshed.Quantity, Equals, float64(2))
+	c.Assert(refreshed.Member, HasLen, 2)
+
+	res, err = http.Get(s.Server.URL + "/Group/" + group.Id + "/$members?offset=1&count=5")
+	util.CheckErr(err)
+	params := &models.Parameters{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(params))
+	c.Assert(*params.Parameter[0].ValueInteger, Equals, 2)
+	c.Assert(params.Parameter, HasLen, 2)
+	c.Assert(params.Parameter[1].ValueUri, Equals, refreshed.Member[1].Reference)
+	for _, member := range refreshed.Member {
+		c.Assert(member.Reference, Not(Equals), "Patient/"+ids[1])
+	}
+
+	group.Characteristic[0].ValueCodeableConcept = models.CodeableConcept{}
+	_, err = GroupFilter(group)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestPatientEverything(c *C) {
+	patientId, otherId, practitionerId := bson.NewObjectId().Hex(), bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	subject := models.Reference{Reference: "Patient/" + patientId}
+	util.CheckErr(Database.C("patients").Insert(&models.Patient{Id: patientId}, &models.Patient{Id: otherId}))
+	util.CheckErr(Database.C("practitioners").Insert(&models.Practitioner{Id: practitionerId}))
+	util.CheckErr(Database.C("conditions").Insert(
+		&models.Condition{Id: bson.NewObjectId().Hex(), Subject: subject, OnsetDate: models.FHIRDateTime{Time: time.Date(2014, 3, 1, 0, 0, 0, 0, time.UTC)}},
+		&models.Condition{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + otherId}},
+	))
+	util.CheckErr(Database.C("encounters").Insert(&models.Encounter{Id: bson.NewObjectId().Hex(), Subject: subject, Period: models.Period{Start: models.FHIRDateTime{Time: time.Date(2013, 6, 1, 0, 0, 0, 0, time.UTC)}}}))
+	observationId := bson.NewObjectId().Hex()
+	util.CheckErr(Database.C("observations").Insert(&models.Observation{
+		Id:              observationId,
+		Subject:         subject,
+		Performer:       []models.Reference{{Reference: "Practitioner/" + practitionerId}},
+		AppliesDateTime: models.FHIRDateTime{Time: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}))
+
+	everything := func(params string) *models.Bundle {
+		res, err := http.Get(s.Server.URL + "/Patient/" + patientId + "/$everything" + params)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		bundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+		return bundle
+	}
+	ids := func(bundle *models.Bundle) []string {
+		var ids []string
+		for _, entry := range bundle.Entry {
+			ids = append(ids, entry.Id)
+		}
+		return ids
+	}
+
+	bundle := everything("")
+	c.Assert(bundle.TotalResults, Equals, 4)
+	c.Assert(bundle.Entry, HasLen, 5)
+	c.Assert(bundle.Entry[0].Id, Equals, "Patient/"+patientId)
+	c.Assert(bundle.Entry[3].Id, Equals, "Observation/"+observationId)
+	c.Assert(bundle.Entry[4].Id, Equals, "Practitioner/"+practitionerId)
+
+	// The open-ended encounter overlaps the window
+	bundle = everything("?start=2014&end=2014")
+	c.Assert(bundle.TotalResults, Equals, 3)
+	c.Assert(ids(bundle)[2], Matches, "Encounter/.*")
+
+	bundle = everything("?count=2&offset=2")
+	c.Assert(bundle.TotalResults, Equals, 4)
+	c.Assert(ids(bundle), DeepEquals, []string{"Observation/" + observationId, "Practitioner/" + practitionerId})
+	c.Assert(bundle.Link, HasLen, 2)
+	c.Assert(bundle.Link[1].Rel, Equals, "previous")
+
+	util.CheckErr(Database.C("observations").UpdateId(observationId, bson.M{"$set": bson.M{"meta.lastUpdated": time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}}))
+	bundle = everything("?_since=2010-01-01")
+	c.Assert(bundle.TotalResults, Equals, 3)
+
+	res, err := http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex() + "/$everything")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestCompartmentSearch(c *C) {
+	patientId, otherId := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	subject := models.Reference{Reference: "Patient/" + patientId}
+	glucose := models.CodeableConcept{Coding: []models.Coding{{System: "http://loinc.org", Code: "2339-0"}}}
+	util.CheckErr(Database.C("patients").Insert(&models.Patient{Id: patientId}))
+	util.CheckErr(Database.C("observations").Insert(
+		&models.Observation{Id: bson.NewObjectId().Hex(), Subject: subject, Name: glucose},
+		&models.Observation{Id: bson.NewObjectId().Hex(), Subject: subject},
+		&models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + otherId}, Name: glucose},
+		&models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "http://other.example.org/fhir/Patient/" + patientId}},
+	))
+	util.CheckErr(Database.C("careplans").Insert(&models.CarePlan{Id: bson.NewObjectId().Hex(), Patient: subject}))
+
+	search := func(path string, status int) *models.Bundle {
+		res, err := http.Get(s.Server.URL + "/Patient/" + patientId + path)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, status)
+		bundle := &models.Bundle{}
+		if status == http.StatusOK {
+			util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+		}
+		return bundle
+	}
+	c.Assert(search("/Observation", http.StatusOK).TotalResults, Equals, 2)
+	c.Assert(search("/Observation?name=http://loinc.org|2339-0", http.StatusOK).TotalResults, Equals, 1)
+	c.Assert(search("/CarePlan", http.StatusOK).TotalResults, Equals, 1)
+	all := search("/*?_count=2", http.StatusOK)
+	c.Assert(all.TotalResults, Equals, 4)
+	c.Assert(all.Entry, HasLen, 2)
+	c.Assert(all.Entry[0].Id, Equals, "Patient/"+patientId)
+	c.Assert(all.Entry[1].Id, Matches, "CarePlan/.*")
+	search("/*?name=http://loinc.org|2339-0", http.StatusBadRequest)
+	search("/Practitioner", http.StatusNotFound)
+	search("/Observation?bogus=1", http.StatusBadRequest)
+
+	observation := &models.Observation{Subject: subject, Performer: []models.Reference{{Reference: "Patient/" + otherId}, {Reference: "Practitioner/1"}, {Reference: "http://other.example.org/fhir/Patient/3"}}}
+	c.Assert(PatientCompartment.Ids("Observation", observation), DeepEquals, []string{patientId, otherId})
+	c.Assert(PatientCompartment.Contains("Observation", observation, otherId), Equals, true)
+	c.Assert(PatientCompartment.Contains("Patient", &models.Patient{Id: patientId}, patientId), Equals, true)
+}
+
+func (s *ServerSuite) TestPatientMerge(c *C) {
+	sourceId, targetId := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	active := true
+	util.CheckErr(Database.C("patients").Insert(&models.Patient{Id: sourceId, Active: &active}, &models.Patient{Id: targetId}))
+	observation := &models.Observation{
+		Id:        bson.NewObjectId().Hex(),
+		Subject:   models.Reference{Reference: "Patient/" + sourceId},
+		Performer: []models.Reference{{Reference: "Practitioner/1"}, {Reference: "http://example.org/fhir/Patient/" + sourceId}, {Reference: "Patient/" + sourceId + "/_history/1"}},
+	}
+	condition := &models.Condition{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + sourceId}}
+	event := &models.SecurityEvent{Id: bson.NewObjectId().Hex(), Object: []models.SecurityEventObjectComponent{{Reference: models.Reference{Reference: "Patient/" + sourceId}}}}
+	util.CheckErr(Database.C("securityevents").Insert(event))
+	util.CheckErr(Database.C("observations").Insert(observation))
+	util.CheckErr(Database.C("conditions").Insert(condition))
+	util.CheckErr(UpdateFacts("Condition", condition))
+	_, err := SaveVersion("Condition", condition.Id)
+	util.CheckErr(err)
+
+	post := func(operation, body string) *models.Parameters {
+		res, err := http.Post(s.Server.URL+"/Patient/"+operation, "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		params := &models.Parameters{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(params))
+		return params
+	}
+	result := post("$merge", `{"resourceType": "Parameters", "parameter": [{"name": "source", "valueUri": "Patient/`+sourceId+`"}, {"name": "target", "valueUri": "Patient/`+targetId+`"}]}`)
+	c.Assert(*result.Parameter[1].ValueInteger, Equals, 3)
+
+	merged := &models.Observation{}
+	util.CheckErr(Database.C("observations").FindId(observation.Id).One(merged))
+	c.Assert(merged.Subject.Reference, Equals, "Patient/"+targetId)
+	c.Assert(merged.Performer[0].Reference, Equals, "Practitioner/1")
+	c.Assert(merged.Performer[1].Reference, Equals, "http://example.org/fhir/Patient/"+sourceId)
+	c.Assert(merged.Performer[2].Reference, Equals, "Patient/"+targetId+"/_history/1")
+	audited := &models.SecurityEvent{}
+	util.CheckErr(Database.C("securityevents").FindId(event.Id).One(audited))
+	c.Assert(audited.Object[0].Reference.Reference, Equals, "Patient/"+sourceId)
+	source, target := &models.Patient{}, &models.Patient{}
+	util.CheckErr(Database.C("patients").FindId(sourceId).One(source))
+	util.CheckErr(Database.C("patients").FindId(targetId).One(target))
+	c.Assert(*source.Active, Equals, false)
+	c.Assert(source.Link, DeepEquals, []models.PatientLinkComponent{{Other: models.Reference{Reference: "Patient/" + targetId}, Type: "replace"}})
+	c.Assert(target.Link[0].Type, Equals, "seealso")
+	n, err := Database.C("facts").Find(bson.M{"sourceid": condition.Id, "targetid": targetId}).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 1)
+	version, err := currentVersion("Condition", condition.Id)
+	util.CheckErr(err)
+	c.Assert(version, Equals, "2")
+
+	res, err := http.Post(s.Server.URL+"/Patient/$merge", "application/json", strings.NewReader(`{"resourceType": "Parameters", "parameter": [{"name": "source", "valueUri": "Patient/`+sourceId+`"}, {"name": "target", "valueUri": "Patient/`+targetId+`"}]}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 422)
+
+	post("$unmerge", `{"resourceType": "Parameters", "parameter": [{"name": "source", "valueUri": "Patient/`+sourceId+`"}]}`)
+	util.CheckErr(Database.C("observations").FindId(observation.Id).One(merged))
+	c.Assert(merged.Subject.Reference, Equals, "Patient/"+sourceId)
+	c.Assert(merged.Performer[1].Reference, Equals, "http://example.org/fhir/Patient/"+sourceId)
+	c.Assert(merged.Performer[2].Reference, Equals, "Patient/"+sourceId+"/_history/1")
+	source, target = &models.Patient{}, &models.Patient{}
+	util.CheckErr(Database.C("patients").FindId(sourceId).One(source))
+	util.CheckErr(Database.C("patients").FindId(targetId).One(target))
+	c.Assert(*source.Active, Equals, true)
+	c.Assert(source.Link, HasLen, 0)
+	c.Assert(target.Link, HasLen, 0)
+	n, err = Database.C("facts").Find(bson.M{"sourceid": condition.Id, "targetid": sourceId}).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 1)
+
+	// The condition was restored to the version before the merge
+	unmerged := &models.Condition{}
+	util.CheckErr(Database.C("conditions").FindId(condition.Id).One(unmerged))
+	c.Assert(unmerged.Subject.Reference, Equals, "Patient/"+sourceId)
+	version, err = currentVersion("Condition", condition.Id)
+	util.CheckErr(err)
+	c.Assert(version, Equals, "3")
+}
+
+func (s *ServerSuite) TestPatientMatch(c *C) {
+	birthDate := models.FHIRDateTime{Time: time.Date(1961, time.July, 14, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+	male := models.CodeableConcept{Coding: []models.Coding{{Code: "M"}}}
+	smith := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Smith"}, Given: []string{"Jonathan"}}}, BirthDate: birthDate, Gender: male}
+	smyth := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Smyth"}, Given: []string{"Jon"}}}, BirthDate: birthDate, Gender: male}
+	jones := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Jones"}, Given: []string{"Mary"}}}, BirthDate: birthDate}
+	util.CheckErr(Database.C("patients").Insert(smith, smyth, jones))
+
+	body := `{"resourceType": "Patient", "name": [{"family": ["Smith"], "given": ["Jonathan"]}], "birthDate": "1961-07-14", "gender": {"coding": [{"code": "M"}]}}`
+	res, err := http.Post(s.Server.URL+"/Patient/$match", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	result := &models.Parameters{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(result))
+	c.Assert(*result.Parameter[0].ValueInteger, Equals, 2)
+	c.Assert(result.Parameter[1].Part[0].ValueUri, Equals, "Patient/"+smith.Id)
+	c.Assert(result.Parameter[1].Part[2].ValueCode, Equals, "certain")
+	c.Assert(result.Parameter[2].Part[0].ValueUri, Equals, "Patient/"+smyth.Id)
+	c.Assert(*result.Parameter[2].Part[1].ValueDecimal < 1, Equals, true)
+
+	matches, err := MatchPatients(smyth, 0)
+	util.CheckErr(err)
+	c.Assert(matches, HasLen, 1)
+	c.Assert(matches[0].Patient.Id, Equals, smith.Id)
+
+	// Names that sound alike select a patient, and family names are
+	// compared by their first two letters rather than bytes
+	schmidt := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Schmidt"}}}}
+	john := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Adams"}, Given: []string{"John"}}}}
+	ostergaard := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Østergaard"}}}}
+	orsted := &models.Patient{Id: bson.NewObjectId().Hex(), Name: []models.HumanName{{Family: []string{"Ørsted"}}}}
+	for _, patient := range []*models.Patient{schmidt, john, ostergaard, orsted} {
+		util.CheckErr(Database.C("patients").Insert(patient))
+		util.CheckErr(UpdateFacts("Patient", patient))
+	}
+	selected := func(candidate *models.Patient) map[string]bool {
+		query, err := matchQuery(candidate)
+		util.CheckErr(err)
+		var ids []struct {
+			Id string `bson:"_id"`
+		}
+		util.CheckErr(Database.C("patients").Find(query).Select(bson.M{"_id": 1}).All(&ids))
+		found := make(map[string]bool)
+		for _, doc := range ids {
+			found[doc.Id] = true
+		}
+		return found
+	}
+	found := selected(&models.Patient{Name: []models.HumanName{{Family: []string{"Smith"}, Given: []string{"Jon"}}}})
+	c.Assert(found[schmidt.Id], Equals, true)
+	c.Assert(found[john.Id], Equals, true)
+	found = selected(&models.Patient{Name: []models.HumanName{{Family: []string{"Østby"}}}})
+	c.Assert(found[ostergaard.Id], Equals, true)
+	c.Assert(found[orsted.Id], Equals, false)
+}
+
+func (s *ServerSuite) TestUniqueIdentifiers(c *C) {
+	UniqueIdentifiers["Patient"] = []string{"urn:mrn"}
+	defer delete(UniqueIdentifiers, "Patient")
+	util.CheckErr(EnsureIdentifierIndexes())
+
+	config := make(map[string][]negroni.Handler)
+	for _, action := range []string{"Create", "Update", "Delete"} {
+		config["Patient"+action] = []negroni.Handler{negroni.HandlerFunc(UniqueIdentifierHandler)}
+	}
+	router := mux.NewRouter()
+	router.KeepContext = true
+	RegisterOperationRoutes(router, config)
+	RegisterRoutes(router, config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	create := func(mrn string) *http.Response {
+		body := `{"resourceType": "Patient", "identifier": [{"system": "urn:mrn", "value": "` + mrn + `"}, {"system": "urn:other", "value": "1"}]}`
+		res, err := http.Post(server.URL+"/Patient", "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	res := create("A100")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	splitLocation := strings.Split(res.Header["Location"][0], "/")
+	id := splitLocation[len(splitLocation)-1]
+	c.Assert(create("A100").StatusCode, Equals, http.StatusConflict)
+
+	res, err := http.Get(server.URL + "/Patient?identifier=urn:mrn|A100")
+	util.CheckErr(err)
+	bundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Entry[0].Id, Equals, "Patient/"+id)
+
+	// Identifiers from other systems need not be unique
+	res, err = http.Get(server.URL + "/Patient?identifier=urn:other|1")
+	util.CheckErr(err)
+	bundle = &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	c.Assert(bundle.Entry, HasLen, 1)
+
+	// Changing the identifier releases the old one
+	req, _ := http.NewRequest("PUT", server.URL+"/Patient/"+id, strings.NewReader(`{"resourceType": "Patient", "identifier": [{"system": "urn:mrn", "value": "A200"}]}`))
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	found, err := FindByIdentifier("Patient", "urn:mrn", "A200")
+	util.CheckErr(err)
+	c.Assert(found, Equals, id)
+	res = create("A100")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	req, _ = http.NewRequest("DELETE", server.URL+"/Patient/"+id, nil)
+	_, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	found, err = FindByIdentifier("Patient", "urn:mrn", "A200")
+	util.CheckErr(err)
+	c.Assert(found, Equals, "")
+}
+
+func (s *ServerSuite) TestDuplicateIdentifierCreate(c *C) {
+	UniqueIdentifiers["Patient"] = []string{"urn:mrn"}
+	defer delete(UniqueIdentifiers, "Patient")
+	util.CheckErr(EnsureIdentifierIndexes())
+
+	// Go through the middleware the server runs with
+	f := NewServer("localhost")
+	RegisterRoutes(f.Router, f.MiddlewareConfig)
+	server := httptest.NewServer(f.Router)
+	defer server.Close()
+
+	mrn := bson.NewObjectId().Hex()
+	create := func() *http.Response {
+		body := `{"resourceType": "Patient", "identifier": [{"system": "urn:mrn", "value": "` + mrn + `"}]}`
+		res, err := http.Post(server.URL+"/Patient", "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	c.Assert(create().StatusCode, Equals, http.StatusOK)
+	res := create()
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue[0].Type.Code, Equals, "duplicate")
+	n, err := Database.C("patients").Find(bson.M{"identifier.value": mrn}).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 1)
+}
+
+func (s *ServerSuite) TestValidationThroughServer(c *C) {
+	// Go through the middleware the server runs with
+	f := NewServer("localhost")
+	RegisterRoutes(f.Router, f.MiddlewareConfig)
+	server := httptest.NewServer(f.Router)
+	defer server.Close()
+
+	create := func(gender string) *http.Response {
+		body := `{"resourceType": "Observation", "status": "final", "reliability": "ok",
+			"name": {"coding": [{"system": "http://loinc.org", "code": "2951-2"}]},
+			"subject": {"reference": "#p1"},
+			"contained": [{"resourceType": "Patient", "id": "p1", "gender": {"coding": [{"system": "http://hl7.org/fhir/v3/AdministrativeGender", "code": "` + gender + `"}]}}]}`
+		res, err := http.Post(server.URL+"/Observation", "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	res := create("X")
+	c.Assert(res.StatusCode, Equals, 422)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Location, DeepEquals, []string{"Observation.contained[0].gender.coding[0]"})
+	c.Assert(create("F").StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ServerSuite) TestReferentialIntegrity(c *C) {
+	config := make(map[string][]negroni.Handler)
+	for _, name := range []string{"ConditionCreate", "PatientDelete"} {
+		config[name] = []negroni.Handler{negroni.HandlerFunc(ReferentialIntegrityHandler)}
+	}
+	router := mux.NewRouter()
+	router.KeepContext = true
+	RegisterRoutes(router, config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	create := func(subject string) *http.Response {
+		res, err := http.Post(server.URL+"/Condition", "application/json", strings.NewReader(`{"resourceType": "Condition", "subject": {"reference": "`+subject+`"}}`))
+		util.CheckErr(err)
+		return res
+	}
+	c.Assert(create("Patient/doesnotexist").StatusCode, Equals, 422)
+	c.Assert(create("Patient/"+s.FixtureId).StatusCode, Equals, http.StatusOK)
+	c.Assert(create("http://example.org/fhir/Patient/1").StatusCode, Equals, http.StatusOK)
+
+	patientId := bson.NewObjectId().Hex()
+	util.CheckErr(Database.C("patients").Insert(&models.Patient{Id: patientId}))
+	observation := &models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + patientId}}
+	external := &models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "http://example.org/fhir/Patient/" + patientId}}
+	util.CheckErr(Database.C("observations").Insert(observation, external))
+	remove := func() *http.Response {
+		req, _ := http.NewRequest("DELETE", server.URL+"/Patient/"+patientId, nil)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+
+	res := remove()
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 2)
+	c.Assert(outcome.Issue[1].Details, Equals, "Observation/"+observation.Id+" refers to Patient/"+patientId)
+
+	DeletePolicies["Patient"] = CascadeDelete
+	defer func() { DeletePolicies["Patient"] = RestrictDelete }()
+	defer func(log *AuditLog) { DefaultAuditLog = log }(DefaultAuditLog)
+	DefaultAuditLog = NewAuditLog(10)
+	c.Assert(remove().StatusCode, Equals, http.StatusOK)
+	n, err := Database.C("observations").FindId(observation.Id).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 0)
+	n, err = Database.C("observations").FindId(external.Id).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 1)
+
+	// The cascaded delete is kept, signed and audited like any other
+	deleted, err := LoadVersion("Observation", observation.Id, "1")
+	util.CheckErr(err)
+	c.Assert(deleted.(*models.Observation).Subject.Reference, Equals, "Patient/"+patientId)
+	provenance := &models.Provenance{}
+	util.CheckErr(Database.C("provenances").Find(bson.M{"target.reference": "Observation/" + observation.Id + "/_history/1"}).One(provenance))
+	c.Assert(provenance.Reason.Coding[0].Code, Equals, "delete")
+	event := <-DefaultAuditLog.events
+	c.Assert(event.Event.Action, Equals, "D")
+	c.Assert(event.Object[0].Reference.Reference, Equals, "Observation/"+observation.Id)
+	c.Assert(event.Object[1].Reference.Reference, Equals, "Patient/"+patientId)
+}
+
+func (s *ServerSuite) TestDeleteAuditedPatient(c *C) {
+	// Go through the middleware the server runs with, auditing every request
+	defer func(log *AuditLog) { DefaultAuditLog = log }(DefaultAuditLog)
+	DefaultAuditLog = NewAuditLog(10)
+	f := NewServer("localhost")
+	RegisterRoutes(f.Router, f.MiddlewareConfig)
+	n := negroni.New(negroni.HandlerFunc(AuditHandler))
+	n.UseHandler(f.Router)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	request := func(method, path, body string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res
+	}
+	res := request("POST", "/Patient", `{"resourceType": "Patient", "name": [{"family": ["Audited"]}]}`)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	location := res.Header.Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+	c.Assert(request("GET", "/Patient/"+id, "").StatusCode, Equals, http.StatusOK)
+	DefaultAuditLog.Flush()
+
+	// The patient's Provenance and SecurityEvents do not stop it being deleted
+	count, err := Database.C("provenances").Find(bson.M{"target.reference": bson.RegEx{Pattern: "^Patient/" + id + "/"}}).Count()
+	util.CheckErr(err)
+	c.Assert(count > 0, Equals, true)
+	count, err = Database.C("securityevents").Find(bson.M{"object.reference.reference": "Patient/" + id}).Count()
+	util.CheckErr(err)
+	c.Assert(count > 0, Equals, true)
+	c.Assert(request("DELETE", "/Patient/"+id, "").StatusCode, Equals, http.StatusOK)
+}
+
+func (s *ServerSuite) TestSecurityEventsAreReadOnly(c *C) {
+	event := &models.SecurityEvent{Id: bson.NewObjectId().Hex()}
+	event.Event.Action = "R"
+	util.CheckErr(Database.C("securityevents").Insert(event))
+	defer Database.C("securityevents").RemoveId(event.Id)
+	f := NewServer("localhost")
+	RegisterRoutes(f.Router, f.MiddlewareConfig)
+	server := httptest.NewServer(f.Router)
+	defer server.Close()
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		req, _ := http.NewRequest(method, server.URL+"/SecurityEvent/"+event.Id, strings.NewReader(`{"resourceType": "SecurityEvent", "event": {"action": "D"}}`))
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusMethodNotAllowed)
+	}
+	stored := &models.SecurityEvent{}
+	util.CheckErr(Database.C("securityevents").FindId(event.Id).One(stored))
+	c.Assert(stored.Event.Action, Equals, "R")
+}
+
+func (s *ServerSuite) TestSaveVersion(c *C) {
+	util.CheckErr(EnsureHistoryIndexes())
+	medication := &models.Medication{Id: bson.NewObjectId().Hex(), Name: "Aspirin"}
+	util.CheckErr(Database.C("medications").Insert(medication))
+	versions := make(chan string)
+	for i := 0; i < 10; i++ {
+		go func() {
+			version, err := SaveVersion("Medication", medication.Id)
+			util.CheckErr(err)
+			versions <- version
+		}()
+	}
+	seen := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		seen[<-versions] = true
+	}
+	c.Assert(seen, HasLen, 10)
+	c.Assert(seen["10"], Equals, true)
+
+	// Versions kept before the counter are skipped
+	other := &models.Medication{Id: bson.NewObjectId().Hex(), Name: "Metformin"}
+	util.CheckErr(Database.C("medications").Insert(other))
+	util.CheckErr(Database.C("history").Insert(ResourceVersion{Id: bson.NewObjectId().Hex(), Type: "Medication", ResourceId: other.Id, Version: "1"}))
+	version, err := SaveVersion("Medication", other.Id)
+	util.CheckErr(err)
+	c.Assert(version, Equals, "2")
+}
+
+func (s *ServerSuite) TestResolve(c *C) {
+	medication := &models.Medication{Id: bson.NewObjectId().Hex(), Name: "Aspirin"}
+	util.CheckErr(Database.C("medications").Insert(medication))
+	version, err := SaveVersion("Medication", medication.Id)
+	util.CheckErr(err)
+	c.Assert(version, Equals, "1")
+	util.CheckErr(Database.C("medications").UpdateId(medication.Id, bson.M{"$set": bson.M{"name": "Aspirin 81mg"}}))
+	version, err = SaveVersion("Medication", medication.Id)
+	util.CheckErr(err)
+	c.Assert(version, Equals, "2")
+
+	resolved, err := Resolve(models.Reference{Reference: "Medication/" + medication.Id}, nil)
+	util.CheckErr(err)
+	c.Assert(resolved.(*models.Medication).Name, Equals, "Aspirin 81mg")
+	resolved, err = Resolve(models.Reference{Reference: "Medication/" + medication.Id + "/_history/1"}, nil)
+	util.CheckErr(err)
+	c.Assert(resolved.(*models.Medication).Name, Equals, "Aspirin")
+	_, err = Resolve(models.Reference{Reference: "Medication/" + medication.Id + "/_history/3"}, nil)
+	c.Assert(err, NotNil)
+
+	prescription := &models.MedicationPrescription{}
+	util.CheckErr(json.Unmarshal([]byte(`{"resourceType": "MedicationPrescription", "contained": [{"resourceType": "Medication", "id": "med1", "name": "Metformin"}], "medication": {"reference": "#med1"}}`), prescription))
+	resolved, err = Resolve(prescription.Medication, prescription)
+	util.CheckErr(err)
+	c.Assert(resolved.(*models.Medication).Name, Equals, "Metformin")
+
+	_, err = Resolve(models.Reference{Reference: "http://other.org/fhir/Medication/1"}, nil)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestSecurityEvent(c *C) {
+	observation := models.Observation{Id: bson.NewObjectId().Hex(), Subject: models.Reference{Reference: "Patient/" + s.FixtureId}}
+	r, _ := http.NewRequest("GET", "/Observation/"+observation.Id, nil)
+	r.RemoteAddr = "10.0.0.7:52114"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r.SetBasicAuth("drsmith", "secret")
+	context.Set(r, "Observation", observation)
+	context.Set(r, "Resource", "Observation")
+	context.Set(r, "Action", "read")
+	defer context.Clear(r)
+
+	event := NewSecurityEvent(r, http.StatusOK, time.Now())
+	c.Assert(event.Event.Action, Equals, "R")
+	c.Assert(event.Event.Outcome, Equals, "0")
+	c.Assert(event.Event.Subtype[0].Coding[0].Code, Equals, "read")
+	c.Assert(event.Participant[0].UserId, Equals, "drsmith")
+	c.Assert(event.Participant[0].Network.Identifier, Equals, "10.0.0.7")
+	TrustedProxies = []string{"10.0.0.0/8"}
+	c.Assert(clientAddress(r), Equals, "203.0.113.9")
+	r.Header.Set("X-Forwarded-For", "203.0.113.9, 10.0.0.2")
+	c.Assert(clientAddress(r), Equals, "203.0.113.9")
+	TrustedProxies = nil
+	c.Assert(event.Object, HasLen, 2)
+	c.Assert(event.Object[0].Reference.Reference, Equals, "Observation/"+observation.Id)
+	c.Assert(event.Object[1].Reference.Reference, Equals, "Patient/"+s.FixtureId)
+	c.Assert(event.Object[1].Role, Equals, "1")
+
+	auditLog := NewAuditLog(1)
+	auditLog.Record(event)
+	auditLog.Record(NewSecurityEvent(r, http.StatusNotFound, time.Now()))
+	auditLog.Flush()
+	n, err := Database.C("securityevents").Find(bson.M{"object.reference.reference": "Observation/" + observation.Id}).Count()
+	util.CheckErr(err)
+	c.Assert(n, Equals, 2)
+}
+
+func (s *ServerSuite) TestAuditHandler(c *C) {
+	defer func(auditLog *AuditLog) { DefaultAuditLog = auditLog }(DefaultAuditLog)
+	DefaultAuditLog = NewAuditLog(10)
+	observationId := bson.NewObjectId().Hex()
+	util.CheckErr(Database.C("observations").Insert(&models.Observation{Id: observationId, Subject: models.Reference{Reference: "Patient/" + s.FixtureId}}))
+	defer Database.C("observations").RemoveId(observationId)
+
+	n := negroni.New(negroni.HandlerFunc(AuditHandler))
+	n.UseHandler(s.Router)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/Observation/" + observationId)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	event := <-DefaultAuditLog.events
+	c.Assert(event.Event.Action, Equals, "R")
+	c.Assert(event.Event.Subtype, HasLen, 1)
+	c.Assert(event.Event.Subtype[0].Coding[0].Code, Equals, "read")
+	c.Assert(event.Object, HasLen, 2)
+	c.Assert(event.Object[0].Reference.Reference, Equals, "Observation/"+observationId)
+	c.Assert(event.Object[1].Reference.Reference, Equals, "Patient/"+s.FixtureId)
+
+	_, err = http.Get(server.URL + "/Observation?subject=Patient/" + s.FixtureId)
+	util.CheckErr(err)
+	event = <-DefaultAuditLog.events
+	c.Assert(event.Event.Subtype[0].Coding[0].Code, Equals, "search")
+	c.Assert(event.Object[0].Reference.Reference, Equals, "Observation/"+observationId)
+	c.Assert(event.Object[len(event.Object)-1].Query, Not(Equals), "")
+}
+
+func (s *ServerSuite) TestPatientDisclosures(c *C) {
+	patient := "Patient/" + s.FixtureId
+	observationId := bson.NewObjectId().Hex()
+	observation := "Observation/" + observationId
+	util.CheckErr(Database.C("observations").Insert(&models.Observation{Id: observationId, Subject: models.Reference{Reference: patient}}))
+	defer Database.C("observations").RemoveId(observationId)
+
+	event := func(user, action, outcome string, when time.Time, references ...string) *models.SecurityEvent {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "10.0.0.7:52114"
+		r.SetBasicAuth(user, "secret")
+		context.Set(r, "Action", action)
+		defer context.Clear(r)
+		e := NewSecurityEvent(r, http.StatusOK, when)
+		e.Event.Outcome = outcome
+		for _, reference := range references {
+			parts := strings.Split(reference, "/")
+			e.Object = append(e.Object, resourceAuditObjects(parts[0], parts[1], nil, "6")...)
+		}
+		return e
+	}
+	// An observation deleted since it was read, a patient merged into this
+	// one, and another patient
+	deleted := "Observation/" + bson.NewObjectId().Hex()
+	mergedId, otherId := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	util.CheckErr(Database.C("merges").Insert(&PatientMerge{Id: bson.NewObjectId().Hex(), Source: mergedId, Target: s.FixtureId}))
+	defer Database.C("merges").RemoveAll(bson.M{"source": mergedId})
+	other := "Observation/" + bson.NewObjectId().Hex()
+
+	jan := time.Date(2015, time.January, 10, 9, 0, 0, 0, time.UTC)
+	auditLog := NewAuditLog(20)
+	auditLog.Record(event("drsmith", "read", "0", jan, observation, deleted, patient))
+	auditLog.Record(event("drsmith", "search", "0", jan.Add(time.Hour), observation, patient, other, "Patient/"+otherId))
+	auditLog.Record(event("drsmith", "update", "0", jan.Add(2*time.Hour), observation, patient))
+	auditLog.Record(event("drsmith", "read", "0", jan.Add(3*time.Hour), observation))
+	auditLog.Record(event("nurse", "read", "4", jan, patient))
+	auditLog.Record(event("nurse", "read", "0", jan.AddDate(0, 2, 0), patient))
+	auditLog.Record(event("clerk", "read", "0", jan, "Patient/"+otherId))
+	auditLog.Record(event("registrar", "read", "0", jan, "Patient/"+mergedId))
+	auditLog.Flush()
+	defer Database.C("securityevents").RemoveAll(bson.M{"event.dateTime.time": bson.M{"$gte": jan, "$lt": jan.AddDate(0, 3, 0)}})
+
+	end := jan.AddDate(0, 1, 0)
+	report, err := PatientDisclosures(s.FixtureId, &jan, &end)
+	util.CheckErr(err)
+	c.Assert(report.Disclosures, HasLen, 4)
+	read := report.Disclosures[0]
+	c.Assert(read.User, Equals, "drsmith")
+	c.Assert(read.Address, Equals, "10.0.0.7")
+	c.Assert(read.Action, Equals, "read")
+	c.Assert(read.Count, Equals, 1)
+	c.Assert(read.First.Equal(jan), Equals, true)
+	c.Assert(read.Resources, DeepEquals, []string{observation, deleted, patient})
+	c.Assert(report.Disclosures[1].Action, Equals, "search")
+	c.Assert(report.Disclosures[1].Resources, DeepEquals, []string{observation, patient})
+	c.Assert(report.Disclosures[2].Action, Equals, "update")
+	c.Assert(report.Disclosures[3].User, Equals, "registrar")
+	c.Assert(report.Disclosures[3].Resources, DeepEquals, []string{"Patient/" + mergedId})
+
+	buf := &bytes.Buffer{}
+	util.CheckErr(report.WriteCSV(buf))
+	c.Assert(strings.Count(buf.String(), "\n"), Equals, 5)
+	buf.Reset()
+	util.CheckErr(report.WriteText(buf))
+	c.Assert(strings.Contains(buf.String(), "drsmith (10.0.0.7)\n  read: 1 times"), Equals, true)
+
+	_, err = PatientDisclosures(bson.NewObjectId().Hex(), nil, nil)
+	c.Assert(err, Equals, ErrPatientNotFound)
+
+	// A read through the router is reported
+	defer func(log *AuditLog) { DefaultAuditLog = log }(DefaultAuditLog)
+	DefaultAuditLog = NewAuditLog(10)
+	n := negroni.New(negroni.HandlerFunc(AuditHandler))
+	n.UseHandler(s.Router)
+	server := httptest.NewServer(n)
+	defer server.Close()
+	since := time.Now().Add(-time.Second)
+	res, err := http.Get(server.URL + "/" + observation)
+	util.CheckErr(err)
+	_, err = ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	res.Body.Close()
+	DefaultAuditLog.Flush()
+	defer Database.C("securityevents").RemoveAll(bson.M{"event.dateTime.time": bson.M{"$gte": since}})
+	report, err = PatientDisclosures(s.FixtureId, &since, nil)
+	util.CheckErr(err)
+	c.Assert(report.Disclosures, HasLen, 1)
+	c.Assert(report.Disclosures[0].Action, Equals, "read")
+	c.Assert(report.Disclosures[0].Address, Equals, "127.0.0.1")
+	c.Assert(report.Disclosures[0].Resources, DeepEquals, []string{observation, patient})
+}
+
+func (s *ServerSuite) TestProvenanceCapture(c *C) {
+	config := make(map[string][]negroni.Handler)
+	for _, action := range []string{"Create", "Update"} {
+		config["Observation"+action] = []negroni.Handler{negroni.HandlerFunc(ProvenanceHandler), negroni.HandlerFunc(HistoryHandler)}
+	}
+	router := mux.NewRouter()
+	router.KeepContext = true
+	RegisterOperationRoutes(router, config)
+	RegisterRoutes(router, config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	write := func(method, path, provenance string) *http.Response {
+		body := `{"resourceType": "Observation", "subject": {"reference": "Patient/` + s.FixtureId + `"}}`
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if provenance != "" {
+			req.Header.Set("X-Provenance", provenance)
+		}
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+	res := write("POST", "/Observation", `{"agent": [{"type": {"code": "device"}, "reference": "Device/lab-interface", "display": "Lab interface"}], "reason": {"text": "HL7 ORU feed"}}`)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	splitLocation := strings.Split(res.Header["Location"][0], "/")
+	id := splitLocation[len(splitLocation)-1]
+	defer Database.C("provenances").RemoveAll(bson.M{"target.reference": bson.M{"$regex": "^Observation/" + id}})
+	c.Assert(write("PUT", "/Observation/"+id, "").StatusCode, Equals, http.StatusOK)
+	c.Assert(write("PUT", "/Observation/"+id, "not provenance").StatusCode, Equals, http.StatusBadRequest)
+
+	search := func(target string) *models.Bundle {
+		res, err := http.Get(server.URL + "/Provenance?target=" + target)
+		util.CheckErr(err)
+		bundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+		return bundle
+	}
+	c.Assert(search("Observation/"+id).Entry, HasLen, 2)
+	bundle := search("Observation/" + id + "/_history/1")
+	c.Assert(bundle.Entry, HasLen, 1)
+
+	first := &models.Provenance{}
+	util.CheckErr(Database.C("provenances").Find(bson.M{"target.reference": "Observation/" + id + "/_history/1"}).One(first))
+	c.Assert(first.Agent, HasLen, 1)
+	c.Assert(first.Agent[0].Reference, Equals, "Device/lab-interface")
+	c.Assert(first.Reason.Text, Equals, "HL7 ORU feed")
+	second := &models.Provenance{}
+	util.CheckErr(Database.C("provenances").Find(bson.M{"target.reference": "Observation/" + id + "/_history/2"}).One(second))
+	c.Assert(second.Reason.Coding[0].Code, Equals, "update")
+	c.Assert(second.Agent[len(second.Agent)-1].Type.Code, Equals, "software")
+
+	r, _ := http.NewRequest("PUT", "/Observation/"+id, nil)
+	r.RemoteAddr = "10.0.0.7:52114"
+	r.Header.Set("X-Forwarded-For", "203.0.113.9")
+	r, state := withRequestState(r)
+	state.Principal = &Principal{Subject: "drsmith"}
+	agents := requestAgents(r)
+	c.Assert(agents, HasLen, 2)
+	c.Assert(agents[0].Reference, Equals, "drsmith")
+	c.Assert(agents[1].Reference, Equals, "10.0.0.7")
+}
+
+func (s *ServerSuite) TestSignature(c *C) {
+	dir, err := ioutil.TempDir("", "signature")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	defer func(trusted map[string]*x509.Certificate) { TrustedCertificates = trusted }(TrustedCertificates)
+	TrustedCertificates = make(map[string]*x509.Certificate)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.CheckErr(err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.CheckErr(err)
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		keyFile, certFile := writeSigningKey(dir, key)
+		signer, err := LoadSigner(keyFile, certFile)
+		util.CheckErr(err)
+		signature, err := signer.Sign([]byte(`{"id":"1"}`))
+		util.CheckErr(err)
+		c.Assert(strings.Count(signature, "."), Equals, 2)
+		c.Assert(VerifySignature(signature, []byte(`{"id":"1"}`)), IsNil)
+		c.Assert(VerifySignature(signature, []byte(`{"id":"2"}`)), Equals, ErrSignatureInvalid)
+	}
+
+	// The key must match the certificate
+	keyFile, _ := writeSigningKey(dir, rsaKey)
+	_, certFile := writeSigningKey(dir, ecKey)
+	_, err = LoadSigner(keyFile, certFile)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestVerifyResource(c *C) {
+	dir, err := ioutil.TempDir("", "signature")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	util.CheckErr(err)
+	ProvenanceSigner, err = LoadSigner(writeSigningKey(dir, key))
+	util.CheckErr(err)
+	defer func() { ProvenanceSigner = nil }()
+
+	config := make(map[string][]negroni.Handler)
+	for _, action := range []string{"Create", "Update"} {
+		config["Observation"+action] = []negroni.Handler{negroni.HandlerFunc(ProvenanceHandler), negroni.HandlerFunc(HistoryHandler)}
+	}
+	router := mux.NewRouter()
+	router.KeepContext = true
+	RegisterOperationRoutes(router, config)
+	RegisterRoutes(router, config)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	body := `{"resourceType": "Observation", "status": "preliminary", "subject": {"reference": "Patient/` + s.FixtureId + `"}}`
+	res, err := http.Post(server.URL+"/Observation", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	splitLocation := strings.Split(res.Header["Location"][0], "/")
+	id := splitLocation[len(splitLocation)-1]
+	req, _ := http.NewRequest("PUT", server.URL+"/Observation/"+id, strings.NewReader(strings.Replace(body, "preliminary", "final", 1)))
+	req.Header.Set("Content-Type", "application/json")
+	_, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+
+	verification, err := VerifyResource("Observation", id)
+	util.CheckErr(err)
+	c.Assert(verification.Verified(), Equals, true)
+	c.Assert(verification.Current.Version, Equals, "2")
+	c.Assert(verification.Current.Outcome, Equals, SignatureVerified)
+	c.Assert(verification.Versions, HasLen, 2)
+	c.Assert(verification.Versions[0].Outcome, Equals, SignatureVerified)
+	c.Assert(verification.Versions[0].Provenance, HasLen, 1)
+
+	// Tamper with the stored resource and its first version
+	util.CheckErr(Database.C("observations").UpdateId(id, bson.M{"$set": bson.M{"status": "amended"}}))
+	util.CheckErr(Database.C("history").Update(bson.M{"type": "Observation", "resourceid": id, "version": "1"}, bson.M{"$set": bson.M{"resource.status": "final"}}))
+	res, err = http.Get(server.URL + "/Observation/" + id + "/$verify")
+	util.CheckErr(err)
+	params := &models.Parameters{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(params))
+	c.Assert(*params.Parameter[0].ValueBoolean, Equals, false)
+	c.Assert(params.Parameter[1].Name, Equals, "resource")
+	c.Assert(params.Parameter[1].Part[1].ValueCode, Equals, SignatureModified)
+	c.Assert(params.Parameter[2].Part[1].ValueCode, Equals, SignatureModified)
+	c.Assert(params.Parameter[3].Part[1].ValueCode, Equals, SignatureVerified)
+
+	// A version kept without a signature is a failure while signing is on
+	unsigned := &models.Observation{Id: bson.NewObjectId().Hex(), Status: "final"}
+	util.CheckErr(Database.C("observations").Insert(unsigned))
+	_, err = SaveVersion("Observation", unsigned.Id)
+	util.CheckErr(err)
+	verification, err = VerifyResource("Observation", unsigned.Id)
+	util.CheckErr(err)
+	c.Assert(verification.Versions[0].Outcome, Equals, Unsigned)
+	c.Assert(verification.Verified(), Equals, false)
+	signer := ProvenanceSigner
+	ProvenanceSigner = nil
+	c.Assert(verification.Verified(), Equals, true)
+	ProvenanceSigner = signer
+
+	// Resources the server rewrites are signed too
+	sourceId, targetId := bson.NewObjectId().Hex(), bson.NewObjectId().Hex()
+	util.CheckErr(Database.C("patients").Insert(&models.Patient{Id: sourceId}, &models.Patient{Id: targetId}))
+	merged := &models.Observation{Id: bson.NewObjectId().Hex(), Status: "final", Subject: models.Reference{Reference: "Patient/" + sourceId}}
+	util.CheckErr(Database.C("observations").Insert(merged))
+	res, err = http.Post(server.URL+"/Patient/$merge", "application/json", strings.NewReader(`{"resourceType": "Parameters", "parameter": [{"name": "source", "valueUri": "Patient/`+sourceId+`"}, {"name": "target", "valueUri": "Patient/`+targetId+`"}]}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	for _, path := range []string{"/Observation/" + merged.Id, "/Patient/" + sourceId, "/Patient/" + targetId} {
+		res, err = http.Get(server.URL + path + "/$verify")
+		util.CheckErr(err)
+		params = &models.Parameters{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(params))
+		c.Assert(*params.Parameter[0].ValueBoolean, Equals, true)
+		c.Assert(params.Parameter[1].Part[1].ValueCode, Equals, SignatureVerified)
+	}
+	provenance := &models.Provenance{}
+	util.CheckErr(Database.C("provenances").Find(bson.M{"target.reference": "Observation/" + merged.Id + "/_history/1"}).One(provenance))
+	c.Assert(provenance.Reason.Text, Equals, "$merge")
+
+	res, err = http.Get(server.URL + "/Observation/" + bson.NewObjectId().Hex() + "/$verify")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+}
+
+func (s *ServerSuite) TestAuthenticator(c *C) {
+	dir, err := ioutil.TempDir("", "authentication")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.CheckErr(err)
+	_, certFile := writeSigningKey(dir, key)
+	auth := NewAuthenticator("https://auth.example.org", "https://fhir.example.org")
+	util.CheckErr(auth.LoadPEM(certFile))
+
+	n := negroni.New()
+	n.Use(negroni.HandlerFunc(auth.Handler))
+	n.UseHandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		principal := RequestPrincipal(r)
+		rw.Write([]byte(principal.Subject + " " + strings.Join(principal.Scopes, ",")))
+	})
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	request := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+	get := func(token string) *http.Response { return request("GET", "/Patient", token) }
+	exp := time.Now().Add(time.Hour).Unix()
+
+	res := get(signToken(key, bson.M{"iss": "https://auth.example.org", "aud": []string{"https://fhir.example.org"}, "sub": "clinician", "scope": "launch user/*.*", "exp": exp}))
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	body, _ := ioutil.ReadAll(res.Body)
+	c.Assert(string(body), Equals, "clinician launch,user/*.*")
+
+	res = get("")
+	c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+	c.Assert(res.Header.Get("WWW-Authenticate"), Equals, `Bearer realm="fhir"`)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue[0].Type.Code, Equals, "login")
+
+	for _, claims := range []bson.M{
+		{"iss": "https://other.example.org", "aud": "https://fhir.example.org", "sub": "clinician", "exp": exp},
+		{"iss": "https://auth.example.org", "aud": "https://other.example.org", "sub": "clinician", "exp": exp},
+		{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "clinician", "exp": time.Now().Add(-time.Hour).Unix()},
+	} {
+		res = get(signToken(key, claims))
+		c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+		c.Assert(strings.Contains(res.Header.Get("WWW-Authenticate"), `error="invalid_token"`), Equals, true)
+	}
+
+	// A token signed by another key is rejected
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.CheckErr(err)
+	res = get(signToken(other, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "clinician", "exp": exp}))
+	c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+
+	// Scopes limit what the token allows
+	reader := signToken(key, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "clerk", "scope": "user/Patient.read patient/*.*", "exp": exp})
+	c.Assert(request("GET", "/Patient/1", reader).StatusCode, Equals, http.StatusOK)
+	c.Assert(request("POST", "/Patient/$match", reader).StatusCode, Equals, http.StatusOK)
+	for _, forbidden := range [][]string{{"POST", "/Patient"}, {"GET", "/Observation"}, {"GET", "/Patient/1/Observation"}, {"GET", "/Patient/1/$everything"}, {"GET", "/Patient/1/*"}, {"GET", "/Patient/1/$disclosures"}, {"POST", "/Patient/$merge"}, {"GET", "/admin/deliveries"}} {
+		res = request(forbidden[0], forbidden[1], reader)
+		c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+		c.Assert(strings.Contains(res.Header.Get("WWW-Authenticate"), `error="insufficient_scope"`), Equals, true)
+	}
+	auditor := signToken(key, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "auditor", "scope": "user/Patient.read user/SecurityEvent.read", "exp": exp})
+	c.Assert(request("GET", "/Patient/1/$disclosures", auditor).StatusCode, Equals, http.StatusOK)
+	admin := signToken(key, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "operator", "scope": "admin", "exp": exp})
+	c.Assert(request("GET", "/admin/deliveries", admin).StatusCode, Equals, http.StatusOK)
+	c.Assert(request("GET", "/Patient", admin).StatusCode, Equals, http.StatusForbidden)
+
+	// Websocket clients may send the token as a subprotocol
+	ws := httptest.NewServer(negroni.New(negroni.HandlerFunc(auth.Handler), negroni.HandlerFunc(DefaultWebSocketHub.WebSocketHandler)))
+	defer ws.Close()
+	wsURL := "ws" + strings.TrimPrefix(ws.URL, "http") + "/websocket"
+	_, res, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	c.Assert(err, NotNil)
+	c.Assert(res.StatusCode, Equals, http.StatusUnauthorized)
+	subscriber := signToken(key, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": "dashboard", "scope": "user/Subscription.read", "exp": exp})
+	dialer := &websocket.Dialer{Subprotocols: []string{"bearer", subscriber}}
+	conn, _, err := dialer.Dial(wsURL, nil)
+	util.CheckErr(err)
+	c.Assert(conn.Subprotocol(), Equals, "bearer")
+	conn.Close()
+}
+
+func (s *ServerSuite) TestCORSHandler(c *C) {
+	defer func() { AllowedOrigins = nil }()
+	AllowedOrigins = []string{"https://app.example.org"}
+	n := negroni.New(negroni.HandlerFunc(CORSHandler))
+	n.UseHandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		rw.Write([]byte("{}"))
+	})
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	request := func(method, origin string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+"/Patient", nil)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+	res := request("GET", "https://app.example.org")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "https://app.example.org")
+	res = request("GET", "https://evil.example.org")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+
+	res = request("OPTIONS", "https://app.example.org")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(strings.Contains(res.Header.Get("Access-Control-Allow-Headers"), "Authorization"), Equals, true)
+	res = request("OPTIONS", "https://evil.example.org")
+	c.Assert(res.Header.Get("Access-Control-Allow-Origin"), Equals, "")
+	c.Assert(res.Header.Get("Access-Control-Allow-Headers"), Equals, "")
+}
+
+// signToken makes an RS256 JWT with the claims.
+func (s *ServerSuite) TestSubscriptionAccess(c *C) {
+	dir, err := ioutil.TempDir("", "authentication")
+	util.CheckErr(err)
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	util.CheckErr(err)
+	_, certFile := writeSigningKey(dir, key)
+	auth := NewAuthenticator("https://auth.example.org", "https://fhir.example.org")
+	util.CheckErr(auth.LoadPEM(certFile))
+
+	f := NewServer("localhost")
+	RegisterRoutes(f.Router, f.MiddlewareConfig)
+	n := negroni.New(negroni.HandlerFunc(auth.Handler))
+	n.UseHandler(f.Router)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	token := func(subject string) string {
+		return signToken(key, bson.M{"iss": "https://auth.example.org", "aud": "https://fhir.example.org", "sub": subject, "scope": "user/Subscription.* user/Patient.read", "exp": exp})
+	}
+	owner, other := token("dashboard"), token("intruder")
+	request := func(method, path, token, criteria string) *http.Response {
+		body := `{"resourceType": "Subscription", "criteria": "` + criteria + `", "status": "requested", "channel": {"type": "websocket"}}`
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+
+	// Subscribing needs read access to the type the criteria search
+	res := request("POST", "/Subscription", owner, "Observation?status=final")
+	c.Assert(res.StatusCode, Equals, http.StatusForbidden)
+	res = request("POST", "/Subscription", owner, "Patient?gender=female")
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	location := res.Header.Get("Location")
+	id := location[strings.LastIndex(location, "/")+1:]
+	subject, err := subscriptionOwner(id)
+	util.CheckErr(err)
+	c.Assert(subject, Equals, "dashboard")
+	c.Assert(request("PUT", "/Subscription/"+id, owner, "Observation").StatusCode, Equals, http.StatusForbidden)
+
+	// Only the owner may change it or bind to it
+	c.Assert(request("PUT", "/Subscription/"+id, other, "Patient").StatusCode, Equals, http.StatusForbidden)
+	c.Assert(request("DELETE", "/Subscription/"+id, other, "").StatusCode, Equals, http.StatusForbidden)
+	c.Assert(request("PUT", "/Subscription/"+id, owner, "Patient").StatusCode, Equals, http.StatusOK)
+	subject, err = subscriptionOwner(id)
+	util.CheckErr(err)
+	c.Assert(subject, Equals, "dashboard")
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/websocket"
+	for _, bind := range []struct{ token, reply string }{
+		{other, "error Subscription " + id + " belongs to another user"},
+		{owner, "bound " + id},
+	} {
+		conn, _, err := (&websocket.Dialer{Subprotocols: []string{"bearer", bind.token}}).Dial(wsURL, nil)
+		util.CheckErr(err)
+		util.CheckErr(conn.WriteMessage(websocket.TextMessage, []byte("bind "+id)))
+		c.Assert(readWebSocketMessage(conn), Equals, bind.reply)
+		conn.Close()
+	}
+
+	c.Assert(request("DELETE", "/Subscription/"+id, owner, "").StatusCode, Equals, http.StatusOK)
+}
+
+func signToken(key *rsa.PrivateKey, claims bson.M) string {
+	payload, err := json.Marshal(claims)
+	util.CheckErr(err)
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(input))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	util.CheckErr(err)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// writeSigningKey writes a key, and a self-signed certificate for it, to PEM
+// files.
+func writeSigningKey(dir string, key crypto.Signer) (string, string) {
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "FHIR Server"}, NotBefore: time.Now(), NotAfter: time.Now().AddDate(1, 0, 0)}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	util.CheckErr(err)
+	block := &pem.Block{}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block.Type, block.Bytes = "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k)
+	case *ecdsa.PrivateKey:
+		block.Type = "EC PRIVATE KEY"
+		block.Bytes, err = x509.MarshalECPrivateKey(k)
+		util.CheckErr(err)
+	}
+	keyFile, err := ioutil.TempFile(dir, "key")
+	util.CheckErr(err)
+	defer keyFile.Close()
+	util.CheckErr(pem.Encode(keyFile, block))
+	certFile, err := ioutil.TempFile(dir, "cert")
+	util.CheckErr(err)
+	defer certFile.Close()
+	util.CheckErr(pem.Encode(certFile, &pem.Block{Type: "CERTIFICATE", Bytes: cert}))
+	return keyFile.Name(), certFile.Name()
+}
+
+func LoadValueSetFromFixture(fileName string) *models.ValueSet {
+	data, err := os.Open(fileName)
+	defer data.Close()
+	util.CheckErr(err)
+	vs := &models.ValueSet{}
+	err = json.NewDecoder(data).Decode(vs)
+	util.CheckErr(err)
+	return vs
+}
+
 func LoadPatientFromFixture(fileName string) *models.Patient {
 	data, err := os.Open(fileName)
 	defer data.Close()
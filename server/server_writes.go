@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RecordServerWrite records a change the server made to a stored resource by
+// itself, such as a merge rewriting a reference, in the same way the
+// middleware records a client's write: the resource's meta.lastUpdated is
+// set, its new version is kept, and a Provenance is recorded for the version,
+// signed if ProvenanceSigner is set. The Provenance's reason is the operation
+// that made the change, such as "$merge", and its agents are the server and
+// the requester of r.
+func RecordServerWrite(r *http.Request, operation, resourceType, id string) error {
+	if err := Database.C(CollectionName(resourceType)).UpdateId(id, bson.M{"$set": bson.M{"meta.lastUpdated": time.Now()}}); err != nil {
+		return err
+	}
+	if _, err := SaveVersion(resourceType, id); err != nil {
+		return err
+	}
+	return RecordProvenance(r, serverProvenance(r, "update", operation), resourceType, id)
+}
+
+// DeleteResource deletes a stored resource for the request r, as a change the
+// server makes by itself, such as a delete cascaded from another. As with a
+// client's delete, the resource's facts and identifier claims are removed
+// with it and a SecurityEvent is recorded. Its last version is kept in its
+// history if it was not already, and a Provenance of the delete, signed like
+// that of a write, targets that version. It returns mgo.ErrNotFound if the
+// resource is not stored.
+func DeleteResource(r *http.Request, operation, resourceType, id string) error {
+	resource, err := models.NewStructForResourceName(resourceType)
+	if err != nil {
+		return err
+	}
+	collection := Database.C(CollectionName(resourceType))
+	if err := collection.FindId(id).One(resource); err != nil {
+		return err
+	}
+	if version, err := currentVersion(resourceType, id); err != nil {
+		return err
+	} else if version == "" {
+		if _, err := SaveVersion(resourceType, id); err != nil {
+			return err
+		}
+	}
+	if err := RecordProvenance(r, serverProvenance(r, "delete", operation), resourceType, id); err != nil {
+		return err
+	}
+
+	if err := collection.RemoveId(id); err != nil {
+		return err
+	}
+	if _, ok := FactExtractors[resourceType]; ok {
+		if err := RemoveFacts(resourceType, id); err != nil {
+			return err
+		}
+	}
+	if err := ReleaseIdentifiers(resourceType, id, nil); err != nil {
+		return err
+	}
+	DefaultAuditLog.Record(serverSecurityEvent(r, "delete", resourceType, id, resource))
+	return nil
+}
+
+// serverProvenance starts the Provenance of a change the server made for a
+// request, giving the interaction and the operation that caused it as the
+// reason.
+func serverProvenance(r *http.Request, interaction, operation string) *models.Provenance {
+	return &models.Provenance{
+		Reason: models.CodeableConcept{
+			Coding: []models.Coding{{System: "http://hl7.org/fhir/restful-interaction", Code: interaction}},
+			Text:   operation,
+		},
+		Agent: append([]models.ProvenanceAgentComponent{{
+			Role:      models.Coding{System: "http://hl7.org/fhir/provenance-participant-role", Code: "performer"},
+			Type:      models.Coding{System: "http://hl7.org/fhir/provenance-participant-type", Code: "software"},
+			Reference: models.BaseURL,
+			Display:   "FHIR server",
+		}}, requestAgents(r)...),
+	}
+}
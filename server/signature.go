@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"strings"
+)
+
+// Signer signs resources with a private key, identified by the certificate
+// for its public key. RSA keys sign with RS256, and P-256 ECDSA keys with
+// ES256.
+type Signer struct {
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+}
+
+// ProvenanceSigner, if set, signs the resources that captured Provenance
+// targets, putting the signature in Provenance.integritySignature.
+var ProvenanceSigner *Signer
+
+// TrustedCertificates holds the certificates whose signatures are accepted
+// when verifying, by thumbprint. LoadSigner adds the signer's certificate.
+var TrustedCertificates = make(map[string]*x509.Certificate)
+
+// ErrSignatureInvalid is returned when a signature does not match what it
+// signs.
+var ErrSignatureInvalid = errors.New("Signature does not match")
+
+// signatureHeader is the protected header of a signature: its algorithm and
+// the SHA-256 thumbprint of the signing certificate.
+type signatureHeader struct {
+	Algorithm  string `json:"alg"`
+	Thumbprint string `json:"x5t#S256"`
+}
+
+// LoadSigner reads a private key and its certificate from PEM files, and
+// trusts the certificate. The key may be PKCS#1 or PKCS#8 RSA, or SEC 1 or
+// PKCS#8 ECDSA on P-256.
+func LoadSigner(keyFile, certFile string) (*Signer, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s holds no PEM data", keyFile)
+	}
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("%s holds a %s, not a private key", keyFile, block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || signatureAlgorithm(signer.Public()) == "" {
+		return nil, fmt.Errorf("%s holds an unsupported kind of key", keyFile)
+	}
+
+	certs, err := readCertificates(certFile)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(certs[0].PublicKey, signer.Public()) {
+		return nil, fmt.Errorf("%s is not the certificate for the key in %s", certFile, keyFile)
+	}
+	TrustedCertificates[thumbprint(certs[0])] = certs[0]
+	return &Signer{Key: signer, Certificate: certs[0]}, nil
+}
+
+// LoadCertificates trusts the certificates in PEM files, such as those of
+// keys that signed resources in the past.
+func LoadCertificates(files ...string) error {
+	for _, file := range files {
+		certs, err := readCertificates(file)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			TrustedCertificates[thumbprint(cert)] = cert
+		}
+	}
+	return nil
+}
+
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s holds no certificates", file)
+	}
+	return certs, nil
+}
+
+// thumbprint returns the base64url SHA-256 digest of a certificate.
+func thumbprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// signatureAlgorithm returns the algorithm used to sign with a key, or "" if
+// the key cannot be used.
+func signatureAlgorithm(key crypto.PublicKey) string {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "RS256"
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return "ES256"
+		}
+	}
+	return ""
+}
+
+// Sign returns a detached JSON Web Signature of the payload, in compact form
+// with the payload left out: header..signature.
+func (s *Signer) Sign(payload []byte) (string, error) {
+	header, err := json.Marshal(signatureHeader{Algorithm: signatureAlgorithm(s.Key.Public()), Thumbprint: thumbprint(s.Certificate)})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	digest := sha256.Sum256([]byte(protected + "." + base64.RawURLEncoding.EncodeToString(payload)))
+	signature, err := s.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := s.Key.Public().(*ecdsa.PublicKey); ok {
+		// JWS uses the fixed width r || s form rather than ASN.1.
+		var rs struct{ R, S *big.Int }
+		if _, err := asn1.Unmarshal(signature, &rs); err != nil {
+			return "", err
+		}
+		signature = append(leftPad(rs.R.Bytes(), 32), leftPad(rs.S.Bytes(), 32)...)
+	}
+	return protected + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func leftPad(b []byte, size int) []byte {
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// VerifySignature checks a detached signature made by Sign against the
+// payload, using the trusted certificate it names.
+func VerifySignature(signature string, payload []byte) error {
+	parts := strings.Split(signature, ".")
+	if len(parts) != 3 || parts[1] != "" {
+		return errors.New("Signature is not a detached JWS")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	header := signatureHeader{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	cert, ok := TrustedCertificates[header.Thumbprint]
+	if !ok {
+		return errors.New("Signature was made with an untrusted certificate")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	return verifyJWS(cert.PublicKey, header.Algorithm, parts[0]+"."+base64.RawURLEncoding.EncodeToString(payload), sig)
+}
+
+// verifyJWS checks a JWS signature over its signing input with a public key,
+// which must suit the algorithm.
+func verifyJWS(key crypto.PublicKey, algorithm, signingInput string, sig []byte) error {
+	if signatureAlgorithm(key) != algorithm {
+		return fmt.Errorf("Signature algorithm %s does not suit the key", algorithm)
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) != nil {
+			return ErrSignatureInvalid
+		}
+	case *ecdsa.PublicKey:
+		if len(sig) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return ErrSignatureInvalid
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/context"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SubscriptionNotifier delivers notifications over one type of subscription
+// channel.
+type SubscriptionNotifier interface {
+	Notify(sub *models.Subscription, resourceType string, resource interface{}) error
+}
+
+// SubscriptionNotifiers holds the notifier for each supported channel type.
+// Subscriptions with other channel types are put into the error state when
+// they first match.
+var SubscriptionNotifiers = map[string]SubscriptionNotifier{
+	"rest-hook": &RestHookNotifier{Queue: DefaultDeliveryQueue},
+	"websocket": DefaultWebSocketHub,
+}
+
+// activeSubscriptionStatuses are the statuses of subscriptions that are
+// evaluated against written resources.
+var activeSubscriptionStatuses = []string{"requested", "active"}
+
+// SubscriptionHandler evaluates subscriptions against the resource written by
+// a create or update route once the route has succeeded. Notifications are
+// sent in the background so that they do not delay the response.
+func SubscriptionHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	next(rw, r)
+
+	action, _ := context.Get(r, "Action").(string)
+	if action != "create" && action != "update" {
+		return
+	}
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	resourceType, _ := context.Get(r, "Resource").(string)
+	if resource := context.Get(r, resourceType); resource != nil {
+		go NotifySubscriptions(resourceType, resource)
+	}
+}
+
+// SubscriptionAccessHandler guards the Subscription create, update and delete
+// routes when requests are authenticated. A subscription delivers the
+// resources its criteria select, so writing one needs read access to the type
+// it searches. The principal that creates or updates a subscription is
+// recorded as its owner, and only the owner may update, delete or bind to it
+// afterwards; subscriptions written without authentication have no owner.
+func SubscriptionAccessHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	principal := RequestPrincipal(r)
+	if principal == nil {
+		next(rw, r)
+		return
+	}
+	if r.Method == "POST" || r.Method == "PUT" {
+		resource, err := DecodeResourceBody(r)
+		if err != nil {
+			WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("structure", err.Error()))
+			return
+		}
+		if message := checkSubscriptionCriteria(principal, resource.(*models.Subscription).Criteria); message != "" {
+			WriteOperationOutcome(rw, http.StatusForbidden, NewOperationOutcomeIssue("forbidden", message))
+			return
+		}
+	}
+	if id, ok := requestVars(r)["id"]; ok {
+		if owner, err := subscriptionOwner(id); err == nil && owner != principal.Subject {
+			WriteOperationOutcome(rw, http.StatusForbidden, NewOperationOutcomeIssue("forbidden", "Subscription "+id+" belongs to another user"))
+			return
+		}
+	}
+
+	next(rw, r)
+
+	if r.Method != "POST" && r.Method != "PUT" {
+		return
+	}
+	if w, ok := rw.(negroni.ResponseWriter); ok && w.Status() >= http.StatusBadRequest {
+		return
+	}
+	if id := resourceId(context.Get(r, "Subscription")); id != "" {
+		if err := Database.C("subscriptions").UpdateId(id, bson.M{"$set": bson.M{"owner": principal.Subject}}); err != nil {
+			log.Println("Recording owner of subscription", id, err)
+		}
+	}
+}
+
+// checkSubscriptionCriteria returns why a principal may not subscribe with
+// the given criteria, or "" if it may.
+func checkSubscriptionCriteria(principal *Principal, criteria string) string {
+	resourceType := strings.SplitN(strings.TrimPrefix(criteria, "/"), "?", 2)[0]
+	if !principal.Allows(resourceType, "read") {
+		return "The token's scopes do not allow reading " + resourceType + " resources"
+	}
+	return ""
+}
+
+// subscriptionOwner returns the subject of the principal that last wrote a
+// stored subscription, or "" if it was written without authentication.
+func subscriptionOwner(id string) (string, error) {
+	var stored struct {
+		Owner string `bson:"owner"`
+	}
+	err := Database.C("subscriptions").FindId(id).Select(bson.M{"owner": 1}).One(&stored)
+	return stored.Owner, err
+}
+
+// NotifySubscriptions notifies every active subscription whose criteria match
+// a resource that has just been written, updating the status of each
+// subscription notified.
+func NotifySubscriptions(resourceType string, resource interface{}) {
+	if err := ExpireSubscriptions(); err != nil {
+		log.Println("Expiring subscriptions:", err)
+	}
+
+	var subs []models.Subscription
+	query := bson.M{
+		"status":   bson.M{"$in": activeSubscriptionStatuses},
+		"criteria": bson.M{"$regex": "^/?" + regexp.QuoteMeta(resourceType) + `(\?|$)`},
+	}
+	if err := Database.C("subscriptions").Find(query).All(&subs); err != nil {
+		log.Println("Loading subscriptions:", err)
+		return
+	}
+
+	id := resourceId(resource)
+	for i := range subs {
+		sub := &subs[i]
+		matched, err := SubscriptionMatches(sub, id)
+		if err != nil {
+			setSubscriptionStatus(sub, "error", "Invalid criteria: "+err.Error())
+			continue
+		}
+		if !matched {
+			continue
+		}
+
+		notifier, ok := SubscriptionNotifiers[sub.Channel.Type]
+		if !ok {
+			setSubscriptionStatus(sub, "error", "Unsupported channel type: "+sub.Channel.Type)
+			continue
+		}
+		if err := notifier.Notify(sub, resourceType, resource); err != nil {
+			setSubscriptionStatus(sub, "error", err.Error())
+		} else if sub.Status != "active" {
+			setSubscriptionStatus(sub, "active", "")
+		}
+	}
+}
+
+// SubscriptionMatches reports whether the stored resource with the given id
+// matches a subscription's criteria, by searching for it with them.
+func SubscriptionMatches(sub *models.Subscription, id string) (bool, error) {
+	resourceType, query, err := ParseSearchCriteria(sub.Criteria)
+	if err != nil {
+		return false, err
+	}
+	n, err := Database.C(CollectionName(resourceType)).Find(bson.M{"$and": []bson.M{{"_id": id}, query}}).Count()
+	return n > 0, err
+}
+
+// ExpireSubscriptions turns off active subscriptions whose end has passed.
+func ExpireSubscriptions() error {
+	_, err := Database.C("subscriptions").UpdateAll(
+		bson.M{"status": bson.M{"$in": activeSubscriptionStatuses}, "end.time": bson.M{"$lt": time.Now()}},
+		bson.M{"$set": bson.M{"status": "off", "error": "The subscription has ended"}},
+	)
+	return err
+}
+
+func setSubscriptionStatus(sub *models.Subscription, status, message string) {
+	sub.Status, sub.Error = status, message
+	update := bson.M{"$set": bson.M{"status": status}, "$unset": bson.M{"error": ""}}
+	if message != "" {
+		update = bson.M{"$set": bson.M{"status": status, "error": message}}
+	}
+	if err := Database.C("subscriptions").UpdateId(sub.Id, update); err != nil {
+		log.Println("Updating subscription", sub.Id, err)
+	}
+}
+
+// resourceId returns the Id of a model struct or pointer to one.
+func resourceId(resource interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	if id := v.FieldByName("Id"); id.IsValid() && id.Kind() == reflect.String {
+		return id.String()
+	}
+	return ""
+}
+
+// RestHookNotifier POSTs to a subscription's channel URL. If the channel has
+// a payload the resource is sent as the body with the payload as its content
+// type, otherwise the body is empty. The channel header, if any, is sent as
+// one or more "Name: value" lines. Notifications are sent through a delivery
+// queue, so they are retried if the receiver is unavailable.
+type RestHookNotifier struct {
+	Queue *DeliveryQueue
+}
+
+func (n *RestHookNotifier) Notify(sub *models.Subscription, resourceType string, resource interface{}) error {
+	req, err := NewRestHookRequest(sub, resource)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	return n.Queue.Enqueue(&Delivery{Method: req.Method, Url: sub.Channel.Url, Header: req.Header, Body: body, Subscription: sub.Id})
+}
+
+// NewRestHookRequest builds the request that notifies a rest-hook
+// subscription of a resource.
+func NewRestHookRequest(sub *models.Subscription, resource interface{}) (*http.Request, error) {
+	var body []byte
+	if sub.Channel.Payload != "" {
+		var err error
+		if body, err = json.Marshal(resource); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("POST", sub.Channel.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if sub.Channel.Payload != "" {
+		req.Header.Set("Content-Type", sub.Channel.Payload)
+	}
+	for _, line := range strings.Split(sub.Channel.Header, "\n") {
+		if parts := strings.SplitN(line, ":", 2); len(parts) == 2 {
+			req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+		}
+	}
+	return req, nil
+}
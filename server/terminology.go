@@ -0,0 +1,567 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+	"github.com/intervention-engine/fhir/terminology"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ValueSetExpander computes the expansion of value sets, resolving imported
+// value sets and code system definitions through its lookup functions.
+type ValueSetExpander struct {
+	// FindValueSet returns the value set with the given identifier.
+	FindValueSet func(identifier string) (*models.ValueSet, error)
+	// FindCodeSystem returns the definition of the code system with the
+	// given URI.
+	FindCodeSystem func(system string) (*models.ValueSetDefineComponent, error)
+	// Concepts, if set, holds code systems loaded from release files. It is
+	// used for systems that no value set defines.
+	Concepts *terminology.ConceptStore
+}
+
+// MaxStoredExpansion limits the number of concepts an include or exclude may
+// select from the concept store, so that a value set cannot expand to the
+// whole of a large code system such as SNOMED CT.
+var MaxStoredExpansion = 10000
+
+// NewValueSetExpander returns an expander that resolves value sets and code
+// systems from the valuesets collection.
+func NewValueSetExpander() *ValueSetExpander {
+	return &ValueSetExpander{FindValueSet: FindValueSetByIdentifier, FindCodeSystem: FindCodeSystemDefinition, Concepts: NewConceptStore()}
+}
+
+// NewConceptStore returns the store of concepts loaded from release files, or
+// nil if there is no database connection.
+func NewConceptStore() *terminology.ConceptStore {
+	if Database == nil {
+		return nil
+	}
+	return terminology.NewConceptStore(Database)
+}
+
+// FindValueSetByIdentifier loads the value set with the given identifier.
+func FindValueSetByIdentifier(identifier string) (*models.ValueSet, error) {
+	vs := &models.ValueSet{}
+	if err := Database.C("valuesets").Find(bson.M{"identifier": identifier}).One(vs); err != nil {
+		return nil, err
+	}
+	return vs, nil
+}
+
+// FindCodeSystemDefinition loads the definition of the code system with the
+// given URI from the value set that defines it.
+func FindCodeSystemDefinition(system string) (*models.ValueSetDefineComponent, error) {
+	vs := &models.ValueSet{}
+	if err := Database.C("valuesets").Find(bson.M{"define.system": system}).One(vs); err != nil {
+		return nil, err
+	}
+	return &vs.Define, nil
+}
+
+// Expand returns the codes contained in a value set, in the order they are
+// defined, without duplicates.
+func (e *ValueSetExpander) Expand(vs *models.ValueSet) ([]models.ValueSetExpansionContainsComponent, error) {
+	return e.expand(vs, make(map[string]bool))
+}
+
+func (e *ValueSetExpander) expand(vs *models.ValueSet, visiting map[string]bool) ([]models.ValueSetExpansionContainsComponent, error) {
+	if vs.Identifier != "" {
+		if visiting[vs.Identifier] {
+			return nil, fmt.Errorf("ValueSet %s imports itself", vs.Identifier)
+		}
+		visiting[vs.Identifier] = true
+		defer delete(visiting, vs.Identifier)
+	}
+
+	codes := newExpansionCodes()
+	if vs.Define.System != "" {
+		for _, concept := range flattenConcepts(vs.Define.Concept) {
+			codes.add(containsForConcept(vs.Define.System, vs.Define.Version, concept))
+		}
+	}
+
+	for _, identifier := range vs.Compose.Import {
+		imported, err := e.FindValueSet(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve imported ValueSet %s: %s", identifier, err)
+		}
+		contains, err := e.expand(imported, visiting)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contains {
+			codes.add(c)
+		}
+	}
+
+	for _, include := range vs.Compose.Include {
+		contains, err := e.selectConcepts(include)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contains {
+			codes.add(c)
+		}
+	}
+
+	for _, exclude := range vs.Compose.Exclude {
+		contains, err := e.selectConcepts(exclude)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range contains {
+			codes.remove(c)
+		}
+	}
+
+	return codes.list(), nil
+}
+
+// selectConcepts returns the codes selected by an include or exclude
+// statement: the listed concepts, the concepts matching all of the filters, or
+// every concept in the code system if neither is given.
+func (e *ValueSetExpander) selectConcepts(set models.ConceptSetComponent) ([]models.ValueSetExpansionContainsComponent, error) {
+	var define *models.ValueSetDefineComponent
+	if len(set.Filter) > 0 || len(set.Concept) == 0 {
+		var err error
+		if define, err = e.FindCodeSystem(set.System); err != nil {
+			if e.hasStoredSystem(set.System) {
+				return e.selectStoredConcepts(set)
+			}
+			return nil, fmt.Errorf("Unable to resolve code system %s: %s", set.System, err)
+		}
+	}
+
+	var contains []models.ValueSetExpansionContainsComponent
+	if len(set.Concept) > 0 {
+		lookedUp := false
+		for _, concept := range set.Concept {
+			c := models.ValueSetExpansionContainsComponent{System: set.System, Version: set.Version, Code: concept.Code, Display: concept.Display}
+			if c.Display == "" {
+				if !lookedUp {
+					// The code system is only needed to fill in missing displays
+					define, _ = e.FindCodeSystem(set.System)
+					lookedUp = true
+				}
+				c.Display = e.display(define, set.System, concept.Code)
+			}
+			contains = append(contains, c)
+		}
+		return contains, nil
+	}
+
+	concepts := flattenConcepts(define.Concept)
+	for _, filter := range set.Filter {
+		var err error
+		if concepts, err = applyConceptFilter(define.Concept, concepts, filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, concept := range concepts {
+		contains = append(contains, containsForConcept(set.System, set.Version, concept))
+	}
+	return contains, nil
+}
+
+// display returns the display of a code as LookupCode finds it: from the
+// concept store if it holds the code, or else from the code system's
+// definition, if there is one.
+func (e *ValueSetExpander) display(define *models.ValueSetDefineComponent, system, code string) string {
+	if e.Concepts != nil {
+		if display := e.Concepts.Display(system, code); display != "" {
+			return display
+		}
+	}
+	if define != nil {
+		if found := findConcept(define.Concept, code); found != nil {
+			return found.Display
+		}
+	}
+	return ""
+}
+
+func (e *ValueSetExpander) hasStoredSystem(system string) bool {
+	if e.Concepts == nil {
+		return false
+	}
+	found, err := e.Concepts.HasSystem(system)
+	return err == nil && found
+}
+
+// selectStoredConcepts selects concepts from the concept store using the same
+// filters as applyConceptFilter, which are translated to a single query.
+func (e *ValueSetExpander) selectStoredConcepts(set models.ConceptSetComponent) ([]models.ValueSetExpansionContainsComponent, error) {
+	clauses, err := storedConceptClauses(set)
+	if err != nil {
+		return nil, err
+	}
+
+	var concepts []terminology.Concept
+	if err := e.Concepts.Collection.Find(bson.M{"$and": clauses}).Sort("code").Limit(MaxStoredExpansion + 1).All(&concepts); err != nil {
+		return nil, err
+	}
+	if len(concepts) > MaxStoredExpansion {
+		return nil, fmt.Errorf("Selecting from code system %s matches more than %d concepts", set.System, MaxStoredExpansion)
+	}
+	contains := make([]models.ValueSetExpansionContainsComponent, len(concepts))
+	for i, c := range concepts {
+		contains[i] = models.ValueSetExpansionContainsComponent{System: set.System, Version: set.Version, Code: c.Code, Display: c.Display}
+	}
+	return contains, nil
+}
+
+// storedConceptClauses translates the filters of an include or exclude
+// statement to clauses of a concept store query.
+func storedConceptClauses(set models.ConceptSetComponent) ([]bson.M, error) {
+	clauses := []bson.M{{"system": set.System}}
+	for _, filter := range set.Filter {
+		if filter.Property != "concept" && filter.Property != "code" {
+			return nil, fmt.Errorf("Unsupported filter property: %s", filter.Property)
+		}
+		switch filter.Op {
+		case "is-a":
+			clauses = append(clauses, bson.M{"$or": []bson.M{{"code": filter.Value}, {"ancestors": filter.Value}}})
+		case "is-not-a":
+			clauses = append(clauses, bson.M{"code": bson.M{"$ne": filter.Value}, "ancestors": bson.M{"$ne": filter.Value}})
+		case "=":
+			clauses = append(clauses, bson.M{"code": filter.Value})
+		case "regex":
+			if _, err := regexp.Compile(filter.Value); err != nil {
+				return nil, err
+			}
+			clauses = append(clauses, bson.M{"code": bson.M{"$regex": "^(?:" + filter.Value + ")$"}})
+		default:
+			return nil, fmt.Errorf("Unsupported filter operation: %s", filter.Op)
+		}
+	}
+	return clauses, nil
+}
+
+// Lookup finds a code in a value set without expanding it, so that checking
+// a code costs a few queries however large the value set is. It returns the
+// code as Expand would list it, or nil if the value set does not contain it.
+// If system is empty the code may come from any system in the value set.
+func (e *ValueSetExpander) Lookup(vs *models.ValueSet, system, code string) (*models.ValueSetExpansionContainsComponent, error) {
+	return e.lookup(vs, system, code, make(map[string]bool))
+}
+
+func (e *ValueSetExpander) lookup(vs *models.ValueSet, system, code string, visiting map[string]bool) (*models.ValueSetExpansionContainsComponent, error) {
+	if vs.Identifier != "" {
+		if visiting[vs.Identifier] {
+			return nil, fmt.Errorf("ValueSet %s imports itself", vs.Identifier)
+		}
+		visiting[vs.Identifier] = true
+		defer delete(visiting, vs.Identifier)
+	}
+
+	var found *models.ValueSetExpansionContainsComponent
+	if vs.Define.System != "" && (system == "" || system == vs.Define.System) {
+		if concept := findConcept(vs.Define.Concept, code); concept != nil {
+			c := containsForConcept(vs.Define.System, vs.Define.Version, *concept)
+			found = &c
+		}
+	}
+	for _, identifier := range vs.Compose.Import {
+		if found != nil {
+			break
+		}
+		imported, err := e.FindValueSet(identifier)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to resolve imported ValueSet %s: %s", identifier, err)
+		}
+		if found, err = e.lookup(imported, system, code, visiting); err != nil {
+			return nil, err
+		}
+	}
+	for _, include := range vs.Compose.Include {
+		if found != nil {
+			break
+		}
+		var err error
+		if found, err = e.selectConcept(include, system, code); err != nil {
+			return nil, err
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	for _, exclude := range vs.Compose.Exclude {
+		excluded, err := e.selectConcept(exclude, found.System, code)
+		if err != nil {
+			return nil, err
+		} else if excluded != nil {
+			return nil, nil
+		}
+	}
+	return found, nil
+}
+
+// selectConcept returns the code as selectConcepts would list it if an
+// include or exclude statement selects it, or nil if it does not.
+func (e *ValueSetExpander) selectConcept(set models.ConceptSetComponent, system, code string) (*models.ValueSetExpansionContainsComponent, error) {
+	if system != "" && set.System != system {
+		return nil, nil
+	}
+	if len(set.Concept) > 0 {
+		for _, concept := range set.Concept {
+			if concept.Code != code {
+				continue
+			}
+			c := models.ValueSetExpansionContainsComponent{System: set.System, Version: set.Version, Code: concept.Code, Display: concept.Display}
+			if c.Display == "" {
+				define, _ := e.FindCodeSystem(set.System)
+				c.Display = e.display(define, set.System, code)
+			}
+			return &c, nil
+		}
+		return nil, nil
+	}
+
+	define, err := e.FindCodeSystem(set.System)
+	if err != nil {
+		if e.hasStoredSystem(set.System) {
+			return e.selectStoredConcept(set, code)
+		}
+		return nil, fmt.Errorf("Unable to resolve code system %s: %s", set.System, err)
+	}
+	concept := findConcept(define.Concept, code)
+	if concept == nil {
+		return nil, nil
+	}
+	concepts := []models.ConceptDefinitionComponent{*concept}
+	for _, filter := range set.Filter {
+		if concepts, err = applyConceptFilter(define.Concept, concepts, filter); err != nil {
+			return nil, err
+		}
+	}
+	if len(concepts) == 0 {
+		return nil, nil
+	}
+	c := containsForConcept(set.System, set.Version, *concept)
+	return &c, nil
+}
+
+// selectStoredConcept looks a code up in the concept store with the filters
+// of an include or exclude statement.
+func (e *ValueSetExpander) selectStoredConcept(set models.ConceptSetComponent, code string) (*models.ValueSetExpansionContainsComponent, error) {
+	clauses, err := storedConceptClauses(set)
+	if err != nil {
+		return nil, err
+	}
+	var concept terminology.Concept
+	err = e.Concepts.Collection.Find(bson.M{"$and": append(clauses, bson.M{"_id": terminology.ConceptId(set.System, code)})}).One(&concept)
+	if err == mgo.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &models.ValueSetExpansionContainsComponent{System: set.System, Version: set.Version, Code: concept.Code, Display: concept.Display}, nil
+}
+
+// applyConceptFilter narrows concepts to those that match a filter. The
+// "concept" property supports the is-a, is-not-a, = and regex operations.
+func applyConceptFilter(tree []models.ConceptDefinitionComponent, concepts []models.ConceptDefinitionComponent, filter models.ConceptSetFilterComponent) ([]models.ConceptDefinitionComponent, error) {
+	if filter.Property != "concept" && filter.Property != "code" {
+		return nil, fmt.Errorf("Unsupported filter property: %s", filter.Property)
+	}
+
+	var keep func(code string) bool
+	switch filter.Op {
+	case "is-a", "is-not-a":
+		subsumed := make(map[string]bool)
+		if root := findConcept(tree, filter.Value); root != nil {
+			for _, c := range flattenConcepts([]models.ConceptDefinitionComponent{*root}) {
+				subsumed[c.Code] = true
+			}
+		}
+		isA := filter.Op == "is-a"
+		keep = func(code string) bool { return subsumed[code] == isA }
+	case "=":
+		keep = func(code string) bool { return code == filter.Value }
+	case "regex":
+		re, err := regexp.Compile("^(?:" + filter.Value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		keep = re.MatchString
+	default:
+		return nil, fmt.Errorf("Unsupported filter operation: %s", filter.Op)
+	}
+
+	var result []models.ConceptDefinitionComponent
+	for _, c := range concepts {
+		if keep(c.Code) {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// FilterExpansion keeps only the codes whose code or display contains text,
+// ignoring case.
+func FilterExpansion(contains []models.ValueSetExpansionContainsComponent, text string) []models.ValueSetExpansionContainsComponent {
+	if text == "" {
+		return contains
+	}
+	text = strings.ToLower(text)
+	var result []models.ValueSetExpansionContainsComponent
+	for _, c := range contains {
+		if strings.Contains(strings.ToLower(c.Display), text) || strings.Contains(strings.ToLower(c.Code), text) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// flattenConcepts returns every concept in a concept hierarchy, parents
+// before their children.
+func flattenConcepts(concepts []models.ConceptDefinitionComponent) []models.ConceptDefinitionComponent {
+	var result []models.ConceptDefinitionComponent
+	for _, c := range concepts {
+		result = append(result, c)
+		result = append(result, flattenConcepts(c.Concept)...)
+	}
+	return result
+}
+
+// findConcept searches a concept hierarchy for the concept with the given code.
+func findConcept(concepts []models.ConceptDefinitionComponent, code string) *models.ConceptDefinitionComponent {
+	for i := range concepts {
+		if concepts[i].Code == code {
+			return &concepts[i]
+		}
+		if found := findConcept(concepts[i].Concept, code); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func containsForConcept(system, version string, concept models.ConceptDefinitionComponent) models.ValueSetExpansionContainsComponent {
+	return models.ValueSetExpansionContainsComponent{
+		System:   system,
+		Version:  version,
+		Abstract: concept.Abstract,
+		Code:     concept.Code,
+		Display:  concept.Display,
+	}
+}
+
+// expansionCodes is an ordered set of codes keyed on system and code.
+type expansionCodes struct {
+	order   []string
+	ordered map[string]bool
+	codes   map[string]models.ValueSetExpansionContainsComponent
+}
+
+func newExpansionCodes() *expansionCodes {
+	return &expansionCodes{ordered: make(map[string]bool), codes: make(map[string]models.ValueSetExpansionContainsComponent)}
+}
+
+func (e *expansionCodes) add(c models.ValueSetExpansionContainsComponent) {
+	key := c.System + "|" + c.Code
+	if !e.ordered[key] {
+		e.order = append(e.order, key)
+		e.ordered[key] = true
+	}
+	e.codes[key] = c
+}
+
+func (e *expansionCodes) remove(c models.ValueSetExpansionContainsComponent) {
+	delete(e.codes, c.System+"|"+c.Code)
+}
+
+func (e *expansionCodes) list() []models.ValueSetExpansionContainsComponent {
+	var result []models.ValueSetExpansionContainsComponent
+	for _, key := range e.order {
+		if c, ok := e.codes[key]; ok {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// CodeValidation is the result of checking a code against a value set.
+type CodeValidation struct {
+	// Valid is true when the code is a member of the value set and any
+	// display given matches the display defined for the code.
+	Valid bool
+	// Member is true when the code is a member of the value set.
+	Member bool
+	// Display is the display defined for the code, if it is a member.
+	Display string
+	// Message explains why the code is not valid.
+	Message string
+}
+
+// TerminologyService answers questions about codes and the value sets that
+// contain them.
+type TerminologyService struct {
+	Expander *ValueSetExpander
+}
+
+// NewTerminologyService returns a terminology service backed by the value sets
+// stored on the server.
+func NewTerminologyService() *TerminologyService {
+	return &TerminologyService{Expander: NewValueSetExpander()}
+}
+
+// ValidateCode checks whether a code is a member of a value set and, if a
+// display is given, whether it matches the display defined for the code. If
+// system is empty the code may come from any system in the value set. The
+// code is looked up rather than the value set expanded, so value sets too
+// large to expand can be checked.
+func (t *TerminologyService) ValidateCode(vs *models.ValueSet, system, code, display string) (*CodeValidation, error) {
+	c, err := t.Expander.Lookup(vs, system, code)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return &CodeValidation{Message: fmt.Sprintf("The code %s|%s is not in ValueSet %s", system, code, valueSetName(vs))}, nil
+	}
+	result := &CodeValidation{Valid: true, Member: true, Display: c.Display}
+	if display != "" && c.Display != "" && !strings.EqualFold(display, c.Display) {
+		result.Valid = false
+		result.Message = fmt.Sprintf("The display %q does not match the display %q defined for code %s", display, c.Display, code)
+	}
+	return result, nil
+}
+
+// ValidateConcept checks whether any coding in a CodeableConcept is a member
+// of a value set.
+func (t *TerminologyService) ValidateConcept(vs *models.ValueSet, concept models.CodeableConcept) (*CodeValidation, error) {
+	for _, coding := range concept.Coding {
+		result, err := t.ValidateCode(vs, coding.System, coding.Code, coding.Display)
+		if err != nil || result.Member {
+			return result, err
+		}
+	}
+	return &CodeValidation{Message: fmt.Sprintf("None of the codings are in ValueSet %s", valueSetName(vs))}, nil
+}
+
+// FindValueSetByReference loads the value set a reference points at. Local
+// references, such as "ValueSet/1234" or one under models.BaseURL, are looked
+// up by id; anything else is treated as the identifier of the value set.
+func FindValueSetByReference(ref models.Reference) (*models.ValueSet, error) {
+	if parsed := models.ParseReference(ref.Reference); parsed.Type == "ValueSet" && !parsed.External {
+		vs := &models.ValueSet{}
+		if err := Database.C("valuesets").FindId(parsed.Id).One(vs); err != nil {
+			return nil, err
+		}
+		return vs, nil
+	}
+	return FindValueSetByIdentifier(ref.Reference)
+}
+
+func valueSetName(vs *models.ValueSet) string {
+	if vs.Identifier != "" {
+		return vs.Identifier
+	}
+	return vs.Id
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// ValidationHandler is middleware for the create and update routes. It decodes
+// the resource in the request body and rejects it with a 422 OperationOutcome
+// if it violates the base FHIR invariants for its type. Valid requests are
+// passed on with the body intact.
+func ValidationHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+
+	if issues := models.ValidateResource(resource); len(issues) > 0 {
+		WriteOperationOutcome(rw, 422, issues...)
+		return
+	}
+	next(rw, r)
+}
+
+// ValueSetBindings binds coded elements to the value sets that their codes
+// must be drawn from. It is keyed on resource type and then on element path,
+// and each binding names the identifier of a stored ValueSet, e.g.
+//
+//	ValueSetBindings["Observation"] = map[string]string{"name": "http://example.org/fhir/vs/lab-codes"}
+var ValueSetBindings = make(map[string]map[string]string)
+
+// BindingValidationHandler is middleware for the create and update routes. It
+// rejects resources with a 422 OperationOutcome if a Coding is not a member of
+// the ValueSet it names in its valueSet element, or if a bound element has no
+// coding from the ValueSet configured in ValueSetBindings.
+func BindingValidationHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resource, err := DecodeResourceBody(r)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", err.Error()))
+		return
+	}
+
+	issues := ValidateBindings(resource, NewTerminologyService())
+	for _, issue := range issues {
+		if issue.Severity == "error" {
+			WriteOperationOutcome(rw, 422, issues...)
+			return
+		}
+	}
+	next(rw, r)
+}
+
+// ValidateBindings checks the codings in a resource against the value sets
+// they are bound to. Unknown codes are errors; display text that does not
+// match the code system is reported as a warning.
+func ValidateBindings(resource interface{}, terminology *TerminologyService) []models.OperationOutcomeIssueComponent {
+	var issues []models.OperationOutcomeIssueComponent
+	addIssue := func(severity, code, location, details string) {
+		issue := NewOperationOutcomeIssue(code, details)
+		issue.Severity = severity
+		issue.Location = []string{location}
+		issues = append(issues, issue)
+	}
+
+	models.WalkElements(resource, func(location string, element interface{}) {
+		coding, ok := element.(models.Coding)
+		if !ok || coding.ValueSet.Reference == "" {
+			return
+		}
+		vs, err := FindValueSetByReference(coding.ValueSet)
+		if err != nil {
+			addIssue("error", "not-found", location, "Unable to find ValueSet "+coding.ValueSet.Reference)
+			return
+		}
+		result, err := terminology.ValidateCode(vs, coding.System, coding.Code, coding.Display)
+		switch {
+		case err != nil:
+			addIssue("error", "processing", location, err.Error())
+		case !result.Member:
+			addIssue("error", "code-unknown", location, result.Message)
+		case !result.Valid:
+			addIssue("warning", "value", location, result.Message)
+		}
+	})
+
+	resourceType := reflect.Indirect(reflect.ValueOf(resource)).Type().Name()
+	for path, identifier := range ValueSetBindings[resourceType] {
+		models.ElementsAtPath(resource, path, func(location string, element interface{}) {
+			concept, ok := element.(models.CodeableConcept)
+			if !ok {
+				return
+			}
+			vs, err := FindValueSetByIdentifier(identifier)
+			if err != nil {
+				addIssue("error", "not-found", location, "Unable to find ValueSet "+identifier)
+				return
+			}
+			result, err := terminology.ValidateConcept(vs, concept)
+			switch {
+			case err != nil:
+				addIssue("error", "processing", location, err.Error())
+			case !result.Member:
+				addIssue("error", "code-unknown", location, result.Message)
+			}
+		})
+	}
+	return issues
+}
+
+// DecodeResourceBody decodes the resource in a create or update request body
+// into the model for the resource type named in the path. The body is left
+// intact for the next handler.
+func DecodeResourceBody(r *http.Request) (interface{}, error) {
+	resource, err := models.NewStructForResourceName(ResourceTypeFromPath(r.URL.Path))
+	if err != nil {
+		return nil, err
+	}
+	body, err := ReadBody(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, resource); err != nil {
+		return nil, err
+	}
+	return resource, nil
+}
+
+// ReadBody reads the request body and replaces it with a fresh reader, so that
+// middleware can inspect the body before the handler decodes it.
+func ReadBody(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// ResourceTypeFromPath returns the resource type named by the first segment of
+// a request path, e.g. "Patient" for "/Patient/1234".
+func ResourceTypeFromPath(path string) string {
+	return strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+}
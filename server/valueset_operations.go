@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ValueSetExpandHandler implements the $expand operation, both on a ValueSet
+// instance and on the ValueSet type with an identifier parameter. The filter
+// parameter limits the expansion to codes whose display or code contains the
+// given text, and offset and count page through the result.
+func ValueSetExpandHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "expand")
+	vs, status, err := loadValueSetForOperation(r)
+	if err != nil {
+		WriteOperationOutcome(rw, status, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	}
+
+	query := r.URL.Query()
+	offset, err := optionalInt(query.Get("offset"), 0)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid offset: "+err.Error()))
+		return
+	}
+	count, err := optionalInt(query.Get("count"), -1)
+	if err != nil {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("invalid", "Invalid count: "+err.Error()))
+		return
+	}
+
+	contains, err := NewValueSetExpander().Expand(vs)
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+	contains = pageExpansion(FilterExpansion(contains, query.Get("filter")), offset, count)
+
+	vs.Expansion = models.ValueSetExpansionComponent{
+		Identifier: models.Identifier{Value: bson.NewObjectId().Hex()},
+		Timestamp:  models.FHIRDateTime{Time: time.Now(), Precision: models.Timestamp},
+		Contains:   contains,
+	}
+	context.Set(r, "ValueSet", vs)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(vs)
+}
+
+// ValueSetValidateCodeHandler implements the $validate-code operation, which
+// checks whether the code given by the system, code and display parameters is
+// a member of a ValueSet. The result is an OperationOutcome whose issue is
+// informational if the code is valid and an error otherwise.
+func ValueSetValidateCodeHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	context.Set(r, "Action", "validate-code")
+	vs, status, err := loadValueSetForOperation(r)
+	if err != nil {
+		WriteOperationOutcome(rw, status, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("code") == "" {
+		WriteOperationOutcome(rw, http.StatusBadRequest, NewOperationOutcomeIssue("required", "The code parameter is required"))
+		return
+	}
+
+	result, err := NewTerminologyService().ValidateCode(vs, query.Get("system"), query.Get("code"), query.Get("display"))
+	if err != nil {
+		WriteOperationOutcome(rw, 422, NewOperationOutcomeIssue("not-supported", err.Error()))
+		return
+	}
+
+	var issue models.OperationOutcomeIssueComponent
+	switch {
+	case result.Valid:
+		issue = NewOperationOutcomeIssue("informational", "The code is valid; its display is "+strconv.Quote(result.Display))
+		issue.Severity = "information"
+	case result.Member:
+		issue = NewOperationOutcomeIssue("value", result.Message)
+	default:
+		issue = NewOperationOutcomeIssue("code-unknown", result.Message)
+	}
+	WriteOperationOutcome(rw, http.StatusOK, issue)
+}
+
+// loadValueSetForOperation loads the ValueSet an operation applies to: the
+// instance named in the path or, for type-level operations, the ValueSet with
+// the identifier given as a parameter. On failure it also returns the HTTP
+// status to respond with.
+func loadValueSetForOperation(r *http.Request) (*models.ValueSet, int, error) {
+	if _, ok := mux.Vars(r)["id"]; ok {
+		vs, err := LoadValueSet(r)
+		if err != nil {
+			return nil, http.StatusNotFound, err
+		}
+		return vs, 0, nil
+	}
+
+	identifier := r.URL.Query().Get("identifier")
+	if identifier == "" {
+		return nil, http.StatusBadRequest, errors.New("The identifier parameter is required")
+	}
+	vs, err := FindValueSetByIdentifier(identifier)
+	if err == mgo.ErrNotFound {
+		return nil, http.StatusNotFound, errors.New("No ValueSet with identifier " + identifier)
+	} else if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	context.Set(r, "Resource", "ValueSet")
+	return vs, 0, nil
+}
+
+func pageExpansion(contains []models.ValueSetExpansionContainsComponent, offset, count int) []models.ValueSetExpansionContainsComponent {
+	if offset >= len(contains) {
+		return nil
+	}
+	contains = contains[offset:]
+	if count >= 0 && count < len(contains) {
+		contains = contains[:count]
+	}
+	return contains
+}
+
+// optionalInt parses a non-negative integer parameter, returning def if the
+// parameter is not present.
+func optionalInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err == nil && i < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	return i, err
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// The outcomes of verifying a version of a resource against the signatures in
+// the Provenance that targets it.
+const (
+	SignatureVerified  = "verified"
+	SignatureModified  = "modified"
+	SignatureUntrusted = "untrusted"
+	Unsigned           = "unsigned"
+)
+
+// ErrResourceNotFound is returned by VerifyResource for a resource that is
+// neither stored nor has a history.
+var ErrResourceNotFound = errors.New("Resource not found")
+
+// Verification is the outcome of verifying a resource and its history. The
+// stored resource is checked against the signatures of its current version,
+// and each version in the history against its own signatures.
+type Verification struct {
+	Current  VersionVerification
+	Deleted  bool
+	Versions []VersionVerification
+}
+
+// VersionVerification is the outcome of verifying one version, with the ids of
+// the Provenance whose signatures were checked.
+type VersionVerification struct {
+	Version    string
+	Outcome    string
+	Provenance []string
+}
+
+// Verified reports whether no signature failed to verify. When
+// ProvenanceSigner is set every version the server keeps is signed, so a kept
+// version with no signature is a failure too: it was written around the
+// server, or its Provenance was removed. Otherwise unsigned versions do not
+// count against it.
+func (v *Verification) Verified() bool {
+	all := append([]VersionVerification{v.Current}, v.Versions...)
+	for _, version := range all {
+		switch version.Outcome {
+		case SignatureModified, SignatureUntrusted:
+			return false
+		case Unsigned:
+			if ProvenanceSigner != nil && version.Version != "" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// VerifyResource checks the stored resource, and every version of it, against
+// the signatures of the Provenance that targets them.
+func VerifyResource(resourceType, id string) (*Verification, error) {
+	var versions []ResourceVersion
+	if err := Database.C("history").Find(bson.M{"type": resourceType, "resourceid": id}).Sort("saved").All(&versions); err != nil {
+		return nil, err
+	}
+	current, err := models.NewStructForResourceName(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	err = Database.C(CollectionName(resourceType)).FindId(id).One(current)
+	deleted := err == mgo.ErrNotFound
+	if deleted && len(versions) == 0 {
+		return nil, ErrResourceNotFound
+	} else if err != nil && !deleted {
+		return nil, err
+	}
+
+	var provenances []models.Provenance
+	target := bson.M{"$regex": "^" + regexp.QuoteMeta(resourceType+"/"+id) + "(/_history/[^/]+)?$"}
+	if err := Database.C(CollectionName("Provenance")).Find(bson.M{"target.reference": target, "integritySignature": bson.M{"$gt": ""}}).All(&provenances); err != nil {
+		return nil, err
+	}
+	signatures := make(map[string][]models.Provenance)
+	for _, provenance := range provenances {
+		for _, ref := range provenance.Target {
+			if parsed := models.ParseReference(ref.Reference); parsed.Type == resourceType && parsed.Id == id {
+				signatures[parsed.Version] = append(signatures[parsed.Version], provenance)
+			}
+		}
+	}
+
+	check := func(version string, resource interface{}) (VersionVerification, error) {
+		result := VersionVerification{Version: version, Outcome: Unsigned}
+		payload, err := models.CanonicalJSON(resource, models.CanonicalOptions{})
+		if err != nil {
+			return result, err
+		}
+		for _, provenance := range signatures[version] {
+			result.Provenance = append(result.Provenance, provenance.Id)
+			switch err := VerifySignature(provenance.IntegritySignature, payload); {
+			case err == ErrSignatureInvalid:
+				result.Outcome = SignatureModified
+			case err != nil && result.Outcome != SignatureModified:
+				result.Outcome = SignatureUntrusted
+			case err == nil && result.Outcome == Unsigned:
+				result.Outcome = SignatureVerified
+			}
+		}
+		return result, nil
+	}
+
+	verification := &Verification{Deleted: deleted}
+	if !deleted {
+		version, err := currentVersion(resourceType, id)
+		if err != nil {
+			return nil, err
+		}
+		if verification.Current, err = check(version, current); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range versions {
+		resource, err := entry.Load()
+		if err != nil {
+			return nil, err
+		}
+		result, err := check(entry.Version, resource)
+		if err != nil {
+			return nil, err
+		}
+		verification.Versions = append(verification.Versions, result)
+	}
+	return verification, nil
+}
+
+// signResource signs the canonical form of a version of a resource, or of the
+// stored resource if version is "", with ProvenanceSigner.
+func signResource(resourceType, id, version string) (string, error) {
+	var resource interface{}
+	var err error
+	if version != "" {
+		resource, err = LoadVersion(resourceType, id, version)
+	} else if resource, err = models.NewStructForResourceName(resourceType); err == nil {
+		err = Database.C(CollectionName(resourceType)).FindId(id).One(resource)
+	}
+	if err != nil {
+		return "", err
+	}
+	payload, err := models.CanonicalJSON(resource, models.CanonicalOptions{})
+	if err != nil {
+		return "", err
+	}
+	return ProvenanceSigner.Sign(payload)
+}
+
+// currentVersion returns the stored resource's meta.versionId, which is ""
+// until HistoryHandler has kept a version of it.
+func currentVersion(resourceType, id string) (string, error) {
+	var doc struct {
+		Meta struct {
+			VersionId string `bson:"versionId"`
+		} `bson:"meta"`
+	}
+	err := Database.C(CollectionName(resourceType)).FindId(id).Select(bson.M{"meta.versionId": 1}).One(&doc)
+	return doc.Meta.VersionId, err
+}
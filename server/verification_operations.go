@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/context"
+	"github.com/gorilla/mux"
+	"github.com/intervention-engine/fhir/models"
+)
+
+// ResourceVerifyHandler implements the $verify operation, which checks a
+// resource and each version of it against the signatures in the Provenance
+// that targets them, reporting whether any has been modified since it was
+// signed. It returns Parameters with an overall verified flag, and a
+// resource part for the stored resource and a version part for each version,
+// giving the version, outcome and the Provenance checked.
+func ResourceVerifyHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	resourceType := ResourceTypeFromPath(r.URL.Path)
+	context.Set(r, "Action", "verify")
+	context.Set(r, "Resource", resourceType)
+
+	verification, err := VerifyResource(resourceType, mux.Vars(r)["id"])
+	if err == ErrResourceNotFound {
+		WriteOperationOutcome(rw, http.StatusNotFound, NewOperationOutcomeIssue("not-found", err.Error()))
+		return
+	} else if err != nil {
+		WriteOperationOutcome(rw, http.StatusInternalServerError, NewOperationOutcomeIssue("exception", err.Error()))
+		return
+	}
+
+	verified := verification.Verified()
+	params := models.NewParameters().Add(models.ParametersParameterComponent{Name: "verified", ValueBoolean: &verified})
+	if verification.Deleted {
+		params.Add(models.ParametersParameterComponent{Name: "resource", Part: []models.ParametersParameterComponent{{Name: "outcome", ValueCode: "deleted"}}})
+	} else {
+		params.Add(models.ParametersParameterComponent{Name: "resource", Part: verificationParts(verification.Current)})
+	}
+	for _, version := range verification.Versions {
+		params.Add(models.ParametersParameterComponent{Name: "version", Part: verificationParts(version)})
+	}
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	rw.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(rw).Encode(params)
+}
+
+func verificationParts(v VersionVerification) []models.ParametersParameterComponent {
+	var parts []models.ParametersParameterComponent
+	if v.Version != "" {
+		parts = append(parts, models.ParametersParameterComponent{Name: "version", ValueString: v.Version})
+	}
+	parts = append(parts, models.ParametersParameterComponent{Name: "outcome", ValueCode: v.Outcome})
+	for _, id := range v.Provenance {
+		parts = append(parts, models.ParametersParameterComponent{Name: "provenance", ValueString: "Provenance/" + id})
+	}
+	return parts
+}
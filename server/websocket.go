@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// WebSocketPingInterval is how often the server sends a ping frame to each
+// connected client. A client that has not answered within two intervals is
+// disconnected.
+var WebSocketPingInterval = 30 * time.Second
+
+// WebSocketPendingLimit is the number of notifications kept for a websocket
+// subscription while no client is bound to it. They are sent when a client
+// next binds, so that a client that reconnects does not miss notifications.
+// The oldest are dropped first.
+var WebSocketPendingLimit = 100
+
+// DefaultWebSocketHub delivers the notifications for websocket subscriptions
+// to the clients connected to /websocket.
+var DefaultWebSocketHub = NewWebSocketHub()
+
+// upgrader accepts connections from clients other than browsers, from
+// browser scripts served by the server itself, and from the AllowedOrigins.
+// It selects the "bearer" subprotocol when a client sends its token that way.
+var upgrader = websocket.Upgrader{
+	Subprotocols: []string{"bearer"},
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" || allowedOrigin(origin) {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	},
+}
+
+// WebSocketHub tracks which connected clients are bound to which
+// subscriptions. It is the SubscriptionNotifier for websocket channels.
+type WebSocketHub struct {
+	mu      sync.Mutex
+	clients map[string]map[*websocketClient]bool
+	pending map[string][]string
+}
+
+type websocketClient struct {
+	conn *websocket.Conn
+	send chan string
+}
+
+// NewWebSocketHub returns a hub with no clients.
+func NewWebSocketHub() *WebSocketHub {
+	return &WebSocketHub{clients: make(map[string]map[*websocketClient]bool), pending: make(map[string][]string)}
+}
+
+// Notify sends a notification to every client bound to the subscription. If
+// the channel has a payload the notification is the resource, otherwise it is
+// "ping <subscription id>".
+func (h *WebSocketHub) Notify(sub *models.Subscription, resourceType string, resource interface{}) error {
+	message := "ping " + sub.Id
+	if sub.Channel.Payload != "" {
+		body, err := json.Marshal(resource)
+		if err != nil {
+			return err
+		}
+		message = string(body)
+	}
+	h.Publish(sub.Id, message)
+	return nil
+}
+
+// Publish sends a message to the clients bound to a subscription, or keeps it
+// until one binds.
+func (h *WebSocketHub) Publish(id, message string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.clients[id]) == 0 {
+		pending := append(h.pending[id], message)
+		if len(pending) > WebSocketPendingLimit {
+			pending = pending[len(pending)-WebSocketPendingLimit:]
+		}
+		h.pending[id] = pending
+		return
+	}
+	for client := range h.clients[id] {
+		client.deliver(message)
+	}
+}
+
+func (h *WebSocketHub) bind(id string, client *websocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[id] == nil {
+		h.clients[id] = make(map[*websocketClient]bool)
+	}
+	h.clients[id][client] = true
+	client.deliver("bound " + id)
+	for _, message := range h.pending[id] {
+		client.deliver(message)
+	}
+	delete(h.pending, id)
+}
+
+func (h *WebSocketHub) unbind(id string, client *websocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients[id], client)
+	if len(h.clients[id]) == 0 {
+		delete(h.clients, id)
+	}
+}
+
+func (h *WebSocketHub) remove(client *websocketClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, clients := range h.clients {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.clients, id)
+		}
+	}
+}
+
+// deliver queues a message for the client without blocking the hub. A client
+// that falls too far behind is disconnected; it can reconnect and bind again.
+func (c *websocketClient) deliver(message string) {
+	select {
+	case c.send <- message:
+	default:
+		c.conn.Close()
+	}
+}
+
+// WebSocketHandler accepts websocket connections on which clients bind to
+// websocket subscriptions by sending "bind <subscription id>". The server
+// answers "bound <subscription id>" or "error <reason>", then sends each
+// notification for the subscription as it happens. "unbind <subscription id>"
+// stops the notifications. A connection may be bound to several
+// subscriptions.
+func (h *WebSocketHub) WebSocketHandler(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	conn, err := upgrader.Upgrade(rw, r, nil)
+	if err != nil {
+		log.Println("Upgrading websocket:", err)
+		return
+	}
+	client := &websocketClient{conn: conn, send: make(chan string, WebSocketPendingLimit+1)}
+	go client.writeMessages()
+
+	defer func() {
+		h.remove(client)
+		close(client.send)
+		conn.Close()
+	}()
+	conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * WebSocketPingInterval))
+	})
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(string(message))
+		if len(fields) != 2 {
+			client.deliver("error Expected bind <subscription id> or unbind <subscription id>")
+			continue
+		}
+		switch fields[0] {
+		case "bind":
+			if err := checkWebSocketSubscription(fields[1], RequestPrincipal(r)); err != "" {
+				client.deliver("error " + err)
+				continue
+			}
+			h.bind(fields[1], client)
+		case "unbind":
+			h.unbind(fields[1], client)
+			client.deliver("unbound " + fields[1])
+		default:
+			client.deliver("error Unknown command " + fields[0])
+		}
+	}
+}
+
+// writeMessages sends queued messages and heartbeat pings until the client's
+// send channel is closed.
+func (c *websocketClient) writeMessages() {
+	ticker := time.NewTicker(WebSocketPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-c.send:
+			if !ok {
+				return
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(WebSocketPingInterval))
+			if err := c.conn.WriteMessage(websocket.TextMessage, []byte(message)); err != nil {
+				c.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(WebSocketPingInterval)); err != nil {
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// checkWebSocketSubscription returns the reason a client cannot bind to a
+// subscription, or "" if it can. When requests are authenticated, only the
+// subscription's owner may bind to it, and only while its scopes still allow
+// reading what the subscription selects.
+func checkWebSocketSubscription(id string, principal *Principal) string {
+	sub := &models.Subscription{}
+	if err := Database.C("subscriptions").Find(bson.M{"_id": id}).One(sub); err != nil {
+		return "Unknown subscription " + id
+	}
+	if sub.Channel.Type != "websocket" {
+		return "Subscription " + id + " does not use a websocket channel"
+	}
+	if sub.Status != "requested" && sub.Status != "active" {
+		return "Subscription " + id + " is " + sub.Status
+	}
+	if principal != nil {
+		if owner, err := subscriptionOwner(id); err != nil || owner != principal.Subject {
+			return "Subscription " + id + " belongs to another user"
+		}
+		return checkSubscriptionCriteria(principal, sub.Criteria)
+	}
+	return ""
+}
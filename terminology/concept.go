@@ -0,0 +1,167 @@
+// Package terminology stores the concepts of large code systems such as LOINC,
+// SNOMED CT and ICD-10-CM, loaded offline from their release files, and
+// answers lookup and subsumption questions about them.
+package terminology
+
+import (
+	"errors"
+
+	"github.com/intervention-engine/fhir/models"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Code system URIs for the supported release formats.
+const (
+	LOINC    = "http://loinc.org"
+	SNOMEDCT = "http://snomed.info/sct"
+	ICD10CM  = "http://hl7.org/fhir/sid/icd-10-cm"
+)
+
+// Subsumption outcomes, as used by the $subsumes operation.
+const (
+	Equivalent  = "equivalent"
+	Subsumes    = "subsumes"
+	SubsumedBy  = "subsumed-by"
+	NotSubsumed = "not-subsumed"
+)
+
+// ConceptsName is the name of the collection concepts are stored in.
+const ConceptsName = "concepts"
+
+// Concept is a single concept in a code system. Parents holds the codes of
+// the concept's immediate parents and Ancestors every code above it in the
+// hierarchy, so that subsumption and descendant queries need a single lookup.
+type Concept struct {
+	Id          string                                         `bson:"_id"`
+	System      string                                         `bson:"system"`
+	Version     string                                         `bson:"version,omitempty"`
+	Code        string                                         `bson:"code"`
+	Display     string                                         `bson:"display,omitempty"`
+	Active      bool                                           `bson:"active"`
+	Designation []models.ConceptDefinitionDesignationComponent `bson:"designation,omitempty"`
+	Properties  map[string]string                              `bson:"properties,omitempty"`
+	Parents     []string                                       `bson:"parents,omitempty"`
+	Ancestors   []string                                       `bson:"ancestors,omitempty"`
+}
+
+// ConceptId returns the id a concept is stored under.
+func ConceptId(system, code string) string {
+	return system + "|" + code
+}
+
+// ErrConceptNotFound is returned when a code is not in the concept store.
+var ErrConceptNotFound = errors.New("Concept not found")
+
+// ConceptStore keeps concepts in a Mongo collection.
+type ConceptStore struct {
+	Collection *mgo.Collection
+}
+
+// NewConceptStore returns a store backed by the concepts collection of db.
+func NewConceptStore(db *mgo.Database) *ConceptStore {
+	return &ConceptStore{Collection: db.C(ConceptsName)}
+}
+
+// EnsureIndexes creates the indexes used by lookups and hierarchy queries.
+func (s *ConceptStore) EnsureIndexes() error {
+	for _, key := range [][]string{{"system", "ancestors"}, {"system", "parents"}, {"system", "display"}} {
+		if err := s.Collection.EnsureIndexKey(key...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save inserts or replaces concepts, computing Ids as needed.
+func (s *ConceptStore) Save(concepts ...Concept) error {
+	bulk := s.Collection.Bulk()
+	bulk.Unordered()
+	for i := range concepts {
+		c := &concepts[i]
+		c.Id = ConceptId(c.System, c.Code)
+		bulk.Upsert(bson.M{"_id": c.Id}, c)
+	}
+	_, err := bulk.Run()
+	return err
+}
+
+// HasSystem reports whether any concepts from system have been loaded.
+func (s *ConceptStore) HasSystem(system string) (bool, error) {
+	n, err := s.Collection.Find(bson.M{"system": system}).Limit(1).Count()
+	return n > 0, err
+}
+
+// Lookup returns the concept with the given code.
+func (s *ConceptStore) Lookup(system, code string) (*Concept, error) {
+	c := &Concept{}
+	err := s.Collection.FindId(ConceptId(system, code)).One(c)
+	if err == mgo.ErrNotFound {
+		return nil, ErrConceptNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Children returns the concepts immediately below code.
+func (s *ConceptStore) Children(system, code string) ([]Concept, error) {
+	var children []Concept
+	err := s.Collection.Find(bson.M{"system": system, "parents": code}).Sort("code").All(&children)
+	return children, err
+}
+
+// Descendants returns every concept below code, and the concept itself if
+// includeSelf is true. At most limit concepts are returned if limit > 0.
+func (s *ConceptStore) Descendants(system, code string, includeSelf bool, limit int) ([]Concept, error) {
+	query := bson.M{"system": system, "ancestors": code}
+	if includeSelf {
+		query = bson.M{"system": system, "$or": []bson.M{{"ancestors": code}, {"code": code}}}
+	}
+	var concepts []Concept
+	err := s.Collection.Find(query).Sort("code").Limit(limit).All(&concepts)
+	return concepts, err
+}
+
+// Subsumes tests whether codeA subsumes codeB, returning one of Equivalent,
+// Subsumes, SubsumedBy or NotSubsumed.
+func (s *ConceptStore) Subsumes(system, codeA, codeB string) (string, error) {
+	if codeA == codeB {
+		if _, err := s.Lookup(system, codeA); err != nil {
+			return "", err
+		}
+		return Equivalent, nil
+	}
+	a, err := s.Lookup(system, codeA)
+	if err != nil {
+		return "", err
+	}
+	b, err := s.Lookup(system, codeB)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case containsCode(b.Ancestors, a.Code):
+		return Subsumes, nil
+	case containsCode(a.Ancestors, b.Code):
+		return SubsumedBy, nil
+	}
+	return NotSubsumed, nil
+}
+
+// Display returns the display of a code, or "" if the code is unknown.
+func (s *ConceptStore) Display(system, code string) string {
+	if c, err := s.Lookup(system, code); err == nil {
+		return c.Display
+	}
+	return ""
+}
+
+func containsCode(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
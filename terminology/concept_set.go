@@ -0,0 +1,96 @@
+package terminology
+
+import "sort"
+
+// conceptSet collects the concepts of one code system while a release is
+// read, so that the hierarchy can be closed over once everything is known.
+type conceptSet struct {
+	system   string
+	concepts map[string]*Concept
+	order    []string
+}
+
+func newConceptSet(system string) *conceptSet {
+	return &conceptSet{system: system, concepts: make(map[string]*Concept)}
+}
+
+// get returns the concept with the given code, creating it if necessary.
+func (s *conceptSet) get(code string) *Concept {
+	c, ok := s.concepts[code]
+	if !ok {
+		c = &Concept{System: s.system, Code: code, Active: true}
+		s.concepts[code] = c
+		s.order = append(s.order, code)
+	}
+	return c
+}
+
+func (s *conceptSet) addParent(code, parent string) {
+	if code == parent {
+		return
+	}
+	c := s.get(code)
+	if !containsCode(c.Parents, parent) {
+		c.Parents = append(c.Parents, parent)
+	}
+}
+
+// list fills in each concept's ancestors and returns the concepts in the
+// order they were first seen.
+func (s *conceptSet) list() []Concept {
+	closure := make(map[string][]string, len(s.concepts))
+	var ancestors func(code string, visiting map[string]bool) []string
+	ancestors = func(code string, visiting map[string]bool) []string {
+		if a, ok := closure[code]; ok {
+			return a
+		}
+		c, ok := s.concepts[code]
+		if !ok || visiting[code] {
+			return nil
+		}
+		visiting[code] = true
+		seen := make(map[string]bool)
+		for _, parent := range c.Parents {
+			seen[parent] = true
+			for _, a := range ancestors(parent, visiting) {
+				seen[a] = true
+			}
+		}
+		delete(visiting, code)
+		result := make([]string, 0, len(seen))
+		for a := range seen {
+			result = append(result, a)
+		}
+		sort.Strings(result)
+		closure[code] = result
+		return result
+	}
+
+	concepts := make([]Concept, 0, len(s.order))
+	for _, code := range s.order {
+		c := s.concepts[code]
+		c.Ancestors = ancestors(code, make(map[string]bool))
+		concepts = append(concepts, *c)
+	}
+	return concepts
+}
+
+// Import saves concepts to the store in batches of the given size.
+func Import(store *ConceptStore, concepts []Concept, batchSize int) error {
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if err := store.EnsureIndexes(); err != nil {
+		return err
+	}
+	for start := 0; start < len(concepts); start += batchSize {
+		end := start + batchSize
+		if end > len(concepts) {
+			end = len(concepts)
+		}
+		if err := store.Save(concepts[start:end]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package terminology
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// LoadICD10CM reads the fixed width ICD-10-CM order file (icd10cm_order_*.txt).
+// Codes are stored with the decimal point that the order file omits, and each
+// code's parent is the longest shorter code in the file that it begins with.
+// Header rows, which cannot be used on claims, have the property billable set
+// to false.
+func LoadICD10CM(in io.Reader) ([]Concept, error) {
+	set := newConceptSet(ICD10CM)
+
+	scanner := bufio.NewScanner(in)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		// order(5) code(7) header(1) short(60) long, each separated by a space
+		if len(text) < 77 {
+			return nil, fmt.Errorf("ICD-10-CM order file line %d is too short", line)
+		}
+		code := formatICD10CM(strings.TrimSpace(text[6:13]))
+		c := set.get(code)
+		c.Display = strings.TrimSpace(text[77:])
+		c.Properties = map[string]string{"billable": fmt.Sprint(text[14] == '1')}
+		c.Designation = []models.ConceptDefinitionDesignationComponent{{
+			Language: "en-US",
+			Use:      models.Coding{System: SNOMEDCT, Code: snomedSynonym, Display: "Synonym"},
+			Value:    strings.TrimSpace(text[16:76]),
+		}}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, code := range set.order {
+		stripped := strings.Replace(code, ".", "", 1)
+		for n := len(stripped) - 1; n >= 3; n-- {
+			if parent := formatICD10CM(stripped[:n]); set.concepts[parent] != nil {
+				set.addParent(code, parent)
+				break
+			}
+		}
+	}
+	return set.list(), nil
+}
+
+// formatICD10CM inserts the decimal point after the three character category.
+func formatICD10CM(code string) string {
+	if len(code) <= 3 {
+		return code
+	}
+	return code[:3] + "." + code[3:]
+}
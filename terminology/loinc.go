@@ -0,0 +1,92 @@
+package terminology
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// loincProperties are the Loinc.csv columns kept as concept properties.
+var loincProperties = []string{"COMPONENT", "PROPERTY", "TIME_ASPCT", "SYSTEM", "SCALE_TYP", "METHOD_TYP", "CLASS", "STATUS"}
+
+// LoadLOINC reads LOINC concepts from the Loinc.csv table and, if hierarchy
+// is not nil, parent links from MultiAxialHierarchy.csv. Hierarchy parts
+// (LP codes) that are not in Loinc.csv are added as concepts of their own.
+func LoadLOINC(table io.Reader, hierarchy io.Reader) ([]Concept, error) {
+	set := newConceptSet(LOINC)
+
+	err := readCSV(table, func(row map[string]string) error {
+		code := row["LOINC_NUM"]
+		if code == "" {
+			return fmt.Errorf("Loinc.csv row has no LOINC_NUM")
+		}
+		c := set.get(code)
+		c.Display = row["LONG_COMMON_NAME"]
+		c.Active = row["STATUS"] != "DEPRECATED" && row["STATUS"] != "DISCOURAGED"
+		if short := row["SHORTNAME"]; short != "" {
+			c.Designation = append(c.Designation, models.ConceptDefinitionDesignationComponent{
+				Language: "en-US",
+				Use:      models.Coding{System: LOINC, Code: "SHORTNAME", Display: "Short name"},
+				Value:    short,
+			})
+		}
+		c.Properties = make(map[string]string)
+		for _, p := range loincProperties {
+			if v := row[p]; v != "" {
+				c.Properties[p] = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hierarchy != nil {
+		err = readCSV(hierarchy, func(row map[string]string) error {
+			code, parent := row["CODE"], row["IMMEDIATE_PARENT"]
+			c := set.get(code)
+			if c.Display == "" {
+				c.Display = row["CODE_TEXT"]
+			}
+			if parent != "" {
+				set.addParent(code, parent)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return set.list(), nil
+}
+
+// readCSV calls fn with each row of a CSV file keyed by its header.
+func readCSV(in io.Reader, fn func(row map[string]string) error) error {
+	reader := csv.NewReader(in)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	header, err := reader.Read()
+	if err != nil {
+		return err
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			if i < len(record) {
+				row[name] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+}
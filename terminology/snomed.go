@@ -0,0 +1,126 @@
+package terminology
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/intervention-engine/fhir/models"
+)
+
+// SNOMED CT identifiers used when reading an RF2 release.
+const (
+	snomedIsA                = "116680003"
+	snomedFullySpecifiedName = "900000000000003001"
+	snomedSynonym            = "900000000000013009"
+	snomedPreferred          = "900000000000548007"
+)
+
+// SNOMEDFiles holds the RF2 snapshot files to load. Language is optional;
+// without it concepts are displayed using their fully specified name rather
+// than their preferred term.
+type SNOMEDFiles struct {
+	Concepts      io.Reader
+	Descriptions  io.Reader
+	Relationships io.Reader
+	Language      io.Reader
+}
+
+// LoadSNOMED reads concepts, descriptions and IS-A relationships from an RF2
+// snapshot release.
+func LoadSNOMED(files SNOMEDFiles) ([]Concept, error) {
+	set := newConceptSet(SNOMEDCT)
+
+	// id effectiveTime active moduleId definitionStatusId
+	err := readRF2(files.Concepts, 5, func(f []string) error {
+		set.get(f[0]).Active = f[2] == "1"
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// id effectiveTime active moduleId refsetId referencedComponentId acceptabilityId
+	preferred := make(map[string]bool)
+	if files.Language != nil {
+		err = readRF2(files.Language, 7, func(f []string) error {
+			if f[2] == "1" && f[6] == snomedPreferred {
+				preferred[f[5]] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// id effectiveTime active moduleId conceptId languageCode typeId term caseSignificanceId
+	hasPreferred := make(map[string]bool)
+	err = readRF2(files.Descriptions, 9, func(f []string) error {
+		if f[2] != "1" {
+			return nil
+		}
+		c, ok := set.concepts[f[4]]
+		if !ok {
+			return nil
+		}
+		use := models.Coding{System: SNOMEDCT, Code: f[6]}
+		switch f[6] {
+		case snomedFullySpecifiedName:
+			use.Display = "Fully specified name"
+			if !hasPreferred[c.Code] {
+				c.Display = f[7]
+			}
+		case snomedSynonym:
+			use.Display = "Synonym"
+			if preferred[f[0]] && !hasPreferred[c.Code] {
+				c.Display = f[7]
+				hasPreferred[c.Code] = true
+			}
+		}
+		c.Designation = append(c.Designation, models.ConceptDefinitionDesignationComponent{Language: f[5], Use: use, Value: f[7]})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// id effectiveTime active moduleId sourceId destinationId relationshipGroup typeId characteristicTypeId modifierId
+	err = readRF2(files.Relationships, 10, func(f []string) error {
+		if f[2] == "1" && f[7] == snomedIsA {
+			set.addParent(f[4], f[5])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return set.list(), nil
+}
+
+// readRF2 calls fn with the fields of each row of a tab separated RF2 file,
+// skipping the header and rejecting rows with fewer than columns fields.
+func readRF2(in io.Reader, columns int, fn func(fields []string) error) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line == 1 {
+			continue
+		}
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if text == "" {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < columns {
+			return fmt.Errorf("RF2 line %d has %d fields, expected %d", line, len(fields), columns)
+		}
+		if err := fn(fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,127 @@
+package terminology
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+type TerminologySuite struct{}
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+var _ = check.Suite(&TerminologySuite{})
+
+func (s *TerminologySuite) TestLoadLOINC(c *check.C) {
+	table := `"LOINC_NUM","COMPONENT","PROPERTY","TIME_ASPCT","SYSTEM","SCALE_TYP","METHOD_TYP","CLASS","STATUS","SHORTNAME","LONG_COMMON_NAME"
+"2951-2","Sodium","SCnc","Pt","Ser/Plas","Qn","","CHEM","ACTIVE","Sodium SerPl-sCnc","Sodium [Moles/volume] in Serum or Plasma"
+"1234-5","Old","SCnc","Pt","Ser/Plas","Qn","","CHEM","DEPRECATED","Old","Old test"
+`
+	hierarchy := `PATH_TO_ROOT,SEQUENCE,IMMEDIATE_PARENT,CODE,CODE_TEXT
+,1,,LP29693-6,Laboratory
+LP29693-6,1,LP29693-6,LP15099-2,Sodium
+LP29693-6.LP15099-2,1,LP15099-2,2951-2,Sodium [Moles/volume] in Serum or Plasma
+`
+	concepts, err := LoadLOINC(strings.NewReader(table), strings.NewReader(hierarchy))
+	c.Assert(err, check.IsNil)
+	c.Assert(concepts, check.HasLen, 4)
+
+	sodium := concepts[0]
+	c.Assert(sodium.System, check.Equals, LOINC)
+	c.Assert(sodium.Display, check.Equals, "Sodium [Moles/volume] in Serum or Plasma")
+	c.Assert(sodium.Active, check.Equals, true)
+	c.Assert(sodium.Properties["COMPONENT"], check.Equals, "Sodium")
+	c.Assert(sodium.Designation, check.HasLen, 1)
+	c.Assert(sodium.Designation[0].Value, check.Equals, "Sodium SerPl-sCnc")
+	c.Assert(sodium.Parents, check.DeepEquals, []string{"LP15099-2"})
+	c.Assert(sodium.Ancestors, check.DeepEquals, []string{"LP15099-2", "LP29693-6"})
+
+	c.Assert(concepts[1].Active, check.Equals, false)
+	c.Assert(concepts[2].Code, check.Equals, "LP29693-6")
+	c.Assert(concepts[2].Display, check.Equals, "Laboratory")
+}
+
+func (s *TerminologySuite) TestLoadSNOMED(c *check.C) {
+	files := SNOMEDFiles{
+		Concepts: strings.NewReader(rf2(
+			"id\teffectiveTime\tactive\tmoduleId\tdefinitionStatusId",
+			"138875005\t20150131\t1\t900000000000207008\t900000000000074008",
+			"73211009\t20150131\t1\t900000000000207008\t900000000000074008",
+			"46635009\t20150131\t1\t900000000000207008\t900000000000074008",
+			"190330002\t20150131\t0\t900000000000207008\t900000000000074008",
+		)),
+		Descriptions: strings.NewReader(rf2(
+			"id\teffectiveTime\tactive\tmoduleId\tconceptId\tlanguageCode\ttypeId\tterm\tcaseSignificanceId",
+			"1\t20150131\t1\t900000000000207008\t73211009\ten\t900000000000003001\tDiabetes mellitus (disorder)\t900000000000448009",
+			"2\t20150131\t1\t900000000000207008\t73211009\ten\t900000000000013009\tDiabetes mellitus\t900000000000448009",
+			"3\t20150131\t1\t900000000000207008\t73211009\ten\t900000000000013009\tDM - Diabetes mellitus\t900000000000448009",
+			"4\t20150131\t1\t900000000000207008\t46635009\ten\t900000000000003001\tDiabetes mellitus type 1 (disorder)\t900000000000448009",
+		)),
+		Relationships: strings.NewReader(rf2(
+			"id\teffectiveTime\tactive\tmoduleId\tsourceId\tdestinationId\trelationshipGroup\ttypeId\tcharacteristicTypeId\tmodifierId",
+			"10\t20150131\t1\t900000000000207008\t73211009\t138875005\t0\t116680003\t900000000000011006\t900000000000451002",
+			"11\t20150131\t1\t900000000000207008\t46635009\t73211009\t0\t116680003\t900000000000011006\t900000000000451002",
+			"12\t20150131\t0\t900000000000207008\t46635009\t138875005\t0\t116680003\t900000000000011006\t900000000000451002",
+		)),
+		Language: strings.NewReader(rf2(
+			"id\teffectiveTime\tactive\tmoduleId\trefsetId\treferencedComponentId\tacceptabilityId",
+			"20\t20150131\t1\t900000000000207008\t900000000000509007\t2\t900000000000548007",
+			"21\t20150131\t1\t900000000000207008\t900000000000509007\t3\t900000000000549004",
+		)),
+	}
+	concepts, err := LoadSNOMED(files)
+	c.Assert(err, check.IsNil)
+	c.Assert(concepts, check.HasLen, 4)
+
+	dm := concepts[1]
+	c.Assert(dm.Display, check.Equals, "Diabetes mellitus")
+	c.Assert(dm.Designation, check.HasLen, 3)
+	c.Assert(dm.Designation[0].Use.Display, check.Equals, "Fully specified name")
+	c.Assert(dm.Parents, check.DeepEquals, []string{"138875005"})
+
+	t1dm := concepts[2]
+	c.Assert(t1dm.Display, check.Equals, "Diabetes mellitus type 1 (disorder)")
+	c.Assert(t1dm.Parents, check.DeepEquals, []string{"73211009"})
+	c.Assert(t1dm.Ancestors, check.DeepEquals, []string{"138875005", "73211009"})
+
+	c.Assert(concepts[3].Active, check.Equals, false)
+}
+
+func (s *TerminologySuite) TestLoadICD10CM(c *check.C) {
+	lines := []string{
+		orderLine(1, "E10", false, "Type 1 diabetes mellitus", "Type 1 diabetes mellitus"),
+		orderLine(2, "E101", false, "Type 1 diabetes mellitus with ketoacidosis", "Type 1 diabetes mellitus with ketoacidosis"),
+		orderLine(3, "E1010", true, "Type 1 diab w ketoacidosis w/o coma", "Type 1 diabetes mellitus with ketoacidosis without coma"),
+		orderLine(4, "E109", true, "Type 1 diabetes mellitus without complications", "Type 1 diabetes mellitus without complications"),
+	}
+	concepts, err := LoadICD10CM(strings.NewReader(strings.Join(lines, "\n")))
+	c.Assert(err, check.IsNil)
+	c.Assert(concepts, check.HasLen, 4)
+
+	c.Assert(concepts[0].Code, check.Equals, "E10")
+	c.Assert(concepts[0].Properties["billable"], check.Equals, "false")
+	c.Assert(concepts[0].Parents, check.HasLen, 0)
+
+	c.Assert(concepts[2].Code, check.Equals, "E10.10")
+	c.Assert(concepts[2].Display, check.Equals, "Type 1 diabetes mellitus with ketoacidosis without coma")
+	c.Assert(concepts[2].Designation[0].Value, check.Equals, "Type 1 diab w ketoacidosis w/o coma")
+	c.Assert(concepts[2].Properties["billable"], check.Equals, "true")
+	c.Assert(concepts[2].Parents, check.DeepEquals, []string{"E10.1"})
+	c.Assert(concepts[2].Ancestors, check.DeepEquals, []string{"E10", "E10.1"})
+
+	c.Assert(concepts[3].Parents, check.DeepEquals, []string{"E10"})
+}
+
+func rf2(lines ...string) string {
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+func orderLine(order int, code string, billable bool, short, long string) string {
+	header := "0"
+	if billable {
+		header = "1"
+	}
+	return fmt.Sprintf("%05d %-7s %s %-60s %s", order, code, header, short, long)
+}